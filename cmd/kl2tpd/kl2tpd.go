@@ -300,6 +300,30 @@ func (app *application) HandleEvent(event interface{}) {
 			app.sessionPW[ev.TunnelName][ev.SessionName].close()
 			delete(app.sessionPW[ev.TunnelName], ev.SessionName)
 		}
+
+	case *l2tp.SessionLinkInfoEvent:
+
+		// PPPoL2TP channels are synchronous, so the ACCM doesn't
+		// apply to them: all we can do is report it.
+		level.Info(app.logger).Log(
+			"message", "set link info",
+			"tunnel_name", ev.TunnelName,
+			"session_name", ev.SessionName,
+			"send_accm", fmt.Sprintf("%#08x", ev.SendACCM),
+			"receive_accm", fmt.Sprintf("%#08x", ev.ReceiveACCM))
+
+	case *l2tp.SessionWANErrorEvent:
+
+		level.Info(app.logger).Log(
+			"message", "WAN error notify",
+			"tunnel_name", ev.TunnelName,
+			"session_name", ev.SessionName,
+			"crc_errors", ev.CallErrors.CRCErrors,
+			"framing_errors", ev.CallErrors.FramingErrors,
+			"hardware_overruns", ev.CallErrors.HardwareOverruns,
+			"buffer_overruns", ev.CallErrors.BufferOverruns,
+			"timeout_errors", ev.CallErrors.TimeoutErrors,
+			"alignment_errors", ev.CallErrors.AlignmentErrors)
 	}
 }
 
@@ -383,6 +407,7 @@ func main() {
 	cfgPathPtr := flag.String("config", "/etc/kl2tpd/kl2tpd.toml", "specify configuration file path")
 	verbosePtr := flag.Bool("verbose", false, "toggle verbose log output")
 	nullDataPlanePtr := flag.Bool("null", false, "toggle null data plane")
+	pcapPathPtr := flag.String("pcap", "", "write a pcapng capture of control protocol traffic to the specified file")
 	flag.Parse()
 
 	config, err := config.LoadFileWithCustomParser(*cfgPathPtr, mycfg)
@@ -396,5 +421,22 @@ func main() {
 		stdlog.Fatalf("failed to instantiate application: %v", err)
 	}
 
-	os.Exit(app.run())
+	var pcapFile *os.File
+	if *pcapPathPtr != "" {
+		pcapFile, err = os.Create(*pcapPathPtr)
+		if err != nil {
+			stdlog.Fatalf("failed to create capture file: %v", err)
+		}
+
+		err = app.l2tpCtx.SetCaptureWriter(pcapFile)
+		if err != nil {
+			stdlog.Fatalf("failed to start capture: %v", err)
+		}
+	}
+
+	ret := app.run()
+	if pcapFile != nil {
+		pcapFile.Close()
+	}
+	os.Exit(ret)
 }
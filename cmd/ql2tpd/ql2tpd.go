@@ -18,6 +18,11 @@ a minimal control plane transport is set up to send and acknowledge keep-alive
 (HELLO) messages.  This mode of operation extends static mode by allowing tunnel
 failure to be detected.  If a given tunnel is determined to have failed (HELLO message
 transmission fails) then the sessions in that tunnel are automatically torn down.
+
+If run with the -detach argument, L2TPv3 tunnels without a hello_timeout are created
+without a tunnel socket, and ql2tpd leaves their kernel-space data plane in place when
+it exits.  When ql2tpd is restarted it adopts the existing tunnel and session instances,
+so restarting the daemon doesn't interrupt traffic.
 */
 package main
 
@@ -42,6 +47,8 @@ func main() {
 
 	cfgPathPtr := flag.String("config", "/etc/ql2tpd/ql2tpd.toml", "specify configuration file path")
 	verbosePtr := flag.Bool("verbose", false, "toggle verbose log output")
+	detachPtr := flag.Bool("detach", false, "leave static tunnels and sessions in place on exit")
+	pcapPathPtr := flag.String("pcap", "", "write a pcapng capture of control protocol traffic to the specified file")
 	flag.Parse()
 
 	config, err := config.LoadFile(*cfgPathPtr)
@@ -56,14 +63,44 @@ func main() {
 		logger = level.NewFilter(logger, level.AllowInfo())
 	}
 
+	// The capture file is closed after the context, so the context
+	// can capture its final control messages
+	var pcapFile *os.File
+	if *pcapPathPtr != "" {
+		pcapFile, err = os.Create(*pcapPathPtr)
+		if err != nil {
+			stdlog.Fatalf("failed to create capture file: %v", err)
+		}
+		defer pcapFile.Close()
+	}
+
 	l2tpCtx, err := l2tp.NewContext(l2tp.LinuxNetlinkDataPlane, logger)
 	if err != nil {
 		stdlog.Fatalf("failed to load l2tp configuration: %v", err)
 	}
-	defer l2tpCtx.Close()
+	if *detachPtr {
+		defer l2tpCtx.Detach()
+	} else {
+		defer l2tpCtx.Close()
+	}
+
+	if pcapFile != nil {
+		err = l2tpCtx.SetCaptureWriter(pcapFile)
+		if err != nil {
+			stdlog.Fatalf("failed to start capture: %v", err)
+		}
+	}
 
 	for _, tcfg := range config.Tunnels {
-		tunl, err := l2tpCtx.NewQuiescentTunnel(tcfg.Name, tcfg.Config)
+		var tunl l2tp.Tunnel
+		// The kernel tears down a tunnel when its socket is closed, so
+		// to leave the data plane in place on exit we must create L2TPv3
+		// tunnels which don't need a control plane socket as static tunnels.
+		if *detachPtr && tcfg.Config.HelloTimeout == 0 && tcfg.Config.Version == l2tp.ProtocolVersion3 {
+			tunl, err = l2tpCtx.NewStaticTunnel(tcfg.Name, tcfg.Config)
+		} else {
+			tunl, err = l2tpCtx.NewQuiescentTunnel(tcfg.Name, tcfg.Config)
+		}
 		if err != nil {
 			stdlog.Fatalf("failed to instantiate tunnel %v: %v", tcfg.Name, err)
 		}
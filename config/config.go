@@ -13,6 +13,8 @@ configuration parameters for that instance as key:value pairs.
 
 	# local specifies the local address that the tunnel should
 	# bind its socket to
+	# IPv6 link-local addresses may specify a zone using the
+	# interface name or index, e.g. "[fe80::1%eth0]:5000"
 	local = "127.0.0.1:5000"
 
 	# peer specifies the address of the peer that the tunnel should
@@ -77,11 +79,82 @@ configuration parameters for that instance as key:value pairs.
 	# If unset the host's name will be queried and the returned value used.
 	host_name "basilbrush.local"
 
+	# router_id sets the router ID the tunnel will advertise in the
+	# Router ID AVP per RFC3931.  It applies to L2TPv3 tunnels only.
+	# If unset a random value will be used.
+	router_id = 2130706433
+
 	# framing_caps sets the framing capabilities the tunnel will advertise
 	# in the Framing Capabilities AVP per RFC2661.
 	# The default is to advertise both sync and async framing.
 	framing_caps = ["sync","async"]
 
+	# secret sets the shared secret used for tunnel authentication per
+	# RFC2661 section 5.1.1, for L2TPv3 control message authentication
+	# per RFC3931 section 4.3, and for hiding AVP values per RFC2661
+	# section 4.3.  The same secret must be configured on both ends of
+	# the tunnel.
+	# By default no secret is set, so the tunnel isn't authenticated and
+	# hidden AVPs can't be decoded.
+	secret = "mysecret"
+
+	# hide_avps, if set, enables hiding of AVPs carrying tunnel and
+	# session IDs, call information, and proxy authentication data in
+	# messages sent to the peer.  The secret must also be set.
+	# AVP hiding is supported for L2TPv2 tunnels only.
+	# By default AVPs are not hidden.
+	hide_avps = true
+
+	# digest_type sets the hash algorithm used for L2TPv3 control message
+	# authentication per RFC3931 section 5.4.1.  It applies only to
+	# L2TPv3 tunnels which have a secret set.
+	# Valid values are "md5" for HMAC-MD5, and "sha1" for HMAC-SHA1.
+	# The default is "md5".
+	digest_type = "md5"
+
+	# debug sets the kernel debugging flags for the tunnel data plane.
+	# Kernel debug messages are logged using the kernel's printk facility.
+	# Current Linux kernels accept but ignore this option.
+	# Valid values are "control" for kernel/userspace API interactions,
+	# "seq" for data sequence numbers, and "data" for data messages.
+	# By default no kernel debugging is enabled.
+	debug = ["control"]
+
+	# bind_interface binds the tunnel socket to the named network
+	# interface, such that tunnel traffic is sent and received using
+	# that interface only.  bind_interface and vrf are mutually exclusive.
+	# By default the tunnel socket isn't bound to an interface.
+	bind_interface = "eth0"
+
+	# vrf places the tunnel socket in the named VRF by binding it to
+	# the VRF master device.  bind_interface and vrf are mutually exclusive.
+	# By default the tunnel socket uses the default VRF.
+	vrf = "vrf-blue"
+
+	# fwmark sets the firewall mark of the tunnel socket, which may be
+	# used for policy routing or packet filtering.
+	# By default the tunnel socket isn't marked.
+	fwmark = 42
+
+	# udp_checksum, if set, enables UDP checksums for data packets sent
+	# by IPv4 UDP static tunnels, whose socket is created by the kernel.
+	# By default static tunnels don't use UDP checksums.
+	# The option is ignored by other tunnels: their socket is created
+	# in userspace, and always uses UDP checksums for IPv4.
+	udp_checksum = true
+
+	# udp6_zero_checksum_tx, if set, disables UDP checksums for packets
+	# sent by IPv6 UDP static tunnels, as permitted by RFC6935.
+	# By default IPv6 UDP checksums are sent.
+	# The option is ignored by other tunnels.
+	udp6_zero_checksum_tx = true
+
+	# udp6_zero_checksum_rx, if set, allows IPv6 UDP static tunnels to
+	# accept packets with a zero UDP checksum, as permitted by RFC6935.
+	# By default such packets are discarded.
+	# The option is ignored by other tunnels.
+	udp6_zero_checksum_rx = true
+
 	# This is a session instance called "s1" within parent tunnel "t1".
 	# Session instances are always created inside a parent tunnel.
 	[tunnel.t1.session.s1]
@@ -99,10 +172,17 @@ configuration parameters for that instance as key:value pairs.
 	psid = 1234
 
 	# pseudowire specifies the type of layer 2 frames carried by the session.
-	# Currently supported values are "ppp", "eth", and "pppac".
+	# Currently supported values are "ppp", "eth", "eth_vlan", and "pppac".
 	# L2TPv2 tunnels support PPP and PPPAC pseudowires only.
 	pseudowire = "eth"
 
+	# vlan_id specifies the VLAN ID carried by an Ethernet VLAN pseudowire,
+	# in the range 1 - 4094.  It must be set for eth_vlan pseudowires, and
+	# doesn't apply to other pseudowire types.
+	# The VLAN ID is validated and passed to the Linux kernel, but has no
+	# effect: frames aren't tagged or filtered by VLAN.
+	vlan_id = 100
+
 	# seqnum, if set, enables the transmission of sequence numbers with
 	# L2TP data messages.  Use of sequence numbers enables the data plane
 	# to reorder data packets to ensure they are delivered in sequence.
@@ -147,6 +227,11 @@ configuration parameters for that instance as key:value pairs.
 	# pppoe_peer_mac specifies the MAC address of the PPPoE peer for the session.
 	# This parameter only applies to pppac pseudowires.
 	pppoe_peer_mac = [ 0x02, 0x42, 0x94, 0xd1, 0x4e, 0x9a ]
+
+	# debug sets the kernel debugging flags for the session data plane.
+	# The values supported are the same as for the tunnel debug option.
+	# By default no kernel debugging is enabled.
+	debug = ["control","seq","data"]
 */
 package config
 
@@ -330,6 +415,36 @@ func toFramingCaps(v interface{}) (l2tp.FramingCapability, error) {
 	return fc, nil
 }
 
+func toDebugFlags(v interface{}) (l2tp.DebugFlags, error) {
+	var df l2tp.DebugFlags
+
+	// First ensure that the supplied value is actually an array
+	flags, ok := v.([]interface{})
+	if !ok {
+		return 0, fmt.Errorf("expected array value")
+	}
+
+	// TOML arrays can be mixed type, so we have to check on a value-by-value
+	// basis that the value in the array can be represented as a string.
+	for _, f := range flags {
+		fs, err := toString(f)
+		if err != nil {
+			return 0, err
+		}
+		switch fs {
+		case "control":
+			df |= l2tp.DebugFlagsControl
+		case "seq":
+			df |= l2tp.DebugFlagsSeq
+		case "data":
+			df |= l2tp.DebugFlagsData
+		default:
+			return 0, fmt.Errorf("expect 'control', 'seq', or 'data'")
+		}
+	}
+	return df, nil
+}
+
 func toEncapType(v interface{}) (l2tp.EncapType, error) {
 	s, err := toString(v)
 	if err == nil {
@@ -354,8 +469,10 @@ func toPseudowireType(v interface{}) (l2tp.PseudowireType, error) {
 			return l2tp.PseudowireTypeEth, nil
 		case "pppac":
 			return l2tp.PseudowireTypePPPAC, nil
+		case "eth_vlan":
+			return l2tp.PseudowireTypeEthVLAN, nil
 		}
-		return 0, fmt.Errorf("expect 'ppp', 'eth', or 'pppac'")
+		return 0, fmt.Errorf("expect 'ppp', 'eth', 'eth_vlan', or 'pppac'")
 	}
 	return 0, err
 }
@@ -374,6 +491,20 @@ func toL2SpecType(v interface{}) (l2tp.L2SpecType, error) {
 	return l2tp.L2SpecTypeNone, err
 }
 
+func toDigestType(v interface{}) (l2tp.DigestType, error) {
+	s, err := toString(v)
+	if err == nil {
+		switch s {
+		case "md5":
+			return l2tp.DigestTypeHMACMD5, nil
+		case "sha1":
+			return l2tp.DigestTypeHMACSHA1, nil
+		}
+		return 0, fmt.Errorf("expect 'md5' or 'sha1'")
+	}
+	return 0, err
+}
+
 func toCCID(v interface{}) (l2tp.ControlConnID, error) {
 	u, err := toUint32(v)
 	return l2tp.ControlConnID(u), err
@@ -426,6 +557,8 @@ func (cfg *Config) newSessionConfig(tunnel *NamedTunnel, name string, scfg map[s
 			ns.Config.InterfaceName, err = toString(v)
 		case "l2spec_type":
 			ns.Config.L2SpecType, err = toL2SpecType(v)
+		case "vlan_id":
+			ns.Config.VlanID, err = toUint16(v)
 		case "pppoe_session_id":
 			ns.Config.PPPoESessionId, err = toUint16(v)
 		case "pppoe_peer_mac":
@@ -437,6 +570,8 @@ func (cfg *Config) newSessionConfig(tunnel *NamedTunnel, name string, scfg map[s
 					err = fmt.Errorf("MAC address must be 6 bytes long")
 				}
 			}
+		case "debug":
+			ns.Config.DebugFlags, err = toDebugFlags(v)
 		default:
 			err = cfg.customParser.ParseSessionParameter(tunnel, ns, k, v)
 		}
@@ -503,6 +638,30 @@ func (cfg *Config) newTunnelConfig(name string, tcfg map[string]interface{}) (*N
 			nt.Config.HostName, err = toString(v)
 		case "framing_caps":
 			nt.Config.FramingCaps, err = toFramingCaps(v)
+		case "router_id":
+			nt.Config.RouterID, err = toUint32(v)
+		case "secret":
+			var secret string
+			secret, err = toString(v)
+			nt.Config.Secret = []byte(secret)
+		case "hide_avps":
+			nt.Config.HideAVPs, err = toBool(v)
+		case "digest_type":
+			nt.Config.DigestType, err = toDigestType(v)
+		case "debug":
+			nt.Config.DebugFlags, err = toDebugFlags(v)
+		case "bind_interface":
+			nt.Config.BindInterface, err = toString(v)
+		case "vrf":
+			nt.Config.VRF, err = toString(v)
+		case "fwmark":
+			nt.Config.FwMark, err = toUint32(v)
+		case "udp_checksum":
+			nt.Config.UDPChecksum, err = toBool(v)
+		case "udp6_zero_checksum_tx":
+			nt.Config.UDPZeroChecksum6Tx, err = toBool(v)
+		case "udp6_zero_checksum_rx":
+			nt.Config.UDPZeroChecksum6Rx, err = toBool(v)
 		case "session":
 			nt.Sessions, err = cfg.loadSessions(nt, v)
 		default:
@@ -24,6 +24,12 @@ func TestGetTunnels(t *testing.T) {
 				 ptid = 8192
 				 framing_caps = ["sync"]
 				 host_name = "blackhole.local"
+				 router_id = 3232235777
+				 secret = "crackers"
+				 digest_type = "sha1"
+				 debug = ["control"]
+				 vrf = "vrf-blue"
+				 fwmark = 42
 
 				 [tunnel.t2]
 				 encap = "udp"
@@ -34,6 +40,11 @@ func TestGetTunnels(t *testing.T) {
 				 retry_timeout = 250
 				 max_retries = 2
 				 framing_caps = ["sync","async"]
+				 secret = "cheese"
+				 hide_avps = true
+				 bind_interface = "eth0"
+				 udp6_zero_checksum_tx = true
+				 udp6_zero_checksum_rx = true
 				 `,
 			want: []NamedTunnel{
 				{
@@ -46,19 +57,30 @@ func TestGetTunnels(t *testing.T) {
 						PeerTunnelID: 8192,
 						FramingCaps:  l2tp.FramingCapSync,
 						HostName:     "blackhole.local",
+						RouterID:     3232235777,
+						Secret:       []byte("crackers"),
+						DigestType:   l2tp.DigestTypeHMACSHA1,
+						DebugFlags:   l2tp.DebugFlagsControl,
+						VRF:          "vrf-blue",
+						FwMark:       42,
 					},
 				},
 				{
 					Name: "t2",
 					Config: &l2tp.TunnelConfig{
-						Encap:        l2tp.EncapTypeUDP,
-						Version:      l2tp.ProtocolVersion2,
-						Peer:         "[2001:0000:1234:0000:0000:C1C0:ABCD:0876]:6543",
-						HelloTimeout: 250 * time.Millisecond,
-						WindowSize:   10,
-						RetryTimeout: 250 * time.Millisecond,
-						MaxRetries:   2,
-						FramingCaps:  l2tp.FramingCapSync | l2tp.FramingCapAsync,
+						Encap:              l2tp.EncapTypeUDP,
+						Version:            l2tp.ProtocolVersion2,
+						Peer:               "[2001:0000:1234:0000:0000:C1C0:ABCD:0876]:6543",
+						HelloTimeout:       250 * time.Millisecond,
+						WindowSize:         10,
+						RetryTimeout:       250 * time.Millisecond,
+						MaxRetries:         2,
+						FramingCaps:        l2tp.FramingCapSync | l2tp.FramingCapAsync,
+						Secret:             []byte("cheese"),
+						HideAVPs:           true,
+						BindInterface:      "eth0",
+						UDPZeroChecksum6Tx: true,
+						UDPZeroChecksum6Rx: true,
 					},
 				},
 			},
@@ -76,6 +98,7 @@ func TestGetTunnels(t *testing.T) {
 				 seqnum = true
 				 reorder_timeout = 1500
 				 l2spec_type = "none"
+				 debug = ["control","seq","data"]
 
 				 [tunnel.t1.session.s2]
 				 pseudowire = "ppp"
@@ -88,6 +111,10 @@ func TestGetTunnels(t *testing.T) {
 				 pseudowire = "pppac"
 				 pppoe_session_id = 5612
 				 pppoe_peer_mac = [ 0xca, 0x6b, 0x7e, 0x93, 0xc4, 0xc3 ]
+
+				 [tunnel.t1.session.s4]
+				 pseudowire = "eth_vlan"
+				 vlan_id = 100
 				`,
 			want: []NamedTunnel{
 				{
@@ -108,6 +135,7 @@ func TestGetTunnels(t *testing.T) {
 								SeqNum:         true,
 								ReorderTimeout: time.Millisecond * 1500,
 								L2SpecType:     l2tp.L2SpecTypeNone,
+								DebugFlags:     l2tp.DebugFlagsControl | l2tp.DebugFlagsSeq | l2tp.DebugFlagsData,
 							},
 						},
 						{
@@ -128,6 +156,13 @@ func TestGetTunnels(t *testing.T) {
 								PPPoEPeerMac:   [6]byte{0xca, 0x6b, 0x7e, 0x93, 0xc4, 0xc3},
 							},
 						},
+						{
+							Name: "s4",
+							Config: &l2tp.SessionConfig{
+								Pseudowire: l2tp.PseudowireTypeEthVLAN,
+								VlanID:     100,
+							},
+						},
 					},
 				},
 			},
@@ -221,7 +256,7 @@ func TestBadConfig(t *testing.T) {
 			in: `[tunnel.t1]
 				 [tunnel.t1.session.s1]
 				 pseudowire = "monkey"`,
-			estr: "expect 'ppp', 'eth', or 'pppac'",
+			estr: "expect 'ppp', 'eth', 'eth_vlan', or 'pppac'",
 		},
 		{
 			name: "Bad value (unrecognised L2SpecType)",
@@ -236,6 +271,13 @@ func TestBadConfig(t *testing.T) {
 				 framing_caps = [ "bizzle" ]`,
 			estr: "expect 'sync' or 'async'",
 		},
+		{
+			name: "Bad value (unrecognised DebugFlags)",
+			in: `[tunnel.t1]
+				 [tunnel.t1.session.s1]
+				 debug = [ "control", "verbose" ]`,
+			estr: "expect 'control', 'seq', or 'data'",
+		},
 		{
 			name: "Bad value (range exceeded)",
 			in: `[tunnel.t1]
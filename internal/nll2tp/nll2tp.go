@@ -8,6 +8,7 @@ import (
 	"github.com/mdlayher/genetlink"
 	"github.com/mdlayher/netlink"
 	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
 )
 
 // L2tpProtocolVersion describes the RFC version of the tunnel:
@@ -45,7 +46,17 @@ type TunnelConfig struct {
 	// For L2TPv2 this may only be UDP.
 	Encap L2tpEncapType
 	// DebugFlags specifies the kernel debugging flags to use for the tunnel instance.
+	// Current kernels accept but ignore the debugging flags.
 	DebugFlags L2tpDebugFlags
+	// UDPChecksum enables UDP checksums for an IPv4 UDP tunnel.
+	// It applies only to tunnels whose socket is created by the kernel.
+	UDPChecksum bool
+	// UDPZeroChecksum6Tx disables UDP checksums on transmit for an IPv6 UDP tunnel.
+	// It applies only to tunnels whose socket is created by the kernel.
+	UDPZeroChecksum6Tx bool
+	// UDPZeroChecksum6Rx allows receipt of packets with a zero UDP checksum for an
+	// IPv6 UDP tunnel.  It applies only to tunnels whose socket is created by the kernel.
+	UDPZeroChecksum6Rx bool
 }
 
 // SessionConfig encapsulates genetlink parameters for L2TP session commands.
@@ -89,7 +100,43 @@ type SessionConfig struct {
 	// as per RFC3931 section 3.2.2
 	L2SpecType L2tpL2specType
 	// DebugFlags specifies the kernel debugging flags to use for the session instance.
+	// Current kernels accept but ignore the debugging flags.
 	DebugFlags L2tpDebugFlags
+	// VlanID specifies the VLAN ID for an RFC4719 Ethernet VLAN pseudowire.
+	// It must be set for, and only for, PwtypeEthVlan sessions.
+	// The kernel doesn't use the VLAN ID attribute, so no VLAN tag is
+	// applied in the data plane.
+	VlanID uint16
+}
+
+// TunnelInfo encapsulates dataplane tunnel information provided by the kernel.
+type TunnelInfo struct {
+	// Tid is the host's L2TP ID for the tunnel.
+	Tid L2tpTunnelID
+	// Ptid is the peer's L2TP ID for the tunnel.
+	Ptid L2tpTunnelID
+	// Version is the tunnel protocol version (L2TPv2 or L2TPv3).
+	Version L2tpProtocolVersion
+	// Encap is the tunnel encapsulation type.
+	Encap L2tpEncapType
+	// DebugFlags is the kernel debugging flags for the tunnel instance.
+	DebugFlags L2tpDebugFlags
+	// LocalAddr is the local IP address of the tunnel socket, which is
+	// 4 bytes long for IPv4, or 16 bytes long for IPv6.
+	LocalAddr []byte
+	// LocalPort is the local UDP port of the tunnel socket.
+	// It is zero for IP encapsulation.
+	LocalPort uint16
+	// PeerAddr is the peer IP address of the tunnel socket, which is
+	// 4 bytes long for IPv4, or 16 bytes long for IPv6.
+	PeerAddr []byte
+	// PeerPort is the peer UDP port of the tunnel socket.
+	// It is zero for IP encapsulation.
+	PeerPort uint16
+	// Statistics is the current dataplane tx/rx stats for the tunnel.
+	// These include data packets discarded by the tunnel before being
+	// passed to a session.
+	Statistics SessionStatistics
 }
 
 // SessionStatistics includes statistics on dataplane receive and transmit.
@@ -113,6 +160,12 @@ type SessionStatistics struct {
 	// RxOOSCount is the number of packets the session has received out of sequence if data packet
 	// reordering is enabled.
 	RxOOSCount uint64
+	// RxCookieDiscardCount is the number of packets discarded because their cookie didn't match
+	// the session cookie.
+	RxCookieDiscardCount uint64
+	// RxInvalidCount is the number of packets discarded because they were invalid, e.g. because
+	// of a malformed header.
+	RxInvalidCount uint64
 }
 
 // SessionInfo encapsulates dataplane session information provided by the kernel.
@@ -125,6 +178,10 @@ type SessionInfo struct {
 	Sid L2tpSessionID
 	// Psid is the peer's L2TP ID for the session.
 	Psid L2tpSessionID
+	// PseudowireType is the type of traffic carried by the session.
+	PseudowireType L2tpPwtype
+	// DebugFlags is the kernel debugging flags for the session instance.
+	DebugFlags L2tpDebugFlags
 	// IfName is the assigned interface name for this session.
 	IfName string
 	// LocalCookie is the RFC3931 cookie for the session.
@@ -167,9 +224,120 @@ type Conn struct {
 	wg         sync.WaitGroup
 }
 
+// Notification is a kernel L2TP multicast notification, which is sent
+// when a tunnel or session is created, modified, or deleted by any
+// process using the genetlink L2TP API.
+type Notification struct {
+	// Command is the genetlink command which triggered the notification,
+	// e.g. CmdTunnelDelete.
+	Command uint8
+	// PortID is the netlink port ID of the socket which sent the request
+	// triggering the notification, allowing a process to recognise the
+	// notifications caused by its own requests.  See Conn.PortID.
+	PortID uint32
+	// Tunnel carries the tunnel information for tunnel notifications,
+	// and is nil for session notifications.
+	Tunnel *TunnelInfo
+	// Session carries the session information for session notifications,
+	// and is nil for tunnel notifications.
+	Session *SessionInfo
+}
+
+// Monitor represents a genetlink L2TP connection to the kernel which
+// receives multicast notifications.
+type Monitor struct {
+	c *genetlink.Conn
+}
+
+// DialMonitor creates a new genetlink L2TP connection to the kernel,
+// joining the L2TP multicast group in order to receive notifications.
+func DialMonitor() (*Monitor, error) {
+	return DialMonitorNetNS(0)
+}
+
+// DialMonitorNetNS creates a new genetlink L2TP monitor connection as
+// for DialMonitor, in the network namespace referred to by the file
+// descriptor netns.  If netns is zero the network namespace of the
+// calling thread is used.
+func DialMonitorNetNS(netns int) (*Monitor, error) {
+	c, err := genetlink.Dial(&netlink.Config{NetNS: netns})
+	if err != nil {
+		return nil, err
+	}
+
+	family, err := c.GetFamily(GenlName)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	for _, g := range family.Groups {
+		if g.Name == GenlMcgroup {
+			err = c.JoinGroup(g.ID)
+			if err != nil {
+				c.Close()
+				return nil, err
+			}
+			return &Monitor{c: c}, nil
+		}
+	}
+
+	c.Close()
+	return nil, fmt.Errorf("no %q multicast group in genetlink family", GenlMcgroup)
+}
+
+// Receive blocks until notifications are received from the kernel.
+// Receive returns an error once the Monitor is closed.
+func (m *Monitor) Receive() ([]Notification, error) {
+	msgs, nlmsgs, err := m.c.Receive()
+	if err != nil {
+		return nil, err
+	}
+	return notifications_decode(msgs, nlmsgs)
+}
+
+func notifications_decode(msgs []genetlink.Message, nlmsgs []netlink.Message) ([]Notification, error) {
+	if len(msgs) != len(nlmsgs) {
+		return nil, fmt.Errorf("mismatched genetlink and netlink messages")
+	}
+
+	var out []Notification
+	var err error
+	for i, msg := range msgs {
+		n := Notification{Command: msg.Header.Command, PortID: nlmsgs[i].Header.PID}
+		switch msg.Header.Command {
+		case CmdTunnelCreate, CmdTunnelDelete, CmdTunnelModify:
+			n.Tunnel, err = tunnelInfo_decode(msg.Data)
+		case CmdSessionCreate, CmdSessionDelete, CmdSessionModify:
+			n.Session, err = sessionInfo_decode(msg.Data)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// Close the monitor connection, releasing associated resources
+func (m *Monitor) Close() {
+	m.c.Close()
+}
+
 // Dial creates a new genetlink L2TP connection to the kernel.
 func Dial() (*Conn, error) {
-	c, err := genetlink.Dial(nil)
+	return DialNetNS(0)
+}
+
+// DialNetNS creates a new genetlink L2TP connection to the kernel in
+// the network namespace referred to by the file descriptor netns.
+// Kernel tunnel and session instances created using the connection,
+// including session network interfaces, belong to that namespace.
+// If netns is zero the network namespace of the calling thread is used.
+func DialNetNS(netns int) (*Conn, error) {
+	c, err := genetlink.Dial(&netlink.Config{NetNS: netns})
 	if err != nil {
 		return nil, err
 	}
@@ -200,6 +368,32 @@ func (c *Conn) Close() {
 	c.c.Close()
 }
 
+// PortID returns the netlink port ID of the connection, which the
+// kernel reports in the notifications triggered by its requests.
+func (c *Conn) PortID() (uint32, error) {
+	rc, err := c.c.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var sa unix.Sockaddr
+	cerr := rc.Control(func(fd uintptr) {
+		sa, err = unix.Getsockname(int(fd))
+	})
+	if cerr != nil {
+		return 0, cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	nlsa, ok := sa.(*unix.SockaddrNetlink)
+	if !ok {
+		return 0, fmt.Errorf("unexpected address type %T", sa)
+	}
+	return nlsa.Pid, nil
+}
+
 // CreateManagedTunnel creates a new managed tunnel instance in the kernel.
 // A "managed" tunnel is one whose tunnel socket fd is created and managed
 // by a userspace process.  A managed tunnel's lifetime is bound by the lifetime
@@ -316,6 +510,32 @@ func (c *Conn) DeleteTunnel(config *TunnelConfig) error {
 	return err
 }
 
+// ModifyTunnel modifies a tunnel instance in the kernel.
+// Only the tunnel debug flags may be changed on a live tunnel: other
+// tunnel configuration parameters are ignored.
+func (c *Conn) ModifyTunnel(config *TunnelConfig) error {
+	attr, err := tunnelModifyAttr(config)
+	if err != nil {
+		return err
+	}
+
+	b, err := netlink.MarshalAttributes(attr)
+	if err != nil {
+		return err
+	}
+
+	req := genetlink.Message{
+		Header: genetlink.Header{
+			Command: CmdTunnelModify,
+			Version: c.genlFamily.Version,
+		},
+		Data: b,
+	}
+
+	_, err = c.execute(req, c.genlFamily.ID, netlink.Request|netlink.Acknowledge)
+	return err
+}
+
 // CreateSession creates a session instance in the kernel.
 // The parent tunnel instance referenced by the tunnel IDs in
 // the session configuration must already exist in the kernel.
@@ -374,6 +594,33 @@ func (c *Conn) DeleteSession(config *SessionConfig) error {
 	return err
 }
 
+// ModifySession modifies a session instance in the kernel.
+// Only the data sequencing parameters (SendSeq, RecvSeq, IsLNS and
+// ReorderTimeout) and the session debug flags may be changed on a
+// live session: other session configuration parameters are ignored.
+func (c *Conn) ModifySession(config *SessionConfig) error {
+	attr, err := sessionModifyAttr(config)
+	if err != nil {
+		return err
+	}
+
+	b, err := netlink.MarshalAttributes(attr)
+	if err != nil {
+		return err
+	}
+
+	req := genetlink.Message{
+		Header: genetlink.Header{
+			Command: CmdSessionModify,
+			Version: c.genlFamily.Version,
+		},
+		Data: b,
+	}
+
+	_, err = c.execute(req, c.genlFamily.ID, netlink.Request|netlink.Acknowledge)
+	return err
+}
+
 func (stats *SessionStatistics) decode(ad *netlink.AttributeDecoder) error {
 	for ad.Next() {
 		switch ad.Type() {
@@ -393,6 +640,10 @@ func (stats *SessionStatistics) decode(ad *netlink.AttributeDecoder) error {
 			stats.RxSeqDiscardCount = ad.Uint64()
 		case AttrRxOosPackets:
 			stats.RxOOSCount = ad.Uint64()
+		case AttrRxCookieDiscards:
+			stats.RxCookieDiscardCount = ad.Uint64()
+		case AttrRxInvalid:
+			stats.RxInvalidCount = ad.Uint64()
 		}
 	}
 	return nil
@@ -416,6 +667,10 @@ func sessionInfo_decode(data []byte) (*SessionInfo, error) {
 			info.Sid = L2tpSessionID(ad.Uint32())
 		case AttrPeerSessionId:
 			info.Psid = L2tpSessionID(ad.Uint32())
+		case AttrPwType:
+			info.PseudowireType = L2tpPwtype(ad.Uint16())
+		case AttrDebug:
+			info.DebugFlags = L2tpDebugFlags(ad.Uint32())
 		case AttrIfname:
 			info.IfName = ad.String()
 		case AttrCookie:
@@ -477,25 +732,151 @@ func (c *Conn) GetSessionInfo(config *SessionConfig) (*SessionInfo, error) {
 		return nil, err
 	}
 
-	info := SessionInfo{}
 	for _, rsp := range msgs {
 		if rsp.Header.Command != CmdSessionGet {
 			continue
 		}
+		return sessionInfo_decode(rsp.Data)
+	}
+	return nil, errors.New("no session information in kernel response")
+}
 
-		attributes, err := netlink.UnmarshalAttributes(rsp.Data)
+// DumpSessions retrieves dataplane session information for all the
+// sessions instantiated in the kernel.
+func (c *Conn) DumpSessions() ([]SessionInfo, error) {
+	req := genetlink.Message{
+		Header: genetlink.Header{
+			Command: CmdSessionGet,
+			Version: c.genlFamily.Version,
+		},
+	}
+
+	msgs, err := c.execute(req, c.genlFamily.ID, netlink.Request|netlink.Dump)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []SessionInfo
+	for _, rsp := range msgs {
+		if rsp.Header.Command != CmdSessionGet {
+			continue
+		}
+		info, err := sessionInfo_decode(rsp.Data)
 		if err != nil {
 			return nil, err
 		}
+		out = append(out, *info)
+	}
+	return out, nil
+}
 
-		for _, a := range attributes {
-			switch a.Type {
-			}
+func tunnelInfo_decode(data []byte) (*TunnelInfo, error) {
+
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create attribute decoder: %v", err)
+	}
+
+	var info TunnelInfo
+	for ad.Next() {
+		switch ad.Type() {
+		case AttrConnId:
+			info.Tid = L2tpTunnelID(ad.Uint32())
+		case AttrPeerConnId:
+			info.Ptid = L2tpTunnelID(ad.Uint32())
+		case AttrProtoVersion:
+			info.Version = L2tpProtocolVersion(ad.Uint8())
+		case AttrEncapType:
+			info.Encap = L2tpEncapType(ad.Uint16())
+		case AttrDebug:
+			info.DebugFlags = L2tpDebugFlags(ad.Uint32())
+		case AttrIpSaddr, AttrIp6Saddr:
+			info.LocalAddr = ad.Bytes()
+		case AttrIpDaddr, AttrIp6Daddr:
+			info.PeerAddr = ad.Bytes()
+		case AttrUdpSport:
+			info.LocalPort = ad.Uint16()
+		case AttrUdpDport:
+			info.PeerPort = ad.Uint16()
+		case AttrStats:
+			ad.Nested(info.Statistics.decode)
 		}
 	}
+
+	if err = ad.Err(); err != nil {
+		return nil, fmt.Errorf("failed to decode attributes: %v", err)
+	}
+
 	return &info, nil
 }
 
+// GetTunnelInfo retrieves dataplane tunnel information from the kernel.
+func (c *Conn) GetTunnelInfo(config *TunnelConfig) (*TunnelInfo, error) {
+	if config == nil {
+		return nil, errors.New("invalid nil tunnel config")
+	}
+
+	b, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{
+			Type: AttrConnId,
+			Data: nlenc.Uint32Bytes(uint32(config.Tid)),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req := genetlink.Message{
+		Header: genetlink.Header{
+			Command: CmdTunnelGet,
+			Version: c.genlFamily.Version,
+		},
+		Data: b,
+	}
+
+	msgs, err := c.execute(req, c.genlFamily.ID, netlink.Request)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rsp := range msgs {
+		if rsp.Header.Command != CmdTunnelGet {
+			continue
+		}
+		return tunnelInfo_decode(rsp.Data)
+	}
+	return nil, errors.New("no tunnel information in kernel response")
+}
+
+// DumpTunnels retrieves dataplane tunnel information for all the
+// tunnels instantiated in the kernel.
+func (c *Conn) DumpTunnels() ([]TunnelInfo, error) {
+	req := genetlink.Message{
+		Header: genetlink.Header{
+			Command: CmdTunnelGet,
+			Version: c.genlFamily.Version,
+		},
+	}
+
+	msgs, err := c.execute(req, c.genlFamily.ID, netlink.Request|netlink.Dump)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []TunnelInfo
+	for _, rsp := range msgs {
+		if rsp.Header.Command != CmdTunnelGet {
+			continue
+		}
+		info, err := tunnelInfo_decode(rsp.Data)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *info)
+	}
+	return out, nil
+}
+
 func (c *Conn) createTunnel(attr []netlink.Attribute) error {
 	b, err := netlink.MarshalAttributes(attr)
 	if err != nil {
@@ -561,7 +942,14 @@ func tunnelCreateAttr(config *TunnelConfig) ([]netlink.Attribute, error) {
 		}
 	}
 
-	return []netlink.Attribute{
+	// Checksum options apply to UDP encapsulation only
+	if config.Encap != EncaptypeUdp {
+		if config.UDPChecksum || config.UDPZeroChecksum6Tx || config.UDPZeroChecksum6Rx {
+			return nil, errors.New("UDP checksum options require UDP encapsulation")
+		}
+	}
+
+	attr := []netlink.Attribute{
 		{
 			Type: AttrConnId,
 			Data: nlenc.Uint32Bytes(uint32(config.Tid)),
@@ -582,6 +970,40 @@ func tunnelCreateAttr(config *TunnelConfig) ([]netlink.Attribute, error) {
 			Type: AttrDebug,
 			Data: nlenc.Uint32Bytes(uint32(config.DebugFlags)),
 		},
+	}
+
+	// UDP_CSUM is a u8, while the zero checksum attributes are flags:
+	// their presence enables the option
+	if config.UDPChecksum {
+		attr = append(attr, netlink.Attribute{
+			Type: AttrUdpCsum,
+			Data: nlenc.Uint8Bytes(1),
+		})
+	}
+	if config.UDPZeroChecksum6Tx {
+		attr = append(attr, netlink.Attribute{Type: AttrUdpZeroCsum6Tx})
+	}
+	if config.UDPZeroChecksum6Rx {
+		attr = append(attr, netlink.Attribute{Type: AttrUdpZeroCsum6Rx})
+	}
+
+	return attr, nil
+}
+
+func tunnelModifyAttr(config *TunnelConfig) ([]netlink.Attribute, error) {
+	if config == nil {
+		return nil, errors.New("invalid nil tunnel config")
+	}
+
+	return []netlink.Attribute{
+		{
+			Type: AttrConnId,
+			Data: nlenc.Uint32Bytes(uint32(config.Tid)),
+		},
+		{
+			Type: AttrDebug,
+			Data: nlenc.Uint32Bytes(uint32(config.DebugFlags)),
+		},
 	}, nil
 }
 
@@ -606,6 +1028,13 @@ func sessionCreateAttr(config *SessionConfig) ([]netlink.Attribute, error) {
 	if config.PseudowireType == PwtypeNone {
 		return nil, errors.New("session config must have a valid pseudowire type")
 	}
+	if config.PseudowireType == PwtypeEthVlan {
+		if config.VlanID == 0 || config.VlanID > 4094 {
+			return nil, fmt.Errorf("session config has invalid VLAN ID %d: valid range is 1-4094", config.VlanID)
+		}
+	} else if config.VlanID != 0 {
+		return nil, errors.New("session config VLAN ID requires an Ethernet VLAN pseudowire")
+	}
 	if len(config.LocalCookie) > 0 {
 		if len(config.LocalCookie) != 4 && len(config.LocalCookie) != 8 {
 			return nil, fmt.Errorf("session config has peer cookie of %d bytes: valid lengths are 4 or 8 bytes",
@@ -638,12 +1067,17 @@ func sessionCreateAttr(config *SessionConfig) ([]netlink.Attribute, error) {
 		},
 	}
 
-	// VLAN pseudowires use the kernel l2tp_eth driver
+	// VLAN pseudowires use the kernel l2tp_eth driver.  The VLAN ID is
+	// sent for completeness, but the kernel ignores it.
 	if config.PseudowireType == PwtypeEthVlan {
 		attr = append(attr, netlink.Attribute{
 			Type: AttrPwType,
 			Data: nlenc.Uint16Bytes(uint16(PwtypeEth)),
 		})
+		attr = append(attr, netlink.Attribute{
+			Type: AttrVlanId,
+			Data: nlenc.Uint16Bytes(config.VlanID),
+		})
 	} else {
 		attr = append(attr, netlink.Attribute{
 			Type: AttrPwType,
@@ -700,6 +1134,11 @@ func sessionCreateAttr(config *SessionConfig) ([]netlink.Attribute, error) {
 		})
 	}
 
+	attr = append(attr, netlink.Attribute{
+		Type: AttrDebug,
+		Data: nlenc.Uint32Bytes(uint32(config.DebugFlags)),
+	})
+
 	attr = append(attr, netlink.Attribute{
 		Type: AttrL2specType,
 		Data: nlenc.Uint8Bytes(uint8(config.L2SpecType)),
@@ -723,6 +1162,61 @@ func sessionCreateAttr(config *SessionConfig) ([]netlink.Attribute, error) {
 	return attr, nil
 }
 
+func boolToUint8(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func sessionModifyAttr(config *SessionConfig) ([]netlink.Attribute, error) {
+
+	// Sanity checks
+	if config == nil {
+		return nil, errors.New("invalid nil session config")
+	}
+	if config.Tid == 0 {
+		return nil, errors.New("session config must have a non-zero parent tunnel ID")
+	}
+	if config.Sid == 0 {
+		return nil, errors.New("session config must have a non-zero session ID")
+	}
+
+	// Unlike session create, the kernel only changes the parameters
+	// for which attributes are present, so always send the flags to
+	// allow them to be cleared as well as set.
+	return []netlink.Attribute{
+		{
+			Type: AttrConnId,
+			Data: nlenc.Uint32Bytes(uint32(config.Tid)),
+		},
+		{
+			Type: AttrSessionId,
+			Data: nlenc.Uint32Bytes(uint32(config.Sid)),
+		},
+		{
+			Type: AttrSendSeq,
+			Data: nlenc.Uint8Bytes(boolToUint8(config.SendSeq)),
+		},
+		{
+			Type: AttrRecvSeq,
+			Data: nlenc.Uint8Bytes(boolToUint8(config.RecvSeq)),
+		},
+		{
+			Type: AttrLnsMode,
+			Data: nlenc.Uint8Bytes(boolToUint8(config.IsLNS)),
+		},
+		{
+			Type: AttrRecvTimeout,
+			Data: nlenc.Uint64Bytes(config.ReorderTimeout),
+		},
+		{
+			Type: AttrDebug,
+			Data: nlenc.Uint32Bytes(uint32(config.DebugFlags)),
+		},
+	}, nil
+}
+
 func runConn(c *Conn, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for req := range c.reqChan {
@@ -0,0 +1,240 @@
+package nll2tp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+)
+
+// Marshal and unmarshal the attributes, as they'd be seen by the kernel,
+// and return the payload of the attribute of the given type.
+func testFindAttr(t *testing.T, attr []netlink.Attribute, typ uint16) ([]byte, bool) {
+	t.Helper()
+
+	b, err := netlink.MarshalAttributes(attr)
+	if err != nil {
+		t.Fatalf("MarshalAttributes(): %v", err)
+	}
+	attr, err = netlink.UnmarshalAttributes(b)
+	if err != nil {
+		t.Fatalf("UnmarshalAttributes(): %v", err)
+	}
+	for _, a := range attr {
+		if a.Type == typ {
+			return a.Data, true
+		}
+	}
+	return nil, false
+}
+
+func TestDebugFlagsAttr(t *testing.T) {
+	flags := L2tpDebugFlags(MsgControl | MsgData)
+
+	tcfg := &TunnelConfig{
+		Tid:        42,
+		Ptid:       43,
+		Version:    ProtocolVersion3,
+		Encap:      EncaptypeUdp,
+		DebugFlags: flags,
+	}
+	scfg := &SessionConfig{
+		Tid:            42,
+		Ptid:           43,
+		Sid:            44,
+		Psid:           45,
+		PseudowireType: PwtypeEth,
+		DebugFlags:     flags,
+	}
+
+	cases := []struct {
+		name    string
+		marshal func() ([]netlink.Attribute, error)
+	}{
+		{
+			name:    "tunnelCreateAttr",
+			marshal: func() ([]netlink.Attribute, error) { return tunnelCreateAttr(tcfg) },
+		},
+		{
+			name:    "tunnelModifyAttr",
+			marshal: func() ([]netlink.Attribute, error) { return tunnelModifyAttr(tcfg) },
+		},
+		{
+			name:    "sessionCreateAttr",
+			marshal: func() ([]netlink.Attribute, error) { return sessionCreateAttr(scfg) },
+		},
+		{
+			name:    "sessionModifyAttr",
+			marshal: func() ([]netlink.Attribute, error) { return sessionModifyAttr(scfg) },
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			attr, err := c.marshal()
+			if err != nil {
+				t.Fatalf("%v(): %v", c.name, err)
+			}
+			data, ok := testFindAttr(t, attr, AttrDebug)
+			if !ok {
+				t.Fatalf("no debug attribute")
+			}
+			// L2TP_ATTR_DEBUG is an NLA_U32
+			if len(data) != 4 {
+				t.Fatalf("expected 4 byte debug attribute, got %v bytes", len(data))
+			}
+			if got := L2tpDebugFlags(nlenc.Uint32(data)); got != flags {
+				t.Errorf("expected debug flags %v, got %v", flags, got)
+			}
+		})
+	}
+}
+
+func TestNotificationsDecode(t *testing.T) {
+	tunnelAttr, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: AttrConnId, Data: nlenc.Uint32Bytes(42)},
+	})
+	if err != nil {
+		t.Fatalf("MarshalAttributes(): %v", err)
+	}
+	sessionAttr, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: AttrConnId, Data: nlenc.Uint32Bytes(42)},
+		{Type: AttrSessionId, Data: nlenc.Uint32Bytes(44)},
+	})
+	if err != nil {
+		t.Fatalf("MarshalAttributes(): %v", err)
+	}
+
+	msgs := []genetlink.Message{
+		{Header: genetlink.Header{Command: CmdTunnelDelete}, Data: tunnelAttr},
+		{Header: genetlink.Header{Command: CmdSessionDelete}, Data: sessionAttr},
+		// Not a tunnel or session notification: skipped
+		{Header: genetlink.Header{Command: CmdNoop}},
+	}
+	nlmsgs := []netlink.Message{
+		{Header: netlink.Header{PID: 1234}},
+		{Header: netlink.Header{PID: 0}},
+		{Header: netlink.Header{PID: 5678}},
+	}
+
+	out, err := notifications_decode(msgs, nlmsgs)
+	if err != nil {
+		t.Fatalf("notifications_decode(): %v", err)
+	}
+	if len(out) != 2 {
+		t.Fatalf("expected 2 notifications, got %v", len(out))
+	}
+	if out[0].Command != CmdTunnelDelete || out[0].PortID != 1234 ||
+		out[0].Tunnel == nil || out[0].Tunnel.Tid != 42 {
+		t.Errorf("bad tunnel notification: %+v", out[0])
+	}
+	if out[1].Command != CmdSessionDelete || out[1].PortID != 0 ||
+		out[1].Session == nil || out[1].Session.Tid != 42 || out[1].Session.Sid != 44 {
+		t.Errorf("bad session notification: %+v", out[1])
+	}
+
+	_, err = notifications_decode(msgs, nlmsgs[:1])
+	if err == nil {
+		t.Errorf("notifications_decode() succeeded with mismatched messages")
+	}
+}
+
+func TestTunnelInfoStatisticsDecode(t *testing.T) {
+	stats, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: AttrTxPackets, Data: nlenc.Uint64Bytes(1)},
+		{Type: AttrTxBytes, Data: nlenc.Uint64Bytes(2)},
+		{Type: AttrTxErrors, Data: nlenc.Uint64Bytes(3)},
+		{Type: AttrRxPackets, Data: nlenc.Uint64Bytes(4)},
+		{Type: AttrRxBytes, Data: nlenc.Uint64Bytes(5)},
+		{Type: AttrRxSeqDiscards, Data: nlenc.Uint64Bytes(6)},
+		{Type: AttrRxOosPackets, Data: nlenc.Uint64Bytes(7)},
+		{Type: AttrRxErrors, Data: nlenc.Uint64Bytes(8)},
+		{Type: AttrStatsPad},
+		{Type: AttrRxCookieDiscards, Data: nlenc.Uint64Bytes(10)},
+		{Type: AttrRxInvalid, Data: nlenc.Uint64Bytes(11)},
+	})
+	if err != nil {
+		t.Fatalf("MarshalAttributes(): %v", err)
+	}
+	data, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: AttrConnId, Data: nlenc.Uint32Bytes(42)},
+		{Type: AttrStats | netlink.Nested, Data: stats},
+	})
+	if err != nil {
+		t.Fatalf("MarshalAttributes(): %v", err)
+	}
+
+	info, err := tunnelInfo_decode(data)
+	if err != nil {
+		t.Fatalf("tunnelInfo_decode(): %v", err)
+	}
+
+	expect := SessionStatistics{
+		TxPacketCount:        1,
+		TxBytes:              2,
+		TxErrorCount:         3,
+		RxPacketCount:        4,
+		RxBytes:              5,
+		RxSeqDiscardCount:    6,
+		RxOOSCount:           7,
+		RxErrorCount:         8,
+		RxCookieDiscardCount: 10,
+		RxInvalidCount:       11,
+	}
+	if info.Tid != 42 {
+		t.Errorf("expected tunnel ID 42, got %v", info.Tid)
+	}
+	if info.Statistics != expect {
+		t.Errorf("expected statistics %+v, got %+v", expect, info.Statistics)
+	}
+}
+
+func TestUDPChecksumAttr(t *testing.T) {
+	tcfg := &TunnelConfig{
+		Tid:                42,
+		Ptid:               43,
+		Version:            ProtocolVersion3,
+		Encap:              EncaptypeUdp,
+		UDPChecksum:        true,
+		UDPZeroChecksum6Tx: true,
+		UDPZeroChecksum6Rx: true,
+	}
+
+	attr, err := tunnelCreateAttr(tcfg)
+	if err != nil {
+		t.Fatalf("tunnelCreateAttr(): %v", err)
+	}
+
+	// The kernel policy has UDP_CSUM as a u8, and the zero checksum
+	// attributes as flags
+	cases := []struct {
+		name string
+		typ  uint16
+		data []byte
+	}{
+		{"AttrUdpCsum", AttrUdpCsum, []byte{1}},
+		{"AttrUdpZeroCsum6Tx", AttrUdpZeroCsum6Tx, []byte{}},
+		{"AttrUdpZeroCsum6Rx", AttrUdpZeroCsum6Rx, []byte{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			data, ok := testFindAttr(t, attr, c.typ)
+			if !ok {
+				t.Fatalf("no %v attribute", c.name)
+			}
+			if !bytes.Equal(data, c.data) {
+				t.Errorf("expected %v payload %x, got %x", c.name, c.data, data)
+			}
+		})
+	}
+
+	tcfg.UDPChecksum = false
+	attr, err = tunnelCreateAttr(tcfg)
+	if err != nil {
+		t.Fatalf("tunnelCreateAttr(): %v", err)
+	}
+	if _, ok := testFindAttr(t, attr, AttrUdpCsum); ok {
+		t.Errorf("UDP checksum attribute present with UDP checksums disabled")
+	}
+}
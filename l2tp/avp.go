@@ -2,6 +2,7 @@ package l2tp
 
 import (
 	"bytes"
+	"crypto/md5"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -87,6 +88,8 @@ const (
 	avpDataTypeResultCode avpDataType = iota
 	// avpDataTypeMsgID represents an AVP carrying the message type identifier
 	avpDataTypeMsgID avpDataType = iota
+	// avpDataTypeUint16Array represents an AVP carrying an array of uint16 values
+	avpDataTypeUint16Array avpDataType = iota
 	// avpDataTypeUnimplemented represents an AVP carrying a currently unimplemented data type
 	avpDataTypeUnimplemented avpDataType = iota
 	// avpDataTypeIllegal represents an AVP carrying an illegal data type.
@@ -132,8 +135,8 @@ var avpInfoTable = [...]avpInfo{
 	{avpType: avpTypeProxyAuthChallenge, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeBytes},
 	{avpType: avpTypeProxyAuthID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeBytes},
 	{avpType: avpTypeProxyAuthResponse, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeBytes},
-	{avpType: avpTypeCallErrors, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeBytes}, // TODO: handle fully
-	{avpType: avpTypeAccm, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeBytes},       // TODO: handle fully
+	{avpType: avpTypeCallErrors, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeBytes},
+	{avpType: avpTypeAccm, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeBytes},
 	{avpType: avpTypeRandomVector, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeBytes},
 	{avpType: avpTypePrivGroupID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeString},
 	{avpType: avpTypeRxConnectSpeed, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint32},
@@ -160,7 +163,7 @@ var avpInfoTable = [...]avpInfo{
 	{avpType: avpTypeMessageDigest, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeBytes},
 	{avpType: avpTypeRouterID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint32},
 	{avpType: avpTypeAssignedConnID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint32},
-	{avpType: avpTypePseudowireCaps, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUnimplemented}, // TODO: L2TPv3
+	{avpType: avpTypePseudowireCaps, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint16Array},
 	{avpType: avpTypeLocalSessionID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint32},
 	{avpType: avpTypeRemoteSessionID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint32},
 	{avpType: avpTypeAssignedCookie, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeBytes},
@@ -605,6 +608,8 @@ func (t avpDataType) String() string {
 		return "result code"
 	case avpDataTypeMsgID:
 		return "message ID"
+	case avpDataTypeUint16Array:
+		return "uint16 array"
 	case avpDataTypeUnimplemented:
 		return "unimplemented AVP data type"
 	case avpDataTypeIllegal:
@@ -655,6 +660,9 @@ func (p avpPayload) String() string {
 		str.WriteString(s)
 	case avpDataTypeBytes:
 		str.WriteString(fmt.Sprintf("%s", p.data))
+	case avpDataTypeUint16Array:
+		v, _ := p.toUint16Array()
+		str.WriteString(fmt.Sprintf("%v", v))
 	case avpDataTypeEmpty, avpDataTypeUnimplemented, avpDataTypeIllegal:
 		str.WriteString("")
 	}
@@ -738,9 +746,20 @@ func getAVPInfo(avpType avpType, VendorID avpVendorID) (*avpInfo, error) {
 	return nil, errors.New("unrecognised AVP type")
 }
 
+// errUnknownMandatoryAVP is returned by parseAVPBuffer if it encounters
+// an unrecognised AVP with the mandatory bit set.
+var errUnknownMandatoryAVP = errors.New("failed to parse mandatory AVP")
+
 // parseAVPBuffer takes a byte slice of encoded AVP data and parses it
 // into an array of AVP instances.
+//
+// Unrecognised AVPs are skipped.  If any of them are mandatory an error
+// wrapping errUnknownMandatoryAVP is returned along with the AVPs which
+// were parsed, since the handling of the message depends on whether it
+// is for the tunnel or a session.
 func parseAVPBuffer(b []byte) (avps []avp, err error) {
+	var mandatoryErr error
+
 	r := bytes.NewReader(b)
 	for r.Len() >= avpHeaderLen {
 		var h avpHeader
@@ -752,22 +771,25 @@ func parseAVPBuffer(b []byte) (avps []avp, err error) {
 			return nil, err
 		}
 
+		// Bounds check the AVP
+		if h.dataLen() > r.Len() {
+			return nil, errors.New("malformed AVP buffer: current AVP length exceeds buffer length")
+		}
+
 		// Look up the AVP
 		info, err := getAVPInfo(h.AvpType, h.VendorID)
 		if err != nil {
-			if h.isMandatory() {
-				return nil, fmt.Errorf("failed to parse mandatory AVP: %v", err)
-			}
 			// RFC2661 section 4.1 says unrecognised AVPs without the
 			// mandatory bit set MUST be ignored
+			if h.isMandatory() && mandatoryErr == nil {
+				mandatoryErr = fmt.Errorf("%w: %v", errUnknownMandatoryAVP, err)
+			}
+			if _, err := r.Seek(int64(h.dataLen()), io.SeekCurrent); err != nil {
+				return nil, errors.New("malformed AVP buffer: invalid length for current AVP")
+			}
 			continue
 		}
 
-		// Bounds check the AVP
-		if h.dataLen() > r.Len() {
-			return nil, errors.New("malformed AVP buffer: current AVP length exceeds buffer length")
-		}
-
 		if cursor, err = r.Seek(0, io.SeekCurrent); err != nil {
 			return nil, errors.New("malformed AVP buffer: unable to determine offset of current AVP")
 		}
@@ -788,10 +810,190 @@ func parseAVPBuffer(b []byte) (avps []avp, err error) {
 
 	// We must have parsed at least one AVP
 	if len(avps) == 0 {
+		if mandatoryErr != nil {
+			return nil, mandatoryErr
+		}
 		return nil, errors.New("no AVPs present in the input buffer")
 	}
 
-	return avps, nil
+	return avps, mandatoryErr
+}
+
+// avpHidingXor implements the MD5-based stream cipher used for hiding AVP
+// values as per RFC2661 section 4.3.  Since the cipher is an XOR of the
+// input with the MD5 keystream the same function is used for both hiding
+// and unhiding: the hide flag indicates which direction is being used, since
+// the keystream is chained on the ciphertext.
+func avpHidingXor(typ avpType, secret, rv, in []byte, hide bool) []byte {
+	out := make([]byte, len(in))
+
+	// The first intermediate value is MD5(attribute type + secret + RV)
+	seed := new(bytes.Buffer)
+	_ = binary.Write(seed, binary.BigEndian, typ)
+	seed.Write(secret)
+	seed.Write(rv)
+	b := md5.Sum(seed.Bytes())
+
+	for i := 0; i < len(in); i += md5.Size {
+		end := i + md5.Size
+		if end > len(in) {
+			end = len(in)
+		}
+		for j := i; j < end; j++ {
+			out[j] = in[j] ^ b[j-i]
+		}
+
+		// Subsequent intermediate values are MD5(secret + previous ciphertext)
+		var c []byte
+		if hide {
+			c = out[i:end]
+		} else {
+			c = in[i:end]
+		}
+		b = md5.Sum(append(append([]byte{}, secret...), c...))
+	}
+
+	return out
+}
+
+// hideAvp returns a copy of the AVP with its value hidden using the
+// algorithm described by RFC2661 section 4.3.
+func hideAvp(a *avp, secret, rv []byte) (*avp, error) {
+	if a.isHidden() {
+		return nil, fmt.Errorf("AVP %v is already hidden", a.getType())
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("no shared secret for AVP hiding")
+	}
+
+	// The hidden AVP subformat prefixes the original value with its length
+	plain := new(bytes.Buffer)
+	if err := binary.Write(plain, binary.BigEndian, uint16(len(a.payload.data))); err != nil {
+		return nil, err
+	}
+	plain.Write(a.payload.data)
+
+	data := avpHidingXor(a.getType(), secret, rv, plain.Bytes(), true)
+
+	return &avp{
+		header: *newAvpHeader(a.isMandatory(), true, uint(len(data)), a.vendorID(), a.getType()),
+		payload: avpPayload{
+			dataType: a.payload.dataType,
+			data:     data,
+		},
+	}, nil
+}
+
+// unhideAvp returns a copy of the hidden AVP with its original value
+// recovered using the algorithm described by RFC2661 section 4.3.
+func unhideAvp(a *avp, secret, rv []byte) (*avp, error) {
+	if !a.isHidden() {
+		return nil, fmt.Errorf("AVP %v is not hidden", a.getType())
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("no shared secret for AVP hiding")
+	}
+
+	plain := avpHidingXor(a.getType(), secret, rv, a.payload.data, false)
+
+	// The hidden AVP subformat prefixes the original value with its length,
+	// and may have padding following the value
+	if len(plain) < 2 {
+		return nil, fmt.Errorf("hidden AVP %v is too short", a.getType())
+	}
+	vlen := int(binary.BigEndian.Uint16(plain))
+	if vlen > len(plain)-2 {
+		return nil, fmt.Errorf("hidden AVP %v has bad original length %v", a.getType(), vlen)
+	}
+	data := plain[2 : 2+vlen]
+
+	return &avp{
+		header: *newAvpHeader(a.isMandatory(), false, uint(len(data)), a.vendorID(), a.getType()),
+		payload: avpPayload{
+			dataType: a.payload.dataType,
+			data:     data,
+		},
+	}, nil
+}
+
+// unhideAvps takes a slice of AVPs and returns a copy with any hidden AVPs
+// replaced with their unhidden equivalent.  Each hidden AVP is unhidden using
+// the value of the most recent Random Vector AVP to precede it.
+func unhideAvps(avps []avp, secret []byte) ([]avp, error) {
+	var rv []byte
+	out := make([]avp, 0, len(avps))
+	for _, a := range avps {
+		if a.isHidden() {
+			if len(secret) == 0 {
+				return nil, fmt.Errorf("received hidden AVP %v but no shared secret is configured", a.getType())
+			}
+			if rv == nil {
+				return nil, fmt.Errorf("hidden AVP %v is not preceded by a Random Vector AVP", a.getType())
+			}
+			u, err := unhideAvp(&a, secret, rv)
+			if err != nil {
+				return nil, err
+			}
+			a = *u
+		} else if a.vendorID() == vendorIDIetf && a.getType() == avpTypeRandomVector {
+			rv = a.payload.data
+		}
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+// hideAvps takes a slice of AVPs and returns a copy with the AVPs the hide
+// function selects replaced with their hidden equivalent.  A Random Vector
+// AVP with the value passed in is inserted before the first hidden AVP.
+func hideAvps(avps []avp, secret, rv []byte, hide func(a *avp) bool) ([]avp, error) {
+	var haveRv bool
+	out := make([]avp, 0, len(avps)+1)
+	for _, a := range avps {
+		if !a.isHidden() && hide(&a) {
+			if !haveRv {
+				rva, err := newAvp(vendorIDIetf, avpTypeRandomVector, rv)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, *rva)
+				haveRv = true
+			}
+			h, err := hideAvp(&a, secret, rv)
+			if err != nil {
+				return nil, err
+			}
+			a = *h
+		}
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+// isHideableAvp returns true for the AVPs we hide when sending messages
+// with AVP hiding enabled: those carrying identifiers, call information,
+// and proxy authentication data.
+func isHideableAvp(a *avp) bool {
+	if a.vendorID() != vendorIDIetf {
+		return false
+	}
+	switch a.getType() {
+	case avpTypeTunnelID,
+		avpTypeSessionID,
+		avpTypeCallingNumber,
+		avpTypeCalledNumber,
+		avpTypeSubAddress,
+		avpTypeInitialRcvdLcpConfreq,
+		avpTypeLastSentLcpConfreq,
+		avpTypeLastRcvdLcpConfreq,
+		avpTypeProxyAuthType,
+		avpTypeProxyAuthName,
+		avpTypeProxyAuthChallenge,
+		avpTypeProxyAuthID,
+		avpTypeProxyAuthResponse:
+		return true
+	}
+	return false
 }
 
 func encodeResultCode(rc *resultCode) ([]byte, error) {
@@ -832,6 +1034,8 @@ func encodePayload(info *avpInfo, value interface{}) ([]byte, error) {
 		_, ok = value.([]byte)
 	case avpDataTypeMsgID:
 		_, ok = value.(avpMsgType)
+	case avpDataTypeUint16Array:
+		_, ok = value.([]uint16)
 	case avpDataTypeResultCode:
 		var rc resultCode
 		rc, ok = value.(resultCode)
@@ -926,6 +1130,18 @@ func (p *avpPayload) toUint64() (out uint64, err error) {
 	return out, err
 }
 
+func (p *avpPayload) toUint16Array() (out []uint16, err error) {
+	if len(p.data)%2 != 0 {
+		return nil, fmt.Errorf("AVP payload length %v is not a multiple of 2", len(p.data))
+	}
+	out = make([]uint16, len(p.data)/2)
+	r := bytes.NewReader(p.data)
+	if err = binary.Read(r, binary.BigEndian, out); err != nil {
+		return nil, err
+	}
+	return out, err
+}
+
 func (p *avpPayload) toString() (out string, err error) {
 	return string(p.data), nil
 }
@@ -978,6 +1194,8 @@ func (avp *avp) decode() (interface{}, error) {
 			return nil, err
 		}
 		return avpMsgType(v), nil
+	case avpDataTypeUint16Array:
+		return avp.payload.toUint16Array()
 	}
 	return nil, fmt.Errorf("unhandled AVP data type")
 }
@@ -1012,6 +1230,16 @@ func (avp *avp) decodeUint64Data() (value uint64, err error) {
 	return avp.payload.toUint64()
 }
 
+// decodeUint16ArrayData decodes an AVP holding an array of uint16 values.
+// It is an error to call this function on an AVP which doesn't
+// contain a uint16 array payload.
+func (avp *avp) decodeUint16ArrayData() (value []uint16, err error) {
+	if !avp.isDataType(avpDataTypeUint16Array) {
+		return nil, errors.New("AVP data is not of type uint16 array, cannot decode")
+	}
+	return avp.payload.toUint16Array()
+}
+
 // decodeStringData decodes an AVP holding a string value.
 // It is an error to call this function on an AVP which doesn't
 // contain a string payload.
@@ -1105,6 +1333,20 @@ func findUint64Avp(avps []avp, vendorID avpVendorID, typ avpType) (uint64, error
 	return val, nil
 }
 
+// findUint16ArrayAvp looks up a specific AVP in a slice of AVPs and decodes as a uint16 slice.
+// An error will be returned if the AVP isn't present or is of the wrong type.
+func findUint16ArrayAvp(avps []avp, vendorID avpVendorID, typ avpType) ([]uint16, error) {
+	avp, err := findAvp(avps, vendorID, typ)
+	if err != nil {
+		return nil, err
+	}
+	val, err := avp.decodeUint16ArrayData()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %v: %v", typ, err)
+	}
+	return val, nil
+}
+
 // findBytesAvp looks up a specific AVP in a slice of AVPs and decodes as a byte slice.
 // An error will be returned if the AVP isn't present or is of the wrong type.
 func findBytesAvp(avps []avp, vendorID avpVendorID, typ avpType) ([]byte, error) {
@@ -2,6 +2,7 @@ package l2tp
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"reflect"
 	"testing"
@@ -118,6 +119,38 @@ func TestParseAVPBufferBad(t *testing.T) {
 	}
 }
 
+func TestParseAVPBufferUnknown(t *testing.T) {
+	msgType := []byte{0x80, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x06}  // Message Type: HELLO
+	rxWindow := []byte{0x80, 0x08, 0x00, 0x00, 0x00, 0x0a, 0x00, 0x04} // Receive Window Size: 4
+	unknown := []byte{0x00, 0x08, 0x00, 0x00, 0x03, 0xe8, 0xaa, 0xbb}  // type 1000
+	unknownM := []byte{0x80, 0x08, 0x00, 0x00, 0x03, 0xe8, 0xaa, 0xbb} // type 1000, M bit set
+
+	cases := []struct {
+		name      string
+		in        []byte
+		mandatory bool
+	}{
+		{"optional", bytes.Join([][]byte{msgType, unknown, rxWindow}, nil), false},
+		{"mandatory", bytes.Join([][]byte{msgType, unknownM, rxWindow}, nil), true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			avps, err := parseAVPBuffer(c.in)
+			if c.mandatory {
+				if !errors.Is(err, errUnknownMandatoryAVP) {
+					t.Errorf("expected unknown mandatory AVP error, got %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("parseAVPBuffer(): %v", err)
+			}
+			// The unknown AVP is skipped, and parsing continues
+			if len(avps) != 2 || avps[0].getType() != avpTypeMessage || avps[1].getType() != avpTypeRxWindowSize {
+				t.Errorf("expected Message Type and Receive Window Size AVPs, got %v", avps)
+			}
+		})
+	}
+}
+
 type avpMetadata struct {
 	mandatory, hidden bool
 	typ               avpType
@@ -397,6 +430,37 @@ func TestAVPDecodeMsgID(t *testing.T) {
 	}
 }
 
+func TestAVPDecodeUint16Array(t *testing.T) {
+	cases := []struct {
+		in       []byte
+		wantVal  []uint16
+		wantType avpType
+	}{
+		{
+			in:       []byte{0x00, 0x0c, 0x00, 0x00, 0x00, 0x3e, 0x00, 0x07, 0x00, 0x05, 0x00, 0x04},
+			wantVal:  []uint16{7, 5, 4},
+			wantType: avpTypePseudowireCaps,
+		},
+	}
+	for _, c := range cases {
+		got, err := parseAVPBuffer(c.in)
+		if err == nil {
+			if c.wantType != got[0].getType() {
+				t.Errorf("Wanted type %q, got %q", c.wantType, got[0].getType())
+			}
+			if val, err := got[0].decodeUint16ArrayData(); err == nil {
+				if !reflect.DeepEqual(val, c.wantVal) {
+					t.Errorf("Wanted value %v, got %v", c.wantVal, val)
+				}
+			} else {
+				t.Errorf("decodeUint16ArrayData() failed: %q", err)
+			}
+		} else {
+			t.Errorf("parseAVPBuffer(%q) failed: %q", c.in, err)
+		}
+	}
+}
+
 func TestEncodeUint16(t *testing.T) {
 	cases := []struct {
 		vendorID avpVendorID
@@ -529,6 +593,33 @@ func TestEncodeBytes(t *testing.T) {
 	}
 }
 
+func TestEncodeUint16Array(t *testing.T) {
+	cases := []struct {
+		vendorID avpVendorID
+		avpType  avpType
+		value    []uint16
+	}{
+		{vendorID: vendorIDIetf, avpType: avpTypePseudowireCaps, value: []uint16{5}},
+		{vendorID: vendorIDIetf, avpType: avpTypePseudowireCaps, value: []uint16{7, 5}},
+	}
+	for _, c := range cases {
+		if avp, err := newAvp(c.vendorID, c.avpType, c.value); err == nil {
+			if !avp.isDataType(avpDataTypeUint16Array) {
+				t.Errorf("Data type check failed")
+			}
+			if val, err := avp.decodeUint16ArrayData(); err == nil {
+				if !reflect.DeepEqual(val, c.value) {
+					t.Errorf("encode/decode failed: expected %v, got %v", c.value, val)
+				}
+			} else {
+				t.Errorf("decodeUint16ArrayData() failed: %q", err)
+			}
+		} else {
+			t.Errorf("newAvp(%v, %v, %v) failed: %q", c.vendorID, c.avpType, c.value, err)
+		}
+	}
+}
+
 func TestEncodeResultCode(t *testing.T) {
 	cases := []struct {
 		vendorID avpVendorID
@@ -683,3 +774,103 @@ func TestAvpDataTypeStringer(t *testing.T) {
 		}
 	}
 }
+
+func TestAVPHiding(t *testing.T) {
+	secret := []byte("secret")
+	rv := []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f}
+
+	// Expected values are derived from the MD5 construction described in
+	// RFC2661 section 4.3: the first 16 octets are XORed with
+	// MD5(attribute type + secret + RV), and each subsequent 16 octets with
+	// MD5(secret + previous 16 octets of ciphertext).
+	cases := []struct {
+		typ    avpType
+		value  interface{}
+		hidden []byte
+	}{
+		{
+			typ:    avpTypeTunnelID,
+			value:  uint16(0x1234),
+			hidden: []byte{0xbe, 0x6a, 0x0f, 0xf3},
+		},
+		{
+			typ:   avpTypeProxyAuthName,
+			value: "bob.the.builder@example.com",
+			hidden: []byte{
+				0xb0, 0x3c, 0xc5, 0x75, 0x67, 0x9f, 0x9b, 0x88, 0x7c, 0x78, 0xa5, 0x84, 0x1c, 0x2a, 0xc9, 0x9c,
+				0xb1, 0x96, 0x00, 0x09, 0xec, 0x36, 0x30, 0xb5, 0x67, 0x83, 0xb2, 0x81, 0x82,
+			},
+		},
+	}
+	for _, c := range cases {
+		a, err := newAvp(vendorIDIetf, c.typ, c.value)
+		if err != nil {
+			t.Fatalf("newAvp(%v, %v): %v", c.typ, c.value, err)
+		}
+		h, err := hideAvp(a, secret, rv)
+		if err != nil {
+			t.Fatalf("hideAvp(%v): %v", a, err)
+		}
+		if !h.isHidden() || h.isMandatory() != a.isMandatory() {
+			t.Errorf("hideAvp(%v): bad header flags %v", a, h.header)
+		}
+		if !bytes.Equal(h.payload.data, c.hidden) {
+			t.Errorf("hideAvp(%v): expected %x, got %x", a, c.hidden, h.payload.data)
+		}
+		if h.totalLen() != avpHeaderLen+len(c.hidden) {
+			t.Errorf("hideAvp(%v): expected length %v, got %v", a, avpHeaderLen+len(c.hidden), h.totalLen())
+		}
+		u, err := unhideAvp(h, secret, rv)
+		if err != nil {
+			t.Fatalf("unhideAvp(%v): %v", h, err)
+		}
+		if !reflect.DeepEqual(u, a) {
+			t.Errorf("unhideAvp(%v): expected %v, got %v", h, a, u)
+		}
+	}
+}
+
+func TestAVPUnhideMessage(t *testing.T) {
+	secret := []byte("secret")
+	rv := []byte{0xde, 0xad, 0xbe, 0xef}
+
+	msg, err := newV2Icrq(1, 42, &SessionConfig{SessionID: 1234})
+	if err != nil {
+		t.Fatalf("newV2Icrq(): %v", err)
+	}
+	plain := msg.getAvps()
+
+	hidden, err := hideAvps(plain, secret, rv, isHideableAvp)
+	if err != nil {
+		t.Fatalf("hideAvps(): %v", err)
+	}
+	if len(hidden) != len(plain)+1 {
+		t.Fatalf("hideAvps(): expected %v AVPs, got %v", len(plain)+1, len(hidden))
+	}
+	if hidden[0].getType() != avpTypeMessage || hidden[1].getType() != avpTypeRandomVector {
+		t.Errorf("hideAvps(): expected Random Vector to follow Message Type, got %v", hidden)
+	}
+	if sid, err := findAvp(hidden, vendorIDIetf, avpTypeSessionID); err != nil || !sid.isHidden() {
+		t.Errorf("hideAvps(): expected hidden Session ID AVP, got %v (%v)", sid, err)
+	}
+
+	got, err := unhideAvps(hidden, secret)
+	if err != nil {
+		t.Fatalf("unhideAvps(): %v", err)
+	}
+	sid, err := findUint16Avp(got, vendorIDIetf, avpTypeSessionID)
+	if err != nil || sid != 1234 {
+		t.Errorf("unhideAvps(): expected session ID 1234, got %v (%v)", sid, err)
+	}
+
+	// Unhiding must fail without the secret, or without the random vector
+	_, err = unhideAvps(hidden, nil)
+	if err == nil {
+		t.Errorf("unhideAvps() succeeded with no secret")
+	}
+	noRv := append([]avp{hidden[0]}, hidden[2:]...)
+	_, err = unhideAvps(noRv, secret)
+	if err == nil {
+		t.Errorf("unhideAvps() succeeded with no random vector")
+	}
+}
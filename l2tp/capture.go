@@ -0,0 +1,274 @@
+package l2tp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// pcapng block types and options, see
+// https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-05.html
+const (
+	pcapngBlockTypeSHB = 0x0A0D0D0A
+	pcapngBlockTypeIDB = 0x00000001
+	pcapngBlockTypeEPB = 0x00000006
+
+	pcapngByteOrderMagic = 0x1A2B3C4D
+
+	pcapngOptEndOfOpt = 0
+	pcapngOptEPBFlags = 2
+
+	pcapngEPBFlagInbound  = 1
+	pcapngEPBFlagOutbound = 2
+
+	// LINKTYPE_RAW: packets start with an IPv4 or IPv6 header
+	pcapngLinkTypeRaw = 101
+)
+
+// captureWriter writes control frames to an io.Writer in pcapng format.
+//
+// The L2TP control frames we send and receive on our sockets don't
+// include the IP and UDP headers the kernel adds.  To allow tools such
+// as Wireshark to decode the capture, captureWriter synthesises these
+// headers from the frame's source and destination addresses.
+//
+// A single captureWriter is shared by all the tunnels and listeners
+// of a Context.
+type captureWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+	err  error
+}
+
+var pcapngEndian = binary.LittleEndian
+
+// setWriter starts a new capture, writing the pcapng section header
+// and interface description to w.  If w is nil capture is disabled.
+func (cw *captureWriter) setWriter(w io.Writer) error {
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+
+	cw.w = nil
+	cw.err = nil
+
+	if w == nil {
+		return nil
+	}
+
+	// Section header block, no options
+	shb := make([]byte, 28)
+	pcapngEndian.PutUint32(shb[0:], pcapngBlockTypeSHB)
+	pcapngEndian.PutUint32(shb[4:], uint32(len(shb)))
+	pcapngEndian.PutUint32(shb[8:], pcapngByteOrderMagic)
+	pcapngEndian.PutUint16(shb[12:], 1)
+	pcapngEndian.PutUint16(shb[14:], 0)
+	// Section length unspecified
+	pcapngEndian.PutUint64(shb[16:], 0xffffffffffffffff)
+	pcapngEndian.PutUint32(shb[24:], uint32(len(shb)))
+
+	// Interface description block, default microsecond timestamps
+	idb := make([]byte, 20)
+	pcapngEndian.PutUint32(idb[0:], pcapngBlockTypeIDB)
+	pcapngEndian.PutUint32(idb[4:], uint32(len(idb)))
+	pcapngEndian.PutUint16(idb[8:], pcapngLinkTypeRaw)
+	pcapngEndian.PutUint16(idb[10:], 0)
+	// Unlimited snap length
+	pcapngEndian.PutUint32(idb[12:], 0)
+	pcapngEndian.PutUint32(idb[16:], uint32(len(idb)))
+
+	_, err := w.Write(append(shb, idb...))
+	if err != nil {
+		return fmt.Errorf("failed to write capture header: %v", err)
+	}
+
+	cw.w = w
+	return nil
+}
+
+// enabled returns true if frames passed to capture will be written.
+func (cw *captureWriter) enabled() bool {
+	if cw == nil {
+		return false
+	}
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+	return cw.w != nil && cw.err == nil
+}
+
+// capture writes a control frame to the capture.
+//
+// If writing to the capture fails, the error is returned and capture
+// is disabled, so a broken writer is reported only once.
+func (cw *captureWriter) capture(b []byte, src, dst unix.Sockaddr, outbound bool) error {
+	if cw == nil {
+		return nil
+	}
+
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+
+	if cw.w == nil || cw.err != nil {
+		return nil
+	}
+
+	pkt, err := synthesisePacket(b, src, dst)
+	if err != nil {
+		return fmt.Errorf("failed to capture frame: %v", err)
+	}
+
+	_, err = cw.w.Write(newEnhancedPacketBlock(pkt, time.Now(), outbound))
+	if err != nil {
+		cw.err = err
+		return fmt.Errorf("failed to write to capture, capture disabled: %v", err)
+	}
+	return nil
+}
+
+func newEnhancedPacketBlock(pkt []byte, ts time.Time, outbound bool) []byte {
+	padLen := (4 - len(pkt)%4) % 4
+	// Block header, packet data, epb_flags option, end of options, trailer
+	blockLen := 28 + len(pkt) + padLen + 8 + 4 + 4
+
+	b := make([]byte, blockLen)
+	pcapngEndian.PutUint32(b[0:], pcapngBlockTypeEPB)
+	pcapngEndian.PutUint32(b[4:], uint32(blockLen))
+	pcapngEndian.PutUint32(b[8:], 0) // interface ID
+	usec := uint64(ts.UnixNano() / 1000)
+	pcapngEndian.PutUint32(b[12:], uint32(usec>>32))
+	pcapngEndian.PutUint32(b[16:], uint32(usec))
+	pcapngEndian.PutUint32(b[20:], uint32(len(pkt)))
+	pcapngEndian.PutUint32(b[24:], uint32(len(pkt)))
+	copy(b[28:], pkt)
+
+	opt := b[28+len(pkt)+padLen:]
+	flags := uint32(pcapngEPBFlagInbound)
+	if outbound {
+		flags = pcapngEPBFlagOutbound
+	}
+	pcapngEndian.PutUint16(opt[0:], pcapngOptEPBFlags)
+	pcapngEndian.PutUint16(opt[2:], 4)
+	pcapngEndian.PutUint32(opt[4:], flags)
+	pcapngEndian.PutUint16(opt[8:], pcapngOptEndOfOpt)
+	pcapngEndian.PutUint16(opt[10:], 0)
+
+	pcapngEndian.PutUint32(b[blockLen-4:], uint32(blockLen))
+	return b
+}
+
+// synthesisePacket builds an IP packet carrying the control frame b.
+//
+// For UDP encapsulation the frame is wrapped in a UDP header.  For IP
+// encapsulation, the frame is prefixed with the zero session ID which
+// identifies L2TPv3 control messages: the kernel adds and removes this
+// for us, so it isn't present in the frames we see.
+func synthesisePacket(b []byte, src, dst unix.Sockaddr) ([]byte, error) {
+	var payload []byte
+	var proto uint8
+	var srcIP, dstIP []byte
+
+	switch s := src.(type) {
+	case *unix.SockaddrInet4:
+		d, ok := dst.(*unix.SockaddrInet4)
+		if !ok {
+			return nil, fmt.Errorf("address family mismatch: %T, %T", src, dst)
+		}
+		srcIP, dstIP = s.Addr[:], d.Addr[:]
+		proto = unix.IPPROTO_UDP
+		payload = udpDatagram(b, s.Port, d.Port)
+	case *unix.SockaddrInet6:
+		d, ok := dst.(*unix.SockaddrInet6)
+		if !ok {
+			return nil, fmt.Errorf("address family mismatch: %T, %T", src, dst)
+		}
+		srcIP, dstIP = s.Addr[:], d.Addr[:]
+		proto = unix.IPPROTO_UDP
+		payload = udpDatagram(b, s.Port, d.Port)
+	case *unix.SockaddrL2TPIP:
+		d, ok := dst.(*unix.SockaddrL2TPIP)
+		if !ok {
+			return nil, fmt.Errorf("address family mismatch: %T, %T", src, dst)
+		}
+		srcIP, dstIP = s.Addr[:], d.Addr[:]
+		proto = unix.IPPROTO_L2TP
+		payload = append(make([]byte, 4), b...)
+	case *unix.SockaddrL2TPIP6:
+		d, ok := dst.(*unix.SockaddrL2TPIP6)
+		if !ok {
+			return nil, fmt.Errorf("address family mismatch: %T, %T", src, dst)
+		}
+		srcIP, dstIP = s.Addr[:], d.Addr[:]
+		proto = unix.IPPROTO_L2TP
+		payload = append(make([]byte, 4), b...)
+	default:
+		return nil, fmt.Errorf("unexpected address type %T", src)
+	}
+
+	var hdr []byte
+	if len(srcIP) == 4 {
+		hdr = make([]byte, 20)
+		hdr[0] = 0x45
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(hdr)+len(payload)))
+		binary.BigEndian.PutUint16(hdr[6:], 0x4000) // don't fragment
+		hdr[8] = 64
+		hdr[9] = proto
+		copy(hdr[12:], srcIP)
+		copy(hdr[16:], dstIP)
+		binary.BigEndian.PutUint16(hdr[10:], inetChecksum(0, hdr))
+	} else {
+		hdr = make([]byte, 40)
+		hdr[0] = 0x60
+		binary.BigEndian.PutUint16(hdr[4:], uint16(len(payload)))
+		hdr[6] = proto
+		hdr[7] = 64
+		copy(hdr[8:], srcIP)
+		copy(hdr[24:], dstIP)
+	}
+
+	if proto == unix.IPPROTO_UDP {
+		// The UDP checksum covers a pseudo-header of the IP addresses,
+		// protocol, and UDP length.
+		sum := inetSum(0, srcIP)
+		sum = inetSum(sum, dstIP)
+		sum += uint32(proto) + uint32(len(payload))
+		csum := inetChecksum(sum, payload)
+		if csum == 0 {
+			csum = 0xffff
+		}
+		binary.BigEndian.PutUint16(payload[6:], csum)
+	}
+
+	return append(hdr, payload...), nil
+}
+
+func udpDatagram(b []byte, srcPort, dstPort int) []byte {
+	udp := make([]byte, 8+len(b))
+	binary.BigEndian.PutUint16(udp[0:], uint16(srcPort))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dstPort))
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[8:], b)
+	return udp
+}
+
+// Accumulate the ones' complement sum of b as 16-bit words
+func inetSum(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+// Compute the RFC1071 Internet checksum of b, starting from sum
+func inetChecksum(sum uint32, b []byte) uint16 {
+	sum = inetSum(sum, b)
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,302 @@
+package l2tp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/sys/unix"
+)
+
+type testPcapngBlock struct {
+	blockType uint32
+	body      []byte
+}
+
+func testParsePcapng(b []byte) (blocks []testPcapngBlock, err error) {
+	for len(b) > 0 {
+		if len(b) < 12 {
+			return nil, errors.New("short block")
+		}
+		blockType := binary.LittleEndian.Uint32(b[0:])
+		blockLen := binary.LittleEndian.Uint32(b[4:])
+		if blockLen%4 != 0 || int(blockLen) > len(b) {
+			return nil, errors.New("bad block length")
+		}
+		if binary.LittleEndian.Uint32(b[blockLen-4:]) != blockLen {
+			return nil, errors.New("block trailer doesn't match header")
+		}
+		blocks = append(blocks, testPcapngBlock{blockType: blockType, body: b[8 : blockLen-4]})
+		b = b[blockLen:]
+	}
+	return blocks, nil
+}
+
+// Returns the packet data and direction flags of an enhanced packet block
+func testParseEPB(body []byte) (pkt []byte, flags uint32, err error) {
+	if len(body) < 20 {
+		return nil, 0, errors.New("short EPB")
+	}
+	caplen := binary.LittleEndian.Uint32(body[12:])
+	pkt = body[20 : 20+caplen]
+	opts := body[20+caplen+(4-caplen%4)%4:]
+	for len(opts) >= 4 {
+		code := binary.LittleEndian.Uint16(opts[0:])
+		length := binary.LittleEndian.Uint16(opts[2:])
+		if code == pcapngOptEndOfOpt {
+			break
+		}
+		if code == pcapngOptEPBFlags && length == 4 {
+			flags = binary.LittleEndian.Uint32(opts[4:])
+		}
+		opts = opts[4+length+(4-length%4)%4:]
+	}
+	return pkt, flags, nil
+}
+
+func TestCaptureSynthesisePacket(t *testing.T) {
+	frame := []byte{0xc8, 0x02, 0x00, 0x0d, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff}
+	cases := []struct {
+		name     string
+		src, dst unix.Sockaddr
+		hdrLen   int
+		proto    uint8
+	}{
+		{
+			name:   "UDP/IPv4",
+			src:    &unix.SockaddrInet4{Addr: [4]byte{10, 0, 0, 1}, Port: 1701},
+			dst:    &unix.SockaddrInet4{Addr: [4]byte{10, 0, 0, 2}, Port: 5000},
+			hdrLen: 20,
+			proto:  unix.IPPROTO_UDP,
+		},
+		{
+			name:   "UDP/IPv6",
+			src:    &unix.SockaddrInet6{Addr: [16]byte{0: 0xfe, 1: 0x80, 15: 1}, Port: 1701},
+			dst:    &unix.SockaddrInet6{Addr: [16]byte{0: 0xfe, 1: 0x80, 15: 2}, Port: 5000},
+			hdrLen: 40,
+			proto:  unix.IPPROTO_UDP,
+		},
+		{
+			name:   "L2TP/IPv4",
+			src:    &unix.SockaddrL2TPIP{Addr: [4]byte{10, 0, 0, 1}, ConnId: 1},
+			dst:    &unix.SockaddrL2TPIP{Addr: [4]byte{10, 0, 0, 2}, ConnId: 2},
+			hdrLen: 20,
+			proto:  unix.IPPROTO_L2TP,
+		},
+		{
+			name:   "L2TP/IPv6",
+			src:    &unix.SockaddrL2TPIP6{Addr: [16]byte{0: 0xfe, 1: 0x80, 15: 1}, ConnId: 1},
+			dst:    &unix.SockaddrL2TPIP6{Addr: [16]byte{0: 0xfe, 1: 0x80, 15: 2}, ConnId: 2},
+			hdrLen: 40,
+			proto:  unix.IPPROTO_L2TP,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pkt, err := synthesisePacket(frame, c.src, c.dst)
+			if err != nil {
+				t.Fatalf("synthesisePacket(): %v", err)
+			}
+
+			var srcIP, dstIP []byte
+			if c.hdrLen == 20 {
+				if pkt[9] != c.proto {
+					t.Errorf("expected protocol %v, got %v", c.proto, pkt[9])
+				}
+				if int(binary.BigEndian.Uint16(pkt[2:])) != len(pkt) {
+					t.Errorf("bad IPv4 total length %v", binary.BigEndian.Uint16(pkt[2:]))
+				}
+				if inetChecksum(0, pkt[:20]) != 0 {
+					t.Errorf("bad IPv4 header checksum")
+				}
+				srcIP, dstIP = pkt[12:16], pkt[16:20]
+			} else {
+				if pkt[6] != c.proto {
+					t.Errorf("expected next header %v, got %v", c.proto, pkt[6])
+				}
+				if int(binary.BigEndian.Uint16(pkt[4:])) != len(pkt)-40 {
+					t.Errorf("bad IPv6 payload length %v", binary.BigEndian.Uint16(pkt[4:]))
+				}
+				srcIP, dstIP = pkt[8:24], pkt[24:40]
+			}
+
+			payload := pkt[c.hdrLen:]
+			if c.proto == unix.IPPROTO_UDP {
+				if binary.BigEndian.Uint16(payload[0:]) != 1701 || binary.BigEndian.Uint16(payload[2:]) != 5000 {
+					t.Errorf("bad UDP ports")
+				}
+				if int(binary.BigEndian.Uint16(payload[4:])) != len(payload) {
+					t.Errorf("bad UDP length %v", binary.BigEndian.Uint16(payload[4:]))
+				}
+				sum := inetSum(0, srcIP)
+				sum = inetSum(sum, dstIP)
+				sum += uint32(c.proto) + uint32(len(payload))
+				if inetChecksum(sum, payload) != 0 {
+					t.Errorf("bad UDP checksum")
+				}
+				payload = payload[8:]
+			} else {
+				if !bytes.Equal(payload[:4], []byte{0, 0, 0, 0}) {
+					t.Errorf("expected zero session ID, got %x", payload[:4])
+				}
+				payload = payload[4:]
+			}
+
+			if !bytes.Equal(payload, frame) {
+				t.Errorf("expected frame %x, got %x", frame, payload)
+			}
+		})
+	}
+}
+
+func TestCaptureSynthesisePacketMismatch(t *testing.T) {
+	_, err := synthesisePacket([]byte{0},
+		&unix.SockaddrInet4{Addr: [4]byte{10, 0, 0, 1}, Port: 1701},
+		&unix.SockaddrInet6{Addr: [16]byte{15: 1}, Port: 1701})
+	if err == nil {
+		t.Errorf("synthesisePacket() succeeded with mismatched address families")
+	}
+}
+
+type testFailingWriter struct {
+	nwrites, failAfter int
+}
+
+func (w *testFailingWriter) Write(b []byte) (int, error) {
+	w.nwrites++
+	if w.nwrites > w.failAfter {
+		return 0, errors.New("write failed")
+	}
+	return len(b), nil
+}
+
+func TestCaptureWriterFailure(t *testing.T) {
+	src := &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}, Port: 1701}
+	dst := &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}, Port: 1702}
+
+	var cw captureWriter
+	if cw.enabled() {
+		t.Errorf("capture enabled with no writer")
+	}
+
+	err := cw.setWriter(&testFailingWriter{failAfter: 0})
+	if err == nil {
+		t.Errorf("setWriter() succeeded with failing writer")
+	}
+	if cw.enabled() {
+		t.Errorf("capture enabled after failing to write header")
+	}
+
+	w := &testFailingWriter{failAfter: 1}
+	err = cw.setWriter(w)
+	if err != nil {
+		t.Fatalf("setWriter(): %v", err)
+	}
+	err = cw.capture([]byte{0}, src, dst, true)
+	if err == nil {
+		t.Errorf("capture() succeeded with failing writer")
+	}
+	if cw.enabled() {
+		t.Errorf("capture enabled after write failure")
+	}
+	err = cw.capture([]byte{0}, src, dst, true)
+	if err != nil {
+		t.Errorf("capture() reported error after capture was disabled: %v", err)
+	}
+	if w.nwrites != 2 {
+		t.Errorf("expected 2 writes, got %v", w.nwrites)
+	}
+}
+
+func TestCaptureDynamicTunnel(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = ctx.SetCaptureWriter(&buf)
+	if err != nil {
+		t.Fatalf("SetCaptureWriter(): %v", err)
+	}
+
+	sal, sap, err := newUDPAddressPair("127.0.0.1:6000", "127.0.0.1:5000")
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+	cp, peerCp := newControlPlanePipe(sal, sap, pipeImpairment{}, pipeImpairment{})
+	defer peerCp.close()
+
+	cfg := &TunnelConfig{
+		Local:          "127.0.0.1:6000",
+		Peer:           "127.0.0.1:5000",
+		Version:        ProtocolVersion2,
+		TunnelID:       1001,
+		Encap:          EncapTypeUDP,
+		RetryTimeout:   time.Second,
+		MaxRetries:     1,
+		StopCCNTimeout: 100 * time.Millisecond,
+	}
+	tunl, err := newDynamicTunnelWithControlPlane("t1", ctx, sal, sap, cfg, cp)
+	if err != nil {
+		t.Fatalf("newDynamicTunnelWithControlPlane(): %v", err)
+	}
+	ctx.linkTunnel(tunl)
+
+	_, err = pipeTestRecvSccrq(peerCp, 3*time.Second)
+	if err != nil {
+		t.Fatalf("pipeTestRecvSccrq(): %v", err)
+	}
+
+	// Stop the capture, so there are no further writes to the buffer
+	// as the context closes.
+	err = ctx.SetCaptureWriter(nil)
+	if err != nil {
+		t.Fatalf("SetCaptureWriter(nil): %v", err)
+	}
+	ctx.Close()
+
+	blocks, err := testParsePcapng(buf.Bytes())
+	if err != nil {
+		t.Fatalf("testParsePcapng(): %v", err)
+	}
+	if len(blocks) != 3 {
+		t.Fatalf("expected 3 blocks, got %v", len(blocks))
+	}
+	if blocks[0].blockType != pcapngBlockTypeSHB ||
+		binary.LittleEndian.Uint32(blocks[0].body) != pcapngByteOrderMagic {
+		t.Errorf("bad section header block")
+	}
+	if blocks[1].blockType != pcapngBlockTypeIDB ||
+		binary.LittleEndian.Uint16(blocks[1].body) != pcapngLinkTypeRaw {
+		t.Errorf("bad interface description block")
+	}
+	if blocks[2].blockType != pcapngBlockTypeEPB {
+		t.Fatalf("expected enhanced packet block, got %v", blocks[2].blockType)
+	}
+
+	pkt, flags, err := testParseEPB(blocks[2].body)
+	if err != nil {
+		t.Fatalf("testParseEPB(): %v", err)
+	}
+	if flags != pcapngEPBFlagOutbound {
+		t.Errorf("expected outbound flag, got %v", flags)
+	}
+	if len(pkt) < 28 || binary.BigEndian.Uint16(pkt[20:]) != 6000 || binary.BigEndian.Uint16(pkt[22:]) != 5000 {
+		t.Fatalf("bad packet %x", pkt)
+	}
+	msgs, err := parseMessageBuffer(pkt[28:])
+	if err != nil {
+		t.Fatalf("parseMessageBuffer(): %v", err)
+	}
+	if len(msgs) != 1 || msgs[0].getType() != avpMsgTypeSccrq {
+		t.Errorf("expected SCCRQ, got %v", msgs)
+	}
+}
@@ -1,6 +1,7 @@
 package l2tp
 
 import (
+	"fmt"
 	"github.com/katalix/go-l2tp/internal/nll2tp"
 	"time"
 )
@@ -67,12 +68,20 @@ const (
 	PseudowireTypeEth = nll2tp.PwtypeEth
 	// PseudowireTypePPPAC specifies an Access Concentrator PPP pseudowire
 	PseudowireTypePPPAC = nll2tp.PwtypePppAc
+	// PseudowireTypeEthVLAN specifies an RFC4719 Ethernet VLAN pseudowire.
+	// The Linux kernel data plane implements this as an Ethernet
+	// pseudowire, and doesn't apply the session VLAN ID.
+	PseudowireTypeEthVLAN = nll2tp.PwtypeEthVlan
 )
 
 // DebugFlags is used for kernel-space tunnel and session logging control.
 // Logging is emitted using the kernel's printk facility, and may be viewed
 // using dmesg, syslog, or the systemd journal depending on distro configuration.
 // Multiple flags may be combined to enable different log messages.
+//
+// Current Linux kernels no longer use the debugging flags, having replaced
+// them with tracepoints: the kernel header marks the netlink attribute
+// as unused.  The flags are still accepted by these kernels, but are ignored.
 type DebugFlags uint32
 
 const (
@@ -94,6 +103,94 @@ const (
 	L2SpecTypeDefault = nll2tp.L2spectypeDefault
 )
 
+// DigestType defines the hash algorithm used to authenticate L2TPv3 control
+// messages as per RFC3931 section 5.4.1.
+type DigestType int
+
+const (
+	// DigestTypeHMACMD5 defines HMAC-MD5 message digests
+	DigestTypeHMACMD5 DigestType = 0
+	// DigestTypeHMACSHA1 defines HMAC-SHA1 message digests
+	DigestTypeHMACSHA1 DigestType = 1
+)
+
+func (d DigestType) String() string {
+	switch d {
+	case DigestTypeHMACMD5:
+		return "HMAC-MD5"
+	case DigestTypeHMACSHA1:
+		return "HMAC-SHA1"
+	}
+	return fmt.Sprintf("DigestType(%d)", int(d))
+}
+
+// ProxyAuthType defines the PPP authentication type used by the LAC when
+// proxying PPP authentication to the LNS, as per RFC2661 section 4.4.5.
+type ProxyAuthType uint16
+
+const (
+	// ProxyAuthTypeText defines textual username/password exchange
+	ProxyAuthTypeText ProxyAuthType = 1
+	// ProxyAuthTypeCHAP defines PPP CHAP
+	ProxyAuthTypeCHAP ProxyAuthType = 2
+	// ProxyAuthTypePAP defines PPP PAP
+	ProxyAuthTypePAP ProxyAuthType = 3
+	// ProxyAuthTypeNone defines that no authentication was performed
+	ProxyAuthTypeNone ProxyAuthType = 4
+	// ProxyAuthTypeMSCHAPv1 defines Microsoft CHAP version 1
+	ProxyAuthTypeMSCHAPv1 ProxyAuthType = 5
+)
+
+func (p ProxyAuthType) String() string {
+	switch p {
+	case ProxyAuthTypeText:
+		return "text"
+	case ProxyAuthTypeCHAP:
+		return "CHAP"
+	case ProxyAuthTypePAP:
+		return "PAP"
+	case ProxyAuthTypeNone:
+		return "none"
+	case ProxyAuthTypeMSCHAPv1:
+		return "MSCHAPv1"
+	}
+	return fmt.Sprintf("ProxyAuthType(%d)", int(p))
+}
+
+// ProxyLCP describes the LCP negotiation performed between the LAC and
+// the PPP peer, which the LAC may forward to the LNS as per RFC2661
+// section 4.4.5.  Each field holds the LCP CONFREQ packet contents
+// starting with the first option, i.e. without the PPP and LCP headers.
+type ProxyLCP struct {
+	// InitialReceivedConfReq is the first LCP CONFREQ received
+	// from the PPP peer.
+	InitialReceivedConfReq []byte
+	// LastSentConfReq is the final LCP CONFREQ sent to the PPP peer.
+	LastSentConfReq []byte
+	// LastReceivedConfReq is the final LCP CONFREQ received from the
+	// PPP peer.
+	LastReceivedConfReq []byte
+}
+
+// ProxyAuth describes the PPP authentication performed between the LAC
+// and the PPP peer, which the LAC may forward to the LNS as per RFC2661
+// section 4.4.5.
+type ProxyAuth struct {
+	// Type is the authentication type used.
+	Type ProxyAuthType
+	// Name is the name presented by the PPP peer.
+	Name string
+	// Challenge is the challenge sent to the PPP peer, for CHAP and
+	// MSCHAPv1 authentication.
+	Challenge []byte
+	// ID is the identifier of the authentication exchange, for CHAP and
+	// MSCHAPv1 authentication.
+	ID uint8
+	// Response is the response received from the PPP peer.  For PAP
+	// and text authentication this is the peer's password.
+	Response []byte
+}
+
 // TunnelType define the runtime behaviour of a tunnel instance.
 type TunnelType int
 
@@ -190,6 +287,89 @@ type TunnelConfig struct {
 	// in the Framing Capabilities AVP per RFC2661.
 	// The default is to advertise both sync and async framing.
 	FramingCaps FramingCapability
+
+	// RouterID sets the router ID the tunnel will advertise in the
+	// Router ID AVP per RFC3931.  It applies to L2TPv3 tunnels only.
+	// The router ID should be unique to the host: it is common practice
+	// to use one of the host's IPv4 addresses.
+	// If unset a random value will be used.
+	RouterID uint32
+
+	// Secret sets the shared secret used for L2TPv2 tunnel authentication
+	// as per RFC2661 section 5.1.1, for L2TPv3 control message
+	// authentication as per RFC3931 section 4.3, and for hiding AVP values
+	// as per RFC2661 section 4.3.  The same secret must be configured on
+	// both ends of the tunnel.
+	// If the secret is set for an L2TPv2 tunnel the peer is challenged to
+	// prove knowledge of the secret during tunnel establishment.
+	// If the secret is set for an L2TPv3 tunnel every control message
+	// carries a Message Digest AVP, and messages from the peer which fail
+	// digest verification are silently discarded.
+	// Hidden AVPs received from the peer can only be decoded if the
+	// secret is set.
+	// By default no secret is set.
+	Secret []byte
+
+	// HideAVPs, if set, enables hiding of the AVPs carrying tunnel and
+	// session IDs, call information, and proxy authentication data in
+	// messages sent to the peer.  Secret must be set in order to hide AVPs.
+	// AVP hiding is supported for L2TPv2 tunnels only.
+	// By default AVPs are not hidden.
+	HideAVPs bool
+
+	// DigestType sets the hash algorithm used to generate Message Digest
+	// AVPs for L2TPv3 control message authentication.  It applies only
+	// to L2TPv3 tunnels for which Secret is set.
+	// The default is HMAC-MD5.
+	DigestType DigestType
+
+	// DebugFlags sets the kernel debugging flags for the tunnel data
+	// plane instance.  The flags may be changed for a live tunnel using
+	// Tunnel.SetDebugFlags.  Modern kernels ignore the debugging flags:
+	// see DebugFlags.
+	// By default no kernel debugging is enabled.
+	DebugFlags DebugFlags
+
+	// BindInterface, if set, binds the tunnel socket to the named
+	// network interface using SO_BINDTODEVICE, such that tunnel traffic
+	// is sent and received using that interface only.
+	// BindInterface and VRF are mutually exclusive.
+	// By default the tunnel socket isn't bound to an interface.
+	BindInterface string
+
+	// VRF, if set, places the tunnel socket in the named VRF by binding
+	// it to the VRF master device.  Tunnel traffic is then routed using
+	// the VRF routing table.
+	// BindInterface and VRF are mutually exclusive.
+	// By default the tunnel socket uses the default VRF.
+	VRF string
+
+	// FwMark, if set, sets the firewall mark (SO_MARK) of the tunnel
+	// socket, which may be used for policy routing or packet filtering.
+	// By default the tunnel socket isn't marked.
+	FwMark uint32
+
+	// UDPChecksum, if set, enables UDP checksums for data packets sent
+	// by IPv4 UDP static tunnels, whose socket is created by the kernel.
+	// By default static tunnels don't use UDP checksums.
+	// The option is ignored by other tunnels: their socket is created
+	// in userspace, and always uses UDP checksums for IPv4 whether or
+	// not the option is set.
+	UDPChecksum bool
+
+	// UDPZeroChecksum6Tx, if set, disables UDP checksums for packets sent
+	// by IPv6 UDP static tunnels, as permitted by RFC6935.
+	// By default IPv6 UDP checksums are sent.
+	// The option is ignored by other tunnels, which always send IPv6
+	// UDP checksums.
+	UDPZeroChecksum6Tx bool
+
+	// UDPZeroChecksum6Rx, if set, allows IPv6 UDP static tunnels to accept
+	// packets with a zero UDP checksum, as permitted by RFC6935.
+	// By default such packets are discarded.
+	// The option is ignored by other tunnels, which always discard
+	// such packets.
+	UDPZeroChecksum6Rx bool
 }
 
 // SessionConfig encapsulates session configuration for a pseudowire
@@ -248,8 +428,20 @@ type SessionConfig struct {
 	// L2SpecType specifies the L2TPv3 Layer 2 specific sublayer field to
 	// be used in data packet headers as per RFC3931 section 3.2.2.
 	// By default no Layer 2 specific sublayer is used.
+	// Dynamic sessions are torn down if the peer advertises a different
+	// Layer 2 specific sublayer.
 	L2SpecType L2SpecType
 
+	// VlanID specifies the VLAN ID carried by the session, in the
+	// range 1-4094.
+	// This parameter applies to PseudowireTypeEthVLAN only, for which
+	// it must be set.
+	// VlanID is validated and passed to the Linux kernel data plane,
+	// but has no effect: current kernels ignore it, so frames aren't
+	// tagged or filtered by VLAN.  Any VLAN handling must be configured
+	// on the session interface, e.g. using a VLAN device.
+	VlanID uint16
+
 	// PPPoESessionId specifies the assigned PPPoE ID of the session.
 	// This parameter applies to PseudowireTypePPPAC only.
 	PPPoESessionId uint16
@@ -257,4 +449,41 @@ type SessionConfig struct {
 	// PPPoEPeerMac specifies the MAC address of the PPPoE peer.
 	// This parameter applies to PseudowireTypePPPAC only.
 	PPPoEPeerMac [6]byte
+
+	// ConnectSpeed specifies the speed of the call in bits per second,
+	// which is reported to the peer in the (Tx) Connect Speed AVP of
+	// ICCN and OCCN messages.  It applies to L2TPv2 sessions only.
+	// By default a connect speed of 0 is reported.
+	ConnectSpeed uint32
+
+	// FramingType specifies the framing type of the call, which is
+	// reported to the peer in the Framing Type AVP of ICCN and OCCN
+	// messages.  It applies to L2TPv2 sessions only.
+	// By default both sync and async framing are reported.
+	FramingType FramingCapability
+
+	// ProxyLCP, if set, specifies LCP negotiation already performed with
+	// the PPP peer, which is forwarded to the peer in ICCN.  This allows
+	// the LNS to skip LCP renegotiation.  For sessions accepted from the
+	// peer, ProxyLCP is set if the peer's ICCN carried proxy LCP AVPs.
+	// It applies to L2TPv2 sessions only, and is typically used with
+	// PseudowireTypePPPAC.
+	// By default no proxy LCP data is sent.
+	ProxyLCP *ProxyLCP
+
+	// ProxyAuth, if set, specifies PPP authentication already performed
+	// with the PPP peer, which is forwarded to the peer in ICCN.  For
+	// sessions accepted from the peer, ProxyAuth is set if the peer's
+	// ICCN carried proxy authentication AVPs.
+	// It applies to L2TPv2 sessions only, and is typically used with
+	// PseudowireTypePPPAC.
+	// By default no proxy authentication data is sent.
+	ProxyAuth *ProxyAuth
+
+	// DebugFlags sets the kernel debugging flags for the session data
+	// plane instance.  The flags may be changed for a live session using
+	// Session.Reconfigure.  Modern kernels ignore the debugging flags:
+	// see DebugFlags.
+	// By default no kernel debugging is enabled.
+	DebugFlags DebugFlags
 }
@@ -8,7 +8,35 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-type controlPlane struct {
+// controlPlane is the interface the transport and dynamic tunnels use
+// to send and receive control messages.
+//
+// In normal operation this is a socket, but an in-memory pipe may be
+// substituted to allow the control protocol to be tested without
+// real sockets.
+type controlPlane interface {
+	// recvFrom blocks until a frame is received, returning the
+	// sender's address.  It must return an error once the control
+	// plane is closed.
+	recvFrom(p []byte) (n int, addr unix.Sockaddr, err error)
+	// write sends a frame to the peer.
+	write(b []byte) (n int, err error)
+	// connectTo sets the peer address frames are sent to.
+	connectTo(sa unix.Sockaddr) error
+	// close closes the control plane, unblocking any pending recvFrom.
+	close() error
+	// getFd returns the socket file descriptor backing the control
+	// plane, or -1 if there isn't one.
+	getFd() int
+	// getLocalAddr returns the local address of the control plane.
+	getLocalAddr() (unix.Sockaddr, error)
+	// getRemoteAddr returns the peer address frames are sent to.
+	getRemoteAddr() unix.Sockaddr
+}
+
+var _ controlPlane = (*socketControlPlane)(nil)
+
+type socketControlPlane struct {
 	local, remote unix.Sockaddr
 	fd            int
 	file          *os.File
@@ -16,7 +44,7 @@ type controlPlane struct {
 	connected     bool
 }
 
-func (cp *controlPlane) recvFrom(p []byte) (n int, addr unix.Sockaddr, err error) {
+func (cp *socketControlPlane) recvFrom(p []byte) (n int, addr unix.Sockaddr, err error) {
 	cerr := cp.rc.Read(func(fd uintptr) bool {
 		n, addr, err = unix.Recvfrom(int(fd), p, unix.MSG_NOSIGNAL)
 		return err != unix.EAGAIN && err != unix.EWOULDBLOCK
@@ -27,18 +55,18 @@ func (cp *controlPlane) recvFrom(p []byte) (n int, addr unix.Sockaddr, err error
 	return n, addr, cerr
 }
 
-func (cp *controlPlane) write(b []byte) (n int, err error) {
+func (cp *socketControlPlane) write(b []byte) (n int, err error) {
 	if cp.connected {
 		return cp.file.Write(b)
 	}
 	return cp.writeTo(b, cp.remote)
 }
 
-func (cp *controlPlane) writeTo(p []byte, addr unix.Sockaddr) (n int, err error) {
+func (cp *socketControlPlane) writeTo(p []byte, addr unix.Sockaddr) (n int, err error) {
 	return len(p), cp.sendto(p, addr)
 }
 
-func (cp *controlPlane) sendto(p []byte, to unix.Sockaddr) (err error) {
+func (cp *socketControlPlane) sendto(p []byte, to unix.Sockaddr) (err error) {
 	cerr := cp.rc.Write(func(fd uintptr) bool {
 		err = unix.Sendto(int(fd), p, unix.MSG_NOSIGNAL, to)
 		return err != unix.EAGAIN && err != unix.EWOULDBLOCK
@@ -49,7 +77,7 @@ func (cp *controlPlane) sendto(p []byte, to unix.Sockaddr) (err error) {
 	return cerr
 }
 
-func (cp *controlPlane) close() (err error) {
+func (cp *socketControlPlane) close() (err error) {
 	if cp.file != nil {
 		err = cp.file.Close()
 		cp.file = nil
@@ -57,7 +85,7 @@ func (cp *controlPlane) close() (err error) {
 	return
 }
 
-func (cp *controlPlane) connect() error {
+func (cp *socketControlPlane) connect() error {
 	err := unix.Connect(cp.fd, cp.remote)
 	if err == nil {
 		cp.connected = true
@@ -65,15 +93,35 @@ func (cp *controlPlane) connect() error {
 	return err
 }
 
-func (cp *controlPlane) connectTo(sa unix.Sockaddr) error {
+func (cp *socketControlPlane) connectTo(sa unix.Sockaddr) error {
 	cp.remote = sa
 	return cp.connect()
 }
 
-func (cp *controlPlane) bind() error {
+func (cp *socketControlPlane) bind() error {
 	return unix.Bind(cp.fd, cp.local)
 }
 
+// Allow the socket to share its local address with other sockets.
+// This allows tunnels accepted by a listener to use the listener's
+// address, with the kernel delivering frames to the most specific
+// (i.e. connected) socket.
+func (cp *socketControlPlane) reuseAddr() error {
+	return unix.SetsockoptInt(cp.fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+}
+
+func (cp *socketControlPlane) getFd() int {
+	return cp.fd
+}
+
+func (cp *socketControlPlane) getLocalAddr() (unix.Sockaddr, error) {
+	return unix.Getsockname(cp.fd)
+}
+
+func (cp *socketControlPlane) getRemoteAddr() unix.Sockaddr {
+	return cp.remote
+}
+
 func tunnelSocket(family, protocol int) (fd int, err error) {
 
 	fd, err = unix.Socket(family, unix.SOCK_DGRAM, protocol)
@@ -101,7 +149,56 @@ func tunnelSocket(family, protocol int) (fd int, err error) {
 	return fd, nil
 }
 
-func newL2tpControlPlane(localAddr, remoteAddr unix.Sockaddr) (*controlPlane, error) {
+// Apply the socket options called for by the tunnel configuration.
+// These must be set before the socket is bound.
+func setTunnelSocketOptions(fd, family, protocol int, cfg *TunnelConfig) error {
+
+	if cfg.BindInterface != "" && cfg.VRF != "" {
+		return fmt.Errorf("bind interface and VRF cannot both be specified")
+	}
+
+	// Binding to a VRF master device places the socket in the VRF
+	dev := cfg.BindInterface
+	if cfg.VRF != "" {
+		dev = cfg.VRF
+	}
+
+	if dev != "" {
+		err := unix.BindToDevice(fd, dev)
+		if err != nil {
+			return fmt.Errorf("failed to bind socket to device %q: %v", dev, err)
+		}
+	}
+
+	if cfg.FwMark != 0 {
+		err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, int(cfg.FwMark))
+		if err != nil {
+			return fmt.Errorf("failed to set SO_MARK: %v", err)
+		}
+	}
+
+	if family == unix.AF_INET6 && protocol == unix.IPPROTO_UDP {
+		if cfg.UDPZeroChecksum6Tx {
+			err := unix.SetsockoptInt(fd, unix.SOL_UDP, unix.UDP_NO_CHECK6_TX, 1)
+			if err != nil {
+				return fmt.Errorf("failed to set UDP_NO_CHECK6_TX: %v", err)
+			}
+		}
+		if cfg.UDPZeroChecksum6Rx {
+			err := unix.SetsockoptInt(fd, unix.SOL_UDP, unix.UDP_NO_CHECK6_RX, 1)
+			if err != nil {
+				return fmt.Errorf("failed to set UDP_NO_CHECK6_RX: %v", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Create a control plane with a socket in the network namespace referred
+// to by the file descriptor netns, or the current namespace if netns
+// is negative.
+func newL2tpControlPlane(netns int, localAddr, remoteAddr unix.Sockaddr, cfg *TunnelConfig) (*socketControlPlane, error) {
 
 	var family, protocol int
 
@@ -122,11 +219,21 @@ func newL2tpControlPlane(localAddr, remoteAddr unix.Sockaddr) (*controlPlane, er
 		return nil, fmt.Errorf("unexpected address type %T", localAddr)
 	}
 
-	fd, err := tunnelSocket(family, protocol)
+	var fd int
+	err := runInNetNS(netns, func() (err error) {
+		fd, err = tunnelSocket(family, protocol)
+		return
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	err = setTunnelSocketOptions(fd, family, protocol, cfg)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
 	file := os.NewFile(uintptr(fd), "l2tp")
 	sc, err := file.SyscallConn()
 	if err != nil {
@@ -134,7 +241,7 @@ func newL2tpControlPlane(localAddr, remoteAddr unix.Sockaddr) (*controlPlane, er
 		return nil, err
 	}
 
-	return &controlPlane{
+	return &socketControlPlane{
 		local:     localAddr,
 		remote:    remoteAddr,
 		fd:        fd,
@@ -0,0 +1,219 @@
+package l2tp
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// pipeImpairment describes the network conditions applied to frames
+// sent in one direction of a control plane pipe.
+//
+// Impairments are applied using a pseudo-random source seeded from
+// Seed, so a given configuration will always drop, duplicate and
+// reorder a given sequence of frames in the same way.  Delivery is
+// timed using the wall clock, however, so the interleaving of frames
+// with timer-driven events such as retransmissions is not fixed.
+type pipeImpairment struct {
+	// Loss is the probability (0.0-1.0) of a frame being dropped.
+	Loss float64
+	// Duplicate is the probability of a frame being delivered twice.
+	Duplicate float64
+	// Reorder is the probability of a frame being held back and
+	// delivered after the next frame sent.  If no further frame is
+	// sent within pipeReorderTimeout, or the pipe is closed, the held
+	// frame is delivered anyway.
+	Reorder float64
+	// Delay is the time taken for each frame to reach the receiver.
+	Delay time.Duration
+	// Seed seeds the pseudo-random source.
+	Seed int64
+}
+
+// pipeQueueLen is the number of frames which may be queued for
+// reception before further frames are dropped, analogous to a
+// socket receive buffer.
+const pipeQueueLen = 256
+
+// pipeReorderTimeout is the longest time a frame may be held back
+// for reordering.
+const pipeReorderTimeout = 20 * time.Millisecond
+
+var errPipeClosed = errors.New("control plane pipe closed")
+
+type pipeFrame struct {
+	b         []byte
+	from      unix.Sockaddr
+	deliverAt time.Time
+}
+
+// pipeControlPlane is one end of an in-memory control plane pipe.
+type pipeControlPlane struct {
+	local, remote unix.Sockaddr
+	peer          *pipeControlPlane
+	impairment    pipeImpairment
+	rng           *rand.Rand
+	// txLock serialises transmission so that impairments are applied
+	// to frames in the order they are sent.
+	txLock    sync.Mutex
+	held      *pipeFrame
+	heldTimer *time.Timer
+	rxLock    sync.Mutex
+	rxQueue   chan *pipeFrame
+	closeChan chan bool
+	isClosed  bool
+}
+
+var _ controlPlane = (*pipeControlPlane)(nil)
+
+// newControlPlanePipe creates a pair of connected control planes.
+// Frames written to a are received by b after applying impairment
+// aToB, while frames written to b are received by a after applying
+// impairment bToA.
+func newControlPlanePipe(addrA, addrB unix.Sockaddr, aToB, bToA pipeImpairment) (a, b *pipeControlPlane) {
+	a = newPipeControlPlane(addrA, addrB, aToB)
+	b = newPipeControlPlane(addrB, addrA, bToA)
+	a.peer = b
+	b.peer = a
+	return
+}
+
+func newPipeControlPlane(local, remote unix.Sockaddr, impairment pipeImpairment) *pipeControlPlane {
+	return &pipeControlPlane{
+		local:      local,
+		remote:     remote,
+		impairment: impairment,
+		rng:        rand.New(rand.NewSource(impairment.Seed)),
+		rxQueue:    make(chan *pipeFrame, pipeQueueLen),
+		closeChan:  make(chan bool),
+	}
+}
+
+func (cp *pipeControlPlane) recvFrom(p []byte) (n int, addr unix.Sockaddr, err error) {
+	select {
+	case <-cp.closeChan:
+		return 0, nil, errPipeClosed
+	case f := <-cp.rxQueue:
+		// Frames are queued in the order they're sent and all
+		// experience the same delay, so we can simply wait for
+		// each in turn.
+		if d := time.Until(f.deliverAt); d > 0 {
+			timer := time.NewTimer(d)
+			select {
+			case <-cp.closeChan:
+				timer.Stop()
+				return 0, nil, errPipeClosed
+			case <-timer.C:
+			}
+		}
+		return copy(p, f.b), f.from, nil
+	}
+}
+
+func (cp *pipeControlPlane) write(b []byte) (n int, err error) {
+	cp.txLock.Lock()
+	defer cp.txLock.Unlock()
+
+	if cp.closed() {
+		return 0, errPipeClosed
+	}
+
+	// Take a copy since the caller is free to reuse the buffer
+	f := &pipeFrame{
+		b:         append([]byte(nil), b...),
+		from:      cp.local,
+		deliverAt: time.Now().Add(cp.impairment.Delay),
+	}
+
+	if cp.rng.Float64() < cp.impairment.Loss {
+		return len(b), nil
+	}
+
+	if cp.held == nil && cp.rng.Float64() < cp.impairment.Reorder {
+		cp.held = f
+		cp.heldTimer = time.AfterFunc(pipeReorderTimeout, cp.releaseHeld)
+		return len(b), nil
+	}
+
+	cp.peer.deliver(f)
+	if cp.rng.Float64() < cp.impairment.Duplicate {
+		cp.peer.deliver(f)
+	}
+
+	if cp.held != nil {
+		cp.held.deliverAt = f.deliverAt
+		cp.deliverHeld()
+	}
+
+	return len(b), nil
+}
+
+// releaseHeld delivers a frame held back for reordering which hasn't
+// been overtaken by another frame.
+func (cp *pipeControlPlane) releaseHeld() {
+	cp.txLock.Lock()
+	defer cp.txLock.Unlock()
+	if cp.held != nil {
+		cp.deliverHeld()
+	}
+}
+
+// deliverHeld must be called with txLock held.
+func (cp *pipeControlPlane) deliverHeld() {
+	cp.heldTimer.Stop()
+	cp.peer.deliver(cp.held)
+	cp.held = nil
+}
+
+func (cp *pipeControlPlane) deliver(f *pipeFrame) {
+	cp.rxLock.Lock()
+	defer cp.rxLock.Unlock()
+	if cp.isClosed {
+		return
+	}
+	select {
+	case cp.rxQueue <- f:
+	default:
+		// Receive queue full: drop the frame
+	}
+}
+
+func (cp *pipeControlPlane) closed() bool {
+	cp.rxLock.Lock()
+	defer cp.rxLock.Unlock()
+	return cp.isClosed
+}
+
+func (cp *pipeControlPlane) connectTo(sa unix.Sockaddr) error {
+	cp.remote = sa
+	return nil
+}
+
+func (cp *pipeControlPlane) close() error {
+	// Frames already sent are still in flight, so a frame held back
+	// for reordering reaches the peer regardless.
+	cp.releaseHeld()
+
+	cp.rxLock.Lock()
+	defer cp.rxLock.Unlock()
+	if !cp.isClosed {
+		cp.isClosed = true
+		close(cp.closeChan)
+	}
+	return nil
+}
+
+func (cp *pipeControlPlane) getFd() int {
+	return -1
+}
+
+func (cp *pipeControlPlane) getLocalAddr() (unix.Sockaddr, error) {
+	return cp.local, nil
+}
+
+func (cp *pipeControlPlane) getRemoteAddr() unix.Sockaddr {
+	return cp.remote
+}
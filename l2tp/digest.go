@@ -0,0 +1,274 @@
+package l2tp
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"sync"
+)
+
+// messageAuth implements L2TPv3 control message authentication as per
+// RFC3931 sections 4.3 and 5.4.1.
+//
+// Each control message carries a Message Digest AVP immediately following
+// the Message Type AVP.  The digest is an HMAC over the local and remote
+// nonces exchanged in SCCRQ and SCCRP, followed by the control message
+// itself with the digest value zeroed.  The HMAC key is derived from the
+// shared secret configured for the tunnel.
+type messageAuth struct {
+	lock       sync.Mutex
+	digestType DigestType
+	secret     []byte
+	localNonce []byte
+	peerNonce  []byte
+}
+
+const (
+	// controlAuthNonceLen is the length of nonce we generate for the
+	// Control Message Authentication Nonce AVP.  RFC3931 section 5.4.3
+	// requires at least 16 octets.
+	controlAuthNonceLen = 16
+	// digestTypeLen is the length of the digest type field at the start
+	// of the Message Digest AVP value.
+	digestTypeLen = 2
+)
+
+func newMessageAuth(digestType DigestType, secret []byte) (ma *messageAuth, err error) {
+	if len(secret) == 0 {
+		return nil, errors.New("message authentication requires a shared secret")
+	}
+	if _, err = digestLen(digestType); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, controlAuthNonceLen)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	return &messageAuth{
+		digestType: digestType,
+		secret:     secret,
+		localNonce: nonce,
+	}, nil
+}
+
+func digestHash(digestType DigestType) (func() hash.Hash, error) {
+	switch digestType {
+	case DigestTypeHMACMD5:
+		return md5.New, nil
+	case DigestTypeHMACSHA1:
+		return sha1.New, nil
+	}
+	return nil, fmt.Errorf("unsupported message digest type %v", digestType)
+}
+
+func digestLen(digestType DigestType) (int, error) {
+	h, err := digestHash(digestType)
+	if err != nil {
+		return 0, err
+	}
+	return h().Size(), nil
+}
+
+// computeDigest derives the shared key from the secret as per RFC3931
+// section 4.3, and uses it to calculate the message digest.
+func computeDigest(digestType DigestType, secret []byte, nonces [][]byte, b []byte) ([]byte, error) {
+	h, err := digestHash(digestType)
+	if err != nil {
+		return nil, err
+	}
+
+	kmac := hmac.New(h, secret)
+	kmac.Write([]byte{2})
+	key := kmac.Sum(nil)
+
+	mac := hmac.New(h, key)
+	for _, n := range nonces {
+		mac.Write(n)
+	}
+	mac.Write(b)
+	return mac.Sum(nil), nil
+}
+
+// digestOffset returns the offset of the digest value within the
+// rendered message, or an error if the Message Digest AVP isn't the
+// second AVP in the message.
+func digestOffset(msg *v3ControlMessage) (int, error) {
+	avps := msg.getAvps()
+	if len(avps) < 2 || avps[1].getType() != avpTypeMessageDigest {
+		return 0, errors.New("no Message Digest AVP")
+	}
+	return v3HeaderLen + avps[0].totalLen() + avpHeaderLen + digestTypeLen, nil
+}
+
+// nonces returns the nonces to include in the digest for a message
+// sent in the specified direction.  SCCRQ is authenticated without
+// nonces since the peer's nonce isn't yet known.
+func digestNonces(msgType avpMsgType, sender, receiver []byte) ([][]byte, error) {
+	if msgType == avpMsgTypeSccrq {
+		return nil, nil
+	}
+	if len(sender) == 0 || len(receiver) == 0 {
+		return nil, errors.New("nonce not available")
+	}
+	return [][]byte{sender, receiver}, nil
+}
+
+// nonceAvp returns a Control Message Authentication Nonce AVP carrying
+// the local nonce, for inclusion in SCCRQ and SCCRP.
+func (ma *messageAuth) nonceAvp() (*avp, error) {
+	return newAvp(vendorIDIetf, avpTypeControlAuthNonce, ma.localNonce)
+}
+
+// learnPeerNonce stores the peer's nonce if the message carries
+// a Control Message Authentication Nonce AVP.
+func (ma *messageAuth) learnPeerNonce(msg controlMessage) {
+	nonce, err := findBytesAvp(msg.getAvps(), vendorIDIetf, avpTypeControlAuthNonce)
+	if err == nil && len(nonce) > 0 {
+		ma.lock.Lock()
+		ma.peerNonce = append([]byte{}, nonce...)
+		ma.lock.Unlock()
+	}
+}
+
+// sign renders the message to a byte slice with a Message Digest AVP.
+// The AVP is inserted following the Message Type AVP if the message
+// doesn't already have one.  Since the transport sequence numbers are
+// covered by the digest, the message must be signed each time it
+// is transmitted.
+func (ma *messageAuth) sign(msg controlMessage) ([]byte, error) {
+	m, ok := msg.(*v3ControlMessage)
+	if !ok {
+		return nil, errors.New("message authentication is supported for L2TPv3 only")
+	}
+
+	// The Message Digest AVP follows the Message Type AVP
+	if len(m.getAvps()) == 0 {
+		return nil, errors.New("no Message Type AVP")
+	}
+
+	ma.lock.Lock()
+	defer ma.lock.Unlock()
+
+	nonces, err := digestNonces(m.getType(), ma.localNonce, ma.peerNonce)
+	if err != nil {
+		return nil, err
+	}
+
+	dlen, err := digestLen(ma.digestType)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set up the Message Digest AVP with a zero digest value
+	value := make([]byte, digestTypeLen+dlen)
+	binary.BigEndian.PutUint16(value, uint16(ma.digestType))
+	digestAvp, err := newAvp(vendorIDIetf, avpTypeMessageDigest, value)
+	if err != nil {
+		return nil, err
+	}
+
+	avps := m.getAvps()
+	if len(avps) > 1 && avps[1].getType() == avpTypeMessageDigest {
+		avps[1] = *digestAvp
+		m.setAvps(avps)
+	} else {
+		newAvps := []avp{avps[0], *digestAvp}
+		m.setAvps(append(newAvps, avps[1:]...))
+	}
+
+	b, err := m.toBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	offset, err := digestOffset(m)
+	if err != nil {
+		return nil, err
+	}
+
+	digest, err := computeDigest(ma.digestType, ma.secret, nonces, b)
+	if err != nil {
+		return nil, err
+	}
+	copy(b[offset:], digest)
+
+	return b, nil
+}
+
+// verify checks the Message Digest AVP of a received message.
+// The digest type specified by the peer is used, which may differ from
+// our configured digest type.
+func (ma *messageAuth) verify(msg controlMessage) error {
+	m, ok := msg.(*v3ControlMessage)
+	if !ok {
+		return errors.New("message authentication is supported for L2TPv3 only")
+	}
+
+	offset, err := digestOffset(m)
+	if err != nil {
+		return err
+	}
+
+	_, value := m.getAvps()[1].rawData()
+	if len(value) < digestTypeLen {
+		return errors.New("malformed Message Digest AVP")
+	}
+	digestType := DigestType(binary.BigEndian.Uint16(value))
+	dlen, err := digestLen(digestType)
+	if err != nil {
+		return err
+	}
+	if len(value) != digestTypeLen+dlen {
+		return fmt.Errorf("bad Message Digest AVP length %d for %v", len(value), digestType)
+	}
+
+	ma.lock.Lock()
+	peerNonce := ma.peerNonce
+	ma.lock.Unlock()
+
+	// SCCRP carries the nonce we need to verify it
+	if m.getType() == avpMsgTypeSccrp {
+		peerNonce, err = findBytesAvp(m.getAvps(), vendorIDIetf, avpTypeControlAuthNonce)
+		if err != nil {
+			return fmt.Errorf("no nonce in SCCRP: %v", err)
+		}
+	}
+
+	nonces, err := digestNonces(m.getType(), peerNonce, ma.localNonce)
+	if err != nil {
+		return err
+	}
+
+	// Use the received buffer if we have it, since the parser doesn't
+	// retain AVPs it doesn't recognise.
+	var b []byte
+	if m.raw != nil {
+		b = append([]byte{}, m.raw...)
+	} else {
+		b, err = m.toBytes()
+		if err != nil {
+			return err
+		}
+	}
+	if offset+dlen > len(b) {
+		return errors.New("malformed message buffer")
+	}
+	for i := offset; i < offset+dlen; i++ {
+		b[i] = 0
+	}
+
+	expected, err := computeDigest(digestType, ma.secret, nonces, b)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(expected, value[digestTypeLen:]) {
+		return errors.New("message digest mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package l2tp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestComputeDigest(t *testing.T) {
+	nonces := [][]byte{
+		[]byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f},
+		[]byte{0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f},
+	}
+	cases := []struct {
+		digestType DigestType
+		want       []byte
+	}{
+		{
+			digestType: DigestTypeHMACMD5,
+			want: []byte{
+				0x9e, 0x42, 0xe7, 0xbb, 0x07, 0x56, 0x80, 0x60,
+				0xc5, 0x0e, 0xc1, 0x5d, 0x92, 0x91, 0x19, 0x61,
+			},
+		},
+		{
+			digestType: DigestTypeHMACSHA1,
+			want: []byte{
+				0xe1, 0x4f, 0xd2, 0xcd, 0xec, 0xbc, 0x90, 0x2d, 0x59, 0x62,
+				0x1a, 0x31, 0x70, 0xdc, 0x26, 0x13, 0x59, 0xd9, 0xa9, 0x64,
+			},
+		},
+	}
+	for _, c := range cases {
+		got, err := computeDigest(c.digestType, []byte("secret"), nonces, []byte("hello world"))
+		if err != nil {
+			t.Fatalf("computeDigest(%v): %v", c.digestType, err)
+		}
+		if !bytes.Equal(got, c.want) {
+			t.Errorf("computeDigest(%v): expected %x, got %x", c.digestType, c.want, got)
+		}
+	}
+}
+
+// Sign a message, and parse the result as though received from the peer
+func signAndParse(t *testing.T, ma *messageAuth, msg controlMessage) controlMessage {
+	b, err := ma.sign(msg)
+	if err != nil {
+		t.Fatalf("sign(%v): %v", msg.getType(), err)
+	}
+	messages, err := parseMessageBuffer(b)
+	if err != nil {
+		t.Fatalf("parseMessageBuffer(): %v", err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("parseMessageBuffer(): expected 1 message, got %v", len(messages))
+	}
+	return messages[0]
+}
+
+func TestMessageAuth(t *testing.T) {
+	for _, digestType := range []DigestType{DigestTypeHMACMD5, DigestTypeHMACSHA1} {
+		t.Run(digestType.String(), func(t *testing.T) {
+			cfg := &TunnelConfig{
+				Version:      ProtocolVersion3,
+				TunnelID:     42,
+				PeerTunnelID: 4242,
+				HostName:     "test",
+				RouterID:     1,
+			}
+
+			lac, err := newMessageAuth(digestType, []byte("secret"))
+			if err != nil {
+				t.Fatalf("newMessageAuth(): %v", err)
+			}
+			lns, err := newMessageAuth(DigestTypeHMACMD5, []byte("secret"))
+			if err != nil {
+				t.Fatalf("newMessageAuth(): %v", err)
+			}
+			imposter, err := newMessageAuth(digestType, []byte("terces"))
+			if err != nil {
+				t.Fatalf("newMessageAuth(): %v", err)
+			}
+
+			// LAC -> LNS: SCCRQ carrying the LAC nonce
+			sccrq, err := newV3Sccrq(cfg)
+			if err != nil {
+				t.Fatalf("newV3Sccrq(): %v", err)
+			}
+			nonce, err := lac.nonceAvp()
+			if err != nil {
+				t.Fatalf("nonceAvp(): %v", err)
+			}
+			sccrq.appendAvp(nonce)
+			rx := signAndParse(t, lac, sccrq)
+			if err = rx.validate(); err != nil {
+				t.Fatalf("validate(%v): %v", rx.getType(), err)
+			}
+			if err = lns.verify(rx); err != nil {
+				t.Fatalf("verify(%v): %v", rx.getType(), err)
+			}
+			if err = imposter.verify(rx); err == nil {
+				t.Errorf("verify(%v) succeeded with the wrong secret", rx.getType())
+			}
+			lns.learnPeerNonce(rx)
+
+			// LNS -> LAC: SCCRP carrying the LNS nonce
+			sccrp, err := newV3Sccrp(cfg)
+			if err != nil {
+				t.Fatalf("newV3Sccrp(): %v", err)
+			}
+			nonce, err = lns.nonceAvp()
+			if err != nil {
+				t.Fatalf("nonceAvp(): %v", err)
+			}
+			sccrp.appendAvp(nonce)
+			rx = signAndParse(t, lns, sccrp)
+			if err = lac.verify(rx); err != nil {
+				t.Fatalf("verify(%v): %v", rx.getType(), err)
+			}
+			lac.learnPeerNonce(rx)
+
+			// Subsequent messages use both nonces, and must be re-signed
+			// when the sequence numbers change on retransmit
+			hello, err := newV3Hello(cfg)
+			if err != nil {
+				t.Fatalf("newV3Hello(): %v", err)
+			}
+			for nr := uint16(0); nr < 2; nr++ {
+				hello.setTransportSeqNum(1, nr)
+				rx = signAndParse(t, lac, hello)
+				if err = lns.verify(rx); err != nil {
+					t.Fatalf("verify(%v): %v", rx.getType(), err)
+				}
+				if len(hello.getAvps()) != 2 {
+					t.Errorf("sign(%v): expected a single Message Digest AVP, got %v", rx.getType(), hello.getAvps())
+				}
+			}
+
+			// Tampering with the message must cause verification to fail
+			b, err := lac.sign(hello)
+			if err != nil {
+				t.Fatalf("sign(%v): %v", hello.getType(), err)
+			}
+			b[len(b)-1] ^= 0xff
+			messages, err := parseMessageBuffer(b)
+			if err != nil {
+				t.Fatalf("parseMessageBuffer(): %v", err)
+			}
+			if err = lns.verify(messages[0]); err == nil {
+				t.Errorf("verify(%v) succeeded for a modified message", messages[0].getType())
+			}
+
+			// Messages without AVPs can't be signed
+			empty, err := newV3ControlMessage(4242, nil)
+			if err != nil {
+				t.Fatalf("newV3ControlMessage(): %v", err)
+			}
+			if _, err = lac.sign(empty); err == nil {
+				t.Errorf("sign() succeeded for a message with no AVPs")
+			}
+
+			// Messages without a digest must fail verification
+			hello, err = newV3Hello(cfg)
+			if err != nil {
+				t.Fatalf("newV3Hello(): %v", err)
+			}
+			if err = lns.verify(hello); err == nil {
+				t.Errorf("verify(%v) succeeded for a message without a digest", hello.getType())
+			}
+		})
+	}
+}
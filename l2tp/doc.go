@@ -22,10 +22,9 @@ Currently package l2tp implements:
 
  * support for controlling the Linux L2TP data plane for L2TPv2 and
    L2TPv3 tunnels and sessions,
- * the L2TPv2 control plane for client/LAC mode.
-
-In the future we plan to add support for the L2TPv3 control plane, and
-server/LNS mode.
+ * the L2TPv2 control plane for client/LAC and server/LNS modes,
+ * the L2TPv3 control plane for control connection and session establishment
+   over UDP and IP encapsulation.
 
 Usage
 
@@ -72,6 +71,17 @@ allows for detection of tunnel failure in an otherwise static setup.
 
 The final tunnel type is the dynamic tunnel.  This runs the full L2TP control protocol.
 
+Dynamic tunnels may be created either by the local host (client/LAC mode), using
+Context.NewDynamicTunnel, or in response to a control connection initiated by the
+peer (server/LNS mode).  For the latter, Context.NewListener creates a listener
+which accepts control connections on a given address, creating a dynamic tunnel
+for each.  Applications are informed of accepted tunnels by means of the
+TunnelUpEvent.
+
+Calls placed by the peer of a dynamic tunnel are passed to the IncomingCallHandler
+registered using Context.SetIncomingCallHandler, which decides whether to accept
+the call, and provides the configuration for the session created if it does.
+
 Configuration
 
 Each tunnel and session instance can be configured using the TunnelConfig
@@ -97,5 +107,14 @@ instances.
 
 To disable all logging from package l2tp, pass in a nil logger.
 
+Packet capture
+
+Control protocol traffic may be captured in pcapng format for analysis with
+tools such as Wireshark, without needing to run tcpdump on the host.  Use
+Context.SetCaptureWriter to start capturing.
+
+Applications may also observe control messages programmatically, for example
+to gather statistics, by registering a MessageObserver with the Context.
+
 */
 package l2tp
@@ -2,6 +2,7 @@ package l2tp
 
 import (
 	"fmt"
+	"sync"
 )
 
 type fsmCallback func(args []interface{})
@@ -13,16 +14,32 @@ type eventDesc struct {
 }
 
 type fsm struct {
+	lock    sync.RWMutex
 	current string
 	table   []eventDesc
 }
 
+// The FSM is driven from a single goroutine, but the current state
+// may be queried by the user from any goroutine.
+func (f *fsm) state() string {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.current
+}
+
+func (f *fsm) setState(s string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.current = s
+}
+
 func (f *fsm) handleEvent(e string, args ...interface{}) error {
+	current := f.state()
 	for _, t := range f.table {
-		if f.current == t.from {
+		if current == t.from {
 			for _, event := range t.events {
 				if e == event {
-					f.current = t.to
+					f.setState(t.to)
 					if t.cb != nil {
 						t.cb(args)
 					}
@@ -31,5 +48,5 @@ func (f *fsm) handleEvent(e string, args ...interface{}) error {
 			}
 		}
 	}
-	return fmt.Errorf("no transition defined for event %v in state %v", e, f.current)
+	return fmt.Errorf("no transition defined for event %v in state %v", e, current)
 }
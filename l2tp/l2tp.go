@@ -1,14 +1,20 @@
 package l2tp
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"os"
+	"reflect"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"golang.org/x/sys/unix"
 )
 
@@ -23,7 +29,15 @@ type Context struct {
 	callSerial    uint32
 	serialLock    sync.Mutex
 	eventHandlers []EventHandler
+	callHandler   IncomingCallHandler
+	ocallHandler  OutgoingCallHandler
 	evtLock       sync.RWMutex
+	listeners     []*listener
+	llock         sync.Mutex
+	detached      bool
+	netns         int
+	capture       captureWriter
+	observers     messageObservers
 }
 
 // Tunnel is an interface representing an L2TP tunnel.
@@ -37,6 +51,69 @@ type Tunnel interface {
 	//
 	// Any sessions instantiated inside the tunnel are removed.
 	Close()
+
+	// Name returns the name of the tunnel.
+	Name() string
+
+	// State returns the current state of the tunnel.
+	//
+	// For dynamic tunnels this is the state of the control protocol
+	// state machine, e.g. "waitctlreply", "established", or "dead".
+	// Static and quiescent tunnels are always "established".
+	State() string
+
+	// Config returns a copy of the tunnel configuration, including
+	// any values negotiated with the peer such as the peer tunnel ID.
+	// The returned configuration must not be modified.
+	Config() *TunnelConfig
+
+	// Sessions returns the sessions currently instantiated in the tunnel.
+	Sessions() []Session
+
+	// Statistics returns the data plane statistics for the tunnel.
+	// An error is returned if the tunnel data plane hasn't been
+	// instantiated.
+	Statistics() (*TunnelDataPlaneStatistics, error)
+
+	// SetDebugFlags changes the kernel debugging flags of the tunnel
+	// data plane.  The debugging flags of the tunnel's sessions are
+	// unaffected: use Session.Reconfigure to change those.
+	// Modern kernels ignore the debugging flags: see DebugFlags.
+	//
+	// An error is returned if the tunnel data plane hasn't been
+	// instantiated.
+	SetDebugFlags(flags DebugFlags) error
+}
+
+// OutgoingCallTunnel is an interface representing an L2TP tunnel which
+// supports outgoing calls.  The Tunnel instances of dynamic tunnels
+// implement OutgoingCallTunnel, and may be converted using a type
+// assertion.
+type OutgoingCallTunnel interface {
+	Tunnel
+
+	// NewOutgoingCall adds a session to a tunnel instance by requesting
+	// that the peer place an outgoing call using the parameters provided.
+	//
+	// Outgoing calls are supported by dynamic L2TPv2 tunnels only.
+	// Typically the LNS places calls via. the LAC peer.
+	//
+	// The name provided must be unique in the parent tunnel.
+	// On completion of the control protocol message exchange with the
+	// peer a SessionUpEvent is passed to registered event handlers.  The
+	// session configuration in the event reports the connect speed and
+	// framing type of the call as advertised by the peer.
+	NewOutgoingCall(name string, cfg *SessionConfig, call *OutgoingCallParameters) (Session, error)
+}
+
+// Listener is an interface representing an L2TP server/LNS listener,
+// which accepts control connections initiated by peers.
+type Listener interface {
+	// Close stops the listener accepting further control connections.
+	//
+	// Tunnels previously accepted by the listener are not affected,
+	// and continue to run until they are closed or the Context is closed.
+	Close()
 }
 
 type tunnel interface {
@@ -45,6 +122,10 @@ type tunnel interface {
 	getCfg() *TunnelConfig
 	getDP() DataPlane
 	getLogger() log.Logger
+	isDetached() bool
+	isDataPlaneDeleted() bool
+	onDataPlaneDeleted()
+	findSessionByID(id ControlConnID) (s session, ok bool)
 	unlinkSession(s session)
 	handleUserEvent(event interface{})
 }
@@ -53,12 +134,42 @@ type tunnel interface {
 type Session interface {
 	// Close closes the session, releasing allocated resources.
 	Close()
+
+	// State returns the current state of the session.
+	//
+	// For dynamic sessions this is the state of the control protocol
+	// state machine, e.g. "waitreply", "established", or "dead".
+	// Static and quiescent sessions are always "established".
+	State() string
+
+	// Config returns a copy of the session configuration, including
+	// any values negotiated with the peer such as the peer session ID.
+	// The returned configuration must not be modified.
+	Config() *SessionConfig
+
+	// Statistics returns the data plane statistics for the session.
+	// An error is returned if the session data plane hasn't been
+	// instantiated.
+	Statistics() (*SessionDataPlaneStatistics, error)
+
+	// Reconfigure modifies the configuration of a live session.
+	//
+	// Only the data sequencing parameters SeqNum and ReorderTimeout,
+	// and the kernel debugging flags DebugFlags may be modified.
+	// Other parameters must match the current session configuration,
+	// which may be obtained using Config: Reconfigure returns an error
+	// if they differ.
+	//
+	// An error is returned if the session data plane hasn't been
+	// instantiated.
+	Reconfigure(cfg *SessionConfig) error
 }
 
 type session interface {
 	Session
 	getName() string
 	getCfg() *SessionConfig
+	onDataPlaneDeleted()
 	kill()
 }
 
@@ -73,6 +184,10 @@ type DataPlane interface {
 	// fd is the tunnel socket fd, which may be invalid (<0) for tunnel
 	// types which don't manage the tunnel socket in userspace.
 	//
+	// If a data plane instance matching the configuration already
+	// exists, e.g. one left in place by Context.Detach, the data plane
+	// may adopt it.
+	//
 	// On successful return the dataplane should be fully ready for use.
 	NewTunnel(
 		tcfg *TunnelConfig,
@@ -94,14 +209,45 @@ type DataPlane interface {
 
 // TunnelDataPlane is an interface representing a tunnel data plane.
 type TunnelDataPlane interface {
+	// Update applies changes to the tunnel configuration to the
+	// live data plane.  Only parameters which may be modified on
+	// a live tunnel are applied.
+	Update(tcfg *TunnelConfig) error
+
+	// GetStatistics obtains tunnel statistics.
+	GetStatistics() (*TunnelDataPlaneStatistics, error)
+
 	// Down performs the necessary actions to tear down the data plane.
 	// On successful return the dataplane should be fully destroyed.
 	Down() error
 }
 
+// TunnelDataPlaneStatistics holds dataplane statistics for receipt and transmission.
+// Counters which the data plane doesn't report, e.g. on older kernels, are zero.
+type TunnelDataPlaneStatistics struct {
+	TxPackets, TxBytes, TxErrors, RxPackets, RxBytes, RxErrors uint64
+	// RxSeqDiscards counts packets discarded due to sequence number errors.
+	RxSeqDiscards uint64
+	// RxOOSPackets counts packets received out of sequence.
+	RxOOSPackets uint64
+	// RxCookieDiscards counts packets discarded due to a cookie mismatch.
+	RxCookieDiscards uint64
+	// RxInvalid counts packets discarded as invalid, e.g. with a malformed header.
+	RxInvalid uint64
+}
+
 // SessionDataPlaneStatistics holds dataplane statistics for receipt and transmission.
+// Counters which the data plane doesn't report, e.g. on older kernels, are zero.
 type SessionDataPlaneStatistics struct {
 	TxPackets, TxBytes, TxErrors, RxPackets, RxBytes, RxErrors uint64
+	// RxSeqDiscards counts packets discarded due to sequence number errors.
+	RxSeqDiscards uint64
+	// RxOOSPackets counts packets received out of sequence.
+	RxOOSPackets uint64
+	// RxCookieDiscards counts packets discarded due to a cookie mismatch.
+	RxCookieDiscards uint64
+	// RxInvalid counts packets discarded as invalid, e.g. with a malformed header.
+	RxInvalid uint64
 }
 
 // SessionDataPlane is an interface representing a session data plane.
@@ -113,6 +259,11 @@ type SessionDataPlane interface {
 	// which may have been generated by the dataplane.
 	GetInterfaceName() (string, error)
 
+	// Update applies changes to the session configuration to the
+	// live data plane.  Only parameters which may be modified on
+	// a live session (see Session.Reconfigure) are applied.
+	Update(scfg *SessionConfig) error
+
 	// Down performs the necessary actions to tear down the data plane.
 	// On successful return the dataplane should be fully destroyed.
 	Down() error
@@ -131,6 +282,94 @@ type EventHandler interface {
 	HandleEvent(event interface{})
 }
 
+// IncomingCallHandler is an interface for deciding whether to accept
+// incoming calls placed by the peer of a dynamic tunnel.
+type IncomingCallHandler interface {
+	// HandleIncomingCall is called on receipt of an incoming call request
+	// (ICRQ) from the peer, before any resources are allocated for the call.
+	//
+	// To accept the call, return the name and configuration of the session
+	// to create for the call.  The name must be unique in the parent tunnel.
+	// If the configuration doesn't specify a session ID one is allocated,
+	// while the peer session ID is always taken from the call request.
+	// For L2TPv3 the configured pseudowire type must match the pseudowire
+	// type requested by the peer.
+	// On completion of the control protocol message exchange with the peer
+	// a SessionUpEvent is passed to registered event handlers.
+	//
+	// To reject the call, return a non-nil error.  The peer is sent a CDN
+	// message with the result code "temporary lack of resources", including
+	// the error string as the error message.
+	//
+	// HandleIncomingCall will be called from the goroutine of the tunnel
+	// receiving the call, and should not block.
+	HandleIncomingCall(call *IncomingCall) (name string, cfg *SessionConfig, err error)
+}
+
+// IncomingCall describes an incoming call request received from the peer
+// of a dynamic tunnel.  Optional fields which the peer didn't include in the
+// call request are left as the zero value.
+//
+// For L2TPv2 the pseudowire type is always PseudowireTypePPP.
+type IncomingCall struct {
+	TunnelName       string
+	Tunnel           Tunnel
+	TunnelConfig     *TunnelConfig
+	PeerSessionID    ControlConnID
+	CallSerialNumber uint32
+	Pseudowire       PseudowireType
+	BearerType       uint32
+	CallingNumber    string
+	CalledNumber     string
+	SubAddress       string
+}
+
+// OutgoingCallHandler is an interface for deciding whether to accept
+// outgoing call requests from the peer of a dynamic tunnel.
+type OutgoingCallHandler interface {
+	// HandleOutgoingCall is called on receipt of an outgoing call request
+	// (OCRQ) from the peer, before any resources are allocated for the call.
+	//
+	// To accept the call, return the name and configuration of the session
+	// to create for the call.  The name must be unique in the parent tunnel.
+	// If the configuration doesn't specify a session ID one is allocated,
+	// while the peer session ID is always taken from the call request.
+	// The connect speed and framing type in the configuration are reported
+	// to the peer once the call is connected.
+	// On completion of the control protocol message exchange with the peer
+	// a SessionUpEvent is passed to registered event handlers.
+	//
+	// To reject the call, return a non-nil error.  The peer is sent a CDN
+	// message with the result code "temporary lack of resources", including
+	// the error string as the error message.
+	//
+	// HandleOutgoingCall will be called from the goroutine of the tunnel
+	// receiving the call request, and should not block.
+	HandleOutgoingCall(call *OutgoingCall) (name string, cfg *SessionConfig, err error)
+}
+
+// OutgoingCallParameters describes the call an outgoing call request
+// asks the peer to place.  If the framing type is unset both sync and
+// async framing are requested.
+type OutgoingCallParameters struct {
+	CalledNumber           string
+	SubAddress             string
+	MinimumBPS, MaximumBPS uint32
+	BearerType             uint32
+	FramingType            FramingCapability
+}
+
+// OutgoingCall describes an outgoing call request received from the peer
+// of a dynamic tunnel.
+type OutgoingCall struct {
+	OutgoingCallParameters
+	TunnelName       string
+	Tunnel           Tunnel
+	TunnelConfig     *TunnelConfig
+	PeerSessionID    ControlConnID
+	CallSerialNumber uint32
+}
+
 // TunnelUpEvent is passed to registered EventHandler instances when a
 // tunnel comes up.  In the case of static or quiescent tunnels, this occurs
 // immediately on instantiation of the tunnel.  For dynamic tunnels, this
@@ -148,11 +387,15 @@ type TunnelUpEvent struct {
 // immediately on closure of the tunnel.  For dynamic tunnels, this
 // occurs on completion of the L2TP control protocol message exchange with
 // the peer.
+//
+// Result, if set, describes why the tunnel went down: for example if
+// the tunnel data plane instance was deleted by another process.
 type TunnelDownEvent struct {
 	TunnelName                string
 	Tunnel                    Tunnel
 	Config                    *TunnelConfig
 	LocalAddress, PeerAddress unix.Sockaddr
+	Result                    string
 }
 
 // SessionUpEvent is passed to registered EventHandler instances when a session
@@ -184,6 +427,56 @@ type SessionDownEvent struct {
 	Result        string
 }
 
+// SessionLinkInfoEvent is passed to registered EventHandler instances when
+// the peer sends a Set-Link-Info message for an L2TPv2 session.  It carries
+// the PPP Asynchronous Control Character Map (ACCM) values negotiated by the
+// peer's PPP endpoint.
+//
+// The ACCM is reported but not applied.  The ACCM only affects asynchronous
+// HDLC framing, whereas the Linux kernel's PPPoL2TP channels are synchronous,
+// so there is nothing to apply it to.
+// Ref: RFC2661 section 6.14
+type SessionLinkInfoEvent struct {
+	TunnelName    string
+	Tunnel        Tunnel
+	TunnelConfig  *TunnelConfig
+	SessionName   string
+	Session       Session
+	SessionConfig *SessionConfig
+	InterfaceName string
+	// SendACCM is the ACCM to use for PPP frames sent on the link.
+	SendACCM uint32
+	// ReceiveACCM is the ACCM to use for PPP frames received on the link.
+	ReceiveACCM uint32
+}
+
+// SessionWANErrorEvent is passed to registered EventHandler instances when
+// the peer sends a WAN-Error-Notify message for an L2TPv2 session.  It
+// carries the cumulative error counters for the call.
+// Ref: RFC2661 section 6.13
+type SessionWANErrorEvent struct {
+	TunnelName    string
+	Tunnel        Tunnel
+	TunnelConfig  *TunnelConfig
+	SessionName   string
+	Session       Session
+	SessionConfig *SessionConfig
+	InterfaceName string
+	CallErrors    CallErrors
+}
+
+// CallErrors describes the error counters carried in the Call Errors AVP
+// as per RFC2661 section 4.4.6.  The counters are cumulative since the
+// call was established.
+type CallErrors struct {
+	CRCErrors        uint32
+	FramingErrors    uint32
+	HardwareOverruns uint32
+	BufferOverruns   uint32
+	TimeoutErrors    uint32
+	AlignmentErrors  uint32
+}
+
 // LinuxNetlinkDataPlane is a special sentinel value used to indicate
 // that the L2TP context should use the internal Linux kernel data plane
 // implementation.
@@ -210,6 +503,53 @@ var LinuxNetlinkDataPlane DataPlane = &nullDataPlane{}
 //
 // If a nil logger is passed, all logging is disabled.
 func NewContext(dataPlane DataPlane, logger log.Logger) (*Context, error) {
+	return newContext(dataPlane, logger, -1)
+}
+
+// NewContextInNetNS creates a new L2TP context as for NewContext, bound
+// to the network namespace referred to by the file descriptor netnsFd.
+//
+// The context creates its tunnel sockets and its connection to the
+// kernel L2TP subsystem inside the namespace, regardless of the network
+// namespace of the calling thread.  Hence the LinuxNetlinkDataPlane
+// creates kernel tunnel and session instances, including session
+// network interfaces, inside the namespace too.  A user-supplied
+// dataplane is responsible for using the namespace itself.  This
+// allows one process to manage contexts in many namespaces at once.
+//
+// The file descriptor is duplicated, so the caller may close netnsFd
+// once NewContextInNetNS returns.  Entering a network namespace
+// requires the CAP_SYS_ADMIN capability.
+func NewContextInNetNS(dataPlane DataPlane, logger log.Logger, netnsFd int) (*Context, error) {
+	netns, err := dupNetNS(netnsFd)
+	if err != nil {
+		return nil, err
+	}
+	ctx, err := newContext(dataPlane, logger, netns)
+	if err != nil {
+		unix.Close(netns)
+		return nil, err
+	}
+	return ctx, nil
+}
+
+// NewContextInNamedNetNS creates a new L2TP context as for
+// NewContextInNetNS, bound to a named network namespace as created
+// by "ip netns add".
+func NewContextInNamedNetNS(dataPlane DataPlane, logger log.Logger, name string) (*Context, error) {
+	netns, err := openNamedNetNS(name)
+	if err != nil {
+		return nil, err
+	}
+	ctx, err := newContext(dataPlane, logger, netns)
+	if err != nil {
+		unix.Close(netns)
+		return nil, err
+	}
+	return ctx, nil
+}
+
+func newContext(dataPlane DataPlane, logger log.Logger, netns int) (*Context, error) {
 
 	if logger == nil {
 		logger = log.NewNopLogger()
@@ -217,18 +557,33 @@ func NewContext(dataPlane DataPlane, logger log.Logger) (*Context, error) {
 
 	rand.Seed(time.Now().UnixNano())
 
-	dp, err := initDataPlane(dataPlane)
+	// Check up front that we're able to enter the namespace
+	err := runInNetNS(netns, func() error { return nil })
+	if err != nil {
+		return nil, err
+	}
+
+	dp, err := initDataPlane(dataPlane, netns)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialise data plane: %v", err)
 	}
 
-	return &Context{
+	ctx := &Context{
 		logger:        logger,
 		tunnelsByName: make(map[string]tunnel),
 		tunnelsByID:   make(map[ControlConnID]tunnel),
 		dp:            dp,
 		callSerial:    rand.Uint32(),
-	}, nil
+		netns:         netns,
+	}
+	ctx.observers.logger = logger
+
+	// Keep track of data plane instances deleted by other processes
+	if ndp, ok := dp.(*nlDataPlane); ok {
+		ndp.monitor(ctx)
+	}
+
+	return ctx, nil
 }
 
 // NewDynamicTunnel creates a new dynamic L2TP.
@@ -256,25 +611,22 @@ func (ctx *Context) NewDynamicTunnel(name string, cfg *TunnelConfig) (tunl Tunne
 		return nil, fmt.Errorf("already have tunnel %q", name)
 	}
 
-	// Generate host name if unset
-	if myCfg.HostName == "" {
-		name, err := os.Hostname()
-		if err != nil {
-			return nil, fmt.Errorf("failed to look up host name: %v", err)
-		}
-		myCfg.HostName = name
-	}
-
-	// Default StopCCN retransmit timeout if unset.
-	// RFC2661 section 5.7 recommends a default of 31s.
-	if myCfg.StopCCNTimeout == 0 {
-		myCfg.StopCCNTimeout = 31 * time.Second
+	// Apply defaults for unset parameters
+	err = setDynamicTunnelDefaults(&myCfg)
+	if err != nil {
+		return nil, err
 	}
 
 	// Sanity check the configuration
 	if myCfg.Version != ProtocolVersion3 && myCfg.Encap == EncapTypeIP {
 		return nil, fmt.Errorf("IP encapsulation only supported for L2TPv3 tunnels")
 	}
+	if myCfg.HideAVPs && len(myCfg.Secret) == 0 {
+		return nil, fmt.Errorf("AVP hiding requires a shared secret")
+	}
+	if myCfg.HideAVPs && myCfg.Version != ProtocolVersion2 {
+		return nil, fmt.Errorf("AVP hiding only supported for L2TPv2 tunnels")
+	}
 	if myCfg.Version == ProtocolVersion2 {
 		if myCfg.TunnelID > 65535 {
 			return nil, fmt.Errorf("L2TPv2 connection ID %v out of range", myCfg.TunnelID)
@@ -305,19 +657,16 @@ func (ctx *Context) NewDynamicTunnel(name string, cfg *TunnelConfig) (tunl Tunne
 	}
 
 	// Initialise tunnel address structures
-	switch myCfg.Encap {
-	case EncapTypeUDP:
-		sal, sap, err = newUDPAddressPair(myCfg.Local, myCfg.Peer)
-	case EncapTypeIP:
-		sal, sap, err = newIPAddressPair(myCfg.Local, myCfg.TunnelID,
-			myCfg.Peer, myCfg.PeerTunnelID)
-	default:
-		err = fmt.Errorf("unrecognised encapsulation type %v", myCfg.Encap)
-	}
+	sal, sap, err = ctx.newTunnelAddressPair(&myCfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialise tunnel addresses: %v", err)
 	}
 
+	err = checkUDPChecksumConfig(&myCfg, sap)
+	if err != nil {
+		return nil, err
+	}
+
 	t, err := newDynamicTunnel(name, ctx, sal, sap, &myCfg)
 	if err != nil {
 		return nil, err
@@ -388,19 +737,16 @@ func (ctx *Context) NewQuiescentTunnel(name string, cfg *TunnelConfig) (tunl Tun
 	}
 
 	// Initialise tunnel address structures
-	switch myCfg.Encap {
-	case EncapTypeUDP:
-		sal, sap, err = newUDPAddressPair(myCfg.Local, myCfg.Peer)
-	case EncapTypeIP:
-		sal, sap, err = newIPAddressPair(myCfg.Local, myCfg.TunnelID,
-			myCfg.Peer, myCfg.PeerTunnelID)
-	default:
-		err = fmt.Errorf("unrecognised encapsulation type %v", myCfg.Encap)
-	}
+	sal, sap, err = ctx.newTunnelAddressPair(&myCfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialise tunnel addresses: %v", err)
 	}
 
+	err = checkUDPChecksumConfig(&myCfg, sap)
+	if err != nil {
+		return nil, err
+	}
+
 	t, err := newQuiescentTunnel(name, ctx, sal, sap, &myCfg)
 	if err != nil {
 		return nil, err
@@ -423,6 +769,9 @@ func (ctx *Context) NewQuiescentTunnel(name string, cfg *TunnelConfig) (tunl Tun
 // so NewStaticTunnel only supports creation of L2TPv3
 // unmanaged tunnel instances.
 //
+// A static tunnel may adopt the data plane instances left in place
+// by a previous process: see Context.Detach.
+//
 // The name provided must be unique in the Context.
 //
 // The tunnel configuration must include local and peer addresses
@@ -465,19 +814,16 @@ func (ctx *Context) NewStaticTunnel(name string, cfg *TunnelConfig) (tunl Tunnel
 	}
 
 	// Initialise tunnel address structures
-	switch myCfg.Encap {
-	case EncapTypeUDP:
-		sal, sap, err = newUDPAddressPair(myCfg.Local, myCfg.Peer)
-	case EncapTypeIP:
-		sal, sap, err = newIPAddressPair(myCfg.Local, myCfg.TunnelID,
-			myCfg.Peer, myCfg.PeerTunnelID)
-	default:
-		err = fmt.Errorf("unrecognised encapsulation type %v", myCfg.Encap)
-	}
+	sal, sap, err = ctx.newTunnelAddressPair(&myCfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialise tunnel addresses: %v", err)
 	}
 
+	err = checkUDPChecksumConfig(&myCfg, sap)
+	if err != nil {
+		return nil, err
+	}
+
 	t, err := newStaticTunnel(name, ctx, sal, sap, &myCfg)
 	if err != nil {
 		return nil, err
@@ -489,6 +835,95 @@ func (ctx *Context) NewStaticTunnel(name string, cfg *TunnelConfig) (tunl Tunnel
 	return
 }
 
+// NewListener creates a new L2TP listener for server/LNS mode operation.
+//
+// The listener binds a socket to the address provided, which would
+// typically be UDP port 1701 on one of the host's addresses, and accepts
+// control connections from peers sending SCCRQ messages to that address.
+//
+// Each control connection accepted by the listener results in a new
+// dynamic tunnel instance in the Context.  The tunnel is named using
+// its locally assigned tunnel ID, and on completion of the control
+// protocol message exchange with the peer a TunnelUpEvent is passed to
+// registered event handlers.  The Tunnel in the event may be used to
+// manage the tunnel in the same way as tunnels created by NewDynamicTunnel.
+//
+// The configuration provided is used as a template for accepted tunnels.
+// Local and peer addresses and tunnel IDs are derived from the incoming
+// control connection and hence must not be specified.
+//
+// L2TPv2 listeners support UDP encapsulation, while L2TPv3 listeners
+// support both UDP and IP encapsulation.
+func (ctx *Context) NewListener(addr string, cfg *TunnelConfig) (l Listener, err error) {
+
+	// Must have configuration
+	if cfg == nil {
+		return nil, fmt.Errorf("invalid nil config")
+	}
+
+	// Duplicate the configuration so we don't modify the user's copy
+	myCfg := *cfg
+
+	// Apply defaults for unset parameters
+	err = setDynamicTunnelDefaults(&myCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sanity check the configuration
+	if myCfg.Version != ProtocolVersion2 && myCfg.Version != ProtocolVersion3 {
+		return nil, fmt.Errorf("listener supports L2TPv2 and L2TPv3 only")
+	}
+	if myCfg.Version != ProtocolVersion3 && myCfg.Encap == EncapTypeIP {
+		return nil, fmt.Errorf("IP encapsulation only supported for L2TPv3 tunnels")
+	}
+	if myCfg.HideAVPs && len(myCfg.Secret) == 0 {
+		return nil, fmt.Errorf("AVP hiding requires a shared secret")
+	}
+	if myCfg.HideAVPs && myCfg.Version != ProtocolVersion2 {
+		return nil, fmt.Errorf("AVP hiding only supported for L2TPv2 tunnels")
+	}
+	if myCfg.TunnelID != 0 || myCfg.PeerTunnelID != 0 {
+		return nil, fmt.Errorf("tunnel IDs cannot be specified for a listener")
+	}
+	if myCfg.Local != "" || myCfg.Peer != "" {
+		return nil, fmt.Errorf("tunnel addresses cannot be specified for a listener")
+	}
+
+	// Listeners for IP encapsulation bind using the reserved
+	// control connection ID of zero used by the SCCRQ message.
+	var sal unix.Sockaddr
+	err = runInNetNS(ctx.netns, func() (err error) {
+		switch myCfg.Encap {
+		case EncapTypeUDP:
+			sal, err = newUDPTunnelAddress(addr)
+		case EncapTypeIP:
+			sal, err = newIPTunnelAddress(addr, 0)
+		default:
+			err = fmt.Errorf("unrecognised encapsulation type %v", myCfg.Encap)
+		}
+		return
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialise listener address: %v", err)
+	}
+
+	err = checkUDPChecksumConfig(&myCfg, sal)
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := newListener(ctx, sal, &myCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.linkListener(ln)
+	l = ln
+
+	return
+}
+
 // RegisterEventHandler adds an event handler to the L2TP context.
 //
 // On return, the event handler may be called at any time.
@@ -517,6 +952,93 @@ func (ctx *Context) UnregisterEventHandler(handler EventHandler) {
 	}
 }
 
+// RegisterMessageObserver adds a message observer to the L2TP context.
+//
+// On return, the observer may be called at any time with the control
+// messages sent and received by the context's dynamic and quiescent
+// tunnels.  Observers are called from a goroutine managed by the L2TP
+// context, and must not call Close or Detach on the context.
+//
+// Observers are identified by comparing them with ==, so the dynamic
+// type of the observer must be comparable: typically a pointer to a
+// struct.  UnregisterMessageObserver panics if it isn't.
+func (ctx *Context) RegisterMessageObserver(observer MessageObserver) {
+	ctx.observers.register(observer)
+}
+
+// UnregisterMessageObserver removes a message observer from the L2TP
+// context.
+//
+// Messages already queued for delivery when UnregisterMessageObserver
+// is called may still be passed to the observer.  The observer must be
+// the same value passed to RegisterMessageObserver.
+func (ctx *Context) UnregisterMessageObserver(observer MessageObserver) {
+	ctx.observers.unregister(observer)
+}
+
+// SetIncomingCallHandler sets the handler used to decide whether incoming
+// calls placed by the peer of a dynamic tunnel should be accepted.
+//
+// If no handler is set, all incoming calls are rejected.
+func (ctx *Context) SetIncomingCallHandler(handler IncomingCallHandler) {
+	ctx.evtLock.Lock()
+	defer ctx.evtLock.Unlock()
+	ctx.callHandler = handler
+}
+
+func (ctx *Context) handleIncomingCall(call *IncomingCall) (name string, cfg *SessionConfig, err error) {
+	// Don't hold the lock while calling the handler, since the handler
+	// may itself call into the context
+	ctx.evtLock.RLock()
+	handler := ctx.callHandler
+	ctx.evtLock.RUnlock()
+	if handler == nil {
+		return "", nil, fmt.Errorf("no incoming call handler")
+	}
+	return handler.HandleIncomingCall(call)
+}
+
+// SetOutgoingCallHandler sets the handler used to decide whether outgoing
+// call requests from the peer of a dynamic tunnel should be accepted.
+//
+// If no handler is set, all outgoing call requests are rejected.
+func (ctx *Context) SetOutgoingCallHandler(handler OutgoingCallHandler) {
+	ctx.evtLock.Lock()
+	defer ctx.evtLock.Unlock()
+	ctx.ocallHandler = handler
+}
+
+func (ctx *Context) handleOutgoingCall(call *OutgoingCall) (name string, cfg *SessionConfig, err error) {
+	// As for incoming calls, don't hold the lock while calling the handler
+	ctx.evtLock.RLock()
+	handler := ctx.ocallHandler
+	ctx.evtLock.RUnlock()
+	if handler == nil {
+		return "", nil, fmt.Errorf("no outgoing call handler")
+	}
+	return handler.HandleOutgoingCall(call)
+}
+
+// SetCaptureWriter starts capturing the control frames sent and received
+// by the context's dynamic tunnels, quiescent tunnels, and listeners.
+//
+// The capture is written to w in pcapng format.  Since the frames are
+// captured from the tunnel sockets, IP and UDP headers are synthesised
+// for each frame from the socket addresses, allowing the capture to be
+// decoded by tools such as Wireshark.  Wireshark identifies L2TP over
+// UDP by port 1701: if neither peer uses that port, use "Decode As" to
+// select the L2TP dissector.
+//
+// SetCaptureWriter writes the pcapng header to w before returning, and
+// returns an error if this fails.  If writing a frame fails later on,
+// the error is logged and capture stops.
+//
+// Passing a nil writer stops capture.  The caller owns w, and should
+// stop capture or close the context before closing it.
+func (ctx *Context) SetCaptureWriter(w io.Writer) error {
+	return ctx.capture.setWriter(w)
+}
+
 func (ctx *Context) handleUserEvent(event interface{}) {
 	ctx.evtLock.RLock()
 	defer ctx.evtLock.RUnlock()
@@ -525,11 +1047,66 @@ func (ctx *Context) handleUserEvent(event interface{}) {
 	}
 }
 
+// Detach tears down the context in the same way as Close, but leaves
+// the data plane instances of static tunnels without a userspace
+// socket, and their sessions, in place.  This allows for an
+// application to be restarted without interrupting the flow of data:
+// on restart, the static tunnels and sessions are recreated from the
+// same configuration, and adopt the existing data plane instances.
+//
+// The Linux kernel destroys the data plane instance of a tunnel
+// created using a userspace socket when that socket is closed, so
+// all other tunnels and their sessions are closed as for Close.  This
+// includes dynamic and quiescent tunnels, and static tunnels which
+// use an IPv6 zone or the socket options of TunnelConfig such as
+// BindInterface, VRF or FwMark.
+func (ctx *Context) Detach() {
+	ctx.tlock.Lock()
+	ctx.detached = true
+	ctx.tlock.Unlock()
+
+	level.Info(ctx.logger).Log("message", "detaching from data plane")
+
+	ctx.Close()
+}
+
+// Tunnel or session data plane instances may be deleted by another
+// process, e.g. using the iproute2 "ip l2tp" commands, in which case
+// the corresponding tunnel or session should close.
+func (ctx *Context) onDataPlaneTunnelDeleted(tid ControlConnID) {
+	if tunl, ok := ctx.findTunnelByID(tid); ok {
+		tunl.onDataPlaneDeleted()
+	}
+}
+
+func (ctx *Context) onDataPlaneSessionDeleted(tid, sid ControlConnID) {
+	if tunl, ok := ctx.findTunnelByID(tid); ok {
+		if s, ok := tunl.findSessionByID(sid); ok {
+			s.onDataPlaneDeleted()
+		}
+	}
+}
+
+func (ctx *Context) isDetached() bool {
+	ctx.tlock.RLock()
+	defer ctx.tlock.RUnlock()
+	return ctx.detached
+}
+
 // Close tears down the context, including all the L2TP tunnels and sessions
 // running inside it.
 func (ctx *Context) Close() {
 	tunnels := []Tunnel{}
 
+	ctx.llock.Lock()
+	listeners := ctx.listeners
+	ctx.listeners = nil
+	ctx.llock.Unlock()
+
+	for _, l := range listeners {
+		l.Close()
+	}
+
 	ctx.tlock.Lock()
 	for name, tunl := range ctx.tunnelsByName {
 		tunnels = append(tunnels, tunl)
@@ -542,8 +1119,14 @@ func (ctx *Context) Close() {
 		tunl.Close()
 	}
 
+	ctx.observers.close()
+
 	ctx.dp.Close()
 
+	if ctx.netns >= 0 {
+		unix.Close(ctx.netns)
+		ctx.netns = -1
+	}
 }
 
 func (ctx *Context) allocTid(version ProtocolVersion) (ControlConnID, error) {
@@ -573,6 +1156,40 @@ func (ctx *Context) unlinkTunnel(tunl tunnel) {
 	delete(ctx.tunnelsByID, tunl.getCfg().TunnelID)
 }
 
+func (ctx *Context) linkListener(l *listener) {
+	ctx.llock.Lock()
+	defer ctx.llock.Unlock()
+	ctx.listeners = append(ctx.listeners, l)
+}
+
+func (ctx *Context) unlinkListener(l *listener) {
+	ctx.llock.Lock()
+	defer ctx.llock.Unlock()
+	for i, ll := range ctx.listeners {
+		if ll == l {
+			ctx.listeners = append(ctx.listeners[:i], ctx.listeners[i+1:]...)
+			break
+		}
+	}
+}
+
+// Tunnels returns the tunnels currently instantiated in the context.
+func (ctx *Context) Tunnels() (tunnels []Tunnel) {
+	for _, tunl := range ctx.allTunnels() {
+		tunnels = append(tunnels, tunl)
+	}
+	return
+}
+
+func (ctx *Context) allTunnels() (tunnels []tunnel) {
+	ctx.tlock.RLock()
+	defer ctx.tlock.RUnlock()
+	for _, tunl := range ctx.tunnelsByName {
+		tunnels = append(tunnels, tunl)
+	}
+	return
+}
+
 func (ctx *Context) findTunnelByName(name string) (tunl tunnel, ok bool) {
 	ctx.tlock.RLock()
 	defer ctx.tlock.RUnlock()
@@ -594,6 +1211,24 @@ func (ctx *Context) allocCallSerial() uint32 {
 	return ctx.callSerial
 }
 
+// Resolve the tunnel addresses in the context's network namespace,
+// since IPv6 zones may refer to interfaces by name.
+func (ctx *Context) newTunnelAddressPair(cfg *TunnelConfig) (sal, sap unix.Sockaddr, err error) {
+	err = runInNetNS(ctx.netns, func() (err error) {
+		switch cfg.Encap {
+		case EncapTypeUDP:
+			sal, sap, err = newUDPAddressPair(cfg.Local, cfg.Peer)
+		case EncapTypeIP:
+			sal, sap, err = newIPAddressPair(cfg.Local, cfg.TunnelID,
+				cfg.Peer, cfg.PeerTunnelID)
+		default:
+			err = fmt.Errorf("unrecognised encapsulation type %v", cfg.Encap)
+		}
+		return
+	})
+	return
+}
+
 func newUDPTunnelAddress(address string) (unix.Sockaddr, error) {
 
 	u, err := net.ResolveUDPAddr("udp", address)
@@ -607,8 +1242,10 @@ func newUDPTunnelAddress(address string) (unix.Sockaddr, error) {
 			Addr: [4]byte{b[0], b[1], b[2], b[3]},
 		}, nil
 	} else if b := u.IP.To16(); b != nil {
-		// TODO: SockaddrInet6 has a uint32 ZoneId, while UDPAddr
-		// has a Zone string.  How to convert between the two?
+		zoneID, err := zoneToIndex(u.Zone)
+		if err != nil {
+			return nil, err
+		}
 		return &unix.SockaddrInet6{
 			Port: u.Port,
 			Addr: [16]byte{
@@ -617,13 +1254,62 @@ func newUDPTunnelAddress(address string) (unix.Sockaddr, error) {
 				b[8], b[9], b[10], b[11],
 				b[12], b[13], b[14], b[15],
 			},
-			// ZoneId
+			ZoneId: zoneID,
 		}, nil
 	}
 
 	return nil, fmt.Errorf("unhandled address family")
 }
 
+// IPv6 zones may be specified by interface name or index
+func zoneToIndex(zone string) (uint32, error) {
+	if zone == "" {
+		return 0, nil
+	}
+	if idx, err := strconv.ParseUint(zone, 10, 32); err == nil {
+		return uint32(idx), nil
+	}
+	ifi, err := net.InterfaceByName(zone)
+	if err != nil {
+		return 0, fmt.Errorf("zone %q: %v", zone, err)
+	}
+	return uint32(ifi.Index), nil
+}
+
+// Zones are formatted by index rather than interface name, since the
+// interface may belong to a context's network namespace rather than the
+// one the caller is running in.
+func indexToZone(idx uint32) string {
+	if idx == 0 {
+		return ""
+	}
+	return strconv.FormatUint(uint64(idx), 10)
+}
+
+func sockaddrZoneID(sa unix.Sockaddr) uint32 {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet6:
+		return sa.ZoneId
+	case *unix.SockaddrL2TPIP6:
+		return sa.ZoneId
+	}
+	return 0
+}
+
+func sockaddrString(sa unix.Sockaddr) string {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return (&net.UDPAddr{IP: sa.Addr[:], Port: sa.Port}).String()
+	case *unix.SockaddrInet6:
+		return (&net.UDPAddr{IP: sa.Addr[:], Port: sa.Port, Zone: indexToZone(sa.ZoneId)}).String()
+	case *unix.SockaddrL2TPIP:
+		return (&net.UDPAddr{IP: sa.Addr[:]}).String()
+	case *unix.SockaddrL2TPIP6:
+		return (&net.UDPAddr{IP: sa.Addr[:], Zone: indexToZone(sa.ZoneId)}).String()
+	}
+	return fmt.Sprintf("%v", sa)
+}
+
 func newUDPAddressPair(local, remote string) (sal, sap unix.Sockaddr, err error) {
 
 	// We expect the peer address to always be set
@@ -666,8 +1352,10 @@ func newIPTunnelAddress(address string, ccid ControlConnID) (unix.Sockaddr, erro
 			ConnId: uint32(ccid),
 		}, nil
 	} else if b := u.IP.To16(); b != nil {
-		// TODO: SockaddrInet6 has a uint32 ZoneId, while UDPAddr
-		// has a Zone string.  How to convert between the two?
+		zoneID, err := zoneToIndex(u.Zone)
+		if err != nil {
+			return nil, err
+		}
 		return &unix.SockaddrL2TPIP6{
 			Addr: [16]byte{
 				b[0], b[1], b[2], b[3],
@@ -675,7 +1363,7 @@ func newIPTunnelAddress(address string, ccid ControlConnID) (unix.Sockaddr, erro
 				b[8], b[9], b[10], b[11],
 				b[12], b[13], b[14], b[15],
 			},
-			// ZoneId
+			ZoneId: zoneID,
 			ConnId: uint32(ccid),
 		}, nil
 	}
@@ -698,11 +1386,13 @@ func newIPAddressPair(local string, ccid ControlConnID, remote string, pccid Con
 			return nil, nil, fmt.Errorf("local address %q: %v", local, err)
 		}
 	} else {
+		// IP encapsulation demultiplexes control messages using the
+		// connection ID, so we must bind using it in any case.
 		switch sap.(type) {
 		case *unix.SockaddrL2TPIP:
-			sal = &unix.SockaddrL2TPIP{}
+			sal = &unix.SockaddrL2TPIP{ConnId: uint32(ccid)}
 		case *unix.SockaddrL2TPIP6:
-			sal = &unix.SockaddrL2TPIP6{}
+			sal = &unix.SockaddrL2TPIP6{ConnId: uint32(ccid)}
 		default:
 			// should not occur, c.f. newIPTunnelAddress
 			return nil, nil, fmt.Errorf("unhanded address family")
@@ -711,11 +1401,106 @@ func newIPAddressPair(local string, ccid ControlConnID, remote string, pccid Con
 	return
 }
 
-func initDataPlane(dp DataPlane) (DataPlane, error) {
+func setDynamicTunnelDefaults(cfg *TunnelConfig) error {
+	// Generate host name if unset
+	if cfg.HostName == "" {
+		name, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to look up host name: %v", err)
+		}
+		cfg.HostName = name
+	}
+
+	// Generate router ID if unset
+	if cfg.Version == ProtocolVersion3 && cfg.RouterID == 0 {
+		cfg.RouterID = rand.Uint32()
+	}
+
+	// Default StopCCN retransmit timeout if unset.
+	// RFC2661 section 5.7 recommends a default of 31s.
+	if cfg.StopCCNTimeout == 0 {
+		cfg.StopCCNTimeout = 31 * time.Second
+	}
+	return nil
+}
+
+// Check that the UDP checksum options apply to the tunnel's encapsulation
+// and address family.
+func checkUDPChecksumConfig(cfg *TunnelConfig, sa unix.Sockaddr) error {
+	zeroCsum6 := cfg.UDPZeroChecksum6Tx || cfg.UDPZeroChecksum6Rx
+	switch sa.(type) {
+	case *unix.SockaddrInet4:
+		if zeroCsum6 {
+			return fmt.Errorf("IPv6 zero UDP checksum options cannot be used with an IPv4 tunnel")
+		}
+	case *unix.SockaddrInet6:
+		if cfg.UDPChecksum {
+			return fmt.Errorf("UDP checksum option cannot be used with an IPv6 tunnel")
+		}
+	default:
+		if cfg.UDPChecksum || zeroCsum6 {
+			return fmt.Errorf("UDP checksum options require UDP encapsulation")
+		}
+	}
+	return nil
+}
+
+// Check that the VLAN ID is set for, and only for, Ethernet VLAN pseudowires.
+func checkSessionVlanConfig(cfg *SessionConfig) error {
+	if cfg.Pseudowire == PseudowireTypeEthVLAN {
+		if cfg.VlanID == 0 || cfg.VlanID > 4094 {
+			return fmt.Errorf("VLAN ID %v must be in the range 1-4094", cfg.VlanID)
+		}
+	} else if cfg.VlanID != 0 {
+		return fmt.Errorf("VLAN ID may only be set for Ethernet VLAN pseudowires")
+	}
+	return nil
+}
+
+// Check that a new session configuration changes only those parameters
+// which may be modified on a live session.
+func checkSessionReconfigure(cur, cfg *SessionConfig) error {
+	if cfg.SessionID != cur.SessionID {
+		return fmt.Errorf("cannot change session ID of a live session")
+	}
+	if cfg.PeerSessionID != cur.PeerSessionID {
+		return fmt.Errorf("cannot change peer session ID of a live session")
+	}
+	if cfg.Pseudowire != cur.Pseudowire {
+		return fmt.Errorf("cannot change pseudowire type of a live session")
+	}
+	if !bytes.Equal(cfg.Cookie, cur.Cookie) {
+		return fmt.Errorf("cannot change cookie of a live session")
+	}
+	if !bytes.Equal(cfg.PeerCookie, cur.PeerCookie) {
+		return fmt.Errorf("cannot change peer cookie of a live session")
+	}
+	if cfg.InterfaceName != cur.InterfaceName {
+		return fmt.Errorf("cannot change interface name of a live session")
+	}
+	if cfg.L2SpecType != cur.L2SpecType {
+		return fmt.Errorf("cannot change L2-Specific Sublayer of a live session")
+	}
+	if cfg.VlanID != cur.VlanID {
+		return fmt.Errorf("cannot change VLAN ID of a live session")
+	}
+	if cfg.PPPoESessionId != cur.PPPoESessionId || cfg.PPPoEPeerMac != cur.PPPoEPeerMac {
+		return fmt.Errorf("cannot change PPPoE parameters of a live session")
+	}
+	if cfg.ConnectSpeed != cur.ConnectSpeed || cfg.FramingType != cur.FramingType {
+		return fmt.Errorf("cannot change call parameters of a live session")
+	}
+	if !reflect.DeepEqual(cfg.ProxyLCP, cur.ProxyLCP) || !reflect.DeepEqual(cfg.ProxyAuth, cur.ProxyAuth) {
+		return fmt.Errorf("cannot change proxy LCP or authentication data of a live session")
+	}
+	return nil
+}
+
+func initDataPlane(dp DataPlane, netns int) (DataPlane, error) {
 	if dp == nil {
 		return &nullDataPlane{}, nil
 	} else if dp == LinuxNetlinkDataPlane {
-		return newNetlinkDataPlane()
+		return newNetlinkDataPlane(netns)
 	}
 	return dp, nil
 }
@@ -738,10 +1523,12 @@ type baseTunnel struct {
 	logger         log.Logger
 	name           string
 	parent         *Context
+	cfgLock        sync.RWMutex
 	cfg            *TunnelConfig
 	sessionLock    sync.RWMutex
 	sessionsByName map[string]session
 	sessionsByID   map[ControlConnID]session
+	dpDeleted      int32
 }
 
 func newBaseTunnel(logger log.Logger, name string, parent *Context, config *TunnelConfig) *baseTunnel {
@@ -763,6 +1550,63 @@ func (bt *baseTunnel) getCfg() *TunnelConfig {
 	return bt.cfg
 }
 
+func (bt *baseTunnel) Name() string {
+	return bt.name
+}
+
+// The tunnel configuration may be updated by the tunnel goroutine
+// as the control protocol progresses, which does so holding cfgLock.
+func (bt *baseTunnel) Config() *TunnelConfig {
+	bt.cfgLock.RLock()
+	defer bt.cfgLock.RUnlock()
+	cfg := *bt.cfg
+	cfg.Secret = cloneBytes(cfg.Secret)
+	return &cfg
+}
+
+func (bt *baseTunnel) Sessions() (sessions []Session) {
+	for _, s := range bt.allSessions() {
+		sessions = append(sessions, s)
+	}
+	return
+}
+
+// Apply new kernel debugging flags to a live tunnel.
+func (bt *baseTunnel) setDebugFlags(dp TunnelDataPlane, flags DebugFlags) error {
+	if dp == nil {
+		return fmt.Errorf("tunnel data plane not instantiated")
+	}
+
+	bt.cfgLock.Lock()
+	defer bt.cfgLock.Unlock()
+
+	newCfg := *bt.cfg
+	newCfg.DebugFlags = flags
+
+	err := dp.Update(&newCfg)
+	if err != nil {
+		return fmt.Errorf("failed to update tunnel data plane: %v", err)
+	}
+
+	bt.cfg.DebugFlags = flags
+
+	level.Info(bt.logger).Log("message", "reconfigured", "debug_flags", flags)
+
+	return nil
+}
+
+func (bt *baseTunnel) isDetached() bool {
+	return bt.parent.isDetached()
+}
+
+func (bt *baseTunnel) setDataPlaneDeleted() {
+	atomic.StoreInt32(&bt.dpDeleted, 1)
+}
+
+func (bt *baseTunnel) isDataPlaneDeleted() bool {
+	return atomic.LoadInt32(&bt.dpDeleted) != 0
+}
+
 func (bt *baseTunnel) getDP() DataPlane {
 	return bt.parent.dp
 }
@@ -846,10 +1690,11 @@ func (bt *baseTunnel) allocSid() (ControlConnID, error) {
 
 // baseSession implements base functionality which all session types will need
 type baseSession struct {
-	logger log.Logger
-	name   string
-	parent tunnel
-	cfg    *SessionConfig
+	logger  log.Logger
+	name    string
+	parent  tunnel
+	cfgLock sync.RWMutex
+	cfg     *SessionConfig
 }
 
 func newBaseSession(logger log.Logger, name string, parent tunnel, config *SessionConfig) *baseSession {
@@ -865,6 +1710,79 @@ func (bs *baseSession) getName() string {
 	return bs.name
 }
 
+// Apply a new configuration to a live session, updating the data plane.
+func (bs *baseSession) reconfigure(dp SessionDataPlane, cfg *SessionConfig) error {
+	if cfg == nil {
+		return fmt.Errorf("invalid nil config")
+	}
+	if dp == nil {
+		return fmt.Errorf("session data plane not instantiated")
+	}
+
+	bs.cfgLock.Lock()
+	defer bs.cfgLock.Unlock()
+
+	err := checkSessionReconfigure(bs.cfg, cfg)
+	if err != nil {
+		return err
+	}
+
+	newCfg := *bs.cfg
+	newCfg.SeqNum = cfg.SeqNum
+	newCfg.ReorderTimeout = cfg.ReorderTimeout
+	newCfg.DebugFlags = cfg.DebugFlags
+
+	err = dp.Update(&newCfg)
+	if err != nil {
+		return fmt.Errorf("failed to update session data plane: %v", err)
+	}
+
+	bs.cfg.SeqNum = newCfg.SeqNum
+	bs.cfg.ReorderTimeout = newCfg.ReorderTimeout
+	bs.cfg.DebugFlags = newCfg.DebugFlags
+
+	level.Info(bs.logger).Log(
+		"message", "reconfigured",
+		"seqnum", bs.cfg.SeqNum,
+		"reorder_timeout", bs.cfg.ReorderTimeout,
+		"debug_flags", bs.cfg.DebugFlags)
+
+	return nil
+}
+
 func (bs *baseSession) getCfg() *SessionConfig {
 	return bs.cfg
 }
+
+// The session configuration may be updated by the session goroutine
+// as the control protocol progresses, which does so holding cfgLock.
+func (bs *baseSession) Config() *SessionConfig {
+	bs.cfgLock.RLock()
+	defer bs.cfgLock.RUnlock()
+	cfg := *bs.cfg
+	cfg.Cookie = cloneBytes(cfg.Cookie)
+	cfg.PeerCookie = cloneBytes(cfg.PeerCookie)
+	if cfg.ProxyLCP != nil {
+		lcp := *cfg.ProxyLCP
+		lcp.InitialReceivedConfReq = cloneBytes(lcp.InitialReceivedConfReq)
+		lcp.LastSentConfReq = cloneBytes(lcp.LastSentConfReq)
+		lcp.LastReceivedConfReq = cloneBytes(lcp.LastReceivedConfReq)
+		cfg.ProxyLCP = &lcp
+	}
+	if cfg.ProxyAuth != nil {
+		auth := *cfg.ProxyAuth
+		auth.Challenge = cloneBytes(auth.Challenge)
+		auth.Response = cloneBytes(auth.Response)
+		cfg.ProxyAuth = &auth
+	}
+	return &cfg
+}
+
+// cloneBytes returns a copy of b, so that configuration returned to the
+// user doesn't share memory with that of the tunnel or session.
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
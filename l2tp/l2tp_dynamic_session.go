@@ -12,18 +12,40 @@ type dynamicSession struct {
 	isClosed    bool
 	established bool
 	callSerial  uint32
+	call        *OutgoingCallParameters
 	ifname      string
 	result      string
 	dt          *dynamicTunnel
+	dpLock      sync.Mutex
 	dp          SessionDataPlane
 	wg          sync.WaitGroup
 	msgRxChan   chan controlMessage
 	eventChan   chan string
 	closeChan   chan interface{}
 	killChan    chan interface{}
+	dpDeleted   chan bool
 	fsm         fsm
 }
 
+func (ds *dynamicSession) State() string {
+	return ds.fsm.state()
+}
+
+func (ds *dynamicSession) Statistics() (*SessionDataPlaneStatistics, error) {
+	ds.dpLock.Lock()
+	defer ds.dpLock.Unlock()
+	if ds.dp == nil {
+		return nil, fmt.Errorf("session data plane not instantiated")
+	}
+	return ds.dp.GetStatistics()
+}
+
+func (ds *dynamicSession) Reconfigure(cfg *SessionConfig) error {
+	ds.dpLock.Lock()
+	defer ds.dpLock.Unlock()
+	return ds.reconfigure(ds.dp, cfg)
+}
+
 func (ds *dynamicSession) Close() {
 	ds.parent.unlinkSession(ds)
 	close(ds.closeChan)
@@ -36,6 +58,14 @@ func (ds *dynamicSession) kill() {
 	ds.wg.Wait()
 }
 
+func (ds *dynamicSession) onDataPlaneDeleted() {
+	level.Info(ds.logger).Log("message", "data plane deleted externally")
+	select {
+	case ds.dpDeleted <- true:
+	default:
+	}
+}
+
 func (ds *dynamicSession) onTunnelUp() {
 	ds.eventChan <- "tunnelopen"
 }
@@ -44,7 +74,7 @@ func (ds *dynamicSession) handleCtlMsg(msg controlMessage) {
 	ds.msgRxChan <- msg
 }
 
-func (ds *dynamicSession) runSession() {
+func (ds *dynamicSession) runSession(initial *eventArgs) {
 	defer ds.wg.Done()
 
 	level.Info(ds.logger).Log(
@@ -53,6 +83,10 @@ func (ds *dynamicSession) runSession() {
 		"peer_session_id", ds.cfg.PeerSessionID,
 		"pseudowire", ds.cfg.Pseudowire)
 
+	if initial != nil {
+		ds.handleEvent(initial.event, initial.args...)
+	}
+
 	for !ds.isClosed {
 		select {
 		case msg, ok := <-ds.msgRxChan:
@@ -73,6 +107,20 @@ func (ds *dynamicSession) runSession() {
 		case <-ds.closeChan:
 			ds.handleEvent("close", avpCDNResultCodeAdminDisconnect)
 			return
+		case <-ds.dpDeleted:
+			// The data plane instance has already gone, so there's
+			// no need to take it down as part of the session close.
+			ds.dpLock.Lock()
+			deleted := ds.dp != nil
+			ds.dp = nil
+			ds.dpLock.Unlock()
+			if deleted {
+				ds.result = "session data plane deleted externally"
+				ds.handleEvent("close",
+					avpCDNResultCodeGeneralError,
+					avpErrorCodeVendorSpecificError,
+					ds.result)
+			}
 		}
 	}
 }
@@ -93,13 +141,13 @@ func (ds *dynamicSession) handleEvent(ev string, args ...interface{}) {
 }
 
 // panics if expected arguments are not passed
-func fsmArgsToV2Msg(args []interface{}) (msg *v2ControlMessage) {
+func fsmArgsToMsg(args []interface{}) (msg controlMessage) {
 	if len(args) != 1 {
 		panic(fmt.Sprintf("unexpected argument count (wanted 1, got %v)", len(args)))
 	}
-	msg, ok := args[0].(*v2ControlMessage)
+	msg, ok := args[0].(controlMessage)
 	if !ok {
-		panic(fmt.Sprintf("first argument %T not *v2ControlMessage", args[0]))
+		panic(fmt.Sprintf("first argument %T not controlMessage", args[0]))
 	}
 	return
 }
@@ -204,6 +252,17 @@ func (ds *dynamicSession) handleMsg(msg controlMessage) {
 		}
 		ds.handleV2Msg(msg)
 		return
+	case ProtocolVersion3:
+		msg, ok := msg.(*v3ControlMessage)
+		if !ok {
+			// As above, this indicates a coding error.
+			level.Error(ds.logger).Log(
+				"message", "couldn't cast L2TPv3 message as v3ControlMessage")
+			ds.fsmActClose(nil)
+			return
+		}
+		ds.handleV3Msg(msg)
+		return
 	}
 
 	level.Error(ds.logger).Log(
@@ -224,6 +283,20 @@ func (ds *dynamicSession) handleV2Msg(msg *v2ControlMessage) {
 		return
 	}
 
+	// RFC2661 section 4.1 requires that an unrecognised mandatory AVP
+	// terminates the session.
+	if msg.avpErr != nil {
+		level.Error(ds.logger).Log(
+			"message", "bad control message",
+			"message_type", msg.getType(),
+			"error", msg.avpErr)
+		ds.handleEvent("close",
+			avpCDNResultCodeGeneralError,
+			avpErrorCodeMBitShutdown,
+			fmt.Sprintf("bad %v message: %v", msg.getType(), msg.avpErr))
+		return
+	}
+
 	// Validate the message.  If validation fails drive shutdown via.
 	// the FSM to allow the error to be communicated to the peer.
 	err := msg.validate()
@@ -236,6 +309,7 @@ func (ds *dynamicSession) handleV2Msg(msg *v2ControlMessage) {
 			avpCDNResultCodeGeneralError,
 			avpErrorCodeBadValue,
 			fmt.Sprintf("bad %v message: %v", msg.getType(), err))
+		return
 	}
 
 	// Map the message to the appropriate event type.  If we haven't got
@@ -247,7 +321,12 @@ func (ds *dynamicSession) handleV2Msg(msg *v2ControlMessage) {
 		{avpMsgTypeIcrq, "icrq"},
 		{avpMsgTypeIcrp, "icrp"},
 		{avpMsgTypeIccn, "iccn"},
+		{avpMsgTypeOcrq, "ocrq"},
+		{avpMsgTypeOcrp, "ocrp"},
+		{avpMsgTypeOccn, "occn"},
 		{avpMsgTypeCdn, "cdn"},
+		{avpMsgTypeSli, "sli"},
+		{avpMsgTypeWen, "wen"},
 	}
 
 	for _, em := range eventMap {
@@ -267,6 +346,148 @@ func (ds *dynamicSession) handleV2Msg(msg *v2ControlMessage) {
 		fmt.Sprintf("unhandled v2 control message %v", msg.getType()))
 }
 
+func (ds *dynamicSession) handleV3Msg(msg *v3ControlMessage) {
+
+	// As for L2TPv2, ignore mis-delivered messages
+	sid, err := findLocalSessionID(msg)
+	if err != nil || sid != ds.cfg.SessionID {
+		level.Error(ds.logger).Log(
+			"message", "received control message with the wrong SID",
+			"expected", ds.cfg.SessionID,
+			"got", sid)
+		return
+	}
+
+	err = msg.validate()
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "bad control message",
+			"message_type", msg.getType(),
+			"error", err)
+		ds.handleEvent("close",
+			avpCDNResultCodeGeneralError,
+			avpErrorCodeBadValue,
+			fmt.Sprintf("bad %v message: %v", msg.getType(), err))
+		return
+	}
+
+	eventMap := []struct {
+		m avpMsgType
+		e string
+	}{
+		{avpMsgTypeIcrq, "icrq"},
+		{avpMsgTypeIcrp, "icrp"},
+		{avpMsgTypeIccn, "iccn"},
+		{avpMsgTypeCdn, "cdn"},
+	}
+
+	for _, em := range eventMap {
+		if msg.getType() == em.m {
+			ds.handleEvent(em.e, msg)
+			return
+		}
+	}
+
+	level.Error(ds.logger).Log(
+		"message", "unhandled v3 control message",
+		"message_type", msg.getType())
+
+	ds.handleEvent("close",
+		avpCDNResultCodeGeneralError,
+		avpErrorCodeBadValue,
+		fmt.Sprintf("unhandled v3 control message %v", msg.getType()))
+}
+
+// Apply the data plane parameters the peer has advertised in an L2TPv3
+// session message to the session configuration.  The L2-Specific Sublayer
+// must match our own configuration, since we can't change the data plane
+// encapsulation the user has asked for.
+// Ref: RFC3931 sections 5.4.4, 5.4.6, and 5.4.7
+func (ds *dynamicSession) negotiateV3(msg controlMessage) error {
+	avps := msg.getAvps()
+
+	if cookie, err := findBytesAvp(avps, vendorIDIetf, avpTypeAssignedCookie); err == nil {
+		if len(cookie) != 4 && len(cookie) != 8 {
+			return fmt.Errorf("bad Assigned Cookie length %v", len(cookie))
+		}
+		ds.cfgLock.Lock()
+		ds.cfg.PeerCookie = append([]byte(nil), cookie...)
+		ds.cfgLock.Unlock()
+	}
+
+	if l2spec, err := findUint16Avp(avps, vendorIDIetf, avpTypeL2specificSublayer); err == nil {
+		switch L2SpecType(l2spec) {
+		case L2SpecTypeNone, L2SpecTypeDefault:
+			ds.cfgLock.Lock()
+			local := ds.cfg.L2SpecType
+			ds.cfgLock.Unlock()
+			if L2SpecType(l2spec) != local {
+				return fmt.Errorf("L2-Specific Sublayer %v doesn't match local configuration %v",
+					l2spec, local)
+			}
+		default:
+			return fmt.Errorf("unsupported L2-Specific Sublayer %v", l2spec)
+		}
+	}
+
+	if seq, err := findUint16Avp(avps, vendorIDIetf, avpTypeDataSequencing); err == nil {
+		switch seq {
+		case 0:
+		case 1, 2:
+			ds.cfgLock.Lock()
+			ds.cfg.SeqNum = true
+			ds.cfgLock.Unlock()
+		default:
+			return fmt.Errorf("bad Data Sequencing value %v", seq)
+		}
+	}
+
+	return nil
+}
+
+// Pick up proxy LCP and proxy authentication data the peer may have
+// forwarded in ICCN, allowing LCP renegotiation to be skipped.
+// Ref: RFC2661 section 4.4.5
+func (ds *dynamicSession) negotiateV2(msg controlMessage) error {
+	if msg.getType() != avpMsgTypeIccn {
+		return nil
+	}
+
+	auth, err := findProxyAuth(msg)
+	if err != nil {
+		return err
+	}
+
+	ds.cfgLock.Lock()
+	ds.cfg.ProxyLCP = findProxyLCP(msg)
+	ds.cfg.ProxyAuth = auth
+	ds.cfgLock.Unlock()
+
+	return nil
+}
+
+// Negotiate session parameters, sending CDN on failure
+func (ds *dynamicSession) negotiate(msg controlMessage) bool {
+	var err error
+	if msg.protocolVersion() == ProtocolVersion3 {
+		err = ds.negotiateV3(msg)
+	} else {
+		err = ds.negotiateV2(msg)
+	}
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "failed to negotiate session parameters",
+			"message_type", msg.getType(),
+			"error", err)
+		ds.handleEvent("close",
+			avpCDNResultCodeGeneralError,
+			avpErrorCodeBadValue,
+			fmt.Sprintf("bad %v message: %v", msg.getType(), err))
+		return false
+	}
+	return true
+}
+
 func (ds *dynamicSession) sendMessage(msg controlMessage) {
 	err := ds.dt.sendMessage(msg)
 	if err != nil {
@@ -289,7 +510,12 @@ func (ds *dynamicSession) fsmActSendIcrq(args []interface{}) {
 }
 
 func (ds *dynamicSession) sendIcrq() (err error) {
-	msg, err := newV2Icrq(ds.callSerial, ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	var msg controlMessage
+	if ds.parent.getCfg().Version == ProtocolVersion2 {
+		msg, err = newV2Icrq(ds.callSerial, ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	} else {
+		msg, err = newV3Icrq(ds.callSerial, ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	}
 	if err != nil {
 		return err
 	}
@@ -298,9 +524,9 @@ func (ds *dynamicSession) sendIcrq() (err error) {
 }
 
 func (ds *dynamicSession) fsmActOnIcrp(args []interface{}) {
-	msg := fsmArgsToV2Msg(args)
+	msg := fsmArgsToMsg(args)
 
-	psid, err := findUint16Avp(msg.getAvps(), vendorIDIetf, avpTypeSessionID)
+	psid, err := findPeerSessionID(msg)
 	if err != nil {
 		// Shouldn't occur since session ID is mandatory
 		level.Error(ds.logger).Log(
@@ -309,11 +535,17 @@ func (ds *dynamicSession) fsmActOnIcrp(args []interface{}) {
 		ds.handleEvent("close",
 			avpCDNResultCodeGeneralError,
 			avpErrorCodeBadValue,
-			"no Assigned Session ID AVP in ICRP message")
+			"no peer session ID AVP in ICRP message")
 		return
 	}
 
-	ds.cfg.PeerSessionID = ControlConnID(psid)
+	ds.cfgLock.Lock()
+	ds.cfg.PeerSessionID = psid
+	ds.cfgLock.Unlock()
+
+	if !ds.negotiate(msg) {
+		return
+	}
 
 	err = ds.sendIccn()
 	if err != nil {
@@ -327,8 +559,158 @@ func (ds *dynamicSession) fsmActOnIcrp(args []interface{}) {
 
 	level.Info(ds.logger).Log("message", "control plane established")
 
+	ds.establish()
+}
+
+func (ds *dynamicSession) sendIccn() (err error) {
+	var msg controlMessage
+	if ds.parent.getCfg().Version == ProtocolVersion2 {
+		msg, err = newV2Iccn(ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	} else {
+		msg, err = newV3Iccn(ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	}
+	if err != nil {
+		return err
+	}
+	ds.sendMessage(msg)
+	return
+}
+
+func (ds *dynamicSession) fsmActOnIcrq(args []interface{}) {
+	msg := fsmArgsToMsg(args)
+
+	if !ds.negotiate(msg) {
+		return
+	}
+
+	err := ds.sendIcrp()
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "failed to send ICRP message",
+			"error", err)
+		ds.fsmActClose(nil)
+	}
+}
+
+func (ds *dynamicSession) sendIcrp() (err error) {
+	var msg controlMessage
+	if ds.parent.getCfg().Version == ProtocolVersion2 {
+		msg, err = newV2Icrp(ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	} else {
+		msg, err = newV3Icrp(ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	}
+	if err != nil {
+		return err
+	}
+	ds.sendMessage(msg)
+	return
+}
+
+func (ds *dynamicSession) fsmActOnIccn(args []interface{}) {
+	msg := fsmArgsToMsg(args)
+
+	if !ds.negotiate(msg) {
+		return
+	}
+
+	level.Info(ds.logger).Log("message", "control plane established")
+	ds.establish()
+}
+
+func (ds *dynamicSession) fsmActSendOcrq(args []interface{}) {
+	msg, err := newV2Ocrq(ds.callSerial, ds.parent.getCfg().PeerTunnelID, ds.cfg, ds.call)
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "failed to build OCRQ message",
+			"error", err)
+		ds.fsmActClose(nil)
+		return
+	}
+	ds.sendMessage(msg)
+}
+
+func (ds *dynamicSession) fsmActOnOcrp(args []interface{}) {
+	msg := fsmArgsToMsg(args)
+
+	psid, err := findPeerSessionID(msg)
+	if err != nil {
+		// Shouldn't occur since session ID is mandatory
+		level.Error(ds.logger).Log(
+			"message", "failed to parse peer session ID from OCRP",
+			"error", err)
+		ds.handleEvent("close",
+			avpCDNResultCodeGeneralError,
+			avpErrorCodeBadValue,
+			"no peer session ID AVP in OCRP message")
+		return
+	}
+
+	// The peer is now placing the call: we'll hear from it again
+	// when the call connects.
+	ds.cfgLock.Lock()
+	ds.cfg.PeerSessionID = psid
+	ds.cfgLock.Unlock()
+}
+
+func (ds *dynamicSession) fsmActOnOccn(args []interface{}) {
+	msg := fsmArgsToMsg(args)
+
+	// Both AVPs are mandatory and have been checked by message validation
+	speed, _ := findUint32Avp(msg.getAvps(), vendorIDIetf, avpTypeConnectSpeed)
+	framing, _ := findUint32Avp(msg.getAvps(), vendorIDIetf, avpTypeFramingType)
+	ds.cfgLock.Lock()
+	ds.cfg.ConnectSpeed = speed
+	ds.cfg.FramingType = FramingCapability(framing)
+	ds.cfgLock.Unlock()
+
+	level.Info(ds.logger).Log(
+		"message", "control plane established",
+		"connect_speed", speed,
+		"framing_type", framing)
+
+	ds.establish()
+}
+
+// The call is placed synchronously by the user's outgoing call handler,
+// so once the OCRP is sent we can report the call as connected.
+func (ds *dynamicSession) fsmActOnOcrq(args []interface{}) {
+	ptid := ds.parent.getCfg().PeerTunnelID
+
+	msg, err := newV2Ocrp(ptid, ds.cfg)
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "failed to build OCRP message",
+			"error", err)
+		ds.fsmActClose(nil)
+		return
+	}
+	ds.sendMessage(msg)
+	if ds.isClosed {
+		return
+	}
+
+	msg, err = newV2Occn(ptid, ds.cfg)
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "failed to build OCCN message",
+			"error", err)
+		ds.fsmActClose(nil)
+		return
+	}
+	ds.sendMessage(msg)
+	if ds.isClosed {
+		return
+	}
+
+	level.Info(ds.logger).Log("message", "control plane established")
+	ds.establish()
+}
+
+// Bring up the data plane once the call message exchange is complete,
+// and let the user know.
+func (ds *dynamicSession) establish() {
 	// establish the data plane
-	ds.dp, err = ds.parent.getDP().NewSession(
+	dp, err := ds.parent.getDP().NewSession(
 		ds.parent.getCfg().TunnelID,
 		ds.parent.getCfg().PeerTunnelID,
 		ds.cfg)
@@ -341,6 +723,10 @@ func (ds *dynamicSession) fsmActOnIcrp(args []interface{}) {
 		return
 	}
 
+	ds.dpLock.Lock()
+	ds.dp = dp
+	ds.dpLock.Unlock()
+
 	ds.ifname, err = ds.dp.GetInterfaceName()
 	if err != nil {
 		level.Error(ds.logger).Log(
@@ -348,6 +734,7 @@ func (ds *dynamicSession) fsmActOnIcrp(args []interface{}) {
 			"error", err)
 		// TODO: CDN args
 		ds.fsmActClose(nil)
+		return
 	}
 
 	level.Info(ds.logger).Log("message", "data plane established")
@@ -364,13 +751,80 @@ func (ds *dynamicSession) fsmActOnIcrp(args []interface{}) {
 	})
 }
 
-func (ds *dynamicSession) sendIccn() (err error) {
-	msg, err := newV2Iccn(ds.parent.getCfg().PeerTunnelID, ds.cfg)
+// SLI and WEN may race with call establishment, since the peer's PPP
+// link can come up before we've seen the message completing the call.
+// They carry nothing we need prior to that, so just drop them.
+func (ds *dynamicSession) fsmActIgnore(args []interface{}) {
+	msg := fsmArgsToMsg(args)
+	level.Debug(ds.logger).Log(
+		"message", "ignoring message prior to session establishment",
+		"message_type", msg.getType())
+}
+
+// Pass the PPP ACCM values from the peer's SLI message on to the user,
+// who is responsible for the PPP link.
+// Ref: RFC2661 section 6.14
+func (ds *dynamicSession) fsmActOnSli(args []interface{}) {
+	msg := fsmArgsToMsg(args)
+
+	send, recv, err := findAccm(msg)
 	if err != nil {
-		return err
+		level.Error(ds.logger).Log(
+			"message", "failed to parse ACCM from SLI",
+			"error", err)
+		return
 	}
-	ds.sendMessage(msg)
-	return
+
+	level.Debug(ds.logger).Log(
+		"message", "set link info",
+		"send_accm", fmt.Sprintf("%#08x", send),
+		"receive_accm", fmt.Sprintf("%#08x", recv))
+
+	ds.parent.handleUserEvent(&SessionLinkInfoEvent{
+		TunnelName:    ds.parent.getName(),
+		Tunnel:        ds.parent,
+		TunnelConfig:  ds.parent.getCfg(),
+		SessionName:   ds.getName(),
+		Session:       ds,
+		SessionConfig: ds.cfg,
+		InterfaceName: ds.ifname,
+		SendACCM:      send,
+		ReceiveACCM:   recv,
+	})
+}
+
+// Pass the call error counters from the peer's WEN message on to the user.
+// Ref: RFC2661 section 6.13
+func (ds *dynamicSession) fsmActOnWen(args []interface{}) {
+	msg := fsmArgsToMsg(args)
+
+	ce, err := findCallErrors(msg)
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "failed to parse call errors from WEN",
+			"error", err)
+		return
+	}
+
+	level.Debug(ds.logger).Log(
+		"message", "WAN error notify",
+		"crc_errors", ce.CRCErrors,
+		"framing_errors", ce.FramingErrors,
+		"hardware_overruns", ce.HardwareOverruns,
+		"buffer_overruns", ce.BufferOverruns,
+		"timeout_errors", ce.TimeoutErrors,
+		"alignment_errors", ce.AlignmentErrors)
+
+	ds.parent.handleUserEvent(&SessionWANErrorEvent{
+		TunnelName:    ds.parent.getName(),
+		Tunnel:        ds.parent,
+		TunnelConfig:  ds.parent.getCfg(),
+		SessionName:   ds.getName(),
+		Session:       ds,
+		SessionConfig: ds.cfg,
+		InterfaceName: ds.ifname,
+		CallErrors:    *ce,
+	})
 }
 
 func (ds *dynamicSession) fsmActSendCdn(args []interface{}) {
@@ -383,7 +837,12 @@ func (ds *dynamicSession) fsmActSendCdn(args []interface{}) {
 }
 
 func (ds *dynamicSession) sendCdn(rc *resultCode) (err error) {
-	msg, err := newV2Cdn(ds.parent.getCfg().PeerTunnelID, rc, ds.cfg)
+	var msg controlMessage
+	if ds.parent.getCfg().Version == ProtocolVersion2 {
+		msg, err = newV2Cdn(ds.parent.getCfg().PeerTunnelID, rc, ds.cfg)
+	} else {
+		msg, err = newV3Cdn(ds.parent.getCfg().PeerTunnelID, rc, ds.cfg)
+	}
 	if err != nil {
 		return err
 	}
@@ -392,7 +851,7 @@ func (ds *dynamicSession) sendCdn(rc *resultCode) (err error) {
 }
 
 func (ds *dynamicSession) fsmActOnCdn(args []interface{}) {
-	msg := fsmArgsToV2Msg(args)
+	msg := fsmArgsToMsg(args)
 
 	rc, err := findResultCodeAvp(msg.getAvps(), vendorIDIetf, avpTypeResultCode)
 	if err == nil && ds.result == "" {
@@ -403,12 +862,21 @@ func (ds *dynamicSession) fsmActOnCdn(args []interface{}) {
 }
 
 func (ds *dynamicSession) fsmActClose(args []interface{}) {
+	if ds.parent.isDataPlaneDeleted() && ds.result == "" {
+		ds.result = "tunnel data plane deleted externally"
+	}
+
+	ds.dpLock.Lock()
 	if ds.dp != nil {
-		err := ds.dp.Down()
-		if err != nil {
-			level.Error(ds.logger).Log("message", "dataplane down failed", "error", err)
+		if !ds.parent.isDataPlaneDeleted() {
+			err := ds.dp.Down()
+			if err != nil {
+				level.Error(ds.logger).Log("message", "dataplane down failed", "error", err)
+			}
 		}
+		ds.dp = nil
 	}
+	ds.dpLock.Unlock()
 
 	if ds.established {
 		ds.established = false
@@ -429,10 +897,8 @@ func (ds *dynamicSession) fsmActClose(args []interface{}) {
 	ds.isClosed = true
 }
 
-// Create a new client/LAC mode session instance
-func newDynamicSession(serial uint32, name string, parent *dynamicTunnel, cfg *SessionConfig) (ds *dynamicSession, err error) {
-
-	ds = &dynamicSession{
+func newBaseDynamicSession(serial uint32, name string, parent *dynamicTunnel, cfg *SessionConfig) *dynamicSession {
+	return &dynamicSession{
 		baseSession: newBaseSession(
 			log.With(parent.getLogger(), "session_name", name),
 			name,
@@ -444,9 +910,16 @@ func newDynamicSession(serial uint32, name string, parent *dynamicTunnel, cfg *S
 		eventChan:  make(chan string),
 		closeChan:  make(chan interface{}),
 		killChan:   make(chan interface{}),
+		dpDeleted:  make(chan bool, 1),
 	}
+}
+
+// Create a new client/LAC mode session instance
+func newDynamicSession(serial uint32, name string, parent *dynamicTunnel, cfg *SessionConfig) (ds *dynamicSession, err error) {
+
+	ds = newBaseDynamicSession(serial, name, parent, cfg)
 
-	// Ref: RFC2661 section 7.4.1
+	// Ref: RFC2661 section 7.4.1, RFC3931 section 3.4.1
 	ds.fsm = fsm{
 		current: "waittunnel",
 		table: []eventDesc{
@@ -456,25 +929,127 @@ func newDynamicSession(serial uint32, name string, parent *dynamicTunnel, cfg *S
 			{from: "waitreply", events: []string{"icrp"}, cb: ds.fsmActOnIcrp, to: "established"},
 			{from: "waitreply", events: []string{"iccn"}, cb: ds.fsmActClose, to: "dead"},
 			{from: "waitreply", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
-			{from: "waitreply", events: []string{"icrq", "close"}, cb: ds.fsmActSendCdn, to: "dead"},
-
-			{from: "established", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
-			{
-				from: "established",
-				events: []string{
-					"icrq",
-					"icrp",
-					"iccn",
-					"close",
-				},
-				cb: ds.fsmActSendCdn,
-				to: "dead",
-			},
+			{from: "waitreply", events: []string{"sli", "wen"}, cb: ds.fsmActIgnore, to: "waitreply"},
+			{from: "waitreply", events: []string{"icrq", "ocrq", "ocrp", "occn", "close"}, cb: ds.fsmActSendCdn, to: "dead"},
 		},
 	}
+	ds.fsm.table = append(ds.fsm.table, ds.establishedFsmTable()...)
 
 	ds.wg.Add(1)
-	go ds.runSession()
+	go ds.runSession(nil)
 
 	return
 }
+
+// Create a new server/LNS mode session instance in response to the
+// ICRQ message passed in.
+//
+// The session is linked into the parent tunnel before it starts
+// handling the ICRQ.
+func newDynamicLNSSession(serial uint32, name string, parent *dynamicTunnel, cfg *SessionConfig, icrq controlMessage) (ds *dynamicSession, err error) {
+
+	ds = newBaseDynamicSession(serial, name, parent, cfg)
+
+	// Ref: RFC2661 section 7.4.2, RFC3931 section 3.4.1
+	ds.fsm = fsm{
+		current: "idle",
+		table: []eventDesc{
+			{from: "idle", events: []string{"icrq"}, cb: ds.fsmActOnIcrq, to: "waitconnect"},
+
+			{from: "waitconnect", events: []string{"iccn"}, cb: ds.fsmActOnIccn, to: "established"},
+			{from: "waitconnect", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
+			{from: "waitconnect", events: []string{"sli", "wen"}, cb: ds.fsmActIgnore, to: "waitconnect"},
+			{from: "waitconnect", events: []string{"icrq", "icrp", "ocrq", "ocrp", "occn", "close"}, cb: ds.fsmActSendCdn, to: "dead"},
+		},
+	}
+	ds.fsm.table = append(ds.fsm.table, ds.establishedFsmTable()...)
+
+	parent.linkSession(ds)
+
+	ds.wg.Add(1)
+	go ds.runSession(&eventArgs{event: "icrq", args: []interface{}{icrq}})
+
+	return
+}
+
+// Create a new server/LNS mode session instance which asks the peer to
+// place an outgoing call.
+func newDynamicOutgoingSession(serial uint32, name string, parent *dynamicTunnel, cfg *SessionConfig, call *OutgoingCallParameters) (ds *dynamicSession, err error) {
+
+	ds = newBaseDynamicSession(serial, name, parent, cfg)
+	ds.call = call
+
+	// Ref: RFC2661 section 7.4.4
+	ds.fsm = fsm{
+		current: "waittunnel",
+		table: []eventDesc{
+			{from: "waittunnel", events: []string{"tunnelopen"}, cb: ds.fsmActSendOcrq, to: "waitreply"},
+			{from: "waittunnel", events: []string{"close"}, cb: ds.fsmActClose, to: "dead"},
+
+			{from: "waitreply", events: []string{"ocrp"}, cb: ds.fsmActOnOcrp, to: "waitconnect"},
+			{from: "waitreply", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
+			{from: "waitreply", events: []string{"sli", "wen"}, cb: ds.fsmActIgnore, to: "waitreply"},
+			{from: "waitreply", events: []string{"icrq", "icrp", "iccn", "ocrq", "occn", "close"}, cb: ds.fsmActSendCdn, to: "dead"},
+
+			{from: "waitconnect", events: []string{"occn"}, cb: ds.fsmActOnOccn, to: "established"},
+			{from: "waitconnect", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
+			{from: "waitconnect", events: []string{"sli", "wen"}, cb: ds.fsmActIgnore, to: "waitconnect"},
+			{from: "waitconnect", events: []string{"icrq", "icrp", "iccn", "ocrq", "ocrp", "close"}, cb: ds.fsmActSendCdn, to: "dead"},
+		},
+	}
+	ds.fsm.table = append(ds.fsm.table, ds.establishedFsmTable()...)
+
+	ds.wg.Add(1)
+	go ds.runSession(nil)
+
+	return
+}
+
+// Create a new client/LAC mode session instance to place an outgoing
+// call in response to the OCRQ message passed in.
+//
+// The session is linked into the parent tunnel before it starts
+// handling the OCRQ.
+func newDynamicLACOutgoingSession(serial uint32, name string, parent *dynamicTunnel, cfg *SessionConfig, ocrq controlMessage) (ds *dynamicSession, err error) {
+
+	ds = newBaseDynamicSession(serial, name, parent, cfg)
+
+	// Ref: RFC2661 section 7.4.3
+	ds.fsm = fsm{
+		current: "idle",
+		table: []eventDesc{
+			{from: "idle", events: []string{"ocrq"}, cb: ds.fsmActOnOcrq, to: "established"},
+		},
+	}
+	ds.fsm.table = append(ds.fsm.table, ds.establishedFsmTable()...)
+
+	parent.linkSession(ds)
+
+	ds.wg.Add(1)
+	go ds.runSession(&eventArgs{event: "ocrq", args: []interface{}{ocrq}})
+
+	return
+}
+
+// The established state is common to both LAC and LNS mode sessions
+func (ds *dynamicSession) establishedFsmTable() []eventDesc {
+	return []eventDesc{
+		{from: "established", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
+		{from: "established", events: []string{"sli"}, cb: ds.fsmActOnSli, to: "established"},
+		{from: "established", events: []string{"wen"}, cb: ds.fsmActOnWen, to: "established"},
+		{
+			from: "established",
+			events: []string{
+				"icrq",
+				"icrp",
+				"iccn",
+				"ocrq",
+				"ocrp",
+				"occn",
+				"close",
+			},
+			cb: ds.fsmActSendCdn,
+			to: "dead",
+		},
+	}
+}
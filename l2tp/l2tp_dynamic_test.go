@@ -6,6 +6,7 @@ package l2tp
 // These tests are using the null dataplane and hence don't require root.
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"sync"
@@ -23,16 +24,18 @@ type eventCounters struct {
 
 type testEventCounter struct {
 	eventCounters
+	sessionCfgs []SessionConfig
 }
 
 func (tec *testEventCounter) HandleEvent(event interface{}) {
-	switch event.(type) {
+	switch ev := event.(type) {
 	case *TunnelUpEvent:
 		tec.tunnelUp++
 	case *TunnelDownEvent:
 		tec.tunnelDown++
 	case *SessionUpEvent:
 		tec.sessionUp++
+		tec.sessionCfgs = append(tec.sessionCfgs, *ev.SessionConfig)
 	case *SessionDownEvent:
 		tec.sessionDown++
 	}
@@ -100,6 +103,9 @@ type testLNS struct {
 	tunnelEstablished  bool
 	sessionEstablished bool
 	isShutdown         bool
+	// linkInfoBeforeIcrp causes SLI and WEN to be sent for the
+	// session before it is established
+	linkInfoBeforeIcrp bool
 }
 
 func newTestLNS(logger log.Logger, tcfg *TunnelConfig, scfg *SessionConfig) (*testLNS, error) {
@@ -110,7 +116,7 @@ func newTestLNS(logger log.Logger, tcfg *TunnelConfig, scfg *SessionConfig) (*te
 		return nil, fmt.Errorf("newUDPAddressPair(%v, %v): %v", tcfg.Local, tcfg.Peer, err)
 	}
 
-	cp, err := newL2tpControlPlane(sal, sap)
+	cp, err := newL2tpControlPlane(-1, sal, sap, &TunnelConfig{})
 	if err != nil {
 		return nil, fmt.Errorf("newL2tpControlPlane(%v, %v): %v", sal, sap, err)
 	}
@@ -181,6 +187,12 @@ func (lns *testLNS) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr) error
 			return fmt.Errorf("no Session ID AVP in ICRQ")
 		}
 		lns.scfg.PeerSessionID = ControlConnID(psid)
+		if lns.linkInfoBeforeIcrp {
+			err = lns.sendLinkInfo()
+			if err != nil {
+				return err
+			}
+		}
 		rsp, err := newV2Icrp(lns.tcfg.PeerTunnelID, lns.scfg)
 		if err != nil {
 			return fmt.Errorf("failed to build ICRP: %v", err)
@@ -195,6 +207,28 @@ func (lns *testLNS) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr) error
 	return fmt.Errorf("message %v not handled", msg.getType())
 }
 
+func (lns *testLNS) sendLinkInfo() error {
+	sli, err := buildV2Msg(lns.tcfg.PeerTunnelID, lns.scfg.PeerSessionID, []avpIn{
+		{avpTypeMessage, avpMsgTypeSli},
+		{avpTypeAccm, make([]byte, 10)},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to build SLI: %v", err)
+	}
+	err = lns.xport.send(sli)
+	if err != nil {
+		return err
+	}
+	wen, err := buildV2Msg(lns.tcfg.PeerTunnelID, lns.scfg.PeerSessionID, []avpIn{
+		{avpTypeMessage, avpMsgTypeWen},
+		{avpTypeCallErrors, make([]byte, 26)},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to build WEN: %v", err)
+	}
+	return lns.xport.send(wen)
+}
+
 func (lns *testLNS) run(timeout time.Duration) {
 	deadline := time.NewTimer(timeout)
 	for !lns.isShutdown {
@@ -360,3 +394,1421 @@ func TestDynamicClient(t *testing.T) {
 		})
 	}
 }
+
+type testTunnelDownWaiter struct {
+	testEventCounter
+	lock     sync.Mutex
+	downChan chan interface{}
+}
+
+func (tdw *testTunnelDownWaiter) HandleEvent(event interface{}) {
+	tdw.lock.Lock()
+	defer tdw.lock.Unlock()
+	tdw.testEventCounter.HandleEvent(event)
+	if _, ok := event.(*TunnelDownEvent); ok {
+		close(tdw.downChan)
+	}
+}
+
+func (tdw *testTunnelDownWaiter) getEventCounts() eventCounters {
+	tdw.lock.Lock()
+	defer tdw.lock.Unlock()
+	return tdw.eventCounters
+}
+
+func (tdw *testTunnelDownWaiter) getSessionConfigs() []SessionConfig {
+	tdw.lock.Lock()
+	defer tdw.lock.Unlock()
+	return tdw.sessionCfgs
+}
+
+func TestDynamicListener(t *testing.T) {
+	cases := []struct {
+		name       string
+		listenAddr string
+		version    ProtocolVersion
+		encap      EncapType
+		lacLocal   string
+	}{
+		{
+			name:       "L2TPv2 UDP AF_INET",
+			listenAddr: "127.0.0.1:5500",
+			version:    ProtocolVersion2,
+			encap:      EncapTypeUDP,
+			lacLocal:   "127.0.0.1:6500",
+		},
+		{
+			name:       "L2TPv3 UDP AF_INET",
+			listenAddr: "127.0.0.1:5502",
+			version:    ProtocolVersion3,
+			encap:      EncapTypeUDP,
+			lacLocal:   "127.0.0.1:6502",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+			// Bring up the LNS context and listener
+			lnsCtx, err := NewContext(nil, log.With(logger, "context", "lns"))
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer lnsCtx.Close()
+
+			lnsEvents := &testTunnelDownWaiter{downChan: make(chan interface{})}
+			lnsCtx.RegisterEventHandler(lnsEvents)
+
+			lcfg := &TunnelConfig{
+				Version:        c.version,
+				Encap:          c.encap,
+				StopCCNTimeout: 250 * time.Millisecond,
+			}
+			_, err = lnsCtx.NewListener(c.listenAddr, lcfg)
+			if err != nil {
+				t.Fatalf("NewListener(%q, %v): %v", c.listenAddr, lcfg, err)
+			}
+
+			// Bring up the LAC context and tunnel: the LAC will close the tunnel
+			// as soon as it comes up, which should cause the LNS tunnel to close too.
+			lacCtx, err := NewContext(nil, log.With(logger, "context", "lac"))
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+
+			lacEvents := &testTunnelEventCounterCloser{}
+			lacCtx.RegisterEventHandler(lacEvents)
+
+			tcfg := &TunnelConfig{
+				Local:          c.lacLocal,
+				Peer:           c.listenAddr,
+				Version:        c.version,
+				Encap:          c.encap,
+				StopCCNTimeout: 250 * time.Millisecond,
+			}
+			_, err = lacCtx.NewDynamicTunnel("t1", tcfg)
+			if err != nil {
+				t.Fatalf("NewDynamicTunnel(%q, %v): %v", "t1", tcfg, err)
+			}
+
+			select {
+			case <-lnsEvents.downChan:
+			case <-time.After(3 * time.Second):
+				t.Errorf("timed out waiting for LNS tunnel down")
+			}
+
+			lacCtx.Close()
+			lacEvents.wait()
+
+			expectEvents := eventCounters{tunnelUp: 1, tunnelDown: 1}
+			if got := lacEvents.getEventCounts(); got != expectEvents {
+				t.Errorf("LAC event listener: expected %v event, got %v", expectEvents, got)
+			}
+			if got := lnsEvents.getEventCounts(); got != expectEvents {
+				t.Errorf("LNS event listener: expected %v event, got %v", expectEvents, got)
+			}
+		})
+	}
+}
+
+func TestDynamicListenerAuthentication(t *testing.T) {
+	cases := []struct {
+		name                 string
+		version              ProtocolVersion
+		lacSecret, lnsSecret []byte
+		lacDigest, lnsDigest DigestType
+		expectUp             bool
+	}{
+		{
+			name:      "matching secrets",
+			version:   ProtocolVersion2,
+			lacSecret: []byte("cheese"),
+			lnsSecret: []byte("cheese"),
+			expectUp:  true,
+		},
+		{
+			name:      "mismatched secrets",
+			version:   ProtocolVersion2,
+			lacSecret: []byte("cheese"),
+			lnsSecret: []byte("onion"),
+		},
+		{
+			name:      "LAC has no secret",
+			version:   ProtocolVersion2,
+			lnsSecret: []byte("cheese"),
+		},
+		{
+			name:      "LNS has no secret",
+			version:   ProtocolVersion2,
+			lacSecret: []byte("cheese"),
+		},
+		{
+			name:      "L2TPv3 matching secrets",
+			version:   ProtocolVersion3,
+			lacSecret: []byte("cheese"),
+			lnsSecret: []byte("cheese"),
+			expectUp:  true,
+		},
+		{
+			name:      "L2TPv3 mixed digest types",
+			version:   ProtocolVersion3,
+			lacSecret: []byte("cheese"),
+			lnsSecret: []byte("cheese"),
+			lacDigest: DigestTypeHMACSHA1,
+			lnsDigest: DigestTypeHMACMD5,
+			expectUp:  true,
+		},
+		{
+			name:      "L2TPv3 mismatched secrets",
+			version:   ProtocolVersion3,
+			lacSecret: []byte("cheese"),
+			lnsSecret: []byte("onion"),
+		},
+		{
+			name:      "L2TPv3 LAC has no secret",
+			version:   ProtocolVersion3,
+			lnsSecret: []byte("cheese"),
+		},
+		{
+			name:      "L2TPv3 LNS has no secret",
+			version:   ProtocolVersion3,
+			lacSecret: []byte("cheese"),
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+			lnsCtx, err := NewContext(nil, log.With(logger, "context", "lns"))
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer lnsCtx.Close()
+
+			lnsEvents := &testTunnelDownWaiter{downChan: make(chan interface{})}
+			lnsCtx.RegisterEventHandler(lnsEvents)
+
+			lcfg := &TunnelConfig{
+				Version:        c.version,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+				RetryTimeout:   100 * time.Millisecond,
+				MaxRetries:     2,
+				Secret:         c.lnsSecret,
+				DigestType:     c.lnsDigest,
+			}
+			_, err = lnsCtx.NewListener("127.0.0.1:5504", lcfg)
+			if err != nil {
+				t.Fatalf("NewListener(%q, %v): %v", "127.0.0.1:5504", lcfg, err)
+			}
+
+			lacCtx, err := NewContext(nil, log.With(logger, "context", "lac"))
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+
+			lacEvents := &testTunnelEventCounterCloser{}
+			lacCtx.RegisterEventHandler(lacEvents)
+
+			tcfg := &TunnelConfig{
+				Local:          "127.0.0.1:6504",
+				Peer:           "127.0.0.1:5504",
+				Version:        c.version,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+				RetryTimeout:   100 * time.Millisecond,
+				MaxRetries:     2,
+				Secret:         c.lacSecret,
+				DigestType:     c.lacDigest,
+			}
+			_, err = lacCtx.NewDynamicTunnel("t1", tcfg)
+			if err != nil {
+				t.Fatalf("NewDynamicTunnel(%q, %v): %v", "t1", tcfg, err)
+			}
+
+			if c.expectUp {
+				select {
+				case <-lnsEvents.downChan:
+				case <-time.After(3 * time.Second):
+					t.Errorf("timed out waiting for LNS tunnel down")
+				}
+			} else {
+				// Authentication failure should cause both tunnels
+				// to close without coming up.  For L2TPv3 messages which
+				// fail authentication are discarded, so the tunnels
+				// close when the transport times out.
+				deadline := time.Now().Add(3 * time.Second)
+				for {
+					_, lacUp := lacCtx.findTunnelByName("t1")
+					lnsCtx.tlock.RLock()
+					lnsUp := len(lnsCtx.tunnelsByName) > 0
+					lnsCtx.tlock.RUnlock()
+					if !lacUp && !lnsUp {
+						break
+					}
+					if time.Now().After(deadline) {
+						t.Fatalf("timed out waiting for tunnels to close")
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+
+			lacCtx.Close()
+			lacEvents.wait()
+
+			expectEvents := eventCounters{}
+			if c.expectUp {
+				expectEvents = eventCounters{tunnelUp: 1, tunnelDown: 1}
+			}
+			if got := lacEvents.getEventCounts(); got != expectEvents {
+				t.Errorf("LAC event listener: expected %v event, got %v", expectEvents, got)
+			}
+			if got := lnsEvents.getEventCounts(); got != expectEvents {
+				t.Errorf("LNS event listener: expected %v event, got %v", expectEvents, got)
+			}
+		})
+	}
+}
+
+func TestDynamicHideAVPsConfig(t *testing.T) {
+	ctx, err := NewContext(nil, level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug()))
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	// RFC3931 AVP hiding isn't supported
+	cfg := &TunnelConfig{
+		Local:    "127.0.0.1:6000",
+		Peer:     "127.0.0.1:5000",
+		Version:  ProtocolVersion3,
+		Encap:    EncapTypeUDP,
+		Secret:   []byte("cheese"),
+		HideAVPs: true,
+	}
+	_, err = ctx.NewDynamicTunnel("t1", cfg)
+	if err == nil {
+		t.Errorf("NewDynamicTunnel() succeeded with AVP hiding for L2TPv3")
+	}
+
+	lcfg := &TunnelConfig{
+		Version:  ProtocolVersion3,
+		Encap:    EncapTypeUDP,
+		Secret:   []byte("cheese"),
+		HideAVPs: true,
+	}
+	_, err = ctx.NewListener("127.0.0.1:5000", lcfg)
+	if err == nil {
+		t.Errorf("NewListener() succeeded with AVP hiding for L2TPv3")
+	}
+}
+
+type testCallHandler struct {
+	lock   sync.Mutex
+	calls  []IncomingCall
+	reject bool
+	scfg   SessionConfig
+}
+
+func (tch *testCallHandler) HandleIncomingCall(call *IncomingCall) (string, *SessionConfig, error) {
+	tch.lock.Lock()
+	defer tch.lock.Unlock()
+	tch.calls = append(tch.calls, *call)
+	if tch.reject {
+		return "", nil, fmt.Errorf("test rejection")
+	}
+	scfg := tch.scfg
+	return fmt.Sprintf("call%d", len(tch.calls)), &scfg, nil
+}
+
+func (tch *testCallHandler) getCalls() []IncomingCall {
+	tch.lock.Lock()
+	defer tch.lock.Unlock()
+	return tch.calls
+}
+
+type testReentrantCallHandler struct {
+	ctx *Context
+}
+
+func (trch *testReentrantCallHandler) HandleIncomingCall(call *IncomingCall) (string, *SessionConfig, error) {
+	// Modifying the context's handlers from within a handler mustn't deadlock
+	trch.ctx.RegisterEventHandler(&testSessionEventCounterCloser{})
+	trch.ctx.SetIncomingCallHandler(nil)
+	return "", nil, fmt.Errorf("test rejection")
+}
+
+func (trch *testReentrantCallHandler) HandleOutgoingCall(call *OutgoingCall) (string, *SessionConfig, error) {
+	trch.ctx.RegisterEventHandler(&testSessionEventCounterCloser{})
+	trch.ctx.SetOutgoingCallHandler(nil)
+	return "", nil, fmt.Errorf("test rejection")
+}
+
+func TestCallHandlerReentrant(t *testing.T) {
+	ctx, err := NewContext(nil, level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug()))
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	handler := &testReentrantCallHandler{ctx: ctx}
+	ctx.SetIncomingCallHandler(handler)
+	ctx.SetOutgoingCallHandler(handler)
+
+	calls := []struct {
+		name string
+		call func() error
+	}{
+		{
+			name: "handleIncomingCall",
+			call: func() error {
+				_, _, err := ctx.handleIncomingCall(&IncomingCall{})
+				return err
+			},
+		},
+		{
+			name: "handleOutgoingCall",
+			call: func() error {
+				_, _, err := ctx.handleOutgoingCall(&OutgoingCall{})
+				return err
+			},
+		},
+	}
+	for _, c := range calls {
+		done := make(chan error)
+		go func() {
+			done <- c.call()
+		}()
+		select {
+		case err = <-done:
+			if err == nil {
+				t.Errorf("%v() succeeded with rejecting handler", c.name)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("%v() deadlocked", c.name)
+		}
+
+		err = c.call()
+		if err == nil {
+			t.Errorf("%v() succeeded after handler was cleared", c.name)
+		}
+	}
+}
+
+func TestDynamicListenerIncomingCall(t *testing.T) {
+	cases := []struct {
+		name                 string
+		version              ProtocolVersion
+		secret               []byte
+		reject               bool
+		lacCfg, lnsCfg       SessionConfig
+		expectLAC, expectLNS eventCounters
+	}{
+		{
+			name:      "L2TPv2 accept",
+			version:   ProtocolVersion2,
+			lacCfg:    SessionConfig{Pseudowire: PseudowireTypePPP},
+			lnsCfg:    SessionConfig{Pseudowire: PseudowireTypePPP},
+			expectLAC: eventCounters{tunnelUp: 1, tunnelDown: 1, sessionUp: 1, sessionDown: 1},
+			expectLNS: eventCounters{tunnelUp: 1, tunnelDown: 1, sessionUp: 1, sessionDown: 1},
+		},
+		{
+			name:      "L2TPv2 reject",
+			version:   ProtocolVersion2,
+			reject:    true,
+			lacCfg:    SessionConfig{Pseudowire: PseudowireTypePPP},
+			lnsCfg:    SessionConfig{Pseudowire: PseudowireTypePPP},
+			expectLAC: eventCounters{tunnelUp: 1, tunnelDown: 1},
+			expectLNS: eventCounters{tunnelUp: 1, tunnelDown: 1},
+		},
+		{
+			name:      "L2TPv2 hidden AVPs",
+			version:   ProtocolVersion2,
+			secret:    []byte("cheese"),
+			lacCfg:    SessionConfig{Pseudowire: PseudowireTypePPP},
+			lnsCfg:    SessionConfig{Pseudowire: PseudowireTypePPP},
+			expectLAC: eventCounters{tunnelUp: 1, tunnelDown: 1, sessionUp: 1, sessionDown: 1},
+			expectLNS: eventCounters{tunnelUp: 1, tunnelDown: 1, sessionUp: 1, sessionDown: 1},
+		},
+		{
+			name:    "L2TPv3 accept",
+			version: ProtocolVersion3,
+			lacCfg: SessionConfig{
+				Pseudowire: PseudowireTypeEth,
+				Cookie:     []byte{0x1, 0x2, 0x3, 0x4},
+				L2SpecType: L2SpecTypeDefault,
+				SeqNum:     true,
+			},
+			lnsCfg: SessionConfig{
+				Pseudowire: PseudowireTypeEth,
+				Cookie:     []byte{0x5, 0x6, 0x7, 0x8, 0x9, 0xa, 0xb, 0xc},
+				L2SpecType: L2SpecTypeDefault,
+			},
+			expectLAC: eventCounters{tunnelUp: 1, tunnelDown: 1, sessionUp: 1, sessionDown: 1},
+			expectLNS: eventCounters{tunnelUp: 1, tunnelDown: 1, sessionUp: 1, sessionDown: 1},
+		},
+		{
+			name:      "L2TPv3 Ethernet VLAN accept",
+			version:   ProtocolVersion3,
+			lacCfg:    SessionConfig{Pseudowire: PseudowireTypeEthVLAN, VlanID: 100},
+			lnsCfg:    SessionConfig{Pseudowire: PseudowireTypeEthVLAN, VlanID: 200},
+			expectLAC: eventCounters{tunnelUp: 1, tunnelDown: 1, sessionUp: 1, sessionDown: 1},
+			expectLNS: eventCounters{tunnelUp: 1, tunnelDown: 1, sessionUp: 1, sessionDown: 1},
+		},
+		{
+			name:      "L2TPv3 L2-Specific Sublayer mismatch",
+			version:   ProtocolVersion3,
+			lacCfg:    SessionConfig{Pseudowire: PseudowireTypeEth, L2SpecType: L2SpecTypeDefault},
+			lnsCfg:    SessionConfig{Pseudowire: PseudowireTypeEth, L2SpecType: L2SpecTypeNone},
+			expectLAC: eventCounters{tunnelUp: 1, tunnelDown: 1},
+			expectLNS: eventCounters{tunnelUp: 1, tunnelDown: 1},
+		},
+		{
+			name:      "L2TPv3 pseudowire mismatch",
+			version:   ProtocolVersion3,
+			lacCfg:    SessionConfig{Pseudowire: PseudowireTypeEth},
+			lnsCfg:    SessionConfig{Pseudowire: PseudowireTypePPP},
+			expectLAC: eventCounters{tunnelUp: 1, tunnelDown: 1},
+			expectLNS: eventCounters{tunnelUp: 1, tunnelDown: 1},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+			lnsCtx, err := NewContext(nil, log.With(logger, "context", "lns"))
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer lnsCtx.Close()
+
+			lnsEvents := &testTunnelDownWaiter{downChan: make(chan interface{})}
+			lnsCtx.RegisterEventHandler(lnsEvents)
+
+			callHandler := &testCallHandler{reject: c.reject, scfg: c.lnsCfg}
+			lnsCtx.SetIncomingCallHandler(callHandler)
+
+			lcfg := &TunnelConfig{
+				Version:        c.version,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+				Secret:         c.secret,
+				HideAVPs:       c.secret != nil,
+			}
+			_, err = lnsCtx.NewListener("127.0.0.1:5501", lcfg)
+			if err != nil {
+				t.Fatalf("NewListener(%q, %v): %v", "127.0.0.1:5501", lcfg, err)
+			}
+
+			lacCtx, err := NewContext(nil, log.With(logger, "context", "lac"))
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+
+			lacEvents := &testSessionEventCounterCloser{}
+			lacCtx.RegisterEventHandler(lacEvents)
+
+			tcfg := &TunnelConfig{
+				Local:          "127.0.0.1:6501",
+				Peer:           "127.0.0.1:5501",
+				Version:        c.version,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+				Secret:         c.secret,
+				HideAVPs:       c.secret != nil,
+			}
+			tunl, err := lacCtx.NewDynamicTunnel("t1", tcfg)
+			if err != nil {
+				t.Fatalf("NewDynamicTunnel(%q, %v): %v", "t1", tcfg, err)
+			}
+
+			lacCfg := c.lacCfg
+			_, err = tunl.NewSession("s1", &lacCfg)
+			if err != nil {
+				t.Fatalf("NewSession(%q): %v", "s1", err)
+			}
+
+			// On rejection the LAC session closes on receipt of the CDN,
+			// following which we close the tunnel.
+			if c.expectLAC.sessionUp == 0 {
+				dt := tunl.(*dynamicTunnel)
+				deadline := time.Now().Add(3 * time.Second)
+				for len(callHandler.getCalls()) == 0 || len(dt.allSessions()) > 0 {
+					if time.Now().After(deadline) {
+						t.Fatalf("timed out waiting for LAC session to be rejected")
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				tunl.Close()
+			}
+
+			select {
+			case <-lnsEvents.downChan:
+			case <-time.After(3 * time.Second):
+				t.Errorf("timed out waiting for LNS tunnel down")
+			}
+
+			lacCtx.Close()
+			lacEvents.wait()
+
+			if got := lacEvents.getEventCounts(); got != c.expectLAC {
+				t.Errorf("LAC event listener: expected %v event, got %v", c.expectLAC, got)
+			}
+			if got := lnsEvents.getEventCounts(); got != c.expectLNS {
+				t.Errorf("LNS event listener: expected %v event, got %v", c.expectLNS, got)
+			}
+
+			calls := callHandler.getCalls()
+			if len(calls) != 1 {
+				t.Fatalf("expected 1 incoming call, got %v", len(calls))
+			}
+			if calls[0].PeerSessionID == 0 {
+				t.Errorf("expected incoming call to have a peer session ID")
+			}
+			if calls[0].Pseudowire != c.lacCfg.Pseudowire {
+				t.Errorf("expected incoming call pseudowire %v, got %v", c.lacCfg.Pseudowire, calls[0].Pseudowire)
+			}
+
+			// Check the LNS has picked up the parameters the LAC asked for
+			if c.expectLNS.sessionUp > 0 {
+				got := lnsEvents.getSessionConfigs()[0]
+				if !bytes.Equal(got.PeerCookie, c.lacCfg.Cookie) {
+					t.Errorf("LNS session: expected peer cookie %v, got %v", c.lacCfg.Cookie, got.PeerCookie)
+				}
+				if got.L2SpecType != c.lacCfg.L2SpecType {
+					t.Errorf("LNS session: expected L2SpecType %v, got %v", c.lacCfg.L2SpecType, got.L2SpecType)
+				}
+				if got.SeqNum != c.lacCfg.SeqNum {
+					t.Errorf("LNS session: expected SeqNum %v, got %v", c.lacCfg.SeqNum, got.SeqNum)
+				}
+			}
+			if c.expectLAC.sessionUp > 0 {
+				got := lacEvents.sessionCfgs[0]
+				if !bytes.Equal(got.PeerCookie, c.lnsCfg.Cookie) {
+					t.Errorf("LAC session: expected peer cookie %v, got %v", c.lnsCfg.Cookie, got.PeerCookie)
+				}
+			}
+		})
+	}
+}
+
+type testOutgoingCallHandler struct {
+	lock   sync.Mutex
+	calls  []OutgoingCall
+	reject bool
+	scfg   SessionConfig
+}
+
+func (toch *testOutgoingCallHandler) HandleOutgoingCall(call *OutgoingCall) (string, *SessionConfig, error) {
+	toch.lock.Lock()
+	defer toch.lock.Unlock()
+	toch.calls = append(toch.calls, *call)
+	if toch.reject {
+		return "", nil, fmt.Errorf("test rejection")
+	}
+	scfg := toch.scfg
+	return fmt.Sprintf("ocall%d", len(toch.calls)), &scfg, nil
+}
+
+func (toch *testOutgoingCallHandler) getCalls() []OutgoingCall {
+	toch.lock.Lock()
+	defer toch.lock.Unlock()
+	return toch.calls
+}
+
+type testTunnelUpNotifier struct {
+	upChan chan Tunnel
+}
+
+func (tun *testTunnelUpNotifier) HandleEvent(event interface{}) {
+	if ev, ok := event.(*TunnelUpEvent); ok {
+		tun.upChan <- ev.Tunnel
+	}
+}
+
+func TestDynamicListenerOutgoingCall(t *testing.T) {
+	cases := []struct {
+		name                 string
+		reject               bool
+		expectLAC, expectLNS eventCounters
+	}{
+		{
+			name:      "accept",
+			expectLAC: eventCounters{tunnelUp: 1, tunnelDown: 1, sessionUp: 1, sessionDown: 1},
+			expectLNS: eventCounters{tunnelUp: 1, tunnelDown: 1, sessionUp: 1, sessionDown: 1},
+		},
+		{
+			name:      "reject",
+			reject:    true,
+			expectLAC: eventCounters{tunnelUp: 1, tunnelDown: 1},
+			expectLNS: eventCounters{tunnelUp: 1, tunnelDown: 1},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+			lnsCtx, err := NewContext(nil, log.With(logger, "context", "lns"))
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer lnsCtx.Close()
+
+			lnsEvents := &testTunnelDownWaiter{downChan: make(chan interface{})}
+			lnsCtx.RegisterEventHandler(lnsEvents)
+			lnsTunnels := &testTunnelUpNotifier{upChan: make(chan Tunnel, 1)}
+			lnsCtx.RegisterEventHandler(lnsTunnels)
+
+			lcfg := &TunnelConfig{
+				Version:        ProtocolVersion2,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			}
+			_, err = lnsCtx.NewListener("127.0.0.1:5505", lcfg)
+			if err != nil {
+				t.Fatalf("NewListener(%q, %v): %v", "127.0.0.1:5505", lcfg, err)
+			}
+
+			lacCtx, err := NewContext(nil, log.With(logger, "context", "lac"))
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+
+			lacEvents := &testSessionEventCounterCloser{}
+			lacCtx.RegisterEventHandler(lacEvents)
+
+			callHandler := &testOutgoingCallHandler{
+				reject: c.reject,
+				scfg: SessionConfig{
+					Pseudowire:   PseudowireTypePPP,
+					ConnectSpeed: 56000,
+					FramingType:  FramingCapSync,
+				},
+			}
+			lacCtx.SetOutgoingCallHandler(callHandler)
+
+			tcfg := &TunnelConfig{
+				Local:          "127.0.0.1:6505",
+				Peer:           "127.0.0.1:5505",
+				Version:        ProtocolVersion2,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			}
+			lacTunl, err := lacCtx.NewDynamicTunnel("t1", tcfg)
+			if err != nil {
+				t.Fatalf("NewDynamicTunnel(%q, %v): %v", "t1", tcfg, err)
+			}
+
+			var lnsTunl Tunnel
+			select {
+			case lnsTunl = <-lnsTunnels.upChan:
+			case <-time.After(3 * time.Second):
+				t.Fatalf("timed out waiting for LNS tunnel up")
+			}
+
+			call := &OutgoingCallParameters{
+				CalledNumber: "01234567890",
+				SubAddress:   "42",
+				MinimumBPS:   9600,
+				MaximumBPS:   115200,
+				BearerType:   0x2,
+				FramingType:  FramingCapSync,
+			}
+			ocTunl, ok := lnsTunl.(OutgoingCallTunnel)
+			if !ok {
+				t.Fatalf("dynamic tunnel doesn't implement OutgoingCallTunnel")
+			}
+			_, err = ocTunl.NewOutgoingCall("oc1", &SessionConfig{Pseudowire: PseudowireTypePPP}, call)
+			if err != nil {
+				t.Fatalf("NewOutgoingCall(%q): %v", "oc1", err)
+			}
+
+			// On rejection the LNS session closes on receipt of the CDN,
+			// following which we close the tunnel.
+			if c.reject {
+				dt := lnsTunl.(*dynamicTunnel)
+				deadline := time.Now().Add(3 * time.Second)
+				for len(callHandler.getCalls()) == 0 || len(dt.allSessions()) > 0 {
+					if time.Now().After(deadline) {
+						t.Fatalf("timed out waiting for LNS session to be rejected")
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				lacTunl.Close()
+			}
+
+			select {
+			case <-lnsEvents.downChan:
+			case <-time.After(3 * time.Second):
+				t.Errorf("timed out waiting for LNS tunnel down")
+			}
+
+			lacCtx.Close()
+			lacEvents.wait()
+
+			if got := lacEvents.getEventCounts(); got != c.expectLAC {
+				t.Errorf("LAC event listener: expected %v event, got %v", c.expectLAC, got)
+			}
+			if got := lnsEvents.getEventCounts(); got != c.expectLNS {
+				t.Errorf("LNS event listener: expected %v event, got %v", c.expectLNS, got)
+			}
+
+			calls := callHandler.getCalls()
+			if len(calls) != 1 {
+				t.Fatalf("expected 1 outgoing call, got %v", len(calls))
+			}
+			if calls[0].PeerSessionID == 0 {
+				t.Errorf("expected outgoing call to have a peer session ID")
+			}
+			if calls[0].OutgoingCallParameters != *call {
+				t.Errorf("expected outgoing call parameters %v, got %v", *call, calls[0].OutgoingCallParameters)
+			}
+
+			// Check the LNS has picked up the call details from the OCCN
+			if c.expectLNS.sessionUp > 0 {
+				got := lnsEvents.getSessionConfigs()[0]
+				if got.ConnectSpeed != callHandler.scfg.ConnectSpeed {
+					t.Errorf("LNS session: expected connect speed %v, got %v", callHandler.scfg.ConnectSpeed, got.ConnectSpeed)
+				}
+				if got.FramingType != callHandler.scfg.FramingType {
+					t.Errorf("LNS session: expected framing type %v, got %v", callHandler.scfg.FramingType, got.FramingType)
+				}
+			}
+		})
+	}
+}
+
+func TestTieBreak(t *testing.T) {
+	cases := []struct {
+		name                  string
+		local, peer           []byte
+		localLoses, peerLoses bool
+	}{
+		{name: "no tie breakers"},
+		{name: "local only", local: []byte{1}, peerLoses: true},
+		{name: "peer only", peer: []byte{1}, localLoses: true},
+		{name: "local lower", local: []byte{0, 1}, peer: []byte{1, 0}, peerLoses: true},
+		{name: "peer lower", local: []byte{1, 0}, peer: []byte{0, 1}, localLoses: true},
+		{name: "equal", local: []byte{1, 1}, peer: []byte{1, 1}, localLoses: true, peerLoses: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			localLoses, peerLoses := tieBreak(c.local, c.peer)
+			if localLoses != c.localLoses || peerLoses != c.peerLoses {
+				t.Errorf("tieBreak(%x, %x): expected (%v, %v), got (%v, %v)",
+					c.local, c.peer, c.localLoses, c.peerLoses, localLoses, peerLoses)
+			}
+		})
+	}
+}
+
+func TestDynamicTunnelTieBreak(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	type peer struct {
+		name, tunnel, listen, local string
+		ctx                         *Context
+		events                      *testEventCounter
+		up                          *testTunnelUpNotifier
+	}
+	peers := []*peer{
+		{name: "a", tunnel: "t1", listen: "127.0.0.1:5506", local: "127.0.0.1:6506"},
+		{name: "b", tunnel: "t2", listen: "127.0.0.1:5507", local: "127.0.0.1:6507"},
+	}
+
+	for _, p := range peers {
+		var err error
+		p.ctx, err = NewContext(nil, log.With(logger, "context", p.name))
+		if err != nil {
+			t.Fatalf("NewContext(): %v", err)
+		}
+		p.events = &testEventCounter{}
+		p.ctx.RegisterEventHandler(p.events)
+		p.up = &testTunnelUpNotifier{upChan: make(chan Tunnel, 2)}
+		p.ctx.RegisterEventHandler(p.up)
+	}
+
+	// Both peers originate a tunnel before either is listening, so the
+	// SCCRQ retransmits will collide once the listeners are up.
+	for i, p := range peers {
+		tcfg := &TunnelConfig{
+			Local:          p.local,
+			Peer:           peers[1-i].listen,
+			Version:        ProtocolVersion2,
+			Encap:          EncapTypeUDP,
+			RetryTimeout:   100 * time.Millisecond,
+			StopCCNTimeout: 250 * time.Millisecond,
+		}
+		_, err := p.ctx.NewDynamicTunnel(p.tunnel, tcfg)
+		if err != nil {
+			t.Fatalf("NewDynamicTunnel(%q, %v): %v", p.tunnel, tcfg, err)
+		}
+	}
+	for _, p := range peers {
+		lcfg := &TunnelConfig{
+			Version:        ProtocolVersion2,
+			Encap:          EncapTypeUDP,
+			StopCCNTimeout: 250 * time.Millisecond,
+		}
+		_, err := p.ctx.NewListener(p.listen, lcfg)
+		if err != nil {
+			t.Fatalf("NewListener(%q, %v): %v", p.listen, lcfg, err)
+		}
+	}
+
+	for _, p := range peers {
+		select {
+		case <-p.up.upChan:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timed out waiting for tunnel up on peer %v", p.name)
+		}
+	}
+
+	// Exactly one of the originated tunnels should survive
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		survivors := 0
+		for _, p := range peers {
+			if _, ok := p.ctx.findTunnelByName(p.tunnel); ok {
+				survivors++
+			}
+		}
+		if survivors == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected one originated tunnel to survive, got %v", survivors)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, p := range peers {
+		p.ctx.Close()
+	}
+
+	expect := eventCounters{tunnelUp: 1, tunnelDown: 1}
+	for _, p := range peers {
+		if got := p.events.getEventCounts(); got != expect {
+			t.Errorf("peer %v event listener: expected %v event, got %v", p.name, expect, got)
+		}
+	}
+}
+
+type testLinkInfoHandler struct {
+	sessionUpChan chan Session
+	sliChan       chan *SessionLinkInfoEvent
+	wenChan       chan *SessionWANErrorEvent
+}
+
+func (tlih *testLinkInfoHandler) HandleEvent(event interface{}) {
+	switch ev := event.(type) {
+	case *SessionUpEvent:
+		tlih.sessionUpChan <- ev.Session
+	case *SessionLinkInfoEvent:
+		tlih.sliChan <- ev
+	case *SessionWANErrorEvent:
+		tlih.wenChan <- ev
+	}
+}
+
+func newTestLinkInfoHandler() *testLinkInfoHandler {
+	return &testLinkInfoHandler{
+		sessionUpChan: make(chan Session, 1),
+		sliChan:       make(chan *SessionLinkInfoEvent, 1),
+		wenChan:       make(chan *SessionWANErrorEvent, 1),
+	}
+}
+
+func TestDynamicSessionLinkInfo(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lnsCtx, err := NewContext(nil, log.With(logger, "context", "lns"))
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lnsCtx.Close()
+
+	lnsEvents := newTestLinkInfoHandler()
+	lnsCtx.RegisterEventHandler(lnsEvents)
+	lnsCtx.SetIncomingCallHandler(&testCallHandler{scfg: SessionConfig{Pseudowire: PseudowireTypePPP}})
+
+	lcfg := &TunnelConfig{
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	}
+	_, err = lnsCtx.NewListener("127.0.0.1:5508", lcfg)
+	if err != nil {
+		t.Fatalf("NewListener(%q, %v): %v", "127.0.0.1:5508", lcfg, err)
+	}
+
+	lacCtx, err := NewContext(nil, log.With(logger, "context", "lac"))
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lacCtx.Close()
+
+	lacEvents := newTestLinkInfoHandler()
+	lacCtx.RegisterEventHandler(lacEvents)
+
+	tcfg := &TunnelConfig{
+		Local:          "127.0.0.1:6508",
+		Peer:           "127.0.0.1:5508",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	}
+	lacTunl, err := lacCtx.NewDynamicTunnel("t1", tcfg)
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(%q, %v): %v", "t1", tcfg, err)
+	}
+	_, err = lacTunl.NewSession("s1", &SessionConfig{Pseudowire: PseudowireTypePPP})
+	if err != nil {
+		t.Fatalf("NewSession(%q): %v", "s1", err)
+	}
+
+	var lnsSession Session
+	select {
+	case lnsSession = <-lnsEvents.sessionUpChan:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timed out waiting for LNS session up")
+	}
+	select {
+	case <-lacEvents.sessionUpChan:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timed out waiting for LAC session up")
+	}
+
+	// The library doesn't originate SLI or WEN, so send them from the
+	// LNS session by hand
+	ds := lnsSession.(*dynamicSession)
+	ptid := ds.parent.getCfg().PeerTunnelID
+	psid := ds.cfg.PeerSessionID
+
+	sli, err := buildV2Msg(ptid, psid, []avpIn{
+		{avpTypeMessage, avpMsgTypeSli},
+		{avpTypeAccm, []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x0a, 0xff, 0xff, 0xff, 0xff}},
+	})
+	if err != nil {
+		t.Fatalf("buildV2Msg(SLI): %v", err)
+	}
+	err = ds.dt.sendMessage(sli)
+	if err != nil {
+		t.Fatalf("sendMessage(SLI): %v", err)
+	}
+
+	select {
+	case ev := <-lacEvents.sliChan:
+		if ev.SessionName != "s1" {
+			t.Errorf("SessionLinkInfoEvent: expected session %q, got %q", "s1", ev.SessionName)
+		}
+		if ev.SendACCM != 0x0000000a || ev.ReceiveACCM != 0xffffffff {
+			t.Errorf("SessionLinkInfoEvent: expected ACCM %#08x/%#08x, got %#08x/%#08x",
+				0x0000000a, 0xffffffff, ev.SendACCM, ev.ReceiveACCM)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timed out waiting for SessionLinkInfoEvent")
+	}
+
+	wen, err := buildV2Msg(ptid, psid, []avpIn{
+		{avpTypeMessage, avpMsgTypeWen},
+		{avpTypeCallErrors, []byte{
+			0x00, 0x00,
+			0x00, 0x00, 0x00, 0x01,
+			0x00, 0x00, 0x00, 0x02,
+			0x00, 0x00, 0x00, 0x03,
+			0x00, 0x00, 0x00, 0x04,
+			0x00, 0x00, 0x00, 0x05,
+			0x00, 0x00, 0x00, 0x06,
+		}},
+	})
+	if err != nil {
+		t.Fatalf("buildV2Msg(WEN): %v", err)
+	}
+	err = ds.dt.sendMessage(wen)
+	if err != nil {
+		t.Fatalf("sendMessage(WEN): %v", err)
+	}
+
+	select {
+	case ev := <-lacEvents.wenChan:
+		expect := CallErrors{
+			CRCErrors:        1,
+			FramingErrors:    2,
+			HardwareOverruns: 3,
+			BufferOverruns:   4,
+			TimeoutErrors:    5,
+			AlignmentErrors:  6,
+		}
+		if ev.CallErrors != expect {
+			t.Errorf("SessionWANErrorEvent: expected %v, got %v", expect, ev.CallErrors)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timed out waiting for SessionWANErrorEvent")
+	}
+}
+
+func TestDynamicSessionLinkInfoBeforeEstablished(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	peerTunnelCfg := &TunnelConfig{
+		Local:          "127.0.0.1:5510",
+		Peer:           "127.0.0.1:6510",
+		Version:        ProtocolVersion2,
+		TunnelID:       4567,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	}
+	lns, err := newTestLNS(logger, peerTunnelCfg, &SessionConfig{Pseudowire: PseudowireTypePPP, SessionID: 5566})
+	if err != nil {
+		t.Fatalf("newTestLNS: %v", err)
+	}
+	lns.linkInfoBeforeIcrp = true
+
+	var lnsWg sync.WaitGroup
+	lnsWg.Add(1)
+	go func() {
+		lns.run(3 * time.Second)
+		lnsWg.Done()
+	}()
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	events := newTestLinkInfoHandler()
+	ctx.RegisterEventHandler(events)
+
+	tcfg := &TunnelConfig{
+		Local:          "127.0.0.1:6510",
+		Peer:           "127.0.0.1:5510",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	}
+	tunl, err := ctx.NewDynamicTunnel("t1", tcfg)
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(%q, %v): %v", "t1", tcfg, err)
+	}
+	_, err = tunl.NewSession("s1", &SessionConfig{Pseudowire: PseudowireTypePPP})
+	if err != nil {
+		t.Fatalf("NewSession(%q): %v", "s1", err)
+	}
+
+	// SLI and WEN arriving before the call is established should be
+	// ignored rather than tearing the session down
+	select {
+	case <-events.sessionUpChan:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timed out waiting for session up")
+	}
+	select {
+	case <-events.sliChan:
+		t.Errorf("SessionLinkInfoEvent raised before session establishment")
+	case <-events.wenChan:
+		t.Errorf("SessionWANErrorEvent raised before session establishment")
+	default:
+	}
+
+	ctx.Close()
+	lnsWg.Wait()
+
+	if !lns.sessionEstablished {
+		t.Errorf("LNS session didn't establish")
+	}
+}
+
+func TestDynamicIntrospection(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lnsCtx, err := NewContext(nil, log.With(logger, "context", "lns"))
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lnsCtx.Close()
+
+	lnsEvents := newTestLinkInfoHandler()
+	lnsCtx.RegisterEventHandler(lnsEvents)
+	lnsCtx.SetIncomingCallHandler(&testCallHandler{scfg: SessionConfig{Pseudowire: PseudowireTypePPP}})
+
+	lcfg := &TunnelConfig{
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	}
+	_, err = lnsCtx.NewListener("127.0.0.1:5509", lcfg)
+	if err != nil {
+		t.Fatalf("NewListener(%q, %v): %v", "127.0.0.1:5509", lcfg, err)
+	}
+
+	lacCtx, err := NewContext(nil, log.With(logger, "context", "lac"))
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lacCtx.Close()
+
+	lacEvents := newTestLinkInfoHandler()
+	lacCtx.RegisterEventHandler(lacEvents)
+
+	tcfg := &TunnelConfig{
+		Local:          "127.0.0.1:6509",
+		Peer:           "127.0.0.1:5509",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	}
+	lacTunl, err := lacCtx.NewDynamicTunnel("t1", tcfg)
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(%q, %v): %v", "t1", tcfg, err)
+	}
+
+	// Poll the accessors while the control protocol runs
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			for _, tunl := range lacCtx.Tunnels() {
+				_ = tunl.State()
+				_ = tunl.Config()
+				_, _ = tunl.Statistics()
+				for _, s := range tunl.Sessions() {
+					_ = s.State()
+					_ = s.Config()
+					_, _ = s.Statistics()
+				}
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	_, err = lacTunl.NewSession("s1", &SessionConfig{Pseudowire: PseudowireTypePPP})
+	if err != nil {
+		t.Fatalf("NewSession(%q): %v", "s1", err)
+	}
+
+	var lacSession Session
+	select {
+	case lacSession = <-lacEvents.sessionUpChan:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timed out waiting for LAC session up")
+	}
+	<-done
+
+	tunnels := lacCtx.Tunnels()
+	if len(tunnels) != 1 {
+		t.Fatalf("Tunnels(): expected 1 tunnel, got %d", len(tunnels))
+	}
+	if tunnels[0].Name() != "t1" {
+		t.Errorf("Name(): expected %q, got %q", "t1", tunnels[0].Name())
+	}
+	if tunnels[0].State() != "established" {
+		t.Errorf("tunnel State(): expected %q, got %q", "established", tunnels[0].State())
+	}
+	if tunnels[0].Config().PeerTunnelID == 0 {
+		t.Errorf("tunnel Config(): expected non-zero peer tunnel ID")
+	}
+	if _, err := tunnels[0].Statistics(); err != nil {
+		t.Errorf("tunnel Statistics(): %v", err)
+	}
+
+	sessions := tunnels[0].Sessions()
+	if len(sessions) != 1 || sessions[0] != lacSession {
+		t.Fatalf("Sessions(): expected [%v], got %v", lacSession, sessions)
+	}
+	if lacSession.State() != "established" {
+		t.Errorf("session State(): expected %q, got %q", "established", lacSession.State())
+	}
+	scfg := lacSession.Config()
+	if scfg.PeerSessionID == 0 {
+		t.Errorf("session Config(): expected non-zero peer session ID")
+	}
+	scfg.PeerSessionID = 0
+	if lacSession.Config().PeerSessionID == 0 {
+		t.Errorf("session Config(): modifying the returned config changed the session")
+	}
+	if _, err := lacSession.Statistics(); err != nil {
+		t.Errorf("Statistics(): %v", err)
+	}
+
+	scfg = lacSession.Config()
+	scfg.SeqNum = true
+	if err := lacSession.Reconfigure(scfg); err != nil {
+		t.Errorf("Reconfigure(): %v", err)
+	}
+	if !lacSession.Config().SeqNum {
+		t.Errorf("Reconfigure(): expected sequence numbers to be enabled")
+	}
+
+	lacSession.Close()
+	if len(tunnels[0].Sessions()) != 0 {
+		t.Errorf("Sessions(): expected no sessions after close")
+	}
+}
+
+// Wait for the peer to send an SCCRQ on the control plane passed in
+func pipeTestRecvSccrq(cp *pipeControlPlane, timeout time.Duration) (controlMessage, error) {
+	sccrqChan := make(chan controlMessage)
+	go func() {
+		defer close(sccrqChan)
+		for {
+			b := make([]byte, 4096)
+			n, _, err := cp.recvFrom(b)
+			if err != nil {
+				return
+			}
+			messages, err := parseMessageBuffer(b[:n])
+			if err != nil {
+				continue
+			}
+			for _, msg := range messages {
+				if msg.getType() == avpMsgTypeSccrq {
+					sccrqChan <- msg
+					return
+				}
+			}
+		}
+	}()
+
+	select {
+	case msg, ok := <-sccrqChan:
+		if ok {
+			return msg, nil
+		}
+		return nil, fmt.Errorf("control plane closed")
+	case <-time.After(timeout):
+		cp.close()
+		return nil, fmt.Errorf("timed out waiting for SCCRQ")
+	}
+}
+
+func TestDynamicTunnelPipe(t *testing.T) {
+	impairments := []struct {
+		name       string
+		impairment pipeImpairment
+	}{
+		{
+			name: "no impairment",
+		},
+		{
+			name:       "loss",
+			impairment: pipeImpairment{Loss: 0.2, Seed: 1},
+		},
+		{
+			name:       "duplication",
+			impairment: pipeImpairment{Duplicate: 0.3, Seed: 2},
+		},
+		{
+			name:       "reordering",
+			impairment: pipeImpairment{Reorder: 0.3, Seed: 3},
+		},
+		{
+			name:       "delay",
+			impairment: pipeImpairment{Delay: 10 * time.Millisecond},
+		},
+	}
+	versions := []struct {
+		version    ProtocolVersion
+		pseudowire PseudowireType
+	}{
+		{ProtocolVersion2, PseudowireTypePPP},
+		{ProtocolVersion3, PseudowireTypeEth},
+	}
+	for _, imp := range impairments {
+		for _, v := range versions {
+			t.Run(fmt.Sprintf("%s L2TPv%v", imp.name, v.version), func(t *testing.T) {
+				logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+				lacCtx, err := NewContext(nil, log.With(logger, "context", "lac"))
+				if err != nil {
+					t.Fatalf("NewContext(): %v", err)
+				}
+				defer lacCtx.Close()
+
+				lnsCtx, err := NewContext(nil, log.With(logger, "context", "lns"))
+				if err != nil {
+					t.Fatalf("NewContext(): %v", err)
+				}
+				defer lnsCtx.Close()
+
+				lacEvents := &testSessionEventCounterCloser{}
+				lacCtx.RegisterEventHandler(lacEvents)
+
+				lnsEvents := &testTunnelDownWaiter{downChan: make(chan interface{})}
+				lnsCtx.RegisterEventHandler(lnsEvents)
+				lnsCtx.SetIncomingCallHandler(&testCallHandler{scfg: SessionConfig{Pseudowire: v.pseudowire}})
+
+				sal, sap, err := newUDPAddressPair("127.0.0.1:6000", "127.0.0.1:5000")
+				if err != nil {
+					t.Fatalf("newUDPAddressPair(): %v", err)
+				}
+				lacCp, lnsCp := newControlPlanePipe(sal, sap, imp.impairment, imp.impairment)
+
+				lacCfg := &TunnelConfig{
+					Local:          "127.0.0.1:6000",
+					Peer:           "127.0.0.1:5000",
+					Version:        v.version,
+					TunnelID:       1001,
+					Encap:          EncapTypeUDP,
+					StopCCNTimeout: 250 * time.Millisecond,
+					RetryTimeout:   20 * time.Millisecond,
+					MaxRetries:     10,
+				}
+				lac, err := newDynamicTunnelWithControlPlane("t1", lacCtx, sal, sap, lacCfg, lacCp)
+				if err != nil {
+					lnsCp.close()
+					t.Fatalf("newDynamicTunnelWithControlPlane(): %v", err)
+				}
+				lacCtx.linkTunnel(lac)
+
+				// Stand in for the listener, which would normally
+				// receive the SCCRQ and create the LNS tunnel
+				sccrq, err := pipeTestRecvSccrq(lnsCp, 3*time.Second)
+				if err != nil {
+					t.Fatalf("pipeTestRecvSccrq(): %v", err)
+				}
+
+				lnsCfg := &TunnelConfig{
+					Local:          "127.0.0.1:5000",
+					Peer:           "127.0.0.1:6000",
+					Version:        v.version,
+					TunnelID:       2002,
+					Encap:          EncapTypeUDP,
+					StopCCNTimeout: 250 * time.Millisecond,
+					RetryTimeout:   20 * time.Millisecond,
+					MaxRetries:     10,
+				}
+				lns, err := newDynamicLNSTunnelWithControlPlane("t2", lnsCtx, sap, sal, lnsCfg, lnsCp, sccrq)
+				if err != nil {
+					t.Fatalf("newDynamicLNSTunnelWithControlPlane(): %v", err)
+				}
+				lnsCtx.linkTunnel(lns)
+
+				_, err = lac.NewSession("s1", &SessionConfig{Pseudowire: v.pseudowire})
+				if err != nil {
+					t.Fatalf("NewSession(): %v", err)
+				}
+
+				// The LAC closes its tunnel once the session is up,
+				// which should bring down the LNS tunnel too
+				select {
+				case <-lnsEvents.downChan:
+				case <-time.After(5 * time.Second):
+					t.Errorf("timed out waiting for LNS tunnel down")
+				}
+
+				lacCtx.Close()
+				lacEvents.wait()
+
+				expect := eventCounters{tunnelUp: 1, tunnelDown: 1, sessionUp: 1, sessionDown: 1}
+				if got := lacEvents.getEventCounts(); got != expect {
+					t.Errorf("LAC event listener: expected %v event, got %v", expect, got)
+				}
+				if got := lnsEvents.getEventCounts(); got != expect {
+					t.Errorf("LNS event listener: expected %v event, got %v", expect, got)
+				}
+			})
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package l2tp
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
 	"fmt"
 	"sync"
 	"time"
@@ -26,19 +29,103 @@ type dynamicTunnel struct {
 	isClosing   bool
 	established bool
 	sal, sap    unix.Sockaddr
-	cp          *controlPlane
+	cp          controlPlane
 	xport       *transport
+	dpLock      sync.Mutex
 	dp          TunnelDataPlane
 	closeChan   chan bool
+	dpDeleted   chan bool
+	result      string
 	sendChan    chan *sendMsg
 	eventChan   chan *eventArgs
 	wg          sync.WaitGroup
 	sessionTxWg sync.WaitGroup
 	fsm         fsm
+	// L2TPv2 tunnel authentication state: the challenge we sent the
+	// peer, and the challenge the peer sent us.
+	challenge, peerChallenge []byte
+	// L2TPv3 control message authentication state
+	msgAuth *messageAuth
+	// Tie breaker state: the value we sent in SCCRQ, whether the SCCRQ
+	// is still awaiting a reply, and the peer value we have beaten.
+	tieBreakLock     sync.Mutex
+	tieBreaker       []byte
+	sccrqPending     bool
+	beatenTieBreaker []byte
+	tieBreakerChan   chan bool
 }
 
+// tieBreakerLen is the length of the Tie Breaker AVP value.
+// Ref: RFC2661 section 4.4.3
+const tieBreakerLen = 8
+
 func (dt *dynamicTunnel) NewSession(name string, cfg *SessionConfig) (sess Session, err error) {
 
+	if dt.checkClosing() {
+		return nil, fmt.Errorf("tunnel is closing")
+	}
+
+	myCfg, err := dt.newSessionConfig(name, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := newDynamicSession(dt.parent.allocCallSerial(), name, dt, myCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	dt.injectEvent("newsession", s)
+	sess = s
+
+	return
+}
+
+func (dt *dynamicTunnel) NewOutgoingCall(name string, cfg *SessionConfig, call *OutgoingCallParameters) (sess Session, err error) {
+
+	// Ref: RFC2661 section 5.4; we don't support RFC3931 outgoing calls
+	if dt.cfg.Version != ProtocolVersion2 {
+		return nil, fmt.Errorf("outgoing calls are supported for L2TPv2 tunnels only")
+	}
+
+	// Must have call parameters
+	if call == nil {
+		return nil, fmt.Errorf("invalid nil call parameters")
+	}
+
+	if dt.checkClosing() {
+		return nil, fmt.Errorf("tunnel is closing")
+	}
+
+	myCfg, err := dt.newSessionConfig(name, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Duplicate the call parameters so we don't retain the user's copy
+	myCall := *call
+
+	s, err := newDynamicOutgoingSession(dt.parent.allocCallSerial(), name, dt, myCfg, &myCall)
+	if err != nil {
+		return nil, err
+	}
+
+	dt.injectEvent("newsession", s)
+	sess = s
+
+	return
+}
+
+func (dt *dynamicTunnel) checkClosing() bool {
+	dt.closingLock.Lock()
+	defer dt.closingLock.Unlock()
+	return dt.isClosing
+}
+
+// Validate a session configuration for the tunnel, and return a copy
+// of it with a session ID allocated if necessary.
+func (dt *dynamicTunnel) newSessionConfig(name string, cfg *SessionConfig) (myCfg *SessionConfig, err error) {
+
 	// Must have configuration
 	if cfg == nil {
 		return nil, fmt.Errorf("invalid nil config")
@@ -49,15 +136,14 @@ func (dt *dynamicTunnel) NewSession(name string, cfg *SessionConfig) (sess Sessi
 		return nil, fmt.Errorf("already have session %q", name)
 	}
 
-	dt.closingLock.Lock()
-	if dt.isClosing {
-		dt.closingLock.Unlock()
-		return nil, fmt.Errorf("tunnel is closing")
+	err = checkSessionVlanConfig(cfg)
+	if err != nil {
+		return nil, err
 	}
-	dt.closingLock.Unlock()
 
 	// Duplicate the configuration so we don't modify the user's copy
-	myCfg := *cfg
+	dup := *cfg
+	myCfg = &dup
 
 	// If the session ID in the config is unset, we must generate one.
 	// If the session ID is set, we must check for collisions.
@@ -76,15 +162,26 @@ func (dt *dynamicTunnel) NewSession(name string, cfg *SessionConfig) (sess Sessi
 		}
 	}
 
-	s, err := newDynamicSession(dt.parent.allocCallSerial(), name, dt, &myCfg)
-	if err != nil {
-		return nil, err
-	}
+	return myCfg, nil
+}
 
-	dt.injectEvent("newsession", s)
-	sess = s
+func (dt *dynamicTunnel) SetDebugFlags(flags DebugFlags) error {
+	dt.dpLock.Lock()
+	defer dt.dpLock.Unlock()
+	return dt.setDebugFlags(dt.dp, flags)
+}
 
-	return
+func (dt *dynamicTunnel) Statistics() (*TunnelDataPlaneStatistics, error) {
+	dt.dpLock.Lock()
+	defer dt.dpLock.Unlock()
+	if dt.dp == nil {
+		return nil, fmt.Errorf("tunnel data plane not instantiated")
+	}
+	return dt.dp.GetStatistics()
+}
+
+func (dt *dynamicTunnel) State() string {
+	return dt.fsm.state()
 }
 
 func (dt *dynamicTunnel) Close() {
@@ -95,6 +192,14 @@ func (dt *dynamicTunnel) Close() {
 	}
 }
 
+func (dt *dynamicTunnel) onDataPlaneDeleted() {
+	level.Info(dt.logger).Log("message", "data plane deleted externally")
+	select {
+	case dt.dpDeleted <- true:
+	default:
+	}
+}
+
 func (dt *dynamicTunnel) closeAllSessions() {
 	// In order to prevent any concurrently executing sessions from
 	// blocking in a channel send when trying to transmit control
@@ -133,7 +238,7 @@ func (dt *dynamicTunnel) sendMessage(msg controlMessage) error {
 	return <-sm.completeChan
 }
 
-func (dt *dynamicTunnel) runTunnel() {
+func (dt *dynamicTunnel) runTunnel(initial *eventArgs) {
 	defer dt.wg.Done()
 
 	level.Info(dt.logger).Log(
@@ -145,11 +250,15 @@ func (dt *dynamicTunnel) runTunnel() {
 		"tunnel_id", dt.cfg.TunnelID,
 		"peer_tunnel_id", dt.cfg.PeerTunnelID)
 
-	dt.handleEvent("open")
+	dt.handleEvent(initial.event, initial.args...)
 	for {
 		select {
 		case <-dt.closeChan:
-			dt.handleEvent("close", avpStopCCNResultCodeClearConnection)
+			// The tunnel may already have been torn down following an
+			// error, in which case the transport is no longer available.
+			if !dt.checkClosing() {
+				dt.handleEvent("close", avpStopCCNResultCodeClearConnection)
+			}
 			return
 		case m, ok := <-dt.xport.recvChan:
 			if !ok {
@@ -163,6 +272,25 @@ func (dt *dynamicTunnel) runTunnel() {
 				return
 			}
 			dt.handleEvent(ea.event, ea.args...)
+		case <-dt.tieBreakerChan:
+			if !dt.checkClosing() {
+				dt.handleEvent("tiebreaklost")
+			}
+		case <-dt.dpDeleted:
+			// The data plane instance has already gone, so there's
+			// no need to take it down as part of the tunnel close.
+			dt.dpLock.Lock()
+			deleted := dt.dp != nil
+			dt.dp = nil
+			dt.dpLock.Unlock()
+			if deleted && !dt.checkClosing() {
+				dt.setDataPlaneDeleted()
+				dt.result = "tunnel data plane deleted externally"
+				dt.handleEvent("close",
+					avpStopCCNResultCodeGeneralError,
+					avpErrorCodeVendorSpecificError,
+					dt.result)
+			}
 		case sm, ok := <-dt.sendChan:
 			if !ok {
 				dt.fsmActClose(nil)
@@ -203,13 +331,13 @@ func (dt *dynamicTunnel) injectEvent(ev string, args ...interface{}) {
 }
 
 // panics if expected arguments are not passed
-func fsmArgsToV2MsgFrom(args []interface{}) (msg *v2ControlMessage, from unix.Sockaddr) {
+func fsmArgsToMsgFrom(args []interface{}) (msg controlMessage, from unix.Sockaddr) {
 	if len(args) != 2 {
 		panic(fmt.Sprintf("unexpected argument count (wanted 2, got %v)", len(args)))
 	}
-	msg, ok := args[0].(*v2ControlMessage)
+	msg, ok := args[0].(controlMessage)
 	if !ok {
-		panic(fmt.Sprintf("first argument %T not *v2ControlMessage", args[0]))
+		panic(fmt.Sprintf("first argument %T not controlMessage", args[0]))
 	}
 	from, ok = args[1].(unix.Sockaddr)
 	if !ok {
@@ -253,6 +381,19 @@ func fsmArgsToStopccnResult(args []interface{}) *resultCode {
 
 func (dt *dynamicTunnel) handleMsg(m *recvMsg) {
 
+	// The peer sent a message which requires the tunnel to be torn
+	// down, e.g. one carrying an unrecognised mandatory AVP.
+	if m.err != nil {
+		level.Error(dt.logger).Log(
+			"message", "bad control message",
+			"error", m.err)
+		dt.handleEvent("close",
+			avpStopCCNResultCodeGeneralError,
+			avpErrorCodeMBitShutdown,
+			fmt.Sprintf("bad control message: %v", m.err))
+		return
+	}
+
 	// Initial validation: ignore a message with the wrong protocol version
 	if m.msg.protocolVersion() != dt.cfg.Version {
 		level.Error(dt.logger).Log(
@@ -276,6 +417,17 @@ func (dt *dynamicTunnel) handleMsg(m *recvMsg) {
 		}
 		dt.handleV2Msg(msg, m.from)
 		return
+	case ProtocolVersion3:
+		msg, ok := m.msg.(*v3ControlMessage)
+		if !ok {
+			// As above, this indicates a coding error.
+			level.Error(dt.logger).Log(
+				"message", "couldn't cast L2TPv3 message as v3ControlMessage")
+			dt.fsmActClose(nil)
+			return
+		}
+		dt.handleV3Msg(msg, m.from)
+		return
 	}
 
 	level.Error(dt.logger).Log(
@@ -301,9 +453,40 @@ func (dt *dynamicTunnel) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr)
 		return
 	}
 
+	// A message carrying an unrecognised mandatory AVP for a session
+	// terminates just that session, which sends CDN to the peer.
+	if msg.avpErr != nil {
+		if s, ok := dt.findSessionByID(ControlConnID(msg.Sid())); ok {
+			if ds, ok := s.(*dynamicSession); ok {
+				ds.handleCtlMsg(msg)
+			}
+		} else {
+			level.Error(dt.logger).Log(
+				"message", "received bad session message for unknown session",
+				"message_type", msg.getType(),
+				"session ID", msg.Sid(),
+				"error", msg.avpErr)
+		}
+		return
+	}
+
+	// Recover the values of any hidden AVPs prior to validation
+	err := unhideMsgAvps(msg, dt.cfg.Secret)
+	if err != nil {
+		level.Error(dt.logger).Log(
+			"message", "failed to unhide AVPs",
+			"message_type", msg.getType(),
+			"error", err)
+		dt.handleEvent("close",
+			avpStopCCNResultCodeGeneralError,
+			avpErrorCodeBadValue,
+			fmt.Sprintf("bad %v message: %v", msg.getType(), err))
+		return
+	}
+
 	// Validate the message.  If validation fails drive shutdown via.
 	// the FSM to allow the error to be communicated to the peer.
-	err := msg.validate()
+	err = msg.validate()
 	if err != nil {
 		level.Error(dt.logger).Log(
 			"message", "bad control message",
@@ -313,6 +496,7 @@ func (dt *dynamicTunnel) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr)
 			avpStopCCNResultCodeGeneralError,
 			avpErrorCodeBadValue,
 			fmt.Sprintf("bad %v message: %v", msg.getType(), err))
+		return
 	}
 
 	// Map the message to the appropriate event type.  If we haven't got
@@ -329,9 +513,12 @@ func (dt *dynamicTunnel) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr)
 		{avpMsgTypeIcrq, "sessionmsg"},
 		{avpMsgTypeIcrp, "sessionmsg"},
 		{avpMsgTypeIccn, "sessionmsg"},
+		{avpMsgTypeOcrq, "sessionmsg"},
+		{avpMsgTypeOcrp, "sessionmsg"},
+		{avpMsgTypeOccn, "sessionmsg"},
 		{avpMsgTypeCdn, "sessionmsg"},
-		{avpMsgTypeSli, "sli"},
-		{avpMsgTypeWen, "wen"},
+		{avpMsgTypeSli, "sessionmsg"},
+		{avpMsgTypeWen, "sessionmsg"},
 	}
 
 	for _, em := range eventMap {
@@ -351,6 +538,75 @@ func (dt *dynamicTunnel) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr)
 		fmt.Sprintf("unhandled v2 control message %v", msg.getType()))
 }
 
+func (dt *dynamicTunnel) handleV3Msg(msg *v3ControlMessage, from unix.Sockaddr) {
+
+	// As for L2TPv2, ignore mis-delivered messages
+	if msg.ControlConnectionID() != uint32(dt.cfg.TunnelID) {
+		level.Error(dt.logger).Log(
+			"message", "received control message with the wrong CCID",
+			"expected", dt.cfg.TunnelID,
+			"got", msg.ControlConnectionID())
+		return
+	}
+
+	err := unhideMsgAvps(msg, dt.cfg.Secret)
+	if err != nil {
+		level.Error(dt.logger).Log(
+			"message", "failed to unhide AVPs",
+			"message_type", msg.getType(),
+			"error", err)
+		dt.handleEvent("close",
+			avpStopCCNResultCodeGeneralError,
+			avpErrorCodeBadValue,
+			fmt.Sprintf("bad %v message: %v", msg.getType(), err))
+		return
+	}
+
+	err = msg.validate()
+	if err != nil {
+		level.Error(dt.logger).Log(
+			"message", "bad control message",
+			"message_type", msg.getType(),
+			"error", err)
+		dt.handleEvent("close",
+			avpStopCCNResultCodeGeneralError,
+			avpErrorCodeBadValue,
+			fmt.Sprintf("bad %v message: %v", msg.getType(), err))
+		return
+	}
+
+	eventMap := []struct {
+		m avpMsgType
+		e string
+	}{
+		{avpMsgTypeSccrq, "sccrq"},
+		{avpMsgTypeSccrp, "sccrp"},
+		{avpMsgTypeScccn, "scccn"},
+		{avpMsgTypeStopccn, "stopccn"},
+		{avpMsgTypeHello, ""}, // fsm ignores empty events
+		{avpMsgTypeIcrq, "sessionmsg"},
+		{avpMsgTypeIcrp, "sessionmsg"},
+		{avpMsgTypeIccn, "sessionmsg"},
+		{avpMsgTypeCdn, "sessionmsg"},
+	}
+
+	for _, em := range eventMap {
+		if msg.getType() == em.m {
+			dt.handleEvent(em.e, msg, from)
+			return
+		}
+	}
+
+	level.Error(dt.logger).Log(
+		"message", "unhandled v3 control message",
+		"message_type", msg.getType())
+
+	dt.handleEvent("close",
+		avpStopCCNResultCodeGeneralError,
+		avpErrorCodeBadValue,
+		fmt.Sprintf("unhandled v3 control message %v", msg.getType()))
+}
+
 func (dt *dynamicTunnel) fsmActSendSccrq(args []interface{}) {
 	err := dt.sendSccrq()
 	if err != nil {
@@ -361,19 +617,231 @@ func (dt *dynamicTunnel) fsmActSendSccrq(args []interface{}) {
 	}
 }
 
-func (dt *dynamicTunnel) sendSccrq() error {
-	msg, err := newV2Sccrq(dt.cfg)
+func (dt *dynamicTunnel) sendSccrq() (err error) {
+	var msg controlMessage
+	if dt.cfg.Version == ProtocolVersion2 {
+		msg, err = newV2Sccrq(dt.cfg)
+	} else {
+		msg, err = newV3Sccrq(dt.cfg)
+	}
+	if err != nil {
+		return err
+	}
+	err = dt.appendTieBreaker(msg)
+	if err != nil {
+		return err
+	}
+	err = dt.appendChallenge(msg)
+	if err != nil {
+		return err
+	}
+	err = dt.appendAuthNonce(msg)
 	if err != nil {
 		return err
 	}
+	dt.tieBreakLock.Lock()
+	dt.sccrqPending = true
+	dt.tieBreakLock.Unlock()
 	return dt.xport.send(msg)
 }
 
+// Add a Tie Breaker AVP to the message if we have a tie breaker value.
+// Ref: RFC2661 section 4.4.3
+func (dt *dynamicTunnel) appendTieBreaker(msg controlMessage) error {
+	if len(dt.tieBreaker) == 0 {
+		return nil
+	}
+	a, err := newAvp(vendorIDIetf, avpTypeTiebreaker, dt.tieBreaker)
+	if err != nil {
+		return err
+	}
+	msg.appendAvp(a)
+	return nil
+}
+
+// Compare the tie breaker from a peer's SCCRQ against our own, in the
+// event that the peer and ourselves have both sent SCCRQ to each other.
+// If we lose, the tunnel is silently discarded.
+//
+// Returns true if the peer's SCCRQ loses and should be discarded.
+// Ref: RFC2661 section 4.4.3
+func (dt *dynamicTunnel) resolveTieBreak(peerTieBreaker []byte) (peerLoses bool) {
+	dt.tieBreakLock.Lock()
+	defer dt.tieBreakLock.Unlock()
+
+	// Retransmits of an SCCRQ which has already lost may arrive after
+	// the peer has answered our SCCRQ, so keep on dropping them.
+	if len(peerTieBreaker) > 0 && bytes.Equal(peerTieBreaker, dt.beatenTieBreaker) {
+		return true
+	}
+
+	if !dt.sccrqPending {
+		return false
+	}
+
+	weLose, peerLoses := tieBreak(dt.tieBreaker, peerTieBreaker)
+	if peerLoses {
+		dt.beatenTieBreaker = peerTieBreaker
+	}
+	if weLose {
+		level.Info(dt.logger).Log(
+			"message", "lost tie break with peer SCCRQ",
+			"tie_breaker", fmt.Sprintf("%x", dt.tieBreaker),
+			"peer_tie_breaker", fmt.Sprintf("%x", peerTieBreaker))
+		dt.sccrqPending = false
+		select {
+		case dt.tieBreakerChan <- true:
+		default:
+		}
+	}
+	return peerLoses
+}
+
+// Mark our SCCRQ as having been answered by the peer.
+// Returns false if the tunnel has already lost a tie break.
+func (dt *dynamicTunnel) sccrqAnswered() bool {
+	dt.tieBreakLock.Lock()
+	defer dt.tieBreakLock.Unlock()
+	pending := dt.sccrqPending
+	dt.sccrqPending = false
+	return pending
+}
+
+// Decide the outcome of an SCCRQ collision given the local and peer tie
+// breaker values, either of which may be unset.  The lower value wins.
+// If neither side sent a tie breaker both tunnels survive, while if the
+// values are equal both tunnels are discarded.
+// Ref: RFC2661 section 4.4.3
+func tieBreak(local, peer []byte) (localLoses, peerLoses bool) {
+	if len(local) == 0 && len(peer) == 0 {
+		return false, false
+	} else if len(local) == 0 {
+		return true, false
+	} else if len(peer) == 0 {
+		return false, true
+	}
+	switch bytes.Compare(local, peer) {
+	case -1:
+		return false, true
+	case 1:
+		return true, false
+	}
+	return true, true
+}
+
+// Add a Control Message Authentication Nonce AVP to the message if
+// L2TPv3 message authentication is enabled.
+// Ref: RFC3931 section 5.4.3
+func (dt *dynamicTunnel) appendAuthNonce(msg controlMessage) error {
+	if dt.msgAuth == nil {
+		return nil
+	}
+	a, err := dt.msgAuth.nonceAvp()
+	if err != nil {
+		return err
+	}
+	msg.appendAvp(a)
+	return nil
+}
+
+// L2TPv2 tunnel authentication is used if the tunnel has a secret.
+// Ref: RFC2661 section 5.1.1
+func (dt *dynamicTunnel) authEnabled() bool {
+	return dt.cfg.Version == ProtocolVersion2 && len(dt.cfg.Secret) > 0
+}
+
+// Add a Challenge AVP to the message if authentication is enabled
+func (dt *dynamicTunnel) appendChallenge(msg controlMessage) error {
+	if !dt.authEnabled() {
+		return nil
+	}
+	if dt.challenge == nil {
+		dt.challenge = make([]byte, 16)
+		_, err := rand.Read(dt.challenge)
+		if err != nil {
+			return fmt.Errorf("failed to generate challenge: %v", err)
+		}
+	}
+	a, err := newAvp(vendorIDIetf, avpTypeChallenge, dt.challenge)
+	if err != nil {
+		return err
+	}
+	msg.appendAvp(a)
+	return nil
+}
+
+// Add a Challenge Response AVP to the message if the peer challenged us
+func (dt *dynamicTunnel) appendChallengeResponse(msg controlMessage) error {
+	if dt.peerChallenge == nil {
+		return nil
+	}
+	a, err := newAvp(vendorIDIetf, avpTypeChallengeResponse,
+		v2ChallengeResponse(msg.getType(), dt.cfg.Secret, dt.peerChallenge))
+	if err != nil {
+		return err
+	}
+	msg.appendAvp(a)
+	return nil
+}
+
+// Store the peer's challenge, if any, so that we can respond to it
+func (dt *dynamicTunnel) storePeerChallenge(msg controlMessage) error {
+	if dt.cfg.Version != ProtocolVersion2 {
+		return nil
+	}
+	challenge, err := findBytesAvp(msg.getAvps(), vendorIDIetf, avpTypeChallenge)
+	if err != nil {
+		return nil
+	}
+	if len(dt.cfg.Secret) == 0 {
+		return fmt.Errorf("peer sent a challenge but no secret is configured")
+	}
+	dt.peerChallenge = append([]byte(nil), challenge...)
+	return nil
+}
+
+// Check the peer's response to our challenge, if we sent one
+func (dt *dynamicTunnel) checkChallengeResponse(msg controlMessage) error {
+	if dt.challenge == nil {
+		return nil
+	}
+	rsp, err := findBytesAvp(msg.getAvps(), vendorIDIetf, avpTypeChallengeResponse)
+	if err != nil {
+		return fmt.Errorf("no Challenge Response AVP in %v", msg.getType())
+	}
+	expect := v2ChallengeResponse(msg.getType(), dt.cfg.Secret, dt.challenge)
+	if subtle.ConstantTimeCompare(rsp, expect) != 1 {
+		return fmt.Errorf("bad Challenge Response in %v", msg.getType())
+	}
+	return nil
+}
+
+// Authenticate the peer using a received SCCRP or SCCCN message,
+// storing the peer's challenge, if any.
+func (dt *dynamicTunnel) authenticate(msg controlMessage) bool {
+	err := dt.checkChallengeResponse(msg)
+	if err == nil {
+		err = dt.storePeerChallenge(msg)
+	}
+	if err != nil {
+		level.Error(dt.logger).Log(
+			"message", "tunnel authentication failed",
+			"message_type", msg.getType(),
+			"error", err)
+		dt.handleEvent("close",
+			avpStopCCNResultCodeChannelNotAuthorized,
+			avpErrorCodeNoError,
+			fmt.Sprintf("tunnel authentication failed: %v", err))
+		return false
+	}
+	return true
+}
+
 func (dt *dynamicTunnel) fsmActOnSccrp(args []interface{}) {
 
-	msg, from := fsmArgsToV2MsgFrom(args)
+	msg, from := fsmArgsToMsgFrom(args)
 
-	ptid, err := findUint16Avp(msg.getAvps(), vendorIDIetf, avpTypeTunnelID)
+	ptid, err := findPeerControlConnID(msg)
 	if err != nil {
 		// Shouldn't occur since tunnel ID is mandatory
 		level.Error(dt.logger).Log(
@@ -385,10 +853,23 @@ func (dt *dynamicTunnel) fsmActOnSccrp(args []interface{}) {
 
 	// Reconfigure transport and socket now we know the peer TID
 	// and the address being used for this tunnel
-	dt.xport.config.PeerControlConnID = ControlConnID(ptid)
-	dt.cfg.PeerTunnelID = ControlConnID(ptid)
+	dt.xport.config.PeerControlConnID = ptid
+	dt.cfgLock.Lock()
+	dt.cfg.PeerTunnelID = ptid
+	dt.cfgLock.Unlock()
 	dt.cp.connectTo(from)
 
+	// If we lost a tie break with the peer in the meantime our tunnel
+	// is discarded, so we ignore the reply.
+	if !dt.sccrqAnswered() {
+		dt.fsmActClose(nil)
+		return
+	}
+
+	if !dt.authenticate(msg) {
+		return
+	}
+
 	err = dt.sendScccn()
 	if err != nil {
 		level.Error(dt.logger).Log(
@@ -400,8 +881,101 @@ func (dt *dynamicTunnel) fsmActOnSccrp(args []interface{}) {
 
 	level.Info(dt.logger).Log("message", "control plane established")
 
+	dt.establish()
+}
+
+func (dt *dynamicTunnel) sendScccn() (err error) {
+	var msg controlMessage
+	if dt.cfg.Version == ProtocolVersion2 {
+		msg, err = newV2Scccn(dt.cfg)
+	} else {
+		msg, err = newV3Scccn(dt.cfg)
+	}
+	if err != nil {
+		return err
+	}
+	err = dt.appendChallengeResponse(msg)
+	if err != nil {
+		return err
+	}
+	return dt.xport.send(msg)
+}
+
+func (dt *dynamicTunnel) fsmActOnSccrq(args []interface{}) {
+
+	msg, _ := fsmArgsToMsgFrom(args)
+
+	ptid, err := findPeerControlConnID(msg)
+	if err != nil {
+		// Shouldn't occur since tunnel ID is mandatory, and the listener
+		// has already checked for it.  We can't send StopCCN without knowing
+		// the peer's tunnel ID, so just close.
+		level.Error(dt.logger).Log(
+			"message", "failed to parse peer tunnel ID from SCCRQ",
+			"error", err)
+		dt.fsmActClose(nil)
+		return
+	}
+
+	dt.xport.config.PeerControlConnID = ptid
+	dt.cfgLock.Lock()
+	dt.cfg.PeerTunnelID = ptid
+	dt.cfgLock.Unlock()
+
+	if !dt.authenticate(msg) {
+		return
+	}
+
+	err = dt.sendSccrp()
+	if err != nil {
+		level.Error(dt.logger).Log(
+			"message", "failed to send SCCRP",
+			"error", err)
+		dt.fsmActClose(nil)
+	}
+}
+
+func (dt *dynamicTunnel) sendSccrp() (err error) {
+	var msg controlMessage
+	if dt.cfg.Version == ProtocolVersion2 {
+		msg, err = newV2Sccrp(dt.cfg)
+	} else {
+		msg, err = newV3Sccrp(dt.cfg)
+	}
+	if err != nil {
+		return err
+	}
+	err = dt.appendChallengeResponse(msg)
+	if err != nil {
+		return err
+	}
+	err = dt.appendChallenge(msg)
+	if err != nil {
+		return err
+	}
+	err = dt.appendAuthNonce(msg)
+	if err != nil {
+		return err
+	}
+	return dt.xport.send(msg)
+}
+
+func (dt *dynamicTunnel) fsmActOnScccn(args []interface{}) {
+	msg, _ := fsmArgsToMsgFrom(args)
+
+	if !dt.authenticate(msg) {
+		return
+	}
+
+	level.Info(dt.logger).Log("message", "control plane established")
+	dt.establish()
+}
+
+// Bring up the data plane once the control connection three-way
+// handshake is complete, and let the sessions and the user know.
+func (dt *dynamicTunnel) establish() {
 	// establish the data plane
-	dt.dp, err = dt.parent.dp.NewTunnel(dt.cfg, dt.sal, dt.sap, dt.cp.fd)
+	dp, err := dt.parent.dp.NewTunnel(dt.cfg, dt.sal, dt.sap, dt.cp.getFd())
 	if err != nil {
 		level.Error(dt.logger).Log(
 			"message", "failed to establish data plane",
@@ -413,6 +987,10 @@ func (dt *dynamicTunnel) fsmActOnSccrp(args []interface{}) {
 		return
 	}
 
+	dt.dpLock.Lock()
+	dt.dp = dp
+	dt.dpLock.Unlock()
+
 	level.Info(dt.logger).Log("message", "data plane established")
 
 	// inform sessions that we're up
@@ -432,14 +1010,6 @@ func (dt *dynamicTunnel) fsmActOnSccrp(args []interface{}) {
 	})
 }
 
-func (dt *dynamicTunnel) sendScccn() error {
-	msg, err := newV2Scccn(dt.cfg)
-	if err != nil {
-		return err
-	}
-	return dt.xport.send(msg)
-}
-
 func (dt *dynamicTunnel) fsmActSendStopccn(args []interface{}) {
 
 	rc := fsmArgsToStopccnResult(args)
@@ -448,8 +1018,13 @@ func (dt *dynamicTunnel) fsmActSendStopccn(args []interface{}) {
 	dt.fsmActClose(args)
 }
 
-func (dt *dynamicTunnel) sendStopccn(rc *resultCode) error {
-	msg, err := newV2Stopccn(rc, dt.cfg)
+func (dt *dynamicTunnel) sendStopccn(rc *resultCode) (err error) {
+	var msg controlMessage
+	if dt.cfg.Version == ProtocolVersion2 {
+		msg, err = newV2Stopccn(rc, dt.cfg)
+	} else {
+		msg, err = newV3Stopccn(rc, dt.cfg)
+	}
 	if err != nil {
 		return err
 	}
@@ -489,29 +1064,219 @@ func (dt *dynamicTunnel) fsmActStartSession(args []interface{}) {
 
 func (dt *dynamicTunnel) fsmActForwardSessionMsg(args []interface{}) {
 
-	msg, _ := fsmArgsToV2MsgFrom(args)
+	msg, _ := fsmArgsToMsgFrom(args)
 
-	if s, ok := dt.findSessionByID(ControlConnID(msg.Sid())); ok {
+	sid, err := findLocalSessionID(msg)
+	if err != nil {
+		// Shouldn't occur since the session ID is mandatory
+		level.Error(dt.logger).Log(
+			"message", "failed to parse session ID from session message",
+			"message_type", msg.getType(),
+			"error", err)
+		return
+	}
+
+	if s, ok := dt.findSessionByID(sid); ok {
 		if ds, ok := s.(*dynamicSession); ok {
 			ds.handleCtlMsg(msg)
 		}
+	} else if msg.getType() == avpMsgTypeIcrq && sid == 0 {
+		dt.handleIcrq(msg)
+	} else if msg.getType() == avpMsgTypeOcrq && sid == 0 {
+		dt.handleOcrq(msg)
 	} else {
-		// TODO: on receipt of ICRQ we'll end up here; to handle this
-		// we'd need to be able to create an LNS-mode session instance
 		level.Error(dt.logger).Log(
 			"message", "received session message for unknown session",
 			"message_type", msg.getType(),
-			"session ID", msg.Sid())
+			"session ID", sid)
 	}
 }
 
-func (dt *dynamicTunnel) fsmActIgnoreMsg(args []interface{}) {
+// Handle an incoming call request from the peer.  The user decides
+// whether to accept the call: if they do, we create an LNS-mode session
+// instance to handle it, otherwise the call is rejected.
+func (dt *dynamicTunnel) handleIcrq(msg controlMessage) {
 
-	msg, _ := fsmArgsToV2MsgFrom(args)
+	psid, err := findPeerSessionID(msg)
+	if err != nil {
+		// Shouldn't occur since session ID is mandatory.  We can't send
+		// CDN without knowing the peer's session ID, so just drop the message.
+		level.Error(dt.logger).Log(
+			"message", "failed to parse peer session ID from ICRQ",
+			"error", err)
+		return
+	}
 
-	level.Warn(dt.logger).Log(
-		"message", "ignoring unimplemented v2 control message",
-		"message_type", msg.getType())
+	serial, err := findUint32Avp(msg.getAvps(), vendorIDIetf, avpTypeCallSerialNumber)
+	if err != nil {
+		// Shouldn't occur since call serial number is mandatory
+		level.Error(dt.logger).Log(
+			"message", "failed to parse call serial number from ICRQ",
+			"error", err)
+		return
+	}
+
+	call := &IncomingCall{
+		TunnelName:       dt.getName(),
+		Tunnel:           dt,
+		TunnelConfig:     dt.Config(),
+		PeerSessionID:    psid,
+		CallSerialNumber: serial,
+		Pseudowire:       PseudowireTypePPP,
+	}
+
+	if msg.protocolVersion() == ProtocolVersion3 {
+		pwtype, err := findUint16Avp(msg.getAvps(), vendorIDIetf, avpTypePseudowireType)
+		if err != nil {
+			// Shouldn't occur since pseudowire type is mandatory
+			level.Error(dt.logger).Log(
+				"message", "failed to parse pseudowire type from ICRQ",
+				"error", err)
+			return
+		}
+		call.Pseudowire = PseudowireType(pwtype)
+	}
+
+	// Optional AVPs: ignore errors since the AVP may legitimately be absent
+	call.BearerType, _ = findUint32Avp(msg.getAvps(), vendorIDIetf, avpTypeBearerType)
+	call.CallingNumber, _ = findStringAvp(msg.getAvps(), vendorIDIetf, avpTypeCallingNumber)
+	call.CalledNumber, _ = findStringAvp(msg.getAvps(), vendorIDIetf, avpTypeCalledNumber)
+	call.SubAddress, _ = findStringAvp(msg.getAvps(), vendorIDIetf, avpTypeSubAddress)
+
+	name, cfg, err := dt.parent.handleIncomingCall(call)
+	if err == nil {
+		err = dt.acceptIncomingCall(name, cfg, call, msg)
+	}
+	if err != nil {
+		level.Info(dt.logger).Log(
+			"message", "rejecting incoming call",
+			"peer_session_id", psid,
+			"call_serial_number", serial,
+			"error", err)
+		dt.rejectCall(psid, err)
+	}
+}
+
+func (dt *dynamicTunnel) acceptIncomingCall(name string, cfg *SessionConfig, call *IncomingCall, icrq controlMessage) (err error) {
+
+	// Must have configuration
+	if cfg == nil {
+		return fmt.Errorf("invalid nil config")
+	}
+
+	// L2TPv3 pseudowires must be of the type the peer asked for
+	if dt.cfg.Version == ProtocolVersion3 && v3PseudowireType(cfg) != uint16(call.Pseudowire) {
+		return fmt.Errorf("pseudowire type %v doesn't match requested type %v", cfg.Pseudowire, call.Pseudowire)
+	}
+
+	myCfg, err := dt.newSessionConfig(name, cfg)
+	if err != nil {
+		return err
+	}
+
+	myCfg.PeerSessionID = call.PeerSessionID
+
+	_, err = newDynamicLNSSession(call.CallSerialNumber, name, dt, myCfg, icrq)
+	return err
+}
+
+// Handle an outgoing call request from the peer.  As for incoming calls
+// the user decides whether to accept the call: if they do, we create a
+// LAC-mode outgoing call session instance to handle it, otherwise the
+// call is rejected.
+func (dt *dynamicTunnel) handleOcrq(msg controlMessage) {
+
+	psid, err := findPeerSessionID(msg)
+	if err != nil {
+		// Shouldn't occur since session ID is mandatory.  We can't send
+		// CDN without knowing the peer's session ID, so just drop the message.
+		level.Error(dt.logger).Log(
+			"message", "failed to parse peer session ID from OCRQ",
+			"error", err)
+		return
+	}
+
+	call := &OutgoingCall{
+		TunnelName:    dt.getName(),
+		Tunnel:        dt,
+		TunnelConfig:  dt.Config(),
+		PeerSessionID: psid,
+	}
+
+	// Mandatory AVPs: message validation has already checked for these
+	avps := msg.getAvps()
+	call.CallSerialNumber, _ = findUint32Avp(avps, vendorIDIetf, avpTypeCallSerialNumber)
+	call.MinimumBPS, _ = findUint32Avp(avps, vendorIDIetf, avpTypeMinimumBps)
+	call.MaximumBPS, _ = findUint32Avp(avps, vendorIDIetf, avpTypeMaximumBps)
+	call.BearerType, _ = findUint32Avp(avps, vendorIDIetf, avpTypeBearerType)
+	framing, _ := findUint32Avp(avps, vendorIDIetf, avpTypeFramingType)
+	call.FramingType = FramingCapability(framing)
+	call.CalledNumber, _ = findStringAvp(avps, vendorIDIetf, avpTypeCalledNumber)
+
+	// Optional AVPs
+	call.SubAddress, _ = findStringAvp(avps, vendorIDIetf, avpTypeSubAddress)
+
+	name, cfg, err := dt.parent.handleOutgoingCall(call)
+	if err == nil {
+		err = dt.acceptOutgoingCall(name, cfg, call, msg)
+	}
+	if err != nil {
+		level.Info(dt.logger).Log(
+			"message", "rejecting outgoing call",
+			"peer_session_id", psid,
+			"call_serial_number", call.CallSerialNumber,
+			"error", err)
+		dt.rejectCall(psid, err)
+	}
+}
+
+func (dt *dynamicTunnel) acceptOutgoingCall(name string, cfg *SessionConfig, call *OutgoingCall, ocrq controlMessage) (err error) {
+
+	myCfg, err := dt.newSessionConfig(name, cfg)
+	if err != nil {
+		return err
+	}
+
+	myCfg.PeerSessionID = call.PeerSessionID
+
+	_, err = newDynamicLACOutgoingSession(call.CallSerialNumber, name, dt, myCfg, ocrq)
+	return err
+}
+
+func (dt *dynamicTunnel) rejectCall(psid ControlConnID, reason error) {
+
+	rc := &resultCode{
+		result:  avpCDNResultCodeNoResources,
+		errCode: avpErrorCodeNoError,
+		errMsg:  reason.Error(),
+	}
+
+	var msg controlMessage
+	var err error
+	scfg := &SessionConfig{PeerSessionID: psid}
+	if dt.cfg.Version == ProtocolVersion2 {
+		msg, err = newV2Cdn(dt.cfg.PeerTunnelID, rc, scfg)
+	} else {
+		msg, err = newV3Cdn(dt.cfg.PeerTunnelID, rc, scfg)
+	}
+	if err != nil {
+		level.Error(dt.logger).Log(
+			"message", "failed to build CDN message",
+			"error", err)
+		return
+	}
+
+	// Don't block the tunnel goroutine pending the peer's ack
+	dt.sessionTxWg.Add(1)
+	go func() {
+		defer dt.sessionTxWg.Done()
+		err := dt.xport.send(msg)
+		if err != nil {
+			level.Error(dt.logger).Log(
+				"message", "failed to send CDN message",
+				"error", err)
+		}
+	}()
 }
 
 // Closes all tunnel resources and unlinks child sessions.
@@ -531,12 +1296,15 @@ func (dt *dynamicTunnel) fsmActClose(args []interface{}) {
 
 		dt.closeAllSessions()
 
+		dt.dpLock.Lock()
 		if dt.dp != nil {
 			err := dt.dp.Down()
 			if err != nil {
 				level.Error(dt.logger).Log("message", "dataplane down failed", "error", err)
 			}
+			dt.dp = nil
 		}
+		dt.dpLock.Unlock()
 		if dt.xport != nil {
 			dt.xport.close()
 		}
@@ -552,6 +1320,7 @@ func (dt *dynamicTunnel) fsmActClose(args []interface{}) {
 				Config:       dt.cfg,
 				LocalAddress: dt.sal,
 				PeerAddress:  dt.sap,
+				Result:       dt.result,
 			})
 		}
 
@@ -560,28 +1329,87 @@ func (dt *dynamicTunnel) fsmActClose(args []interface{}) {
 	}
 }
 
-// Create a new client/LAC mode tunnel instance running the full control protocol
-func newDynamicTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg *TunnelConfig) (dt *dynamicTunnel, err error) {
-
-	// Currently only handle L2TPv2
-	if cfg.Version != ProtocolVersion2 {
-		return nil, fmt.Errorf("L2TPv3 dynamic tunnels are not (yet) supported")
-	}
-
-	dt = &dynamicTunnel{
+func newBaseDynamicTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg *TunnelConfig) *dynamicTunnel {
+	return &dynamicTunnel{
 		baseTunnel: newBaseTunnel(
 			log.With(parent.logger, "tunnel_name", name),
 			name,
 			parent,
 			cfg),
-		sal:       sal,
-		sap:       sap,
-		closeChan: make(chan bool),
-		sendChan:  make(chan *sendMsg),
-		eventChan: make(chan *eventArgs),
+		sal:            sal,
+		sap:            sap,
+		closeChan:      make(chan bool),
+		dpDeleted:      make(chan bool, 1),
+		sendChan:       make(chan *sendMsg),
+		eventChan:      make(chan *eventArgs),
+		tieBreakerChan: make(chan bool, 1),
 	}
+}
 
-	// Ref: RFC2661 section 7.2.1
+func (dt *dynamicTunnel) initTransport() (err error) {
+	// RFC2661 AVP hiding uses the shared secret directly, whereas RFC3931
+	// derives a key from it: we only implement the former.
+	var hideSecret, unhideSecret []byte
+	if dt.cfg.Version == ProtocolVersion2 {
+		unhideSecret = dt.cfg.Secret
+		if dt.cfg.HideAVPs {
+			hideSecret = dt.cfg.Secret
+		}
+	}
+	if dt.cfg.Version == ProtocolVersion3 && len(dt.cfg.Secret) > 0 {
+		dt.msgAuth, err = newMessageAuth(dt.cfg.DigestType, dt.cfg.Secret)
+		if err != nil {
+			return err
+		}
+	}
+	dt.xport, err = newTransport(dt.logger, dt.cp, transportConfig{
+		HelloTimeout:      dt.cfg.HelloTimeout,
+		TxWindowSize:      dt.cfg.WindowSize,
+		MaxRetries:        dt.cfg.MaxRetries,
+		RetryTimeout:      dt.cfg.RetryTimeout,
+		AckTimeout:        time.Millisecond * 100,
+		Version:           dt.cfg.Version,
+		PeerControlConnID: dt.cfg.PeerTunnelID,
+		HideAVPsSecret:    hideSecret,
+		UnhideAVPsSecret:  unhideSecret,
+		MessageAuth:       dt.msgAuth,
+		Capture:           &dt.parent.capture,
+		Observers:         &dt.parent.observers,
+		TunnelName:        dt.name,
+	})
+	return
+}
+
+// Create a new client/LAC mode tunnel instance running the full control protocol
+func newDynamicTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg *TunnelConfig) (dt *dynamicTunnel, err error) {
+
+	cp, err := newL2tpControlPlane(parent.netns, sal, sap, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cp.bind()
+	if err != nil {
+		cp.close()
+		return nil, err
+	}
+
+	return newDynamicTunnelWithControlPlane(name, parent, sal, sap, cfg, cp)
+}
+
+// Create a new client/LAC mode tunnel instance which uses the control plane
+// passed in.  The tunnel takes ownership of the control plane.
+func newDynamicTunnelWithControlPlane(name string, parent *Context, sal, sap unix.Sockaddr, cfg *TunnelConfig, cp controlPlane) (dt *dynamicTunnel, err error) {
+
+	if cfg.Version != ProtocolVersion2 && cfg.Version != ProtocolVersion3 {
+		cp.close()
+		return nil, fmt.Errorf("unsupported protocol version %v for dynamic tunnel", cfg.Version)
+	}
+
+	dt = newBaseDynamicTunnel(name, parent, sal, sap, cfg)
+	dt.cp = cp
+
+	// Ref: RFC2661 section 7.2.1, RFC3931 section 3.3
 	dt.fsm = fsm{
 		current: "idle",
 		table: []eventDesc{
@@ -592,6 +1420,8 @@ func newDynamicTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg
 			// waitctlreply is for when we've sent an sccrq to the peer and are waiting on the reply
 			{from: "waitctlreply", events: []string{"sccrp"}, cb: dt.fsmActOnSccrp, to: "established"},
 			{from: "waitctlreply", events: []string{"stopccn"}, cb: dt.fsmActOnStopccn, to: "dead"},
+			// the loser of a tie break is silently discarded
+			{from: "waitctlreply", events: []string{"tiebreaklost"}, cb: dt.fsmActClose, to: "dead"},
 			{from: "waitctlreply", events: []string{"newsession"}, cb: dt.fsmActLinkSession, to: "waitctlreply"},
 			// TODO: don't really expect session messages: OK to ignore?
 			{from: "waitctlreply", events: []string{"sessionmsg"}, cb: nil, to: "waitctlreply"},
@@ -605,18 +1435,95 @@ func newDynamicTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg
 				cb: dt.fsmActSendStopccn,
 				to: "dead",
 			},
+		},
+	}
+	dt.fsm.table = append(dt.fsm.table, dt.establishedFsmTable()...)
+
+	dt.tieBreaker = make([]byte, tieBreakerLen)
+	_, err = rand.Read(dt.tieBreaker)
+	if err != nil {
+		dt.cp.close()
+		return nil, fmt.Errorf("failed to generate tie breaker: %v", err)
+	}
+
+	err = dt.initTransport()
+	if err != nil {
+		dt.cp.close()
+		dt.Close()
+		return nil, err
+	}
+
+	dt.wg.Add(1)
+	go dt.runTunnel(&eventArgs{event: "open"})
+
+	return
+}
+
+// Create a new server/LNS mode tunnel instance running the full control protocol.
+//
+// The tunnel instance is created in response to the SCCRQ message passed in,
+// which has been received by a listener bound to the local address.
+func newDynamicLNSTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg *TunnelConfig, sccrq controlMessage) (dt *dynamicTunnel, err error) {
+
+	// The tunnel socket shares the listener's local address, and is
+	// connected to the peer so that the kernel delivers the peer's
+	// frames to it rather than to the listener socket.
+	cp, err := newL2tpControlPlane(parent.netns, sal, sap, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cp.reuseAddr()
+	if err != nil {
+		cp.close()
+		return nil, fmt.Errorf("failed to set SO_REUSEADDR: %v", err)
+	}
+
+	err = cp.bind()
+	if err != nil {
+		cp.close()
+		return nil, err
+	}
+
+	err = cp.connect()
+	if err != nil {
+		cp.close()
+		return nil, err
+	}
+
+	return newDynamicLNSTunnelWithControlPlane(name, parent, sal, sap, cfg, cp, sccrq)
+}
+
+// Create a new server/LNS mode tunnel instance which uses the control plane
+// passed in.  The tunnel takes ownership of the control plane.
+func newDynamicLNSTunnelWithControlPlane(name string, parent *Context, sal, sap unix.Sockaddr, cfg *TunnelConfig, cp controlPlane, sccrq controlMessage) (dt *dynamicTunnel, err error) {
+
+	if cfg.Version != ProtocolVersion2 && cfg.Version != ProtocolVersion3 {
+		cp.close()
+		return nil, fmt.Errorf("unsupported protocol version %v for dynamic tunnel", cfg.Version)
+	}
 
-			// established is for once the tunnel three-way handshake is complete
-			{from: "established", events: []string{"stopccn"}, cb: dt.fsmActOnStopccn, to: "dead"},
-			{from: "established", events: []string{"newsession"}, cb: dt.fsmActStartSession, to: "established"},
-			{from: "established", events: []string{"sessionmsg"}, cb: dt.fsmActForwardSessionMsg, to: "established"},
-			{from: "established", events: []string{"sli", "wen"}, cb: dt.fsmActIgnoreMsg, to: "established"},
+	dt = newBaseDynamicTunnel(name, parent, sal, sap, cfg)
+	dt.cp = cp
+
+	// Ref: RFC2661 section 7.2.1, RFC3931 section 3.3
+	dt.fsm = fsm{
+		current: "idle",
+		table: []eventDesc{
+			// The listener only creates a tunnel on receipt of an sccrq, which
+			// kicks off the FSM
+			{from: "idle", events: []string{"sccrq"}, cb: dt.fsmActOnSccrq, to: "waitctlconn"},
+
+			// waitctlconn is for when we've sent an sccrp to the peer and are waiting on the scccn
+			{from: "waitctlconn", events: []string{"scccn"}, cb: dt.fsmActOnScccn, to: "established"},
+			{from: "waitctlconn", events: []string{"stopccn"}, cb: dt.fsmActOnStopccn, to: "dead"},
+			{from: "waitctlconn", events: []string{"newsession"}, cb: dt.fsmActLinkSession, to: "waitctlconn"},
+			{from: "waitctlconn", events: []string{"sessionmsg"}, cb: nil, to: "waitctlconn"},
 			{
-				from: "established",
+				from: "waitctlconn",
 				events: []string{
 					"sccrq",
 					"sccrp",
-					"scccn",
 					"close",
 				},
 				cb: dt.fsmActSendStopccn,
@@ -624,35 +1531,46 @@ func newDynamicTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg
 			},
 		},
 	}
+	dt.fsm.table = append(dt.fsm.table, dt.establishedFsmTable()...)
 
-	dt.cp, err = newL2tpControlPlane(sal, sap)
+	err = dt.initTransport()
 	if err != nil {
+		dt.cp.close()
 		dt.Close()
 		return nil, err
 	}
 
-	err = dt.cp.bind()
-	if err != nil {
-		dt.Close()
-		return nil, err
-	}
-
-	dt.xport, err = newTransport(dt.logger, dt.cp, transportConfig{
-		HelloTimeout:      dt.cfg.HelloTimeout,
-		TxWindowSize:      dt.cfg.WindowSize,
-		MaxRetries:        dt.cfg.MaxRetries,
-		RetryTimeout:      dt.cfg.RetryTimeout,
-		AckTimeout:        time.Millisecond * 100,
-		Version:           dt.cfg.Version,
-		PeerControlConnID: dt.cfg.PeerTunnelID,
-	})
-	if err != nil {
-		dt.Close()
-		return nil, err
+	// The SCCRQ was received by the listener rather than our transport,
+	// but we need to ack it all the same.  It also carries the peer's
+	// nonce for message authentication.
+	dt.xport.accept(sccrq)
+	if dt.msgAuth != nil {
+		dt.msgAuth.learnPeerNonce(sccrq)
 	}
 
 	dt.wg.Add(1)
-	go dt.runTunnel()
+	go dt.runTunnel(&eventArgs{event: "sccrq", args: []interface{}{sccrq, sap}})
 
 	return
 }
+
+// The established state is common to both LAC and LNS mode tunnels
+func (dt *dynamicTunnel) establishedFsmTable() []eventDesc {
+	return []eventDesc{
+		// established is for once the tunnel three-way handshake is complete
+		{from: "established", events: []string{"stopccn"}, cb: dt.fsmActOnStopccn, to: "dead"},
+		{from: "established", events: []string{"newsession"}, cb: dt.fsmActStartSession, to: "established"},
+		{from: "established", events: []string{"sessionmsg"}, cb: dt.fsmActForwardSessionMsg, to: "established"},
+		{
+			from: "established",
+			events: []string{
+				"sccrq",
+				"sccrp",
+				"scccn",
+				"close",
+			},
+			cb: dt.fsmActSendStopccn,
+			to: "dead",
+		},
+	}
+}
@@ -0,0 +1,334 @@
+package l2tp
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/sys/unix"
+)
+
+type listener struct {
+	logger log.Logger
+	parent *Context
+	cfg    *TunnelConfig
+	sal    unix.Sockaddr
+	cp     *socketControlPlane
+	peers  map[string]tunnel
+	auth   *messageAuth
+	wg     sync.WaitGroup
+}
+
+func (l *listener) Close() {
+	if l != nil {
+		l.parent.unlinkListener(l)
+		l.cp.close()
+		l.wg.Wait()
+		level.Info(l.logger).Log("message", "close")
+	}
+}
+
+func (l *listener) run() {
+	defer l.wg.Done()
+
+	level.Info(l.logger).Log(
+		"message", "new listener",
+		"version", l.cfg.Version,
+		"encap", l.cfg.Encap,
+		"local", sockaddrString(l.sal))
+
+	for {
+		b := make([]byte, 4096)
+		n, from, err := l.cp.recvFrom(b)
+		if err != nil {
+			level.Debug(l.logger).Log(
+				"message", "socket read failed",
+				"error", err)
+			return
+		}
+		l.handleFrame(b[:n], from)
+	}
+}
+
+func (l *listener) handleFrame(b []byte, from unix.Sockaddr) {
+	err := l.parent.capture.capture(b, from, l.sal, false)
+	if err != nil {
+		level.Error(l.logger).Log(
+			"message", "frame capture failed",
+			"error", err)
+	}
+
+	messages, err := parseMessageBuffer(b)
+	if err != nil {
+		level.Error(l.logger).Log(
+			"message", "frame receive failed",
+			"peer", sockaddrString(from),
+			"error", err)
+		return
+	}
+
+	for _, m := range messages {
+		if m.protocolVersion() != l.cfg.Version {
+			level.Error(l.logger).Log(
+				"message", "received control message with wrong protocol version",
+				"peer", sockaddrString(from),
+				"expected", l.cfg.Version,
+				"got", m.protocolVersion())
+			continue
+		}
+		l.handleMsg(m, from)
+	}
+}
+
+func (l *listener) handleMsg(msg controlMessage, from unix.Sockaddr) {
+
+	var tid ControlConnID
+	switch m := msg.(type) {
+	case *v2ControlMessage:
+		tid = ControlConnID(m.Tid())
+	case *v3ControlMessage:
+		tid = ControlConnID(m.ControlConnectionID())
+	}
+
+	// Once a tunnel is accepted its control messages are delivered to
+	// the tunnel socket.  Anything else arriving at the listener is either
+	// a retransmit which raced with tunnel creation, or was mis-delivered,
+	// so we just drop it.
+	if msg.getType() != avpMsgTypeSccrq || tid != 0 || msg.ns() != 0 {
+		level.Debug(l.logger).Log(
+			"message", "ignoring control message",
+			"peer", sockaddrString(from),
+			"message_type", msg.getType(),
+			"tunnel_id", tid)
+		return
+	}
+
+	// RFC3931 section 4.3: silently discard messages which fail
+	// authentication.
+	if l.auth != nil {
+		err := l.auth.verify(msg)
+		if err != nil {
+			level.Debug(l.logger).Log(
+				"message", "dropping SCCRQ which failed authentication",
+				"peer", sockaddrString(from),
+				"error", err)
+			return
+		}
+	}
+
+	err := unhideMsgAvps(msg, l.cfg.Secret)
+	if err != nil {
+		level.Error(l.logger).Log(
+			"message", "failed to unhide AVPs",
+			"peer", sockaddrString(from),
+			"message_type", msg.getType(),
+			"error", err)
+		return
+	}
+
+	err = msg.validate()
+	if err != nil {
+		level.Error(l.logger).Log(
+			"message", "bad control message",
+			"peer", sockaddrString(from),
+			"message_type", msg.getType(),
+			"error", err)
+		return
+	}
+
+	ptid, err := findPeerControlConnID(msg)
+	if err != nil {
+		level.Error(l.logger).Log(
+			"message", "failed to parse peer tunnel ID from SCCRQ",
+			"peer", sockaddrString(from),
+			"error", err)
+		return
+	}
+
+	// The peer will retransmit SCCRQ if our SCCRP is delayed: don't
+	// create more than one tunnel for a given control connection.
+	l.prunePeers()
+	key := fmt.Sprintf("%s/%d", sockaddrString(from), ptid)
+	if _, ok := l.peers[key]; ok {
+		level.Debug(l.logger).Log(
+			"message", "ignoring duplicate SCCRQ",
+			"peer", sockaddrString(from),
+			"peer_tunnel_id", ptid)
+		return
+	}
+
+	if l.peerLosesTieBreak(msg, from) {
+		level.Info(l.logger).Log(
+			"message", "dropping SCCRQ which lost tie break",
+			"peer", sockaddrString(from),
+			"peer_tunnel_id", ptid)
+		return
+	}
+
+	t, err := l.accept(msg, from, ptid)
+	if err != nil {
+		level.Error(l.logger).Log(
+			"message", "failed to accept control connection",
+			"peer", sockaddrString(from),
+			"error", err)
+		return
+	}
+
+	l.peers[key] = t
+}
+
+// Forget about tunnels which have since been closed
+func (l *listener) prunePeers() {
+	for key, t := range l.peers {
+		if tt, ok := l.parent.findTunnelByName(t.getName()); !ok || tt != t {
+			delete(l.peers, key)
+		}
+	}
+}
+
+// If we have an SCCRQ outstanding to the peer, use the Tie Breaker AVP
+// to decide which control connection survives.  Any of our tunnels which
+// lose are discarded, and if the peer loses we must drop its SCCRQ.
+// Ref: RFC2661 section 4.4.3
+func (l *listener) peerLosesTieBreak(msg controlMessage, from unix.Sockaddr) (peerLoses bool) {
+	// Tie Breaker AVP is optional
+	peerTieBreaker, _ := findBytesAvp(msg.getAvps(), vendorIDIetf, avpTypeTiebreaker)
+
+	for _, t := range l.parent.allTunnels() {
+		dt, ok := t.(*dynamicTunnel)
+		if !ok || dt.cfg.Version != l.cfg.Version || !sockaddrSameHost(dt.sap, from) {
+			continue
+		}
+		if dt.resolveTieBreak(peerTieBreaker) {
+			peerLoses = true
+		}
+	}
+	return
+}
+
+func (l *listener) accept(msg controlMessage, from unix.Sockaddr, ptid ControlConnID) (dt *dynamicTunnel, err error) {
+
+	// Duplicate the configuration so we don't modify the template
+	myCfg := *l.cfg
+
+	myCfg.TunnelID, err = l.parent.allocTid(myCfg.Version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate a TID: %v", err)
+	}
+	myCfg.Local = sockaddrString(l.sal)
+	myCfg.Peer = sockaddrString(from)
+
+	name := fmt.Sprintf("lns-%d", myCfg.TunnelID)
+	if _, ok := l.parent.findTunnelByName(name); ok {
+		return nil, fmt.Errorf("already have tunnel %q", name)
+	}
+
+	sal, sap := tunnelAddressPair(l.sal, from, myCfg.TunnelID, ptid)
+
+	dt, err = newDynamicLNSTunnel(name, l.parent, sal, sap, &myCfg, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	l.parent.linkTunnel(dt)
+
+	return dt, nil
+}
+
+// Derive the addresses for an accepted tunnel from the listener address
+// and the peer address the SCCRQ arrived from.
+//
+// UDP tunnel sockets simply share the listener address.  IP encapsulation
+// demultiplexes control messages by connection ID rather than by port, so
+// for IP each tunnel socket is bound using its own control connection ID.
+func tunnelAddressPair(sal, from unix.Sockaddr, tid, ptid ControlConnID) (unix.Sockaddr, unix.Sockaddr) {
+	switch sal := sal.(type) {
+	case *unix.SockaddrL2TPIP:
+		tsal := *sal
+		tsal.ConnId = uint32(tid)
+		if from, ok := from.(*unix.SockaddrL2TPIP); ok {
+			tsap := *from
+			tsap.ConnId = uint32(ptid)
+			return &tsal, &tsap
+		}
+		return &tsal, from
+	case *unix.SockaddrL2TPIP6:
+		tsal := *sal
+		tsal.ConnId = uint32(tid)
+		if from, ok := from.(*unix.SockaddrL2TPIP6); ok {
+			tsap := *from
+			tsap.ConnId = uint32(ptid)
+			return &tsal, &tsap
+		}
+		return &tsal, from
+	}
+	return sal, from
+}
+
+// Check whether two addresses refer to the same host, ignoring the port
+func sockaddrSameHost(a, b unix.Sockaddr) bool {
+	aaddr, _, err := sockaddrAddrPort(a)
+	if err != nil {
+		return false
+	}
+	baddr, _, err := sockaddrAddrPort(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(aaddr, baddr)
+}
+
+// Create a new listener to accept incoming control connections
+func newListener(parent *Context, sal unix.Sockaddr, cfg *TunnelConfig) (l *listener, err error) {
+
+	var auth *messageAuth
+	if cfg.Version == ProtocolVersion3 && len(cfg.Secret) > 0 {
+		auth, err = newMessageAuth(cfg.DigestType, cfg.Secret)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cp, err := newL2tpControlPlane(parent.netns, sal, nil, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cp.reuseAddr()
+	if err != nil {
+		cp.close()
+		return nil, fmt.Errorf("failed to set SO_REUSEADDR: %v", err)
+	}
+
+	err = cp.bind()
+	if err != nil {
+		cp.close()
+		return nil, err
+	}
+
+	// The listener address may not specify the port, in which case
+	// we need to find out what we were assigned by the kernel so that
+	// tunnel sockets can share it.
+	sal, err = cp.getLocalAddr()
+	if err != nil {
+		cp.close()
+		return nil, err
+	}
+
+	l = &listener{
+		logger: log.With(parent.logger, "listener", sockaddrString(sal)),
+		parent: parent,
+		cfg:    cfg,
+		sal:    sal,
+		cp:     cp,
+		peers:  make(map[string]tunnel),
+		auth:   auth,
+	}
+
+	l.wg.Add(1)
+	go l.run()
+
+	return
+}
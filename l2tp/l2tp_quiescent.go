@@ -13,10 +13,11 @@ import (
 type quiescentTunnel struct {
 	*baseTunnel
 	sal, sap  unix.Sockaddr
-	cp        *controlPlane
+	cp        *socketControlPlane
 	xport     *transport
 	dp        TunnelDataPlane
 	closeChan chan bool
+	closeOnce sync.Once
 	wg        sync.WaitGroup
 }
 
@@ -27,6 +28,11 @@ func (qt *quiescentTunnel) NewSession(name string, cfg *SessionConfig) (Session,
 		return nil, fmt.Errorf("invalid nil config")
 	}
 
+	err := checkSessionVlanConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	// Duplicate the configuration so we don't modify the user's copy
 	myCfg := *cfg
 
@@ -48,14 +54,37 @@ func (qt *quiescentTunnel) NewSession(name string, cfg *SessionConfig) (Session,
 	return s, nil
 }
 
+func (qt *quiescentTunnel) SetDebugFlags(flags DebugFlags) error {
+	return qt.setDebugFlags(qt.dp, flags)
+}
+
+func (qt *quiescentTunnel) Statistics() (*TunnelDataPlaneStatistics, error) {
+	if qt.dp == nil {
+		return nil, fmt.Errorf("tunnel data plane not instantiated")
+	}
+	return qt.dp.GetStatistics()
+}
+
+func (qt *quiescentTunnel) State() string {
+	return "established"
+}
+
 func (qt *quiescentTunnel) Close() {
 	if qt != nil {
-		close(qt.closeChan)
-		qt.wg.Wait()
-		qt.close()
+		qt.closeOnce.Do(func() {
+			close(qt.closeChan)
+			qt.wg.Wait()
+			qt.close()
+		})
 	}
 }
 
+func (qt *quiescentTunnel) onDataPlaneDeleted() {
+	level.Info(qt.logger).Log("message", "data plane deleted externally")
+	qt.setDataPlaneDeleted()
+	qt.Close()
+}
+
 func (qt *quiescentTunnel) close() {
 	if qt != nil {
 		qt.baseTunnel.closeAllSessions()
@@ -66,9 +95,11 @@ func (qt *quiescentTunnel) close() {
 		if qt.cp != nil {
 			qt.cp.close()
 		}
-		if qt.dp != nil {
+		if qt.dp != nil && !qt.isDataPlaneDeleted() {
 			err := qt.dp.Down()
-			level.Error(qt.logger).Log("message", "dataplane down failed", "error", err)
+			if err != nil {
+				level.Error(qt.logger).Log("message", "dataplane down failed", "error", err)
+			}
 		}
 
 		qt.parent.unlinkTunnel(qt)
@@ -86,8 +117,8 @@ func (qt *quiescentTunnel) xportReader() {
 		select {
 		case <-qt.closeChan:
 			return
-		case _, ok := <-qt.xport.recvChan:
-			if !ok {
+		case m, ok := <-qt.xport.recvChan:
+			if !ok || m.err != nil {
 				qt.close()
 				return
 			}
@@ -109,7 +140,7 @@ func newQuiescentTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cf
 
 	// Initialise the control plane.
 	// We bind/connect immediately since we're not runnning most of the control protocol.
-	qt.cp, err = newL2tpControlPlane(sal, sap)
+	qt.cp, err = newL2tpControlPlane(parent.netns, sal, sap, qt.cfg)
 	if err != nil {
 		qt.Close()
 		return nil, err
@@ -141,6 +172,9 @@ func newQuiescentTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cf
 		AckTimeout:        time.Millisecond * 100,
 		Version:           qt.cfg.Version,
 		PeerControlConnID: qt.cfg.PeerTunnelID,
+		Capture:           &qt.parent.capture,
+		Observers:         &qt.parent.observers,
+		TunnelName:        qt.name,
 	})
 	if err != nil {
 		qt.Close()
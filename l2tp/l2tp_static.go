@@ -2,6 +2,7 @@ package l2tp
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -10,13 +11,18 @@ import (
 
 type staticTunnel struct {
 	*baseTunnel
-	dp TunnelDataPlane
+	cp        *socketControlPlane
+	dp        TunnelDataPlane
+	closeOnce sync.Once
 }
 
 type staticSession struct {
 	*baseSession
-	dp     SessionDataPlane
-	ifname string
+	dp        SessionDataPlane
+	ifname    string
+	closeLock sync.Mutex
+	isClosed  bool
+	dpDeleted bool
 }
 
 func (st *staticTunnel) NewSession(name string, cfg *SessionConfig) (Session, error) {
@@ -34,6 +40,11 @@ func (st *staticTunnel) NewSession(name string, cfg *SessionConfig) (Session, er
 		return nil, fmt.Errorf("peer session ID must be non-zero")
 	}
 
+	err := checkSessionVlanConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	// Clashes of name or session ID are not allowed
 	if _, ok := st.findSessionByName(name); ok {
 		return nil, fmt.Errorf("already have session %q", name)
@@ -57,20 +68,33 @@ func (st *staticTunnel) NewSession(name string, cfg *SessionConfig) (Session, er
 
 func (st *staticTunnel) Close() {
 	if st != nil {
+		st.closeOnce.Do(st.close)
+	}
+}
 
-		st.baseTunnel.closeAllSessions()
+func (st *staticTunnel) close() {
+	st.baseTunnel.closeAllSessions()
 
-		if st.dp != nil {
-			err := st.dp.Down()
-			if err != nil {
-				level.Error(st.logger).Log("message", "dataplane down failed", "error", err)
-			}
+	if st.dp != nil && !st.isDetached() && !st.isDataPlaneDeleted() {
+		err := st.dp.Down()
+		if err != nil {
+			level.Error(st.logger).Log("message", "dataplane down failed", "error", err)
 		}
+	}
 
-		st.parent.unlinkTunnel(st)
-
-		level.Info(st.logger).Log("message", "close")
+	if st.cp != nil {
+		st.cp.close()
 	}
+
+	st.parent.unlinkTunnel(st)
+
+	level.Info(st.logger).Log("message", "close")
+}
+
+func (st *staticTunnel) onDataPlaneDeleted() {
+	level.Info(st.logger).Log("message", "data plane deleted externally")
+	st.setDataPlaneDeleted()
+	st.Close()
 }
 
 func newStaticTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg *TunnelConfig) (st *staticTunnel, err error) {
@@ -82,7 +106,34 @@ func newStaticTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg *
 			cfg),
 	}
 
-	st.dp, err = parent.dp.NewTunnel(st.cfg, sal, sap, -1)
+	// The kernel creates the socket for a static tunnel, but it can't
+	// apply socket options or IPv6 zones to it.  If these are needed,
+	// create the socket here and pass it to the kernel instead.  The
+	// socket must remain open for the lifetime of the tunnel.
+	fd := -1
+	if staticTunnelNeedsSocket(cfg, sal, sap) {
+		st.cp, err = newL2tpControlPlane(parent.netns, sal, sap, st.cfg)
+		if err != nil {
+			st.Close()
+			return nil, err
+		}
+
+		err = st.cp.bind()
+		if err != nil {
+			st.Close()
+			return nil, err
+		}
+
+		err = st.cp.connect()
+		if err != nil {
+			st.Close()
+			return nil, err
+		}
+
+		fd = st.cp.fd
+	}
+
+	st.dp, err = parent.dp.NewTunnel(st.cfg, sal, sap, fd)
 	if err != nil {
 		st.Close()
 		return nil, err
@@ -100,6 +151,14 @@ func newStaticTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg *
 	return
 }
 
+func staticTunnelNeedsSocket(cfg *TunnelConfig, sal, sap unix.Sockaddr) bool {
+	return cfg.BindInterface != "" ||
+		cfg.VRF != "" ||
+		cfg.FwMark != 0 ||
+		sockaddrZoneID(sal) != 0 ||
+		sockaddrZoneID(sap) != 0
+}
+
 func newStaticSession(name string, parent tunnel, cfg *SessionConfig) (ss *staticSession, err error) {
 
 	tid := parent.getCfg().TunnelID
@@ -143,8 +202,54 @@ func newStaticSession(name string, parent tunnel, cfg *SessionConfig) (ss *stati
 	return
 }
 
+func (st *staticTunnel) SetDebugFlags(flags DebugFlags) error {
+	return st.setDebugFlags(st.dp, flags)
+}
+
+func (st *staticTunnel) Statistics() (*TunnelDataPlaneStatistics, error) {
+	if st.dp == nil {
+		return nil, fmt.Errorf("tunnel data plane not instantiated")
+	}
+	return st.dp.GetStatistics()
+}
+
+func (st *staticTunnel) State() string {
+	return "established"
+}
+
+func (ss *staticSession) State() string {
+	return "established"
+}
+
+func (ss *staticSession) Statistics() (*SessionDataPlaneStatistics, error) {
+	if ss.dp == nil {
+		return nil, fmt.Errorf("session data plane not instantiated")
+	}
+	return ss.dp.GetStatistics()
+}
+
+func (ss *staticSession) Reconfigure(cfg *SessionConfig) error {
+	return ss.reconfigure(ss.dp, cfg)
+}
+
 func (ss *staticSession) Close() {
-	if ss.dp != nil {
+	ss.closeLock.Lock()
+	if ss.isClosed {
+		ss.closeLock.Unlock()
+		return
+	}
+	ss.isClosed = true
+	dpDeleted := ss.dpDeleted
+	ss.closeLock.Unlock()
+
+	var result string
+	if dpDeleted {
+		result = "session data plane deleted externally"
+	} else if ss.parent.isDataPlaneDeleted() {
+		result = "tunnel data plane deleted externally"
+	}
+
+	if ss.dp != nil && !ss.parent.isDetached() && result == "" {
 		err := ss.dp.Down()
 		if err != nil {
 			level.Error(ss.logger).Log("message", "dataplane down failed", "error", err)
@@ -159,12 +264,21 @@ func (ss *staticSession) Close() {
 		Session:       ss,
 		SessionConfig: ss.cfg,
 		InterfaceName: ss.ifname,
+		Result:        result,
 	})
 
 	ss.parent.unlinkSession(ss)
 	level.Info(ss.logger).Log("message", "close")
 }
 
+func (ss *staticSession) onDataPlaneDeleted() {
+	level.Info(ss.logger).Log("message", "data plane deleted externally")
+	ss.closeLock.Lock()
+	ss.dpDeleted = true
+	ss.closeLock.Unlock()
+	ss.Close()
+}
+
 func (ss *staticSession) kill() {
 	ss.Close()
 }
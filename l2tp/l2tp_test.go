@@ -3,14 +3,18 @@ package l2tp
 import (
 	"bytes"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"os/user"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"golang.org/x/sys/unix"
 )
 
 // Must be called with root permissions
@@ -397,6 +401,644 @@ func TestRequiresRoot(t *testing.T) {
 	}
 }
 
+func TestSessionReconfigure(t *testing.T) {
+	ctx, err := NewContext(nil, level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug()))
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	tcfg := &TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "localhost:5000",
+		Version:      ProtocolVersion3,
+		TunnelID:     62719,
+		PeerTunnelID: 23121,
+		Encap:        EncapTypeUDP,
+	}
+	tunl, err := ctx.NewStaticTunnel("t1", tcfg)
+	if err != nil {
+		t.Fatalf("NewStaticTunnel(%v): %v", tcfg, err)
+	}
+
+	scfg := &SessionConfig{
+		SessionID:     12345,
+		PeerSessionID: 54321,
+		Pseudowire:    PseudowireTypeEth,
+		Cookie:        []byte{0x34, 0x04, 0xa9, 0xbe},
+	}
+	sess, err := tunl.NewSession("s1", scfg)
+	if err != nil {
+		t.Fatalf("NewSession(%v): %v", scfg, err)
+	}
+
+	err = tunl.SetDebugFlags(DebugFlagsControl)
+	if err != nil {
+		t.Fatalf("SetDebugFlags(): %v", err)
+	}
+	if tunl.Config().DebugFlags != DebugFlagsControl {
+		t.Errorf("SetDebugFlags(): expected flags %v, got %v", DebugFlagsControl, tunl.Config().DebugFlags)
+	}
+
+	cases := []struct {
+		name       string
+		modify     func(cfg *SessionConfig)
+		expectFail bool
+	}{
+		{
+			name: "enable sequence numbers",
+			modify: func(cfg *SessionConfig) {
+				cfg.SeqNum = true
+				cfg.ReorderTimeout = 50 * time.Millisecond
+			},
+		},
+		{
+			name: "change debug flags",
+			modify: func(cfg *SessionConfig) {
+				cfg.DebugFlags = DebugFlagsControl | DebugFlagsData
+			},
+		},
+		{
+			name:       "reject nil config",
+			expectFail: true,
+		},
+		{
+			name:       "reject session ID change",
+			modify:     func(cfg *SessionConfig) { cfg.SessionID++ },
+			expectFail: true,
+		},
+		{
+			name:       "reject pseudowire change",
+			modify:     func(cfg *SessionConfig) { cfg.Pseudowire = PseudowireTypePPP },
+			expectFail: true,
+		},
+		{
+			name:       "reject cookie change",
+			modify:     func(cfg *SessionConfig) { cfg.Cookie = []byte{0x34, 0x04, 0xa9, 0xbf} },
+			expectFail: true,
+		},
+		{
+			name:       "reject interface name change",
+			modify:     func(cfg *SessionConfig) { cfg.InterfaceName = "l2tpeth42" },
+			expectFail: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			before := sess.Config()
+			var cfg *SessionConfig
+			if c.modify != nil {
+				cfg = sess.Config()
+				c.modify(cfg)
+			}
+			err := sess.Reconfigure(cfg)
+			if c.expectFail {
+				if err == nil {
+					t.Fatalf("Expected Reconfigure(%v) to fail", cfg)
+				}
+				if !reflect.DeepEqual(sess.Config(), before) {
+					t.Errorf("Reconfigure(%v): failed call changed config", cfg)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("Reconfigure(%v): %v", cfg, err)
+				}
+				if !reflect.DeepEqual(sess.Config(), cfg) {
+					t.Errorf("Reconfigure(%v): expected config %v, got %v", cfg, cfg, sess.Config())
+				}
+			}
+		})
+	}
+}
+
+type testDataPlane struct {
+	nullDataPlane
+	downs int
+}
+
+type testTunnelDataPlane struct {
+	nullTunnelDataPlane
+	dp *testDataPlane
+}
+
+type testSessionDataPlane struct {
+	nullSessionDataPlane
+	dp *testDataPlane
+}
+
+func (tdp *testDataPlane) NewTunnel(tcfg *TunnelConfig, sal, sap unix.Sockaddr, fd int) (TunnelDataPlane, error) {
+	return &testTunnelDataPlane{dp: tdp}, nil
+}
+
+func (tdp *testDataPlane) NewSession(tid, ptid ControlConnID, scfg *SessionConfig) (SessionDataPlane, error) {
+	return &testSessionDataPlane{dp: tdp}, nil
+}
+
+func (ttdp *testTunnelDataPlane) Down() error {
+	ttdp.dp.downs++
+	return nil
+}
+
+func (tsdp *testSessionDataPlane) Down() error {
+	tsdp.dp.downs++
+	return nil
+}
+
+func TestConfigCopy(t *testing.T) {
+	tcfg := &TunnelConfig{Secret: []byte("cheese")}
+	bt := newBaseTunnel(nil, "t1", nil, tcfg)
+
+	scfg := &SessionConfig{
+		Cookie:     []byte{0x01, 0x02, 0x03, 0x04},
+		PeerCookie: []byte{0x05, 0x06, 0x07, 0x08},
+		ProxyLCP: &ProxyLCP{
+			InitialReceivedConfReq: []byte{0x01},
+			LastSentConfReq:        []byte{0x02},
+			LastReceivedConfReq:    []byte{0x03},
+		},
+		ProxyAuth: &ProxyAuth{
+			Challenge: []byte{0x04},
+			Response:  []byte{0x05},
+		},
+	}
+	bs := newBaseSession(nil, "s1", nil, scfg)
+
+	// Modifying the returned configuration mustn't affect the tunnel
+	// or session
+	gotTunnel := bt.Config()
+	gotTunnel.Secret[0] = 0xff
+
+	gotSession := bs.Config()
+	for _, b := range [][]byte{
+		gotSession.Cookie,
+		gotSession.PeerCookie,
+		gotSession.ProxyLCP.InitialReceivedConfReq,
+		gotSession.ProxyLCP.LastSentConfReq,
+		gotSession.ProxyLCP.LastReceivedConfReq,
+		gotSession.ProxyAuth.Challenge,
+		gotSession.ProxyAuth.Response,
+	} {
+		b[0] = 0xff
+	}
+	gotSession.ProxyAuth.Name = "modified"
+
+	if !reflect.DeepEqual(bt.cfg, &TunnelConfig{Secret: []byte("cheese")}) {
+		t.Errorf("tunnel config modified: %+v", bt.cfg)
+	}
+	expect := &SessionConfig{
+		Cookie:     []byte{0x01, 0x02, 0x03, 0x04},
+		PeerCookie: []byte{0x05, 0x06, 0x07, 0x08},
+		ProxyLCP: &ProxyLCP{
+			InitialReceivedConfReq: []byte{0x01},
+			LastSentConfReq:        []byte{0x02},
+			LastReceivedConfReq:    []byte{0x03},
+		},
+		ProxyAuth: &ProxyAuth{
+			Challenge: []byte{0x04},
+			Response:  []byte{0x05},
+		},
+	}
+	if !reflect.DeepEqual(bs.cfg, expect) {
+		t.Errorf("session config modified: %+v", bs.cfg)
+	}
+}
+
+func TestContextDetach(t *testing.T) {
+	cases := []struct {
+		name        string
+		detach      bool
+		expectDowns int
+	}{
+		{
+			name:        "close",
+			expectDowns: 2,
+		},
+		{
+			name:        "detach",
+			detach:      true,
+			expectDowns: 0,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dp := &testDataPlane{}
+			ctx, err := NewContext(dp, level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug()))
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+
+			tcfg := &TunnelConfig{
+				Local:        "127.0.0.1:6000",
+				Peer:         "localhost:5000",
+				Version:      ProtocolVersion3,
+				TunnelID:     62719,
+				PeerTunnelID: 23121,
+				Encap:        EncapTypeUDP,
+			}
+			tunl, err := ctx.NewStaticTunnel("t1", tcfg)
+			if err != nil {
+				t.Fatalf("NewStaticTunnel(%v): %v", tcfg, err)
+			}
+
+			scfg := &SessionConfig{
+				SessionID:     12345,
+				PeerSessionID: 54321,
+				Pseudowire:    PseudowireTypeEth,
+			}
+			_, err = tunl.NewSession("s1", scfg)
+			if err != nil {
+				t.Fatalf("NewSession(%v): %v", scfg, err)
+			}
+
+			if c.detach {
+				ctx.Detach()
+			} else {
+				ctx.Close()
+			}
+
+			if dp.downs != c.expectDowns {
+				t.Errorf("expected %d data plane instances torn down, got %d", c.expectDowns, dp.downs)
+			}
+		})
+	}
+}
+
+type testSessionDownRecorder struct {
+	results []string
+}
+
+func (r *testSessionDownRecorder) HandleEvent(event interface{}) {
+	if ev, ok := event.(*SessionDownEvent); ok {
+		r.results = append(r.results, ev.Result)
+	}
+}
+
+func TestDataPlaneDeleted(t *testing.T) {
+	cases := []struct {
+		name          string
+		deleteTunnel  bool
+		expectResult  string
+		expectTunnels int
+	}{
+		{
+			name:          "session",
+			expectResult:  "session data plane deleted externally",
+			expectTunnels: 1,
+		},
+		{
+			name:          "tunnel",
+			deleteTunnel:  true,
+			expectResult:  "tunnel data plane deleted externally",
+			expectTunnels: 0,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dp := &testDataPlane{}
+			ctx, err := NewContext(dp, level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug()))
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer ctx.Close()
+
+			recorder := &testSessionDownRecorder{}
+			ctx.RegisterEventHandler(recorder)
+
+			tcfg := &TunnelConfig{
+				Local:        "127.0.0.1:6000",
+				Peer:         "localhost:5000",
+				Version:      ProtocolVersion3,
+				TunnelID:     62719,
+				PeerTunnelID: 23121,
+				Encap:        EncapTypeUDP,
+			}
+			tunl, err := ctx.NewStaticTunnel("t1", tcfg)
+			if err != nil {
+				t.Fatalf("NewStaticTunnel(%v): %v", tcfg, err)
+			}
+
+			scfg := &SessionConfig{
+				SessionID:     12345,
+				PeerSessionID: 54321,
+				Pseudowire:    PseudowireTypeEth,
+			}
+			_, err = tunl.NewSession("s1", scfg)
+			if err != nil {
+				t.Fatalf("NewSession(%v): %v", scfg, err)
+			}
+
+			if c.deleteTunnel {
+				ctx.onDataPlaneTunnelDeleted(tcfg.TunnelID)
+			} else {
+				ctx.onDataPlaneSessionDeleted(tcfg.TunnelID, scfg.SessionID)
+			}
+
+			// A further notification for the same instance is ignored
+			ctx.onDataPlaneSessionDeleted(tcfg.TunnelID, scfg.SessionID)
+
+			if dp.downs != 0 {
+				t.Errorf("expected no data plane instances torn down, got %d", dp.downs)
+			}
+			if len(recorder.results) != 1 || recorder.results[0] != c.expectResult {
+				t.Errorf("expected session down result %q, got %q", c.expectResult, recorder.results)
+			}
+			if len(tunl.Sessions()) != 0 {
+				t.Errorf("expected session to be removed from tunnel, got %v", tunl.Sessions())
+			}
+			if len(ctx.Tunnels()) != c.expectTunnels {
+				t.Errorf("expected %d tunnels, got %d", c.expectTunnels, len(ctx.Tunnels()))
+			}
+		})
+	}
+}
+
+func TestTunnelAddressZone(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("no loopback interface: %v", err)
+	}
+
+	cases := []struct {
+		addr      string
+		expectErr bool
+	}{
+		{addr: "[fe80::1%lo]:1701"},
+		{addr: fmt.Sprintf("[fe80::1%%%d]:1701", lo.Index)},
+		{addr: "[fe80::1%nosuchinterface0]:1701", expectErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.addr, func(t *testing.T) {
+			for _, encap := range []EncapType{EncapTypeUDP, EncapTypeIP} {
+				var sa unix.Sockaddr
+				if encap == EncapTypeUDP {
+					sa, err = newUDPTunnelAddress(c.addr)
+				} else {
+					sa, err = newIPTunnelAddress(c.addr, 42)
+				}
+				if c.expectErr {
+					if err == nil {
+						t.Errorf("%v: expected error, got %v", encap, sockaddrString(sa))
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("%v: %v", encap, err)
+				}
+				if sockaddrZoneID(sa) != uint32(lo.Index) {
+					t.Errorf("%v: expected zone ID %v, got %v", encap, lo.Index, sockaddrZoneID(sa))
+				}
+				// The zone is formatted by index, which doesn't
+				// depend on the network namespace
+				expect := fmt.Sprintf("[fe80::1%%%d]:0", lo.Index)
+				if encap == EncapTypeUDP {
+					expect = fmt.Sprintf("[fe80::1%%%d]:1701", lo.Index)
+				}
+				if s := sockaddrString(sa); s != expect {
+					t.Errorf("%v: expected %q, got %q", encap, expect, s)
+				}
+			}
+		})
+	}
+}
+
+func TestTunnelSocketOptions(t *testing.T) {
+	cfg := &TunnelConfig{
+		BindInterface: "lo",
+		VRF:           "vrf-blue",
+	}
+	sal, sap, err := newUDPAddressPair("127.0.0.1:0", "127.0.0.1:1701")
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+	cp, err := newL2tpControlPlane(-1, sal, sap, cfg)
+	if err == nil {
+		cp.close()
+		t.Errorf("newL2tpControlPlane(%v): expected error", cfg)
+	}
+}
+
+func TestContextNetNS(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	for _, name := range []string{"", "../netns"} {
+		ctx, err := NewContextInNamedNetNS(nil, logger, name)
+		if err == nil {
+			ctx.Close()
+			t.Errorf("NewContextInNamedNetNS(%q): expected error", name)
+		}
+	}
+
+	devnull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("Open(%v): %v", os.DevNull, err)
+	}
+	defer devnull.Close()
+
+	ctx, err := NewContextInNetNS(nil, logger, int(devnull.Fd()))
+	if err == nil {
+		ctx.Close()
+		t.Errorf("NewContextInNetNS(%v): expected error", os.DevNull)
+	}
+
+	// Entering our own namespace exercises the code paths without
+	// needing to create a new namespace
+	self, err := os.Open("/proc/self/ns/net")
+	if err != nil {
+		t.Skipf("network namespaces unavailable: %v", err)
+	}
+	defer self.Close()
+
+	ctx, err = NewContextInNetNS(nil, logger, int(self.Fd()))
+	if err != nil {
+		if strings.Contains(err.Error(), unix.EPERM.Error()) {
+			t.Skipf("NewContextInNetNS(): %v", err)
+		}
+		t.Fatalf("NewContextInNetNS(): %v", err)
+	}
+	defer ctx.Close()
+
+	tcfg := &TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "localhost:5000",
+		Version:      ProtocolVersion3,
+		TunnelID:     62719,
+		PeerTunnelID: 23121,
+		Encap:        EncapTypeUDP,
+	}
+	_, err = ctx.NewQuiescentTunnel("t1", tcfg)
+	if err != nil {
+		t.Fatalf("NewQuiescentTunnel(%v): %v", tcfg, err)
+	}
+}
+
+func TestUDPChecksumConfig(t *testing.T) {
+	cases := []struct {
+		name      string
+		cfg       TunnelConfig
+		expectErr bool
+	}{
+		{
+			name: "IPv4 UDP checksum",
+			cfg: TunnelConfig{
+				Local:       "127.0.0.1:6000",
+				Peer:        "127.0.0.1:5000",
+				Encap:       EncapTypeUDP,
+				UDPChecksum: true,
+			},
+		},
+		{
+			name: "IPv6 zero checksum",
+			cfg: TunnelConfig{
+				Local:              "[::1]:6000",
+				Peer:               "[::1]:5000",
+				Encap:              EncapTypeUDP,
+				UDPZeroChecksum6Tx: true,
+				UDPZeroChecksum6Rx: true,
+			},
+		},
+		{
+			name: "reject IPv4 zero checksum",
+			cfg: TunnelConfig{
+				Local:              "127.0.0.1:6000",
+				Peer:               "127.0.0.1:5000",
+				Encap:              EncapTypeUDP,
+				UDPZeroChecksum6Tx: true,
+			},
+			expectErr: true,
+		},
+		{
+			name: "reject IPv6 UDP checksum",
+			cfg: TunnelConfig{
+				Local:       "[::1]:6000",
+				Peer:        "[::1]:5000",
+				Encap:       EncapTypeUDP,
+				UDPChecksum: true,
+			},
+			expectErr: true,
+		},
+		{
+			name: "reject IP encap UDP checksum",
+			cfg: TunnelConfig{
+				Local:       "127.0.0.1",
+				Peer:        "127.0.0.1",
+				Encap:       EncapTypeIP,
+				UDPChecksum: true,
+			},
+			expectErr: true,
+		},
+		{
+			name: "reject IP encap zero checksum",
+			cfg: TunnelConfig{
+				Local:              "[::1]",
+				Peer:               "[::1]",
+				Encap:              EncapTypeIP,
+				UDPZeroChecksum6Rx: true,
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, err := NewContext(nil, level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug()))
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer ctx.Close()
+
+			c.cfg.Version = ProtocolVersion3
+			c.cfg.TunnelID = 62719
+			c.cfg.PeerTunnelID = 23121
+
+			_, err = ctx.NewStaticTunnel("t1", &c.cfg)
+			if c.expectErr {
+				if err == nil {
+					t.Errorf("NewStaticTunnel(%v): expected error", c.cfg)
+				}
+			} else if err != nil {
+				t.Errorf("NewStaticTunnel(%v): %v", c.cfg, err)
+			}
+		})
+	}
+}
+
+func TestSessionVlanConfig(t *testing.T) {
+	cases := []struct {
+		name      string
+		cfg       SessionConfig
+		expectErr bool
+	}{
+		{
+			name: "Ethernet VLAN",
+			cfg: SessionConfig{
+				Pseudowire: PseudowireTypeEthVLAN,
+				VlanID:     100,
+			},
+		},
+		{
+			name: "reject Ethernet VLAN without VLAN ID",
+			cfg: SessionConfig{
+				Pseudowire: PseudowireTypeEthVLAN,
+			},
+			expectErr: true,
+		},
+		{
+			name: "reject Ethernet VLAN with out of range VLAN ID",
+			cfg: SessionConfig{
+				Pseudowire: PseudowireTypeEthVLAN,
+				VlanID:     4095,
+			},
+			expectErr: true,
+		},
+		{
+			name: "reject Ethernet with VLAN ID",
+			cfg: SessionConfig{
+				Pseudowire: PseudowireTypeEth,
+				VlanID:     100,
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, err := NewContext(nil, level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug()))
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer ctx.Close()
+
+			tunl, err := ctx.NewStaticTunnel("t1", &TunnelConfig{
+				Local:        "127.0.0.1:6000",
+				Peer:         "127.0.0.1:5000",
+				Encap:        EncapTypeUDP,
+				Version:      ProtocolVersion3,
+				TunnelID:     62719,
+				PeerTunnelID: 23121,
+			})
+			if err != nil {
+				t.Fatalf("NewStaticTunnel(): %v", err)
+			}
+
+			c.cfg.SessionID = 1234
+			c.cfg.PeerSessionID = 4321
+
+			_, err = tunl.NewSession("s1", &c.cfg)
+			if c.expectErr {
+				if err == nil {
+					t.Errorf("NewSession(%v): expected error", c.cfg)
+				}
+			} else if err != nil {
+				t.Errorf("NewSession(%v): %v", c.cfg, err)
+			}
+		})
+	}
+}
+
 func ipL2tpShowTunnel(tid uint32) (out string, err error) {
 	var tidStr string
 	var tidArgStr string
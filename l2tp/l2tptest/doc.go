@@ -0,0 +1,38 @@
+/*
+Package l2tptest provides utilities for testing applications which use
+package l2tp.
+
+Peer is a fake L2TP peer which a test scripts message by message.  The
+application under test is pointed at the peer's address, following which
+the test receives each control message the application sends, asserts on
+its contents, and decides how the peer responds.  This allows the
+application's handling of tunnel and session events to be tested against
+realistic peer behaviour, including behaviour which is hard to provoke
+from a real LNS or LAC:
+
+	peer, err := l2tptest.NewPeer(&l2tptest.PeerConfig{
+		Version: l2tp.ProtocolVersion2,
+	})
+	if err != nil {
+		t.Fatalf("NewPeer(): %v", err)
+	}
+	defer peer.Close()
+
+	tunl, err := ctx.NewDynamicTunnel("t1", &l2tp.TunnelConfig{
+		Peer:    peer.Addr(),
+		Version: l2tp.ProtocolVersion2,
+		Encap:   l2tp.EncapTypeUDP,
+	})
+
+	// Reject the control connection
+	_, err = peer.Expect(l2tptest.MessageTypeSCCRQ, time.Second)
+	if err != nil {
+		t.Fatalf("Expect(): %v", err)
+	}
+	err = peer.Send(peer.StopCCN(2, 0, "go away"))
+
+Applications using package l2tp may use the null data plane, selected by
+passing a nil DataPlane to l2tp.NewContext, to run such tests without
+root permissions.
+*/
+package l2tptest
@@ -0,0 +1,384 @@
+package l2tptest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/katalix/go-l2tp/l2tp"
+)
+
+// MessageType identifies an L2TP control message.
+type MessageType uint16
+
+// L2TP control message types.
+// Ref: RFC2661 section 3.2, RFC3931 section 3.1
+const (
+	MessageTypeSCCRQ   MessageType = 1
+	MessageTypeSCCRP   MessageType = 2
+	MessageTypeSCCCN   MessageType = 3
+	MessageTypeStopCCN MessageType = 4
+	MessageTypeHello   MessageType = 6
+	MessageTypeOCRQ    MessageType = 7
+	MessageTypeOCRP    MessageType = 8
+	MessageTypeOCCN    MessageType = 9
+	MessageTypeICRQ    MessageType = 10
+	MessageTypeICRP    MessageType = 11
+	MessageTypeICCN    MessageType = 12
+	MessageTypeCDN     MessageType = 14
+	MessageTypeWEN     MessageType = 15
+	MessageTypeSLI     MessageType = 16
+	// MessageTypeACK is the L2TPv3 explicit acknowledgement.  L2TPv2
+	// zero-length-body acknowledgements are also reported using this type.
+	MessageTypeACK MessageType = 20
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case MessageTypeSCCRQ:
+		return "SCCRQ"
+	case MessageTypeSCCRP:
+		return "SCCRP"
+	case MessageTypeSCCCN:
+		return "SCCCN"
+	case MessageTypeStopCCN:
+		return "StopCCN"
+	case MessageTypeHello:
+		return "HELLO"
+	case MessageTypeOCRQ:
+		return "OCRQ"
+	case MessageTypeOCRP:
+		return "OCRP"
+	case MessageTypeOCCN:
+		return "OCCN"
+	case MessageTypeICRQ:
+		return "ICRQ"
+	case MessageTypeICRP:
+		return "ICRP"
+	case MessageTypeICCN:
+		return "ICCN"
+	case MessageTypeCDN:
+		return "CDN"
+	case MessageTypeWEN:
+		return "WEN"
+	case MessageTypeSLI:
+		return "SLI"
+	case MessageTypeACK:
+		return "ACK"
+	}
+	return fmt.Sprintf("MessageType(%d)", uint16(t))
+}
+
+// AVPType identifies an IETF Attribute Value Pair.
+type AVPType uint16
+
+// IETF AVP types used by the canned messages built by Peer.  Other
+// AVPs may be built by converting the type number from the RFCs.
+// Ref: RFC2661 section 4.4, RFC3931 section 5.4
+const (
+	AVPTypeMessage          AVPType = 0
+	AVPTypeResultCode       AVPType = 1
+	AVPTypeProtocolVersion  AVPType = 2
+	AVPTypeFramingCap       AVPType = 3
+	AVPTypeHostName         AVPType = 7
+	AVPTypeTunnelID         AVPType = 9
+	AVPTypeSessionID        AVPType = 14
+	AVPTypeCallSerialNumber AVPType = 15
+	AVPTypeFramingType      AVPType = 19
+	AVPTypeConnectSpeed     AVPType = 24
+	AVPTypeRouterID         AVPType = 60
+	AVPTypeAssignedConnID   AVPType = 61
+	AVPTypePseudowireCaps   AVPType = 62
+	AVPTypeLocalSessionID   AVPType = 63
+	AVPTypeRemoteSessionID  AVPType = 64
+	AVPTypeRemoteEndID      AVPType = 66
+	AVPTypePseudowireType   AVPType = 68
+	AVPTypeCircuitStatus    AVPType = 71
+)
+
+// AVP is an L2TP Attribute Value Pair.
+type AVP struct {
+	// VendorID is zero for the IETF AVPs defined by the RFCs.
+	VendorID uint16
+	// Type is the AVP type within the vendor's namespace.
+	Type AVPType
+	// Mandatory sets the AVP M bit, which requires the receiver to
+	// tear down the tunnel or session if it doesn't recognise the AVP.
+	Mandatory bool
+	// Value is the encoded AVP value.
+	Value []byte
+}
+
+// BytesAVP builds a mandatory IETF AVP carrying the value b.
+func BytesAVP(t AVPType, b []byte) AVP {
+	return AVP{Type: t, Mandatory: true, Value: b}
+}
+
+// StringAVP builds a mandatory IETF AVP carrying the string s.
+func StringAVP(t AVPType, s string) AVP {
+	return BytesAVP(t, []byte(s))
+}
+
+// Uint16AVP builds a mandatory IETF AVP carrying the value v.
+func Uint16AVP(t AVPType, v uint16) AVP {
+	return BytesAVP(t, appendUint16(nil, v))
+}
+
+// Uint32AVP builds a mandatory IETF AVP carrying the value v.
+func Uint32AVP(t AVPType, v uint32) AVP {
+	return BytesAVP(t, appendUint32(nil, v))
+}
+
+// ResultCodeAVP builds a Result Code AVP for StopCCN or CDN messages.
+// The error code and message are optional: set errMsg to the empty
+// string to omit the message.
+func ResultCodeAVP(result, errCode uint16, errMsg string) AVP {
+	b := appendUint16(nil, result)
+	b = appendUint16(b, errCode)
+	return BytesAVP(AVPTypeResultCode, append(b, errMsg...))
+}
+
+// Uint16 decodes the AVP value as a uint16.
+func (a AVP) Uint16() (uint16, error) {
+	if len(a.Value) != 2 {
+		return 0, fmt.Errorf("AVP %d: expected 2 byte value, got %d", a.Type, len(a.Value))
+	}
+	return binary.BigEndian.Uint16(a.Value), nil
+}
+
+// Uint32 decodes the AVP value as a uint32.
+func (a AVP) Uint32() (uint32, error) {
+	if len(a.Value) != 4 {
+		return 0, fmt.Errorf("AVP %d: expected 4 byte value, got %d", a.Type, len(a.Value))
+	}
+	return binary.BigEndian.Uint32(a.Value), nil
+}
+
+// ResultCode decodes the AVP value as a Result Code.
+func (a AVP) ResultCode() (result, errCode uint16, errMsg string, err error) {
+	if len(a.Value) < 2 {
+		return 0, 0, "", fmt.Errorf("AVP %d: result code too short", a.Type)
+	}
+	result = binary.BigEndian.Uint16(a.Value)
+	if len(a.Value) >= 4 {
+		errCode = binary.BigEndian.Uint16(a.Value[2:])
+		errMsg = string(a.Value[4:])
+	}
+	return
+}
+
+// Message is an L2TP control message.
+type Message struct {
+	// Type is the message type.  When a message is sent the Message
+	// Type AVP is generated from this field.
+	Type MessageType
+	// TunnelID is the tunnel ID (L2TPv2) or control connection ID
+	// (L2TPv3) from the message header.  If zero when a message is
+	// sent, the tunnel ID assigned by the peer under test is used.
+	TunnelID l2tp.ControlConnID
+	// SessionID is the L2TPv2 header session ID.  It is not used for
+	// L2TPv3.
+	SessionID l2tp.ControlConnID
+	// Ns and Nr are the transport sequence numbers.  They are set
+	// automatically when a message is sent.
+	Ns, Nr uint16
+	// AVPs holds the message AVPs, not including the Message Type AVP.
+	AVPs []AVP
+}
+
+// NewMessage builds a message of type t carrying the AVPs passed in.
+func NewMessage(t MessageType, avps ...AVP) *Message {
+	return &Message{Type: t, AVPs: avps}
+}
+
+// FindAVP returns the first IETF AVP of type t in the message.
+func (m *Message) FindAVP(t AVPType) (AVP, bool) {
+	for _, a := range m.AVPs {
+		if a.VendorID == 0 && a.Type == t {
+			return a, true
+		}
+	}
+	return AVP{}, false
+}
+
+// ResultCode returns the decoded Result Code AVP from the message.
+func (m *Message) ResultCode() (result, errCode uint16, errMsg string, err error) {
+	a, ok := m.FindAVP(AVPTypeResultCode)
+	if !ok {
+		return 0, 0, "", fmt.Errorf("no result code AVP in %v", m.Type)
+	}
+	return a.ResultCode()
+}
+
+// AssignedSessionID returns the session ID the sender of a session
+// message has assigned to the session.
+func (m *Message) AssignedSessionID() (l2tp.ControlConnID, error) {
+	if a, ok := m.FindAVP(AVPTypeLocalSessionID); ok {
+		sid, err := a.Uint32()
+		return l2tp.ControlConnID(sid), err
+	}
+	if a, ok := m.FindAVP(AVPTypeSessionID); ok {
+		sid, err := a.Uint16()
+		return l2tp.ControlConnID(sid), err
+	}
+	return 0, fmt.Errorf("no session ID AVP in %v", m.Type)
+}
+
+// assignedTunnelID returns the tunnel ID the sender of an SCCRQ or
+// SCCRP has assigned to the tunnel.
+func (m *Message) assignedTunnelID() (l2tp.ControlConnID, error) {
+	if a, ok := m.FindAVP(AVPTypeAssignedConnID); ok {
+		tid, err := a.Uint32()
+		return l2tp.ControlConnID(tid), err
+	}
+	if a, ok := m.FindAVP(AVPTypeTunnelID); ok {
+		tid, err := a.Uint16()
+		return l2tp.ControlConnID(tid), err
+	}
+	return 0, fmt.Errorf("no tunnel ID AVP in %v", m.Type)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+const (
+	headerLen    = 12
+	avpHeaderLen = 6
+	avpMaxLen    = 0x3ff
+
+	flagType     = 0x8000
+	flagLength   = 0x4000
+	flagSequence = 0x0800
+	avpMandatory = 0x8000
+	avpHidden    = 0x4000
+)
+
+func (m *Message) encode(version l2tp.ProtocolVersion) ([]byte, error) {
+
+	isZLB := version == l2tp.ProtocolVersion2 && m.Type == MessageTypeACK
+
+	b := make([]byte, headerLen)
+
+	if !isZLB {
+		avps := append([]AVP{Uint16AVP(AVPTypeMessage, uint16(m.Type))}, m.AVPs...)
+		for _, a := range avps {
+			alen := avpHeaderLen + len(a.Value)
+			if alen > avpMaxLen {
+				return nil, fmt.Errorf("AVP %d too long", a.Type)
+			}
+			flagsLen := uint16(alen)
+			if a.Mandatory {
+				flagsLen |= avpMandatory
+			}
+			b = appendUint16(b, flagsLen)
+			b = appendUint16(b, a.VendorID)
+			b = appendUint16(b, uint16(a.Type))
+			b = append(b, a.Value...)
+		}
+	}
+
+	if len(b) > 0xffff {
+		return nil, fmt.Errorf("message too long")
+	}
+
+	binary.BigEndian.PutUint16(b[0:], flagType|flagLength|flagSequence|uint16(version))
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	switch version {
+	case l2tp.ProtocolVersion2:
+		binary.BigEndian.PutUint16(b[4:], uint16(m.TunnelID))
+		binary.BigEndian.PutUint16(b[6:], uint16(m.SessionID))
+	case l2tp.ProtocolVersion3:
+		binary.BigEndian.PutUint32(b[4:], uint32(m.TunnelID))
+	default:
+		return nil, fmt.Errorf("unsupported protocol version %v", version)
+	}
+	binary.BigEndian.PutUint16(b[8:], m.Ns)
+	binary.BigEndian.PutUint16(b[10:], m.Nr)
+
+	return b, nil
+}
+
+// decodeMessages parses a received frame into control messages.
+// Data packets are ignored.
+func decodeMessages(version l2tp.ProtocolVersion, b []byte) (messages []*Message, err error) {
+	for len(b) >= headerLen {
+		flagsVer := binary.BigEndian.Uint16(b[0:])
+		if flagsVer&flagType == 0 {
+			return messages, nil
+		}
+		if l2tp.ProtocolVersion(flagsVer&0xf) != version {
+			return nil, fmt.Errorf("unexpected protocol version %d", flagsVer&0xf)
+		}
+
+		mlen := int(binary.BigEndian.Uint16(b[2:]))
+		if mlen < headerLen || mlen > len(b) {
+			return nil, fmt.Errorf("malformed header: bad length %d", mlen)
+		}
+
+		m := &Message{
+			Ns: binary.BigEndian.Uint16(b[8:]),
+			Nr: binary.BigEndian.Uint16(b[10:]),
+		}
+		if version == l2tp.ProtocolVersion2 {
+			m.TunnelID = l2tp.ControlConnID(binary.BigEndian.Uint16(b[4:]))
+			m.SessionID = l2tp.ControlConnID(binary.BigEndian.Uint16(b[6:]))
+		} else {
+			m.TunnelID = l2tp.ControlConnID(binary.BigEndian.Uint32(b[4:]))
+		}
+
+		m.AVPs, err = decodeAVPs(b[headerLen:mlen])
+		if err != nil {
+			return nil, err
+		}
+
+		if len(m.AVPs) == 0 {
+			if version != l2tp.ProtocolVersion2 {
+				return nil, errors.New("message has no AVPs")
+			}
+			m.Type = MessageTypeACK
+		} else {
+			if m.AVPs[0].VendorID != 0 || m.AVPs[0].Type != AVPTypeMessage {
+				return nil, errors.New("first AVP is not Message Type AVP")
+			}
+			t, err := m.AVPs[0].Uint16()
+			if err != nil {
+				return nil, err
+			}
+			m.Type = MessageType(t)
+			m.AVPs = m.AVPs[1:]
+		}
+
+		messages = append(messages, m)
+		b = b[mlen:]
+	}
+	return messages, nil
+}
+
+func decodeAVPs(b []byte) (avps []AVP, err error) {
+	for len(b) > 0 {
+		if len(b) < avpHeaderLen {
+			return nil, errors.New("malformed AVP: short header")
+		}
+		flagsLen := binary.BigEndian.Uint16(b[0:])
+		alen := int(flagsLen & avpMaxLen)
+		if alen < avpHeaderLen || alen > len(b) {
+			return nil, fmt.Errorf("malformed AVP: bad length %d", alen)
+		}
+		if flagsLen&avpHidden != 0 {
+			return nil, errors.New("hidden AVPs are not supported")
+		}
+		avps = append(avps, AVP{
+			VendorID:  binary.BigEndian.Uint16(b[2:]),
+			Type:      AVPType(binary.BigEndian.Uint16(b[4:])),
+			Mandatory: flagsLen&avpMandatory != 0,
+			Value:     append([]byte(nil), b[avpHeaderLen:alen]...),
+		})
+		b = b[alen:]
+	}
+	return avps, nil
+}
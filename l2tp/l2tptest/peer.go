@@ -0,0 +1,429 @@
+package l2tptest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/katalix/go-l2tp/l2tp"
+)
+
+// PeerConfig describes a fake peer.
+type PeerConfig struct {
+	// Version is the L2TP protocol version the peer speaks.
+	Version l2tp.ProtocolVersion
+	// Local is the UDP address the peer binds to.  If unset, the peer
+	// binds to an ephemeral port on the IPv4 loopback address.
+	Local string
+	// Peer is the address of the L2TP implementation under test.  It
+	// need only be set if the fake peer is to initiate the control
+	// connection.  Otherwise it is learned from the first message
+	// received.
+	Peer string
+	// TunnelID is the tunnel ID (L2TPv2) or control connection ID
+	// (L2TPv3) the peer assigns to the control connection.  If unset,
+	// a tunnel ID of 1 is used.
+	TunnelID l2tp.ControlConnID
+	// HostName is the host name the peer advertises.  If unset,
+	// "l2tptest" is used.
+	HostName string
+}
+
+// Peer is a fake L2TP peer for testing code which uses package l2tp.
+//
+// The peer speaks just enough of the control protocol to be scripted
+// message by message from a test: it binds a UDP socket, acknowledges
+// the control messages it receives, and passes each new message to the
+// test via Recv or Expect.  The test decides how to respond, and sends
+// its responses using Send.  Helper methods build well-formed versions
+// of the commonly used control messages, which the test may modify or
+// replace as needed.
+//
+// The peer does not retransmit the messages it sends, and doesn't
+// support hidden AVPs or L2TPv3 message authentication.
+type Peer struct {
+	cfg          PeerConfig
+	conn         *net.UDPConn
+	lock         sync.Mutex
+	remote       *net.UDPAddr
+	peerTunnelID l2tp.ControlConnID
+	ns, nr       uint16
+	silent       bool
+	rxChan       chan *Message
+	closeChan    chan bool
+	closeOnce    sync.Once
+	wg           sync.WaitGroup
+}
+
+// ErrClosed is returned by the Peer methods once the peer is closed.
+var ErrClosed = errors.New("peer closed")
+
+// NewPeer creates a new fake peer, and starts it listening for
+// control messages.
+func NewPeer(cfg *PeerConfig) (*Peer, error) {
+
+	if cfg == nil {
+		return nil, fmt.Errorf("invalid nil config")
+	}
+
+	if cfg.Version != l2tp.ProtocolVersion2 && cfg.Version != l2tp.ProtocolVersion3 {
+		return nil, fmt.Errorf("unsupported protocol version %v", cfg.Version)
+	}
+
+	p := &Peer{
+		cfg:       *cfg,
+		rxChan:    make(chan *Message, 64),
+		closeChan: make(chan bool),
+	}
+
+	if p.cfg.Local == "" {
+		p.cfg.Local = "127.0.0.1:0"
+	}
+	if p.cfg.TunnelID == 0 {
+		p.cfg.TunnelID = 1
+	}
+	if p.cfg.HostName == "" {
+		p.cfg.HostName = "l2tptest"
+	}
+	if p.cfg.Version == l2tp.ProtocolVersion2 && p.cfg.TunnelID > 0xffff {
+		return nil, fmt.Errorf("L2TPv2 tunnel ID %v out of range", p.cfg.TunnelID)
+	}
+
+	local, err := net.ResolveUDPAddr("udp", p.cfg.Local)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve local address %q: %v", p.cfg.Local, err)
+	}
+
+	if p.cfg.Peer != "" {
+		p.remote, err = net.ResolveUDPAddr("udp", p.cfg.Peer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve peer address %q: %v", p.cfg.Peer, err)
+		}
+	}
+
+	p.conn, err = net.ListenUDP("udp", local)
+	if err != nil {
+		return nil, err
+	}
+
+	p.wg.Add(1)
+	go p.run()
+
+	return p, nil
+}
+
+// Addr returns the address the peer is listening on, suitable for use
+// as the peer address of an l2tp.TunnelConfig.
+func (p *Peer) Addr() string {
+	return p.conn.LocalAddr().String()
+}
+
+// TunnelID returns the tunnel ID the peer has assigned to the control
+// connection.
+func (p *Peer) TunnelID() l2tp.ControlConnID {
+	return p.cfg.TunnelID
+}
+
+// PeerTunnelID returns the tunnel ID assigned to the control connection
+// by the implementation under test, as learned from its SCCRQ or SCCRP.
+func (p *Peer) PeerTunnelID() l2tp.ControlConnID {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.peerTunnelID
+}
+
+// SetSilent controls whether the peer has gone silent.  A silent peer
+// continues to pass received messages to Recv, but stops acknowledging
+// them, and refuses to Send.
+func (p *Peer) SetSilent(silent bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.silent = silent
+}
+
+// Close closes the peer's socket.
+func (p *Peer) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.closeChan)
+		err = p.conn.Close()
+		p.wg.Wait()
+	})
+	return err
+}
+
+// Recv returns the next control message received by the peer.
+// Acknowledgements, duplicates, and messages received out of sequence
+// are not returned.
+func (p *Peer) Recv(timeout time.Duration) (*Message, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case m := <-p.rxChan:
+		return m, nil
+	case <-p.closeChan:
+		return nil, ErrClosed
+	case <-timer.C:
+		return nil, fmt.Errorf("timed out waiting for message")
+	}
+}
+
+// Expect returns the next control message received by the peer,
+// failing if it isn't of type t.  HELLO messages are skipped unless
+// a HELLO is the message expected.
+func (p *Peer) Expect(t MessageType, timeout time.Duration) (*Message, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		m, err := p.Recv(time.Until(deadline))
+		if err != nil {
+			return nil, fmt.Errorf("expecting %v: %v", t, err)
+		}
+		if m.Type == MessageTypeHello && t != MessageTypeHello {
+			continue
+		}
+		if m.Type != t {
+			return m, fmt.Errorf("expected %v, got %v", t, m.Type)
+		}
+		return m, nil
+	}
+}
+
+// Send sends a control message to the implementation under test.
+//
+// Send sets the message sequence numbers and, if it is unset, the
+// message tunnel ID.
+func (p *Peer) Send(m *Message) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.silent {
+		return fmt.Errorf("peer is silent")
+	}
+
+	if m.TunnelID == 0 {
+		m.TunnelID = p.peerTunnelID
+	}
+	m.Ns = p.ns
+	m.Nr = p.nr
+
+	err := p.write(m)
+	if err != nil {
+		return err
+	}
+
+	if m.Type != MessageTypeACK {
+		p.ns++
+	}
+	return nil
+}
+
+// Must be called with p.lock held
+func (p *Peer) write(m *Message) error {
+	if p.remote == nil {
+		return fmt.Errorf("peer address unknown")
+	}
+	b, err := m.encode(p.cfg.Version)
+	if err != nil {
+		return err
+	}
+	_, err = p.conn.WriteToUDP(b, p.remote)
+	return err
+}
+
+func (p *Peer) run() {
+	defer p.wg.Done()
+
+	b := make([]byte, 4096)
+	for {
+		n, from, err := p.conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+
+		messages, err := decodeMessages(p.cfg.Version, b[:n])
+		if err != nil {
+			continue
+		}
+
+		for _, m := range messages {
+			if p.handleMessage(m, from) {
+				select {
+				case p.rxChan <- m:
+				case <-p.closeChan:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Apply sequence number checks to a received message and acknowledge it.
+// Returns true if the message is new and should be passed to the user.
+func (p *Peer) handleMessage(m *Message, from *net.UDPAddr) (isNew bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.remote = from
+
+	if m.Type == MessageTypeACK {
+		return false
+	}
+
+	// Messages ahead of the one we're expecting are dropped so that
+	// the sender retransmits them in order.
+	if m.Ns == p.nr {
+		p.nr++
+		isNew = true
+	} else if int16(m.Ns-p.nr) > 0 {
+		return false
+	}
+
+	if isNew && (m.Type == MessageTypeSCCRQ || m.Type == MessageTypeSCCRP) {
+		if tid, err := m.assignedTunnelID(); err == nil {
+			p.peerTunnelID = tid
+		}
+	}
+
+	// Duplicates are acknowledged again in case our earlier
+	// acknowledgement was lost.
+	if !p.silent {
+		_ = p.write(&Message{
+			Type:     MessageTypeACK,
+			TunnelID: p.peerTunnelID,
+			Ns:       p.ns,
+			Nr:       p.nr,
+		})
+	}
+
+	return isNew
+}
+
+func (p *Peer) isV2() bool {
+	return p.cfg.Version == l2tp.ProtocolVersion2
+}
+
+func (p *Peer) tunnelAVPs() []AVP {
+	if p.isV2() {
+		return []AVP{
+			BytesAVP(AVPTypeProtocolVersion, []byte{1, 0}),
+			StringAVP(AVPTypeHostName, p.cfg.HostName),
+			Uint32AVP(AVPTypeFramingCap, 0x3),
+			Uint16AVP(AVPTypeTunnelID, uint16(p.cfg.TunnelID)),
+		}
+	}
+	return []AVP{
+		StringAVP(AVPTypeHostName, p.cfg.HostName),
+		Uint32AVP(AVPTypeRouterID, uint32(p.cfg.TunnelID)),
+		Uint32AVP(AVPTypeAssignedConnID, uint32(p.cfg.TunnelID)),
+		BytesAVP(AVPTypePseudowireCaps, appendUint16(
+			appendUint16(nil, uint16(l2tp.PseudowireTypePPP)),
+			uint16(l2tp.PseudowireTypeEth))),
+	}
+}
+
+// SCCRQ builds a Start-Control-Connection-Request, for use when the
+// fake peer initiates the control connection.
+func (p *Peer) SCCRQ() *Message {
+	return NewMessage(MessageTypeSCCRQ, p.tunnelAVPs()...)
+}
+
+// SCCRP builds a Start-Control-Connection-Reply accepting the control
+// connection requested by the implementation under test.
+func (p *Peer) SCCRP() *Message {
+	return NewMessage(MessageTypeSCCRP, p.tunnelAVPs()...)
+}
+
+// SCCCN builds a Start-Control-Connection-Connected message.
+func (p *Peer) SCCCN() *Message {
+	return NewMessage(MessageTypeSCCCN)
+}
+
+// StopCCN builds a Stop-Control-Connection-Notification carrying the
+// result code passed in.
+func (p *Peer) StopCCN(result, errCode uint16, errMsg string) *Message {
+	if p.isV2() {
+		return NewMessage(MessageTypeStopCCN,
+			Uint16AVP(AVPTypeTunnelID, uint16(p.cfg.TunnelID)),
+			ResultCodeAVP(result, errCode, errMsg))
+	}
+	return NewMessage(MessageTypeStopCCN,
+		ResultCodeAVP(result, errCode, errMsg),
+		Uint32AVP(AVPTypeAssignedConnID, uint32(p.cfg.TunnelID)))
+}
+
+// Hello builds a HELLO keepalive message.
+func (p *Peer) Hello() *Message {
+	return NewMessage(MessageTypeHello)
+}
+
+// ICRQ builds an Incoming-Call-Request for a session with ID sid, for
+// use when the fake peer places a call.
+func (p *Peer) ICRQ(sid l2tp.ControlConnID, pwtype l2tp.PseudowireType) *Message {
+	if p.isV2() {
+		return NewMessage(MessageTypeICRQ,
+			Uint16AVP(AVPTypeSessionID, uint16(sid)),
+			Uint32AVP(AVPTypeCallSerialNumber, uint32(sid)))
+	}
+	return NewMessage(MessageTypeICRQ,
+		Uint32AVP(AVPTypeLocalSessionID, uint32(sid)),
+		Uint32AVP(AVPTypeRemoteSessionID, 0),
+		Uint32AVP(AVPTypeCallSerialNumber, uint32(sid)),
+		Uint16AVP(AVPTypePseudowireType, uint16(pwtype)),
+		BytesAVP(AVPTypeRemoteEndID, []byte{}),
+		Uint16AVP(AVPTypeCircuitStatus, 0x1))
+}
+
+// sessionMessage builds a session message addressed to the session
+// assigned by the implementation under test in req.
+func (p *Peer) sessionMessage(t MessageType, req *Message, sid l2tp.ControlConnID, avps ...AVP) (*Message, error) {
+	psid, err := req.AssignedSessionID()
+	if err != nil {
+		return nil, err
+	}
+	var m *Message
+	if p.isV2() {
+		m = NewMessage(t, append(avps, Uint16AVP(AVPTypeSessionID, uint16(sid)))...)
+		m.SessionID = psid
+	} else {
+		m = NewMessage(t, append(avps,
+			Uint32AVP(AVPTypeLocalSessionID, uint32(sid)),
+			Uint32AVP(AVPTypeRemoteSessionID, uint32(psid)))...)
+	}
+	return m, nil
+}
+
+// ICRP builds an Incoming-Call-Reply accepting the call requested by
+// icrq, and assigning session ID sid to the call.
+func (p *Peer) ICRP(icrq *Message, sid l2tp.ControlConnID) (*Message, error) {
+	if p.isV2() {
+		return p.sessionMessage(MessageTypeICRP, icrq, sid)
+	}
+	return p.sessionMessage(MessageTypeICRP, icrq, sid,
+		Uint16AVP(AVPTypeCircuitStatus, 0x1))
+}
+
+// ICCN builds an Incoming-Call-Connected message for the call accepted
+// by icrp, which the fake peer requested using session ID sid.
+func (p *Peer) ICCN(icrp *Message, sid l2tp.ControlConnID) (*Message, error) {
+	if p.isV2() {
+		psid, err := icrp.AssignedSessionID()
+		if err != nil {
+			return nil, err
+		}
+		m := NewMessage(MessageTypeICCN,
+			Uint32AVP(AVPTypeConnectSpeed, 100000000),
+			Uint32AVP(AVPTypeFramingType, 0x3))
+		m.SessionID = psid
+		return m, nil
+	}
+	return p.sessionMessage(MessageTypeICCN, icrp, sid)
+}
+
+// CDN builds a Call-Disconnect-Notify for the session which the fake
+// peer knows as sid, and which the implementation under test assigned
+// in req.
+func (p *Peer) CDN(req *Message, sid l2tp.ControlConnID, result, errCode uint16, errMsg string) (*Message, error) {
+	return p.sessionMessage(MessageTypeCDN, req, sid, ResultCodeAVP(result, errCode, errMsg))
+}
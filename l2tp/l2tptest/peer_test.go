@@ -0,0 +1,409 @@
+package l2tptest
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/katalix/go-l2tp/l2tp"
+)
+
+const testTimeout = 3 * time.Second
+
+type testEventRecorder struct {
+	events chan interface{}
+}
+
+func (ter *testEventRecorder) HandleEvent(event interface{}) {
+	ter.events <- event
+}
+
+func (ter *testEventRecorder) expect(t *testing.T, event interface{}) interface{} {
+	t.Helper()
+	select {
+	case ev := <-ter.events:
+		switch event.(type) {
+		case *l2tp.TunnelUpEvent:
+			_, ok := ev.(*l2tp.TunnelUpEvent)
+			if ok {
+				return ev
+			}
+		case *l2tp.TunnelDownEvent:
+			_, ok := ev.(*l2tp.TunnelDownEvent)
+			if ok {
+				return ev
+			}
+		case *l2tp.SessionUpEvent:
+			_, ok := ev.(*l2tp.SessionUpEvent)
+			if ok {
+				return ev
+			}
+		case *l2tp.SessionDownEvent:
+			_, ok := ev.(*l2tp.SessionDownEvent)
+			if ok {
+				return ev
+			}
+		}
+		t.Fatalf("expected event %T, got %T", event, ev)
+	case <-time.After(testTimeout):
+		t.Fatalf("timed out waiting for event %T", event)
+	}
+	return nil
+}
+
+func newTestContext(t *testing.T) (*l2tp.Context, *testEventRecorder) {
+	ctx, err := l2tp.NewContext(nil, level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug()))
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	events := &testEventRecorder{events: make(chan interface{}, 16)}
+	ctx.RegisterEventHandler(events)
+	return ctx, events
+}
+
+func newTestPeer(t *testing.T, version l2tp.ProtocolVersion) *Peer {
+	peer, err := NewPeer(&PeerConfig{Version: version, TunnelID: 42})
+	if err != nil {
+		t.Fatalf("NewPeer(): %v", err)
+	}
+	return peer
+}
+
+func newTestTunnel(t *testing.T, ctx *l2tp.Context, peer *Peer, version l2tp.ProtocolVersion) l2tp.Tunnel {
+	tunl, err := ctx.NewDynamicTunnel("t1", &l2tp.TunnelConfig{
+		Local:          "127.0.0.1:0",
+		Peer:           peer.Addr(),
+		Version:        version,
+		Encap:          l2tp.EncapTypeUDP,
+		HelloTimeout:   250 * time.Millisecond,
+		RetryTimeout:   50 * time.Millisecond,
+		MaxRetries:     3,
+		StopCCNTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+	return tunl
+}
+
+// Run the control connection establishment handshake with the peer
+func establishTunnel(t *testing.T, peer *Peer, events *testEventRecorder) {
+	t.Helper()
+
+	sccrq, err := peer.Expect(MessageTypeSCCRQ, testTimeout)
+	if err != nil {
+		t.Fatalf("Expect(): %v", err)
+	}
+	if _, err := sccrq.FindAVP(AVPTypeHostName); !err {
+		t.Errorf("SCCRQ has no host name AVP")
+	}
+	if peer.PeerTunnelID() == 0 {
+		t.Errorf("peer failed to learn tunnel ID from SCCRQ")
+	}
+
+	err = peer.Send(peer.SCCRP())
+	if err != nil {
+		t.Fatalf("Send(): %v", err)
+	}
+
+	_, err = peer.Expect(MessageTypeSCCCN, testTimeout)
+	if err != nil {
+		t.Fatalf("Expect(): %v", err)
+	}
+
+	events.expect(t, &l2tp.TunnelUpEvent{})
+}
+
+var testVersions = []struct {
+	name       string
+	version    l2tp.ProtocolVersion
+	pseudowire l2tp.PseudowireType
+}{
+	{"L2TPv2", l2tp.ProtocolVersion2, l2tp.PseudowireTypePPP},
+	{"L2TPv3", l2tp.ProtocolVersion3, l2tp.PseudowireTypeEth},
+}
+
+func TestPeerStopCCN(t *testing.T) {
+	for _, v := range testVersions {
+		t.Run(v.name, func(t *testing.T) {
+			ctx, events := newTestContext(t)
+			defer ctx.Close()
+
+			peer := newTestPeer(t, v.version)
+			defer peer.Close()
+
+			newTestTunnel(t, ctx, peer, v.version)
+			establishTunnel(t, peer, events)
+
+			err := peer.Send(peer.StopCCN(6, 0, "shutting down"))
+			if err != nil {
+				t.Fatalf("Send(): %v", err)
+			}
+
+			events.expect(t, &l2tp.TunnelDownEvent{})
+		})
+	}
+}
+
+func TestPeerRejectsTunnel(t *testing.T) {
+	for _, v := range testVersions {
+		t.Run(v.name, func(t *testing.T) {
+			ctx, events := newTestContext(t)
+			defer ctx.Close()
+
+			peer := newTestPeer(t, v.version)
+			defer peer.Close()
+
+			tunl := newTestTunnel(t, ctx, peer, v.version)
+
+			_, err := peer.Expect(MessageTypeSCCRQ, testTimeout)
+			if err != nil {
+				t.Fatalf("Expect(): %v", err)
+			}
+
+			err = peer.Send(peer.StopCCN(2, 0, "go away"))
+			if err != nil {
+				t.Fatalf("Send(): %v", err)
+			}
+
+			// The tunnel never came up, so there's no event to wait for
+			deadline := time.Now().Add(testTimeout)
+			for tunl.State() != "dead" {
+				if time.Now().After(deadline) {
+					t.Fatalf("timed out waiting for tunnel to close, state %q", tunl.State())
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			select {
+			case ev := <-events.events:
+				t.Errorf("unexpected event %T", ev)
+			default:
+			}
+		})
+	}
+}
+
+func TestPeerCDN(t *testing.T) {
+	for _, v := range testVersions {
+		t.Run(v.name, func(t *testing.T) {
+			ctx, events := newTestContext(t)
+			defer ctx.Close()
+
+			peer := newTestPeer(t, v.version)
+			defer peer.Close()
+
+			tunl := newTestTunnel(t, ctx, peer, v.version)
+			establishTunnel(t, peer, events)
+
+			_, err := tunl.NewSession("s1", &l2tp.SessionConfig{Pseudowire: v.pseudowire})
+			if err != nil {
+				t.Fatalf("NewSession(): %v", err)
+			}
+
+			icrq, err := peer.Expect(MessageTypeICRQ, testTimeout)
+			if err != nil {
+				t.Fatalf("Expect(): %v", err)
+			}
+
+			icrp, err := peer.ICRP(icrq, 1234)
+			if err != nil {
+				t.Fatalf("ICRP(): %v", err)
+			}
+			err = peer.Send(icrp)
+			if err != nil {
+				t.Fatalf("Send(): %v", err)
+			}
+
+			_, err = peer.Expect(MessageTypeICCN, testTimeout)
+			if err != nil {
+				t.Fatalf("Expect(): %v", err)
+			}
+
+			ev := events.expect(t, &l2tp.SessionUpEvent{}).(*l2tp.SessionUpEvent)
+			if ev.SessionConfig.PeerSessionID != 1234 {
+				t.Errorf("expected peer session ID 1234, got %v", ev.SessionConfig.PeerSessionID)
+			}
+
+			cdn, err := peer.CDN(icrq, 1234, 3, 0, "")
+			if err != nil {
+				t.Fatalf("CDN(): %v", err)
+			}
+			err = peer.Send(cdn)
+			if err != nil {
+				t.Fatalf("Send(): %v", err)
+			}
+
+			events.expect(t, &l2tp.SessionDownEvent{})
+		})
+	}
+}
+
+func TestPeerSilent(t *testing.T) {
+	for _, v := range testVersions {
+		t.Run(v.name, func(t *testing.T) {
+			ctx, events := newTestContext(t)
+			defer ctx.Close()
+
+			peer := newTestPeer(t, v.version)
+			defer peer.Close()
+
+			newTestTunnel(t, ctx, peer, v.version)
+			establishTunnel(t, peer, events)
+
+			peer.SetSilent(true)
+
+			// The tunnel should send a HELLO, and give up when it
+			// isn't acknowledged
+			_, err := peer.Expect(MessageTypeHello, testTimeout)
+			if err != nil {
+				t.Fatalf("Expect(): %v", err)
+			}
+
+			events.expect(t, &l2tp.TunnelDownEvent{})
+		})
+	}
+}
+
+func TestPeerUnknownMandatoryAVP(t *testing.T) {
+	for _, v := range testVersions {
+		t.Run(v.name, func(t *testing.T) {
+			ctx, events := newTestContext(t)
+			defer ctx.Close()
+
+			peer := newTestPeer(t, v.version)
+			defer peer.Close()
+
+			newTestTunnel(t, ctx, peer, v.version)
+			establishTunnel(t, peer, events)
+
+			// RFC2661 and RFC3931 require the tunnel to be torn down
+			// on receipt of an unrecognised mandatory AVP
+			hello := peer.Hello()
+			hello.AVPs = append(hello.AVPs, AVP{VendorID: 0, Type: 1000, Mandatory: true, Value: []byte{0}})
+			err := peer.Send(hello)
+			if err != nil {
+				t.Fatalf("Send(): %v", err)
+			}
+
+			// The peer is told why with a general error StopCCN
+			stopccn, err := peer.Expect(MessageTypeStopCCN, testTimeout)
+			if err != nil {
+				t.Fatalf("Expect(): %v", err)
+			}
+			result, errCode, _, err := stopccn.ResultCode()
+			if err != nil || result != 2 || errCode != 8 {
+				t.Errorf("expected result 2 error 8, got %v, %v, %v", result, errCode, err)
+			}
+
+			events.expect(t, &l2tp.TunnelDownEvent{})
+		})
+	}
+}
+
+func TestPeerSessionUnknownMandatoryAVP(t *testing.T) {
+	ctx, events := newTestContext(t)
+	defer ctx.Close()
+
+	peer := newTestPeer(t, l2tp.ProtocolVersion2)
+	defer peer.Close()
+
+	tunl := newTestTunnel(t, ctx, peer, l2tp.ProtocolVersion2)
+	establishTunnel(t, peer, events)
+
+	_, err := tunl.NewSession("s1", &l2tp.SessionConfig{Pseudowire: l2tp.PseudowireTypePPP})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+
+	icrq, err := peer.Expect(MessageTypeICRQ, testTimeout)
+	if err != nil {
+		t.Fatalf("Expect(): %v", err)
+	}
+	sid, err := icrq.AssignedSessionID()
+	if err != nil {
+		t.Fatalf("AssignedSessionID(): %v", err)
+	}
+	icrp, err := peer.ICRP(icrq, 1234)
+	if err != nil {
+		t.Fatalf("ICRP(): %v", err)
+	}
+	err = peer.Send(icrp)
+	if err != nil {
+		t.Fatalf("Send(): %v", err)
+	}
+	_, err = peer.Expect(MessageTypeICCN, testTimeout)
+	if err != nil {
+		t.Fatalf("Expect(): %v", err)
+	}
+	events.expect(t, &l2tp.SessionUpEvent{})
+
+	// RFC2661 requires that an unrecognised mandatory AVP in a
+	// message for a session terminates only that session
+	sli := NewMessage(MessageTypeSLI,
+		BytesAVP(AVPType(35), make([]byte, 10)),
+		AVP{VendorID: 0, Type: 1000, Mandatory: true, Value: []byte{0}})
+	sli.SessionID = sid
+	err = peer.Send(sli)
+	if err != nil {
+		t.Fatalf("Send(): %v", err)
+	}
+
+	cdn, err := peer.Expect(MessageTypeCDN, testTimeout)
+	if err != nil {
+		t.Fatalf("Expect(): %v", err)
+	}
+	result, errCode, _, err := cdn.ResultCode()
+	if err != nil || result != 2 || errCode != 8 {
+		t.Errorf("expected result 2 error 8, got %v, %v, %v", result, errCode, err)
+	}
+	events.expect(t, &l2tp.SessionDownEvent{})
+
+	if state := tunl.State(); state != "established" {
+		t.Errorf("expected tunnel established, got %q", state)
+	}
+}
+
+func TestMessageEncodeDecode(t *testing.T) {
+	for _, v := range testVersions {
+		t.Run(v.name, func(t *testing.T) {
+			in := NewMessage(MessageTypeCDN,
+				ResultCodeAVP(2, 6, "oops"),
+				Uint32AVP(AVPTypeLocalSessionID, 0x01020304),
+				Uint16AVP(AVPTypeSessionID, 0x0506))
+			in.TunnelID = 42
+			in.Ns = 3
+			in.Nr = 7
+
+			b, err := in.encode(v.version)
+			if err != nil {
+				t.Fatalf("encode(): %v", err)
+			}
+
+			out, err := decodeMessages(v.version, b)
+			if err != nil {
+				t.Fatalf("decodeMessages(): %v", err)
+			}
+			if len(out) != 1 {
+				t.Fatalf("expected 1 message, got %v", len(out))
+			}
+
+			m := out[0]
+			if m.Type != in.Type || m.TunnelID != in.TunnelID || m.Ns != in.Ns || m.Nr != in.Nr {
+				t.Errorf("expected %v, got %v", in, m)
+			}
+
+			result, errCode, errMsg, err := m.ResultCode()
+			if err != nil || result != 2 || errCode != 6 || errMsg != "oops" {
+				t.Errorf("ResultCode(): got %v, %v, %q, %v", result, errCode, errMsg, err)
+			}
+
+			sid, err := m.AssignedSessionID()
+			if err != nil || sid != 0x01020304 {
+				t.Errorf("AssignedSessionID(): got %v, %v", sid, err)
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package l2tp
 
 import (
 	"bytes"
+	"crypto/md5"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -71,6 +73,7 @@ func v2SccrqMsgSpec() *msgSpec {
 	spec.m[avpTypeTiebreaker] = mayExist
 	spec.m[avpTypeFirmwareRevision] = mayExist
 	spec.m[avpTypeVendorName] = mayExist
+	spec.m[avpTypeRandomVector] = mayExist
 	return &spec
 }
 
@@ -91,6 +94,7 @@ func v2SccrpMsgSpec() *msgSpec {
 	spec.m[avpTypeTiebreaker] = mayExist
 	spec.m[avpTypeFirmwareRevision] = mayExist
 	spec.m[avpTypeVendorName] = mayExist
+	spec.m[avpTypeRandomVector] = mayExist
 	return &spec
 }
 
@@ -99,6 +103,7 @@ func v2ScccnMsgSpec() *msgSpec {
 	spec := msgSpec{make(map[avpType]avpSpec)}
 	spec.m[avpTypeMessage] = mustExist
 	spec.m[avpTypeChallengeResponse] = mayExist
+	spec.m[avpTypeRandomVector] = mayExist
 	return &spec
 }
 
@@ -108,6 +113,7 @@ func v2StopccnMsgSpec() *msgSpec {
 	spec.m[avpTypeMessage] = mustExist
 	spec.m[avpTypeTunnelID] = mustExist
 	spec.m[avpTypeResultCode] = mustExist
+	spec.m[avpTypeRandomVector] = mayExist
 	return &spec
 }
 
@@ -115,6 +121,7 @@ func v2HelloMsgSpec() *msgSpec {
 	/* Ref: RFC2661 section 6.5 */
 	spec := msgSpec{make(map[avpType]avpSpec)}
 	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeRandomVector] = mayExist
 	return &spec
 }
 
@@ -129,6 +136,7 @@ func v2IcrqMsgSpec() *msgSpec {
 	spec.m[avpTypeCallingNumber] = mayExist
 	spec.m[avpTypeCalledNumber] = mayExist
 	spec.m[avpTypeSubAddress] = mayExist
+	spec.m[avpTypeRandomVector] = mayExist
 	return &spec
 }
 
@@ -137,6 +145,7 @@ func v2IcrpMsgSpec() *msgSpec {
 	spec := msgSpec{make(map[avpType]avpSpec)}
 	spec.m[avpTypeMessage] = mustExist
 	spec.m[avpTypeSessionID] = mustExist
+	spec.m[avpTypeRandomVector] = mayExist
 	return &spec
 }
 
@@ -157,6 +166,45 @@ func v2IccnMsgSpec() *msgSpec {
 	spec.m[avpTypePrivGroupID] = mayExist
 	spec.m[avpTypeRxConnectSpeed] = mayExist
 	spec.m[avpTypeSequencingRequired] = mayExist
+	spec.m[avpTypeRandomVector] = mayExist
+	return &spec
+}
+
+func v2OcrqMsgSpec() *msgSpec {
+	/* Ref: RFC2661 section 6.9 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeSessionID] = mustExist
+	spec.m[avpTypeCallSerialNumber] = mustExist
+	spec.m[avpTypeMinimumBps] = mustExist
+	spec.m[avpTypeMaximumBps] = mustExist
+	spec.m[avpTypeBearerType] = mustExist
+	spec.m[avpTypeFramingType] = mustExist
+	spec.m[avpTypeCalledNumber] = mustExist
+	spec.m[avpTypeSubAddress] = mayExist
+	spec.m[avpTypeRandomVector] = mayExist
+	return &spec
+}
+
+func v2OcrpMsgSpec() *msgSpec {
+	/* Ref: RFC2661 section 6.10 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeSessionID] = mustExist
+	spec.m[avpTypePhysicalChannelID] = mayExist
+	spec.m[avpTypeRandomVector] = mayExist
+	return &spec
+}
+
+func v2OccnMsgSpec() *msgSpec {
+	/* Ref: RFC2661 section 6.11 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeConnectSpeed] = mustExist
+	spec.m[avpTypeFramingType] = mustExist
+	spec.m[avpTypeRxConnectSpeed] = mayExist
+	spec.m[avpTypeSequencingRequired] = mayExist
+	spec.m[avpTypeRandomVector] = mayExist
 	return &spec
 }
 
@@ -167,6 +215,7 @@ func v2CdnMsgSpec() *msgSpec {
 	spec.m[avpTypeResultCode] = mustExist
 	spec.m[avpTypeSessionID] = mustExist
 	spec.m[avpTypeQ931CauseCode] = mayExist
+	spec.m[avpTypeRandomVector] = mayExist
 	return &spec
 }
 
@@ -175,6 +224,7 @@ func v2WenMsgSpec() *msgSpec {
 	spec := msgSpec{make(map[avpType]avpSpec)}
 	spec.m[avpTypeMessage] = mustExist
 	spec.m[avpTypeCallErrors] = mustExist
+	spec.m[avpTypeRandomVector] = mayExist
 	return &spec
 }
 
@@ -183,6 +233,7 @@ func v2SliMsgSpec() *msgSpec {
 	spec := msgSpec{make(map[avpType]avpSpec)}
 	spec.m[avpTypeMessage] = mustExist
 	spec.m[avpTypeAccm] = mustExist
+	spec.m[avpTypeRandomVector] = mayExist
 	return &spec
 }
 
@@ -204,6 +255,12 @@ func getV2MsgSpec(t avpMsgType) (*msgSpec, error) {
 		return v2IcrpMsgSpec(), nil
 	case avpMsgTypeIccn:
 		return v2IccnMsgSpec(), nil
+	case avpMsgTypeOcrq:
+		return v2OcrqMsgSpec(), nil
+	case avpMsgTypeOcrp:
+		return v2OcrpMsgSpec(), nil
+	case avpMsgTypeOccn:
+		return v2OccnMsgSpec(), nil
 	case avpMsgTypeCdn:
 		return v2CdnMsgSpec(), nil
 	case avpMsgTypeWen:
@@ -214,6 +271,161 @@ func getV2MsgSpec(t avpMsgType) (*msgSpec, error) {
 	return nil, fmt.Errorf("no specification for v2 message %v", t)
 }
 
+func v3SccrqMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.1 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeHostName] = mustExist
+	spec.m[avpTypeRouterID] = mustExist
+	spec.m[avpTypeAssignedConnID] = mustExist
+	spec.m[avpTypePseudowireCaps] = mustExist
+
+	spec.m[avpTypeRandomVector] = mayExist
+	spec.m[avpTypeControlAuthNonce] = mayExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeTiebreaker] = mayExist
+	spec.m[avpTypeFirmwareRevision] = mayExist
+	spec.m[avpTypeVendorName] = mayExist
+	spec.m[avpTypeRxWindowSize] = mayExist
+	spec.m[avpTypePreferredLanguage] = mayExist
+
+	// RFC3931 section 4.7 allows for L2TPv2 AVPs to be included
+	// for backwards compatibility
+	spec.m[avpTypeProtocolVersion] = mayExist
+	spec.m[avpTypeFramingCap] = mayExist
+	spec.m[avpTypeBearerCap] = mayExist
+	spec.m[avpTypeTunnelID] = mayExist
+	return &spec
+}
+
+func v3SccrpMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.2 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeHostName] = mustExist
+	spec.m[avpTypeRouterID] = mustExist
+	spec.m[avpTypeAssignedConnID] = mustExist
+	spec.m[avpTypePseudowireCaps] = mustExist
+
+	spec.m[avpTypeRandomVector] = mayExist
+	spec.m[avpTypeControlAuthNonce] = mayExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeFirmwareRevision] = mayExist
+	spec.m[avpTypeVendorName] = mayExist
+	spec.m[avpTypeRxWindowSize] = mayExist
+	spec.m[avpTypePreferredLanguage] = mayExist
+
+	// RFC3931 section 4.7 allows for L2TPv2 AVPs to be included
+	// for backwards compatibility
+	spec.m[avpTypeProtocolVersion] = mayExist
+	spec.m[avpTypeFramingCap] = mayExist
+	spec.m[avpTypeBearerCap] = mayExist
+	spec.m[avpTypeTunnelID] = mayExist
+	return &spec
+}
+
+func v3ScccnMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.3 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeRandomVector] = mayExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	return &spec
+}
+
+func v3StopccnMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.4 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeResultCode] = mustExist
+	spec.m[avpTypeRandomVector] = mayExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeAssignedConnID] = mayExist
+	return &spec
+}
+
+func v3IcrqMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.6 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeLocalSessionID] = mustExist
+	spec.m[avpTypeRemoteSessionID] = mustExist
+	spec.m[avpTypeCallSerialNumber] = mustExist
+	spec.m[avpTypePseudowireType] = mustExist
+	spec.m[avpTypeRemoteEndID] = mustExist
+	spec.m[avpTypeCircuitStatus] = mustExist
+
+	spec.m[avpTypeRandomVector] = mayExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeAssignedCookie] = mayExist
+	spec.m[avpTypeTiebreaker] = mayExist
+	spec.m[avpTypeL2specificSublayer] = mayExist
+	spec.m[avpTypeDataSequencing] = mayExist
+	spec.m[avpTypeTxConnectSpeedBps] = mayExist
+	spec.m[avpTypeRxConnectSpeedBps] = mayExist
+	spec.m[avpTypePhysicalChannelID] = mayExist
+	return &spec
+}
+
+func v3IcrpMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.7 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeLocalSessionID] = mustExist
+	spec.m[avpTypeRemoteSessionID] = mustExist
+	spec.m[avpTypeCircuitStatus] = mustExist
+
+	spec.m[avpTypeRandomVector] = mayExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeAssignedCookie] = mayExist
+	spec.m[avpTypeL2specificSublayer] = mayExist
+	spec.m[avpTypeDataSequencing] = mayExist
+	spec.m[avpTypeTxConnectSpeedBps] = mayExist
+	spec.m[avpTypeRxConnectSpeedBps] = mayExist
+	spec.m[avpTypePhysicalChannelID] = mayExist
+	return &spec
+}
+
+func v3IccnMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.8 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeLocalSessionID] = mustExist
+	spec.m[avpTypeRemoteSessionID] = mustExist
+
+	spec.m[avpTypeRandomVector] = mayExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeL2specificSublayer] = mayExist
+	spec.m[avpTypeDataSequencing] = mayExist
+	spec.m[avpTypeTxConnectSpeedBps] = mayExist
+	spec.m[avpTypeRxConnectSpeedBps] = mayExist
+	return &spec
+}
+
+func v3CdnMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.12 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeResultCode] = mustExist
+	spec.m[avpTypeLocalSessionID] = mustExist
+	spec.m[avpTypeRemoteSessionID] = mustExist
+
+	spec.m[avpTypeRandomVector] = mayExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeQ931CauseCode] = mayExist
+	return &spec
+}
+
+func v3AckMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.15 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	return &spec
+}
+
 func v3HelloMsgSpec() *msgSpec {
 	/* Ref: RFC3931 section 6.5 */
 	spec := msgSpec{make(map[avpType]avpSpec)}
@@ -225,8 +437,26 @@ func v3HelloMsgSpec() *msgSpec {
 
 func getV3MsgSpec(t avpMsgType) (*msgSpec, error) {
 	switch t {
+	case avpMsgTypeSccrq:
+		return v3SccrqMsgSpec(), nil
+	case avpMsgTypeSccrp:
+		return v3SccrpMsgSpec(), nil
+	case avpMsgTypeScccn:
+		return v3ScccnMsgSpec(), nil
+	case avpMsgTypeStopccn:
+		return v3StopccnMsgSpec(), nil
 	case avpMsgTypeHello:
 		return v3HelloMsgSpec(), nil
+	case avpMsgTypeIcrq:
+		return v3IcrqMsgSpec(), nil
+	case avpMsgTypeIcrp:
+		return v3IcrpMsgSpec(), nil
+	case avpMsgTypeIccn:
+		return v3IccnMsgSpec(), nil
+	case avpMsgTypeCdn:
+		return v3CdnMsgSpec(), nil
+	case avpMsgTypeAck:
+		return v3AckMsgSpec(), nil
 	}
 	return nil, fmt.Errorf("no specification for v3 message %v", t)
 }
@@ -308,6 +538,7 @@ func newL2tpV3MessageHeader(ccid uint32, ns, nr uint16, payloadBytes int) *l2tpV
 func bytesToV2CtlMsg(b []byte) (msg *v2ControlMessage, err error) {
 	var hdr l2tpV2Header
 	var avps []avp
+	var avpErr error
 
 	r := bytes.NewReader(b)
 	if err = binary.Read(r, binary.BigEndian, &hdr); err != nil {
@@ -318,11 +549,21 @@ func bytesToV2CtlMsg(b []byte) (msg *v2ControlMessage, err error) {
 	// so they're valid L2TPv2 messages.  Don't try to parse the AVP payload in this case.
 	if hdr.Common.Len > v2HeaderLen {
 		if avps, err = parseAVPBuffer(b[v2HeaderLen:hdr.Common.Len]); err != nil {
-			return nil, err
+			// RFC2661 section 4.1 says an unrecognised mandatory AVP in
+			// a message for a session terminates just that session.
+			// Return the message so it is sequenced and acked as normal,
+			// and leave the session to tear itself down.
+			if !errors.Is(err, errUnknownMandatoryAVP) || hdr.Sid == 0 || len(avps) == 0 {
+				return nil, err
+			}
+			avpErr = err
 		}
 		// RFC2661 says the first AVP in the message MUST be the Message Type AVP,
 		// so let's validate that now.
 		if avps[0].getType() != avpTypeMessage {
+			if avpErr != nil {
+				return nil, avpErr
+			}
 			return nil, errors.New("invalid L2TPv2 message: first AVP is not Message Type AVP")
 		}
 	}
@@ -330,6 +571,7 @@ func bytesToV2CtlMsg(b []byte) (msg *v2ControlMessage, err error) {
 	return &v2ControlMessage{
 		header: hdr,
 		avps:   avps,
+		avpErr: avpErr,
 	}, nil
 }
 
@@ -355,6 +597,7 @@ func bytesToV3CtlMsg(b []byte) (msg *v3ControlMessage, err error) {
 	return &v3ControlMessage{
 		header: hdr,
 		avps:   avps,
+		raw:    b[:hdr.Common.Len],
 	}, nil
 }
 
@@ -376,6 +619,8 @@ type controlMessage interface {
 	getType() avpMsgType
 	// appendAvp appends an AVP to the message.
 	appendAvp(avp *avp)
+	// setAvps replaces the AVPs held by the message.
+	setAvps(avps []avp)
 	// setTransportSeqNum sets the header sequence numbers.
 	setTransportSeqNum(ns, nr uint16)
 	// toBytes encodes the message as bytes for transmission.
@@ -389,12 +634,19 @@ type controlMessage interface {
 type v2ControlMessage struct {
 	header l2tpV2Header
 	avps   []avp
+	// avpErr is set if the message is for a session and carries an
+	// unrecognised mandatory AVP, in which case the session must be
+	// torn down.
+	avpErr error
 }
 
 // v3ControlMessage represents an RFC3931 control message
 type v3ControlMessage struct {
 	header l2tpV3Header
 	avps   []avp
+	// raw is the buffer the message was parsed from, if any.
+	// It is used for message digest verification.
+	raw []byte
 }
 
 func (m *v2ControlMessage) protocolVersion() ProtocolVersion {
@@ -454,6 +706,11 @@ func (m *v2ControlMessage) appendAvp(avp *avp) {
 	m.header.Common.Len += uint16(avp.totalLen())
 }
 
+func (m *v2ControlMessage) setAvps(avps []avp) {
+	m.avps = avps
+	m.header.Common.Len = uint16(v2HeaderLen + avpsLengthBytes(avps))
+}
+
 func (m *v2ControlMessage) setTransportSeqNum(ns, nr uint16) {
 	m.header.Ns = ns
 	m.header.Nr = nr
@@ -532,6 +789,11 @@ func (m *v3ControlMessage) appendAvp(avp *avp) {
 	m.header.Common.Len += uint16(avp.totalLen())
 }
 
+func (m *v3ControlMessage) setAvps(avps []avp) {
+	m.avps = avps
+	m.header.Common.Len = uint16(v3HeaderLen + avpsLengthBytes(avps))
+}
+
 func (m *v3ControlMessage) setTransportSeqNum(ns, nr uint16) {
 	m.header.Ns = ns
 	m.header.Nr = nr
@@ -662,6 +924,17 @@ func buildV2Msg(ptid ControlConnID, psid ControlConnID, in []avpIn) (msg *v2Cont
 	return
 }
 
+// v2ChallengeResponse computes the value of the Challenge Response AVP
+// for the message type carrying the response as per RFC2661 section 4.4.3:
+// MD5(message type + secret + challenge), where the message type is a
+// single octet.
+func v2ChallengeResponse(msgType avpMsgType, secret, challenge []byte) []byte {
+	b := append([]byte{byte(msgType)}, secret...)
+	b = append(b, challenge...)
+	sum := md5.Sum(b)
+	return sum[:]
+}
+
 // newV2Sccrq builds a new SCCRQ message
 func newV2Sccrq(cfg *TunnelConfig) (msg *v2ControlMessage, err error) {
 	/* RFC2661 says we MUST include:
@@ -830,8 +1103,132 @@ func newV2Iccn(ptid ControlConnID, scfg *SessionConfig) (msg *v2ControlMessage,
 	*/
 	in := []avpIn{
 		{avpTypeMessage, avpMsgTypeIccn},
-		{avpTypeConnectSpeed, uint32(0)},                               // TODO: config field?
-		{avpTypeFramingType, uint32(FramingCapSync | FramingCapAsync)}, // TODO: config field?
+		{avpTypeConnectSpeed, scfg.ConnectSpeed},
+		{avpTypeFramingType, v2FramingType(scfg.FramingType)},
+	}
+	in = append(in, v2ProxyLCPAvps(scfg.ProxyLCP)...)
+	in = append(in, v2ProxyAuthAvps(scfg.ProxyAuth)...)
+	return buildV2Msg(ptid, scfg.PeerSessionID, in)
+}
+
+// v2ProxyLCPAvps returns the proxy LCP AVPs to include in ICCN.
+// Ref: RFC2661 section 4.4.5
+func v2ProxyLCPAvps(lcp *ProxyLCP) (in []avpIn) {
+	if lcp == nil {
+		return nil
+	}
+	if len(lcp.InitialReceivedConfReq) > 0 {
+		in = append(in, avpIn{avpTypeInitialRcvdLcpConfreq, lcp.InitialReceivedConfReq})
+	}
+	if len(lcp.LastSentConfReq) > 0 {
+		in = append(in, avpIn{avpTypeLastSentLcpConfreq, lcp.LastSentConfReq})
+	}
+	if len(lcp.LastReceivedConfReq) > 0 {
+		in = append(in, avpIn{avpTypeLastRcvdLcpConfreq, lcp.LastReceivedConfReq})
+	}
+	return
+}
+
+// v2ProxyAuthAvps returns the proxy authentication AVPs to include in ICCN.
+// Ref: RFC2661 section 4.4.5
+func v2ProxyAuthAvps(auth *ProxyAuth) (in []avpIn) {
+	if auth == nil {
+		return nil
+	}
+	in = append(in, avpIn{avpTypeProxyAuthType, uint16(auth.Type)})
+	if auth.Name != "" {
+		in = append(in, avpIn{avpTypeProxyAuthName, auth.Name})
+	}
+	if len(auth.Challenge) > 0 {
+		in = append(in, avpIn{avpTypeProxyAuthChallenge, auth.Challenge})
+	}
+	if auth.Type == ProxyAuthTypeCHAP || auth.Type == ProxyAuthTypeMSCHAPv1 {
+		// The ID is carried in the low octet, the high octet is reserved
+		in = append(in, avpIn{avpTypeProxyAuthID, []byte{0, auth.ID}})
+	}
+	if len(auth.Response) > 0 {
+		in = append(in, avpIn{avpTypeProxyAuthResponse, auth.Response})
+	}
+	return
+}
+
+// v2FramingType returns the Framing Type AVP value to use,
+// defaulting to both sync and async framing if unset.
+func v2FramingType(framing FramingCapability) uint32 {
+	if framing == 0 {
+		return uint32(FramingCapSync | FramingCapAsync)
+	}
+	return uint32(framing)
+}
+
+// newV2Ocrq builds a new OCRQ message
+func newV2Ocrq(callSerial uint32, ptid ControlConnID, scfg *SessionConfig, call *OutgoingCallParameters) (msg *v2ControlMessage, err error) {
+	/* RFC2661 says we MUST include:
+
+	- Message Type
+	- Assigned Session ID
+	- Call Serial Number
+	- Minimum BPS
+	- Maximum BPS
+	- Bearer Type
+	- Framing Type
+	- Called Number
+
+	and we MAY include:
+
+	- Sub-Address
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeOcrq},
+		{avpTypeSessionID, uint16(scfg.SessionID)},
+		{avpTypeCallSerialNumber, callSerial},
+		{avpTypeMinimumBps, call.MinimumBPS},
+		{avpTypeMaximumBps, call.MaximumBPS},
+		{avpTypeBearerType, call.BearerType},
+		{avpTypeFramingType, v2FramingType(call.FramingType)},
+		{avpTypeCalledNumber, call.CalledNumber},
+	}
+	if call.SubAddress != "" {
+		in = append(in, avpIn{avpTypeSubAddress, call.SubAddress})
+	}
+	return buildV2Msg(ptid, 0, in)
+}
+
+// newV2Ocrp builds a new OCRP message
+func newV2Ocrp(ptid ControlConnID, scfg *SessionConfig) (msg *v2ControlMessage, err error) {
+	/* RFC2661 says we MUST include:
+
+	- Message Type
+	- Assigned Session ID
+
+	and we MAY include:
+
+	- Physical Channel ID
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeOcrp},
+		{avpTypeSessionID, uint16(scfg.SessionID)},
+	}
+	return buildV2Msg(ptid, scfg.PeerSessionID, in)
+}
+
+// newV2Occn builds a new OCCN message
+func newV2Occn(ptid ControlConnID, scfg *SessionConfig) (msg *v2ControlMessage, err error) {
+	/* RFC2661 says we MUST include:
+
+	- Message Type
+	- (Tx) Connect Speed
+	- Framing Type
+
+	and we MAY include:
+
+	- Rx Connect Speed
+	- Sequencing Required
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeOccn},
+		{avpTypeConnectSpeed, scfg.ConnectSpeed},
+		{avpTypeFramingType, v2FramingType(scfg.FramingType)},
 	}
 	return buildV2Msg(ptid, scfg.PeerSessionID, in)
 }
@@ -863,3 +1260,457 @@ func newV3ControlMessage(ccid ControlConnID, avps []avp) (msg *v3ControlMessage,
 		avps:   avps,
 	}, nil
 }
+
+func buildV3Msg(pccid ControlConnID, in []avpIn) (msg *v3ControlMessage, err error) {
+	msg, err = newV3ControlMessage(pccid, []avp{})
+	if err != nil {
+		return
+	}
+	for _, i := range in {
+		avp, err := newAvp(vendorIDIetf, i.typ, i.data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create AVP %v: %v", i.typ, err)
+		}
+		msg.appendAvp(avp)
+	}
+	return
+}
+
+// v3PseudowireCaps returns the pseudowire types we advertise support for
+// in the Pseudowire Capabilities List AVP.
+func v3PseudowireCaps() []uint16 {
+	return []uint16{
+		uint16(PseudowireTypePPP),
+		uint16(PseudowireTypeEth),
+		uint16(PseudowireTypeEthVLAN),
+	}
+}
+
+// newV3Sccrq builds a new SCCRQ message
+func newV3Sccrq(cfg *TunnelConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Host Name
+	- Router ID
+	- Assigned Control Connection ID
+	- Pseudowire Capabilities List
+
+	and we MAY include:
+
+	- Random Vector
+	- Control Message Authentication Nonce
+	- Message Digest
+	- Control Connection Tie Breaker
+	- Vendor Name
+	- Receive Window Size
+	- Preferred Language
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeSccrq},
+		{avpTypeHostName, cfg.HostName},
+		{avpTypeRouterID, cfg.RouterID},
+		{avpTypeAssignedConnID, uint32(cfg.TunnelID)},
+		{avpTypePseudowireCaps, v3PseudowireCaps()},
+	}
+	return buildV3Msg(0, in)
+}
+
+// newV3Sccrp builds a new SCCRP message
+func newV3Sccrp(cfg *TunnelConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Host Name
+	- Router ID
+	- Assigned Control Connection ID
+	- Pseudowire Capabilities List
+
+	and we MAY include:
+
+	- Random Vector
+	- Control Message Authentication Nonce
+	- Message Digest
+	- Vendor Name
+	- Receive Window Size
+	- Preferred Language
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeSccrp},
+		{avpTypeHostName, cfg.HostName},
+		{avpTypeRouterID, cfg.RouterID},
+		{avpTypeAssignedConnID, uint32(cfg.TunnelID)},
+		{avpTypePseudowireCaps, v3PseudowireCaps()},
+	}
+	return buildV3Msg(cfg.PeerTunnelID, in)
+}
+
+// newV3Scccn builds a new SCCCN message
+func newV3Scccn(cfg *TunnelConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeScccn},
+	}
+	return buildV3Msg(cfg.PeerTunnelID, in)
+}
+
+// newV3Stopccn builds a new StopCCN message
+func newV3Stopccn(rc *resultCode, cfg *TunnelConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Result Code
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	- Assigned Control Connection ID
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeStopccn},
+		{avpTypeResultCode, rc},
+		{avpTypeAssignedConnID, uint32(cfg.TunnelID)},
+	}
+	return buildV3Msg(cfg.PeerTunnelID, in)
+}
+
+// newV3Hello builds a new HELLO message
+func newV3Hello(cfg *TunnelConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeHello},
+	}
+	return buildV3Msg(cfg.PeerTunnelID, in)
+}
+
+// v3CircuitStatus returns the value of the Circuit Status AVP for a
+// new session as per RFC3931 section 5.4.5: the circuit is both new
+// and active.
+func v3CircuitStatus() uint16 {
+	return 0x3
+}
+
+// v3DataSequencing returns the value of the Data Sequencing AVP used
+// to request that the peer sends sequence numbers in data messages as
+// per RFC3931 section 5.4.4.
+func v3DataSequencing(scfg *SessionConfig) uint16 {
+	if scfg.SeqNum {
+		return 2 // all incoming data packets require sequencing
+	}
+	return 0 // no incoming data packets require sequencing
+}
+
+// v3PseudowireType returns the value of the Pseudowire Type AVP for a
+// session.  PPP/AC pseudowires appear as PPP pseudowires to the peer.
+func v3PseudowireType(scfg *SessionConfig) uint16 {
+	if scfg.Pseudowire == PseudowireTypePPPAC {
+		return uint16(PseudowireTypePPP)
+	}
+	return uint16(scfg.Pseudowire)
+}
+
+// v3SessionAvps returns the optional AVPs which describe a session's
+// data plane parameters to the peer
+func v3SessionAvps(scfg *SessionConfig) (in []avpIn) {
+	if len(scfg.Cookie) > 0 {
+		in = append(in, avpIn{avpTypeAssignedCookie, scfg.Cookie})
+	}
+	in = append(in,
+		avpIn{avpTypeL2specificSublayer, uint16(scfg.L2SpecType)},
+		avpIn{avpTypeDataSequencing, v3DataSequencing(scfg)})
+	return
+}
+
+// newV3Icrq builds a new ICRQ message
+func newV3Icrq(callSerial uint32, pccid ControlConnID, scfg *SessionConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Local Session ID
+	- Remote Session ID
+	- Serial Number
+	- Pseudowire Type
+	- Remote End ID
+	- Circuit Status
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	- Assigned Cookie
+	- Session Tie Breaker
+	- L2-Specific Sublayer
+	- Data Sequencing
+	- Tx Connect Speed
+	- Rx Connect Speed
+	- Physical Channel ID
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeIcrq},
+		{avpTypeLocalSessionID, uint32(scfg.SessionID)},
+		{avpTypeRemoteSessionID, uint32(0)},
+		{avpTypeCallSerialNumber, callSerial},
+		{avpTypePseudowireType, v3PseudowireType(scfg)},
+		{avpTypeRemoteEndID, []byte{}},
+		{avpTypeCircuitStatus, v3CircuitStatus()},
+	}
+	in = append(in, v3SessionAvps(scfg)...)
+	return buildV3Msg(pccid, in)
+}
+
+// newV3Icrp builds a new ICRP message
+func newV3Icrp(pccid ControlConnID, scfg *SessionConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Local Session ID
+	- Remote Session ID
+	- Circuit Status
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	- Assigned Cookie
+	- L2-Specific Sublayer
+	- Data Sequencing
+	- Tx Connect Speed
+	- Rx Connect Speed
+	- Physical Channel ID
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeIcrp},
+		{avpTypeLocalSessionID, uint32(scfg.SessionID)},
+		{avpTypeRemoteSessionID, uint32(scfg.PeerSessionID)},
+		{avpTypeCircuitStatus, v3CircuitStatus()},
+	}
+	in = append(in, v3SessionAvps(scfg)...)
+	return buildV3Msg(pccid, in)
+}
+
+// newV3Iccn builds a new ICCN message
+func newV3Iccn(pccid ControlConnID, scfg *SessionConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Local Session ID
+	- Remote Session ID
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	- L2-Specific Sublayer
+	- Data Sequencing
+	- Tx Connect Speed
+	- Rx Connect Speed
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeIccn},
+		{avpTypeLocalSessionID, uint32(scfg.SessionID)},
+		{avpTypeRemoteSessionID, uint32(scfg.PeerSessionID)},
+		{avpTypeL2specificSublayer, uint16(scfg.L2SpecType)},
+		{avpTypeDataSequencing, v3DataSequencing(scfg)},
+	}
+	return buildV3Msg(pccid, in)
+}
+
+// newV3Cdn builds a new CDN message
+func newV3Cdn(pccid ControlConnID, rc *resultCode, scfg *SessionConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Result Code
+	- Local Session ID
+	- Remote Session ID
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	- Q.931 Cause Code
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeCdn},
+		{avpTypeResultCode, rc},
+		{avpTypeLocalSessionID, uint32(scfg.SessionID)},
+		{avpTypeRemoteSessionID, uint32(scfg.PeerSessionID)},
+	}
+	return buildV3Msg(pccid, in)
+}
+
+// findPeerControlConnID looks up the peer's control connection ID
+// from an SCCRQ or SCCRP message.
+// For L2TPv2 this is the Assigned Tunnel ID AVP, while for L2TPv3
+// this is the Assigned Control Connection ID AVP.
+func findPeerControlConnID(msg controlMessage) (ControlConnID, error) {
+	switch msg.protocolVersion() {
+	case ProtocolVersion2:
+		ptid, err := findUint16Avp(msg.getAvps(), vendorIDIetf, avpTypeTunnelID)
+		return ControlConnID(ptid), err
+	case ProtocolVersion3:
+		pccid, err := findUint32Avp(msg.getAvps(), vendorIDIetf, avpTypeAssignedConnID)
+		return ControlConnID(pccid), err
+	}
+	return 0, fmt.Errorf("unhandled protocol version %v", msg.protocolVersion())
+}
+
+// findProxyLCP looks up proxy LCP data from an ICCN message.
+// Returns nil if the message carries no proxy LCP AVPs.
+func findProxyLCP(msg controlMessage) *ProxyLCP {
+	avps := msg.getAvps()
+	lcp := ProxyLCP{}
+	lcp.InitialReceivedConfReq, _ = findBytesAvp(avps, vendorIDIetf, avpTypeInitialRcvdLcpConfreq)
+	lcp.LastSentConfReq, _ = findBytesAvp(avps, vendorIDIetf, avpTypeLastSentLcpConfreq)
+	lcp.LastReceivedConfReq, _ = findBytesAvp(avps, vendorIDIetf, avpTypeLastRcvdLcpConfreq)
+	if lcp.InitialReceivedConfReq == nil &&
+		lcp.LastSentConfReq == nil &&
+		lcp.LastReceivedConfReq == nil {
+		return nil
+	}
+	return &lcp
+}
+
+// findProxyAuth looks up proxy authentication data from an ICCN message.
+// Returns nil if the message carries no Proxy Authen Type AVP.
+func findProxyAuth(msg controlMessage) (*ProxyAuth, error) {
+	avps := msg.getAvps()
+	typ, err := findUint16Avp(avps, vendorIDIetf, avpTypeProxyAuthType)
+	if err != nil {
+		return nil, nil
+	}
+	auth := ProxyAuth{Type: ProxyAuthType(typ)}
+	auth.Name, _ = findStringAvp(avps, vendorIDIetf, avpTypeProxyAuthName)
+	auth.Challenge, _ = findBytesAvp(avps, vendorIDIetf, avpTypeProxyAuthChallenge)
+	auth.Response, _ = findBytesAvp(avps, vendorIDIetf, avpTypeProxyAuthResponse)
+	if id, err := findBytesAvp(avps, vendorIDIetf, avpTypeProxyAuthID); err == nil {
+		if len(id) != 2 {
+			return nil, fmt.Errorf("bad Proxy Authen ID AVP length %d", len(id))
+		}
+		auth.ID = id[1]
+	}
+	return &auth, nil
+}
+
+// findAccm looks up the send and receive ACCM values from an SLI message.
+// The ACCM AVP value is a reserved 16 bit field followed by the 32 bit
+// send and receive ACCMs.
+// Ref: RFC2661 section 4.4.6
+func findAccm(msg controlMessage) (send, recv uint32, err error) {
+	b, err := findBytesAvp(msg.getAvps(), vendorIDIetf, avpTypeAccm)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(b) != 10 {
+		return 0, 0, fmt.Errorf("bad ACCM AVP length %d", len(b))
+	}
+	return binary.BigEndian.Uint32(b[2:]), binary.BigEndian.Uint32(b[6:]), nil
+}
+
+// findCallErrors looks up the call error counters from a WEN message.
+// The Call Errors AVP value is a reserved 16 bit field followed by six
+// 32 bit counters.
+// Ref: RFC2661 section 4.4.6
+func findCallErrors(msg controlMessage) (*CallErrors, error) {
+	b, err := findBytesAvp(msg.getAvps(), vendorIDIetf, avpTypeCallErrors)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 26 {
+		return nil, fmt.Errorf("bad Call Errors AVP length %d", len(b))
+	}
+	return &CallErrors{
+		CRCErrors:        binary.BigEndian.Uint32(b[2:]),
+		FramingErrors:    binary.BigEndian.Uint32(b[6:]),
+		HardwareOverruns: binary.BigEndian.Uint32(b[10:]),
+		BufferOverruns:   binary.BigEndian.Uint32(b[14:]),
+		TimeoutErrors:    binary.BigEndian.Uint32(b[18:]),
+		AlignmentErrors:  binary.BigEndian.Uint32(b[22:]),
+	}, nil
+}
+
+// findPeerSessionID looks up the peer's session ID from a session message.
+// For L2TPv2 this is the Assigned Session ID AVP, while for L2TPv3
+// this is the Local Session ID AVP.
+func findPeerSessionID(msg controlMessage) (ControlConnID, error) {
+	switch msg.protocolVersion() {
+	case ProtocolVersion2:
+		psid, err := findUint16Avp(msg.getAvps(), vendorIDIetf, avpTypeSessionID)
+		return ControlConnID(psid), err
+	case ProtocolVersion3:
+		psid, err := findUint32Avp(msg.getAvps(), vendorIDIetf, avpTypeLocalSessionID)
+		return ControlConnID(psid), err
+	}
+	return 0, fmt.Errorf("unhandled protocol version %v", msg.protocolVersion())
+}
+
+// findLocalSessionID looks up the local session ID a session message is
+// addressed to.
+// For L2TPv2 this is carried in the message header, while for L2TPv3
+// this is the Remote Session ID AVP.
+func findLocalSessionID(msg controlMessage) (ControlConnID, error) {
+	switch m := msg.(type) {
+	case *v2ControlMessage:
+		return ControlConnID(m.Sid()), nil
+	case *v3ControlMessage:
+		sid, err := findUint32Avp(m.getAvps(), vendorIDIetf, avpTypeRemoteSessionID)
+		return ControlConnID(sid), err
+	}
+	return 0, fmt.Errorf("unhandled protocol version %v", msg.protocolVersion())
+}
+
+// unhideMsgAvps replaces any hidden AVPs in the message with their
+// unhidden equivalent as per RFC2661 section 4.3.
+func unhideMsgAvps(msg controlMessage, secret []byte) error {
+	// RFC3931 hides AVPs using a key derived from the secret, which
+	// we don't implement.  Rather than recovering garbage using the
+	// RFC2661 scheme, reject L2TPv3 hidden AVPs outright.
+	if msg.protocolVersion() != ProtocolVersion2 {
+		for _, a := range msg.getAvps() {
+			if a.isHidden() {
+				return fmt.Errorf("AVP hiding not supported for L2TPv3")
+			}
+		}
+		return nil
+	}
+	avps, err := unhideAvps(msg.getAvps(), secret)
+	if err != nil {
+		return err
+	}
+	msg.setAvps(avps)
+	return nil
+}
+
+// hideMsgAvps hides the AVPs in the message which carry sensitive data
+// as per RFC2661 section 4.3.  A new Random Vector is generated for each
+// message.
+func hideMsgAvps(msg controlMessage, secret []byte) error {
+	rv := make([]byte, 16)
+	_, err := rand.Read(rv)
+	if err != nil {
+		return fmt.Errorf("failed to generate random vector: %v", err)
+	}
+	avps, err := hideAvps(msg.getAvps(), secret, rv, isHideableAvp)
+	if err != nil {
+		return err
+	}
+	msg.setAvps(avps)
+	return nil
+}
@@ -2,6 +2,8 @@ package l2tp
 
 import (
 	"bytes"
+	"errors"
+	"reflect"
 	"testing"
 )
 
@@ -261,3 +263,423 @@ func TestV2TunnelBuildValidate(t *testing.T) {
 		}
 	}
 }
+
+func TestV3TunnelBuildValidate(t *testing.T) {
+	cases := []struct {
+		tcfg         TunnelConfig
+		rc           resultCode
+		buildersGood []func(*TunnelConfig, *resultCode) (*v3ControlMessage, error)
+	}{
+		{
+			tcfg: TunnelConfig{
+				TunnelID:     1234567,
+				PeerTunnelID: 7654321,
+				RouterID:     0x7f000001,
+			},
+			rc: resultCode{},
+			buildersGood: []func(*TunnelConfig, *resultCode) (*v3ControlMessage, error){
+				func(tcfg *TunnelConfig, rc *resultCode) (*v3ControlMessage, error) {
+					return newV3Sccrq(tcfg)
+				},
+				func(tcfg *TunnelConfig, rc *resultCode) (*v3ControlMessage, error) {
+					return newV3Sccrp(tcfg)
+				},
+				func(tcfg *TunnelConfig, rc *resultCode) (*v3ControlMessage, error) {
+					return newV3Scccn(tcfg)
+				},
+				func(tcfg *TunnelConfig, rc *resultCode) (*v3ControlMessage, error) {
+					return newV3Stopccn(rc, tcfg)
+				},
+				func(tcfg *TunnelConfig, rc *resultCode) (*v3ControlMessage, error) {
+					return newV3Hello(tcfg)
+				},
+			},
+		},
+	}
+	for _, c := range cases {
+		for i, builder := range c.buildersGood {
+			msg, err := builder(&c.tcfg, &c.rc)
+			if err != nil {
+				t.Fatalf("good builder %v: %v %v: %v", i, c.tcfg, c.rc, err)
+			}
+			err = msg.validate()
+			if err != nil {
+				t.Fatalf("good builder validation %v: %v %v: %v", i, c.tcfg, c.rc, err)
+			}
+			// Round-trip via. the parser to check the 32-bit IDs survive
+			b, err := msg.toBytes()
+			if err != nil {
+				t.Fatalf("good builder toBytes %v: %v", i, err)
+			}
+			got, err := parseMessageBuffer(b)
+			if err != nil {
+				t.Fatalf("good builder parseMessageBuffer %v: %v", i, err)
+			}
+			v3msg, ok := got[0].(*v3ControlMessage)
+			if !ok {
+				t.Fatalf("good builder %v: parsed message is %T, not *v3ControlMessage", i, got[0])
+			}
+			if msg.getType() != avpMsgTypeSccrq && v3msg.ControlConnectionID() != uint32(c.tcfg.PeerTunnelID) {
+				t.Errorf("good builder %v: CCID %v, want %v", i, v3msg.ControlConnectionID(), c.tcfg.PeerTunnelID)
+			}
+			if msg.getType() == avpMsgTypeSccrq || msg.getType() == avpMsgTypeSccrp {
+				ccid, err := findPeerControlConnID(v3msg)
+				if err != nil {
+					t.Fatalf("good builder %v: findPeerControlConnID: %v", i, err)
+				}
+				if ccid != c.tcfg.TunnelID {
+					t.Errorf("good builder %v: assigned CCID %v, want %v", i, ccid, c.tcfg.TunnelID)
+				}
+			}
+		}
+	}
+}
+
+func TestV3SessionBuildValidate(t *testing.T) {
+	cases := []struct {
+		ptid         ControlConnID
+		scfg         SessionConfig
+		rc           resultCode
+		buildersGood []func(ControlConnID, *SessionConfig, *resultCode) (*v3ControlMessage, error)
+	}{
+		{
+			ptid: 7654321,
+			scfg: SessionConfig{
+				SessionID:     1234567,
+				PeerSessionID: 89101112,
+				Pseudowire:    PseudowireTypeEth,
+				Cookie:        []byte{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8},
+				L2SpecType:    L2SpecTypeDefault,
+				SeqNum:        true,
+			},
+			rc: resultCode{},
+			buildersGood: []func(ControlConnID, *SessionConfig, *resultCode) (*v3ControlMessage, error){
+				func(ptid ControlConnID, scfg *SessionConfig, rc *resultCode) (*v3ControlMessage, error) {
+					return newV3Icrq(42, ptid, scfg)
+				},
+				func(ptid ControlConnID, scfg *SessionConfig, rc *resultCode) (*v3ControlMessage, error) {
+					return newV3Icrp(ptid, scfg)
+				},
+				func(ptid ControlConnID, scfg *SessionConfig, rc *resultCode) (*v3ControlMessage, error) {
+					return newV3Iccn(ptid, scfg)
+				},
+				func(ptid ControlConnID, scfg *SessionConfig, rc *resultCode) (*v3ControlMessage, error) {
+					return newV3Cdn(ptid, rc, scfg)
+				},
+			},
+		},
+	}
+	for _, c := range cases {
+		for i, builder := range c.buildersGood {
+			msg, err := builder(c.ptid, &c.scfg, &c.rc)
+			if err != nil {
+				t.Fatalf("good builder %v: %v %v: %v", i, c.scfg, c.rc, err)
+			}
+			err = msg.validate()
+			if err != nil {
+				t.Fatalf("good builder validation %v: %v %v: %v", i, c.scfg, c.rc, err)
+			}
+			b, err := msg.toBytes()
+			if err != nil {
+				t.Fatalf("good builder toBytes %v: %v", i, err)
+			}
+			got, err := parseMessageBuffer(b)
+			if err != nil {
+				t.Fatalf("good builder parseMessageBuffer %v: %v", i, err)
+			}
+			v3msg, ok := got[0].(*v3ControlMessage)
+			if !ok {
+				t.Fatalf("good builder %v: parsed message is %T, not *v3ControlMessage", i, got[0])
+			}
+			if v3msg.ControlConnectionID() != uint32(c.ptid) {
+				t.Errorf("good builder %v: CCID %v, want %v", i, v3msg.ControlConnectionID(), c.ptid)
+			}
+			psid, err := findPeerSessionID(v3msg)
+			if err != nil {
+				t.Fatalf("good builder %v: findPeerSessionID: %v", i, err)
+			}
+			if psid != c.scfg.SessionID {
+				t.Errorf("good builder %v: local session ID %v, want %v", i, psid, c.scfg.SessionID)
+			}
+			sid, err := findLocalSessionID(v3msg)
+			if err != nil {
+				t.Fatalf("good builder %v: findLocalSessionID: %v", i, err)
+			}
+			if msg.getType() == avpMsgTypeIcrq {
+				if sid != 0 {
+					t.Errorf("good builder %v: remote session ID %v, want 0", i, sid)
+				}
+				cookie, err := findBytesAvp(v3msg.getAvps(), vendorIDIetf, avpTypeAssignedCookie)
+				if err != nil {
+					t.Fatalf("good builder %v: findBytesAvp: %v", i, err)
+				}
+				if !bytes.Equal(cookie, c.scfg.Cookie) {
+					t.Errorf("good builder %v: cookie %v, want %v", i, cookie, c.scfg.Cookie)
+				}
+			} else if sid != c.scfg.PeerSessionID {
+				t.Errorf("good builder %v: remote session ID %v, want %v", i, sid, c.scfg.PeerSessionID)
+			}
+		}
+	}
+}
+
+func TestV2OutgoingCallBuildValidate(t *testing.T) {
+	ptid := ControlConnID(4321)
+	scfg := SessionConfig{
+		SessionID:     1234,
+		PeerSessionID: 5678,
+		ConnectSpeed:  64000,
+		FramingType:   FramingCapAsync,
+	}
+	call := OutgoingCallParameters{
+		CalledNumber: "01234567890",
+		MinimumBPS:   9600,
+		MaximumBPS:   115200,
+	}
+	builders := []func() (*v2ControlMessage, error){
+		func() (*v2ControlMessage, error) {
+			return newV2Ocrq(42, ptid, &scfg, &call)
+		},
+		func() (*v2ControlMessage, error) {
+			return newV2Ocrp(ptid, &scfg)
+		},
+		func() (*v2ControlMessage, error) {
+			return newV2Occn(ptid, &scfg)
+		},
+	}
+	for i, builder := range builders {
+		msg, err := builder()
+		if err != nil {
+			t.Fatalf("good builder %v: %v", i, err)
+		}
+		err = msg.validate()
+		if err != nil {
+			t.Fatalf("good builder validation %v: %v", i, err)
+		}
+		if msg.Tid() != uint16(ptid) {
+			t.Errorf("good builder %v: TID %v, want %v", i, msg.Tid(), ptid)
+		}
+		switch msg.getType() {
+		case avpMsgTypeOcrq:
+			if msg.Sid() != 0 {
+				t.Errorf("good builder %v: SID %v, want 0", i, msg.Sid())
+			}
+			framing, err := findUint32Avp(msg.getAvps(), vendorIDIetf, avpTypeFramingType)
+			if err != nil || framing != uint32(FramingCapSync|FramingCapAsync) {
+				t.Errorf("good builder %v: framing type %v (%v), want default", i, framing, err)
+			}
+		case avpMsgTypeOcrp:
+			psid, err := findPeerSessionID(msg)
+			if err != nil || psid != scfg.SessionID {
+				t.Errorf("good builder %v: session ID %v (%v), want %v", i, psid, err, scfg.SessionID)
+			}
+		case avpMsgTypeOccn:
+			speed, err := findUint32Avp(msg.getAvps(), vendorIDIetf, avpTypeConnectSpeed)
+			if err != nil || speed != scfg.ConnectSpeed {
+				t.Errorf("good builder %v: connect speed %v (%v), want %v", i, speed, err, scfg.ConnectSpeed)
+			}
+			framing, err := findUint32Avp(msg.getAvps(), vendorIDIetf, avpTypeFramingType)
+			if err != nil || framing != uint32(scfg.FramingType) {
+				t.Errorf("good builder %v: framing type %v (%v), want %v", i, framing, err, scfg.FramingType)
+			}
+		}
+	}
+}
+
+func TestV2IccnProxy(t *testing.T) {
+	cases := []struct {
+		name string
+		lcp  *ProxyLCP
+		auth *ProxyAuth
+	}{
+		{
+			name: "none",
+		},
+		{
+			name: "LCP and CHAP",
+			lcp: &ProxyLCP{
+				InitialReceivedConfReq: []byte{0x01, 0x04, 0x05, 0xdc},
+				LastSentConfReq:        []byte{0x03, 0x05, 0xc2, 0x23, 0x05},
+				LastReceivedConfReq:    []byte{0x01, 0x04, 0x05, 0xd4},
+			},
+			auth: &ProxyAuth{
+				Type:      ProxyAuthTypeCHAP,
+				Name:      "alice",
+				Challenge: []byte{0xde, 0xad, 0xbe, 0xef},
+				ID:        42,
+				Response:  []byte{0xca, 0xfe, 0xf0, 0x0d},
+			},
+		},
+		{
+			name: "PAP",
+			auth: &ProxyAuth{
+				Type:     ProxyAuthTypePAP,
+				Name:     "bob",
+				Response: []byte("hunter2"),
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			scfg := &SessionConfig{
+				PeerSessionID: 5678,
+				ProxyLCP:      c.lcp,
+				ProxyAuth:     c.auth,
+			}
+			msg, err := newV2Iccn(4321, scfg)
+			if err != nil {
+				t.Fatalf("newV2Iccn(): %v", err)
+			}
+			b, err := msg.toBytes()
+			if err != nil {
+				t.Fatalf("toBytes(): %v", err)
+			}
+			messages, err := parseMessageBuffer(b)
+			if err != nil {
+				t.Fatalf("parseMessageBuffer(): %v", err)
+			}
+			err = messages[0].validate()
+			if err != nil {
+				t.Fatalf("validate(): %v", err)
+			}
+
+			lcp := findProxyLCP(messages[0])
+			if !reflect.DeepEqual(lcp, c.lcp) {
+				t.Errorf("findProxyLCP(): expected %v, got %v", c.lcp, lcp)
+			}
+			auth, err := findProxyAuth(messages[0])
+			if err != nil {
+				t.Fatalf("findProxyAuth(): %v", err)
+			}
+			if !reflect.DeepEqual(auth, c.auth) {
+				t.Errorf("findProxyAuth(): expected %v, got %v", c.auth, auth)
+			}
+		})
+	}
+}
+
+func TestV2ChallengeResponse(t *testing.T) {
+	secret := []byte("cheese")
+	challenge := []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f}
+	cases := []struct {
+		msgType avpMsgType
+		want    []byte
+	}{
+		{
+			msgType: avpMsgTypeSccrp,
+			want:    []byte{0x3e, 0x3a, 0xc4, 0x1e, 0x31, 0x74, 0xbe, 0x7e, 0xc8, 0x9f, 0xc8, 0xb9, 0x76, 0xd9, 0x4a, 0xa0},
+		},
+		{
+			msgType: avpMsgTypeScccn,
+			want:    []byte{0xbc, 0x4c, 0x18, 0xad, 0x79, 0xf8, 0xf2, 0xe6, 0x66, 0x96, 0x47, 0x12, 0x51, 0x3e, 0x46, 0x6c},
+		},
+	}
+	for _, c := range cases {
+		got := v2ChallengeResponse(c.msgType, secret, challenge)
+		if !bytes.Equal(got, c.want) {
+			t.Errorf("v2ChallengeResponse(%v): expected %x, got %x", c.msgType, c.want, got)
+		}
+	}
+}
+
+func TestUnhideMsgAvps(t *testing.T) {
+	secret := []byte("secret")
+	scfg := &SessionConfig{SessionID: 0x1234, PeerSessionID: 20}
+
+	v2msg, err := newV2Cdn(42, &resultCode{result: avpCDNResultCodeAdminDisconnect}, scfg)
+	if err != nil {
+		t.Fatalf("newV2Cdn(): %v", err)
+	}
+	v3msg, err := newV3Cdn(42, &resultCode{result: avpCDNResultCodeAdminDisconnect}, scfg)
+	if err != nil {
+		t.Fatalf("newV3Cdn(): %v", err)
+	}
+
+	for _, c := range []struct {
+		name    string
+		msg     controlMessage
+		wantErr bool
+	}{
+		{"v2", v2msg, false},
+		{"v3", v3msg, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			rv := []byte("random vector")
+			avps, err := hideAvps(c.msg.getAvps(), secret, rv, func(a *avp) bool {
+				return a.getType() != avpTypeMessage
+			})
+			if err != nil {
+				t.Fatalf("hideAvps(): %v", err)
+			}
+			c.msg.setAvps(avps)
+
+			err = unhideMsgAvps(c.msg, secret)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("unhideMsgAvps() succeeded for hidden %v AVPs", c.name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unhideMsgAvps(): %v", err)
+			}
+			for _, a := range c.msg.getAvps() {
+				if a.isHidden() {
+					t.Errorf("AVP %v still hidden", a.getType())
+				}
+			}
+		})
+	}
+}
+
+func TestParseMessageBufferUnknownMandatoryAVP(t *testing.T) {
+	cases := []struct {
+		name    string
+		sid     ControlConnID
+		msgType avpMsgType
+	}{
+		{"tunnel", 0, avpMsgTypeHello},
+		{"session", 42, avpMsgTypeSli},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			msg, err := buildV2Msg(1, c.sid, []avpIn{{avpTypeMessage, c.msgType}})
+			if err != nil {
+				t.Fatalf("buildV2Msg(): %v", err)
+			}
+			msg.appendAvp(&avp{
+				header:  *newAvpHeader(true, false, 2, vendorIDIetf, avpType(1000)),
+				payload: avpPayload{dataType: avpDataTypeBytes, data: []byte{0x00, 0x00}},
+			})
+			b, err := msg.toBytes()
+			if err != nil {
+				t.Fatalf("toBytes(): %v", err)
+			}
+
+			messages, err := parseMessageBuffer(b)
+
+			// Session messages are returned so that only the
+			// session is torn down
+			if c.sid == 0 {
+				if !errors.Is(err, errUnknownMandatoryAVP) {
+					t.Fatalf("expected unknown mandatory AVP error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseMessageBuffer(): %v", err)
+			}
+			if len(messages) != 1 {
+				t.Fatalf("expected 1 message, got %v", len(messages))
+			}
+			v2msg, ok := messages[0].(*v2ControlMessage)
+			if !ok {
+				t.Fatalf("expected v2ControlMessage, got %T", messages[0])
+			}
+			if v2msg.getType() != c.msgType || !errors.Is(v2msg.avpErr, errUnknownMandatoryAVP) {
+				t.Errorf("expected %v with unknown mandatory AVP error, got %v with %v",
+					c.msgType, v2msg.getType(), v2msg.avpErr)
+			}
+		})
+	}
+}
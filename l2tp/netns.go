@@ -0,0 +1,56 @@
+package l2tp
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Named network namespaces are bind mounted here by "ip netns add"
+const netnsRunDir = "/var/run/netns"
+
+// Run fn on an OS thread in the network namespace referred to by the
+// file descriptor netns.  If netns is negative, fn is run directly.
+//
+// The thread is locked and never unlocked, so that it is discarded
+// when the goroutine exits rather than being returned to the scheduler
+// in the wrong namespace.
+func runInNetNS(netns int, fn func() error) error {
+	if netns < 0 {
+		return fn()
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		err := unix.Setns(netns, unix.CLONE_NEWNET)
+		if err != nil {
+			errChan <- fmt.Errorf("failed to enter network namespace: %v", err)
+			return
+		}
+		errChan <- fn()
+	}()
+	return <-errChan
+}
+
+func openNamedNetNS(name string) (int, error) {
+	if name == "" || strings.ContainsRune(name, '/') {
+		return -1, fmt.Errorf("invalid network namespace name %q", name)
+	}
+	fd, err := unix.Open(filepath.Join(netnsRunDir, name), unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("failed to open network namespace %q: %v", name, err)
+	}
+	return fd, nil
+}
+
+func dupNetNS(netns int) (int, error) {
+	fd, err := unix.FcntlInt(uintptr(netns), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("failed to duplicate network namespace fd: %v", err)
+	}
+	return fd, nil
+}
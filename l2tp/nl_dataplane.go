@@ -1,7 +1,10 @@
 package l2tp
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"sync"
 
 	"github.com/katalix/go-l2tp/internal/nll2tp"
 	"golang.org/x/sys/unix"
@@ -12,7 +15,41 @@ var _ TunnelDataPlane = (*nlTunnelDataPlane)(nil)
 var _ SessionDataPlane = (*nlSessionDataPlane)(nil)
 
 type nlDataPlane struct {
-	nlconn *nll2tp.Conn
+	nlconn nlConn
+	portID uint32
+	mon    nlMonitor
+	wg     sync.WaitGroup
+}
+
+// nlConn is the subset of the nll2tp.Conn API used by the data plane,
+// which allows the data plane logic to be tested without the kernel.
+type nlConn interface {
+	CreateManagedTunnel(fd int, config *nll2tp.TunnelConfig) error
+	CreateStaticTunnel(localAddr []byte, localPort uint16, peerAddr []byte, peerPort uint16, config *nll2tp.TunnelConfig) error
+	DeleteTunnel(config *nll2tp.TunnelConfig) error
+	ModifyTunnel(config *nll2tp.TunnelConfig) error
+	GetTunnelInfo(config *nll2tp.TunnelConfig) (*nll2tp.TunnelInfo, error)
+	DumpTunnels() ([]nll2tp.TunnelInfo, error)
+	CreateSession(config *nll2tp.SessionConfig) error
+	DeleteSession(config *nll2tp.SessionConfig) error
+	ModifySession(config *nll2tp.SessionConfig) error
+	GetSessionInfo(config *nll2tp.SessionConfig) (*nll2tp.SessionInfo, error)
+	DumpSessions() ([]nll2tp.SessionInfo, error)
+	PortID() (uint32, error)
+	Close()
+}
+
+// nlMonitor is the nll2tp.Monitor API used by the data plane.
+type nlMonitor interface {
+	Receive() ([]nll2tp.Notification, error)
+	Close()
+}
+
+// dataPlaneMonitor is notified of data plane instances being deleted
+// by another process.
+type dataPlaneMonitor interface {
+	onDataPlaneTunnelDeleted(tid ControlConnID)
+	onDataPlaneSessionDeleted(tid, sid ControlConnID)
 }
 
 type nlTunnelDataPlane struct {
@@ -41,13 +78,15 @@ func sockaddrAddrPort(sa unix.Sockaddr) (addr []byte, port uint16, err error) {
 }
 
 func tunnelCfgToNl(cfg *TunnelConfig) (*nll2tp.TunnelConfig, error) {
-	// TODO: facilitate kernel level debug
 	return &nll2tp.TunnelConfig{
-		Tid:        nll2tp.L2tpTunnelID(cfg.TunnelID),
-		Ptid:       nll2tp.L2tpTunnelID(cfg.PeerTunnelID),
-		Version:    nll2tp.L2tpProtocolVersion(cfg.Version),
-		Encap:      nll2tp.L2tpEncapType(cfg.Encap),
-		DebugFlags: nll2tp.L2tpDebugFlags(0)}, nil
+		Tid:                nll2tp.L2tpTunnelID(cfg.TunnelID),
+		Ptid:               nll2tp.L2tpTunnelID(cfg.PeerTunnelID),
+		Version:            nll2tp.L2tpProtocolVersion(cfg.Version),
+		Encap:              nll2tp.L2tpEncapType(cfg.Encap),
+		DebugFlags:         nll2tp.L2tpDebugFlags(cfg.DebugFlags),
+		UDPChecksum:        cfg.UDPChecksum,
+		UDPZeroChecksum6Tx: cfg.UDPZeroChecksum6Tx,
+		UDPZeroChecksum6Rx: cfg.UDPZeroChecksum6Rx}, nil
 }
 
 func sessionCfgToNl(tid, ptid ControlConnID, cfg *SessionConfig) (*nll2tp.SessionConfig, error) {
@@ -60,7 +99,6 @@ func sessionCfgToNl(tid, ptid ControlConnID, cfg *SessionConfig) (*nll2tp.Sessio
 		pwtype = nll2tp.PwtypePpp
 	}
 
-	// TODO: facilitate kernel level debug
 	// TODO: IsLNS defaulting to false allows the peer to decide,
 	// not sure whether this is a good idea or not really.
 	return &nll2tp.SessionConfig{
@@ -77,7 +115,8 @@ func sessionCfgToNl(tid, ptid ControlConnID, cfg *SessionConfig) (*nll2tp.Sessio
 		PeerCookie:     cfg.PeerCookie,
 		IfName:         cfg.InterfaceName,
 		L2SpecType:     nll2tp.L2tpL2specType(cfg.L2SpecType),
-		DebugFlags:     nll2tp.L2tpDebugFlags(0),
+		VlanID:         cfg.VlanID,
+		DebugFlags:     nll2tp.L2tpDebugFlags(cfg.DebugFlags),
 	}, nil
 }
 
@@ -108,6 +147,11 @@ func (dpf *nlDataPlane) NewTunnel(tcfg *TunnelConfig, sal, sap unix.Sockaddr, fd
 
 		err = dpf.nlconn.CreateStaticTunnel(la, lp, ra, rp, nlcfg)
 	}
+	// Only static tunnels may be adopted: the kernel instance of a
+	// tunnel with a socket belongs to the process owning that socket.
+	if errors.Is(err, unix.EEXIST) && fd < 0 {
+		err = dpf.adoptTunnel(nlcfg, sal, sap)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to instantiate tunnel via. netlink: %v", err)
 	}
@@ -122,19 +166,175 @@ func (dpf *nlDataPlane) NewSession(tid, ptid ControlConnID, scfg *SessionConfig)
 	}
 
 	err = dpf.nlconn.CreateSession(nlcfg)
+	if errors.Is(err, unix.EEXIST) {
+		err = dpf.adoptSession(nlcfg)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to instantiate session via. netlink: %v", err)
 	}
 	return &nlSessionDataPlane{f: dpf, cfg: nlcfg}, nil
 }
 
+// Adopt an existing kernel tunnel instance, e.g. one left in place by
+// a previous process which detached from the data plane on shutdown.
+// The kernel instance must match the tunnel configuration.
+func (dpf *nlDataPlane) adoptTunnel(nlcfg *nll2tp.TunnelConfig, sal, sap unix.Sockaddr) error {
+	tunnels, err := dpf.nlconn.DumpTunnels()
+	if err != nil {
+		return fmt.Errorf("failed to dump kernel tunnels: %v", err)
+	}
+
+	for _, info := range tunnels {
+		if info.Tid != nlcfg.Tid {
+			continue
+		}
+		if info.Ptid != nlcfg.Ptid || info.Version != nlcfg.Version || info.Encap != nlcfg.Encap {
+			return fmt.Errorf("kernel tunnel %v doesn't match the tunnel configuration", info.Tid)
+		}
+		if !sockaddrMatches(sal, info.LocalAddr, info.LocalPort) ||
+			!sockaddrMatches(sap, info.PeerAddr, info.PeerPort) {
+			return fmt.Errorf("kernel tunnel %v doesn't match the tunnel addresses", info.Tid)
+		}
+		if info.DebugFlags != nlcfg.DebugFlags {
+			return dpf.nlconn.ModifyTunnel(nlcfg)
+		}
+		return nil
+	}
+	return fmt.Errorf("tunnel ID %v in use, but no kernel tunnel found", nlcfg.Tid)
+}
+
+// Adopt an existing kernel session instance.  The kernel instance must
+// match the session configuration, although the parameters which may
+// be changed on a live session are updated.
+func (dpf *nlDataPlane) adoptSession(nlcfg *nll2tp.SessionConfig) error {
+	sessions, err := dpf.nlconn.DumpSessions()
+	if err != nil {
+		return fmt.Errorf("failed to dump kernel sessions: %v", err)
+	}
+
+	for _, info := range sessions {
+		if info.Tid != nlcfg.Tid || info.Sid != nlcfg.Sid {
+			continue
+		}
+		if info.Psid != nlcfg.Psid ||
+			info.PseudowireType != kernelPwtype(nlcfg.PseudowireType) ||
+			!bytes.Equal(info.LocalCookie, nlcfg.LocalCookie) ||
+			!bytes.Equal(info.PeerCookie, nlcfg.PeerCookie) {
+			return fmt.Errorf("kernel session %v/%v doesn't match the session configuration",
+				info.Tid, info.Sid)
+		}
+		if nlcfg.IfName != "" && info.IfName != nlcfg.IfName {
+			return fmt.Errorf("kernel session %v/%v has interface %v, not %v",
+				info.Tid, info.Sid, info.IfName, nlcfg.IfName)
+		}
+		return dpf.nlconn.ModifySession(nlcfg)
+	}
+	return fmt.Errorf("session ID %v in use, but no kernel session found", nlcfg.Sid)
+}
+
+// VLAN pseudowires are implemented using an Ethernet session
+func kernelPwtype(pwtype nll2tp.L2tpPwtype) nll2tp.L2tpPwtype {
+	if pwtype == nll2tp.PwtypeEthVlan {
+		return nll2tp.PwtypeEth
+	}
+	return pwtype
+}
+
+// Check whether the kernel's view of a tunnel address matches the
+// sockaddr.  The kernel may not report addresses, e.g. for
+// unconnected sockets, in which case there's nothing to compare.
+func sockaddrMatches(sa unix.Sockaddr, addr []byte, port uint16) bool {
+	if sa == nil || len(addr) == 0 {
+		return true
+	}
+	saAddr, saPort, err := sockaddrAddrPort(sa)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(saAddr, addr) && saPort == port
+}
+
+func (dpf *nlDataPlane) monitor(m dataPlaneMonitor) {
+	dpf.wg.Add(1)
+	go func() {
+		defer dpf.wg.Done()
+		for {
+			notifications, err := dpf.mon.Receive()
+			if err != nil {
+				// Notifications are dropped if the socket buffer
+				// overruns, which isn't fatal.
+				if errors.Is(err, unix.ENOBUFS) {
+					continue
+				}
+				return
+			}
+			for _, n := range notifications {
+				// Ignore the notifications caused by our own requests.
+				// They may arrive after a tunnel or session has been
+				// recreated with the same IDs, and would tear it down.
+				if n.PortID == dpf.portID {
+					continue
+				}
+				switch {
+				case n.Command == nll2tp.CmdTunnelDelete && n.Tunnel != nil:
+					m.onDataPlaneTunnelDeleted(ControlConnID(n.Tunnel.Tid))
+				case n.Command == nll2tp.CmdSessionDelete && n.Session != nil:
+					m.onDataPlaneSessionDeleted(ControlConnID(n.Session.Tid), ControlConnID(n.Session.Sid))
+				}
+			}
+		}
+	}()
+}
+
 func (dpf *nlDataPlane) Close() {
 
+	if dpf.mon != nil {
+		dpf.mon.Close()
+		dpf.wg.Wait()
+	}
+
 	if dpf.nlconn != nil {
 		dpf.nlconn.Close()
 	}
 }
 
+func (tdp *nlTunnelDataPlane) Update(tcfg *TunnelConfig) error {
+	nlcfg, err := tunnelCfgToNl(tcfg)
+	if err != nil {
+		return fmt.Errorf("failed to convert tunnel config for netlink use: %v", err)
+	}
+
+	// Tunnel IDs can't be modified: address the tunnel we created
+	nlcfg.Tid = tdp.cfg.Tid
+	nlcfg.Ptid = tdp.cfg.Ptid
+
+	err = tdp.f.nlconn.ModifyTunnel(nlcfg)
+	if err != nil {
+		return fmt.Errorf("failed to modify tunnel via. netlink: %v", err)
+	}
+	tdp.cfg.DebugFlags = nlcfg.DebugFlags
+	return nil
+}
+
+func (tdp *nlTunnelDataPlane) GetStatistics() (*TunnelDataPlaneStatistics, error) {
+	info, err := tdp.f.nlconn.GetTunnelInfo(tdp.cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &TunnelDataPlaneStatistics{
+		TxPackets:        info.Statistics.TxPacketCount,
+		TxBytes:          info.Statistics.TxBytes,
+		TxErrors:         info.Statistics.TxErrorCount,
+		RxPackets:        info.Statistics.RxPacketCount,
+		RxBytes:          info.Statistics.RxBytes,
+		RxErrors:         info.Statistics.RxErrorCount,
+		RxSeqDiscards:    info.Statistics.RxSeqDiscardCount,
+		RxOOSPackets:     info.Statistics.RxOOSCount,
+		RxCookieDiscards: info.Statistics.RxCookieDiscardCount,
+		RxInvalid:        info.Statistics.RxInvalidCount,
+	}, nil
+}
+
 func (tdp *nlTunnelDataPlane) Down() error {
 	return tdp.f.nlconn.DeleteTunnel(tdp.cfg)
 }
@@ -145,12 +345,16 @@ func (sdp *nlSessionDataPlane) GetStatistics() (*SessionDataPlaneStatistics, err
 		return nil, err
 	}
 	return &SessionDataPlaneStatistics{
-		TxPackets: info.Statistics.TxPacketCount,
-		TxBytes:   info.Statistics.TxBytes,
-		TxErrors:  info.Statistics.TxErrorCount,
-		RxPackets: info.Statistics.RxPacketCount,
-		RxBytes:   info.Statistics.RxBytes,
-		RxErrors:  info.Statistics.RxErrorCount,
+		TxPackets:        info.Statistics.TxPacketCount,
+		TxBytes:          info.Statistics.TxBytes,
+		TxErrors:         info.Statistics.TxErrorCount,
+		RxPackets:        info.Statistics.RxPacketCount,
+		RxBytes:          info.Statistics.RxBytes,
+		RxErrors:         info.Statistics.RxErrorCount,
+		RxSeqDiscards:    info.Statistics.RxSeqDiscardCount,
+		RxOOSPackets:     info.Statistics.RxOOSCount,
+		RxCookieDiscards: info.Statistics.RxCookieDiscardCount,
+		RxInvalid:        info.Statistics.RxInvalidCount,
 	}, nil
 }
 
@@ -165,18 +369,55 @@ func (sdp *nlSessionDataPlane) GetInterfaceName() (string, error) {
 	return sdp.interfaceName, nil
 }
 
+func (sdp *nlSessionDataPlane) Update(scfg *SessionConfig) error {
+	nlcfg, err := sessionCfgToNl(ControlConnID(sdp.cfg.Tid), ControlConnID(sdp.cfg.Ptid), scfg)
+	if err != nil {
+		return fmt.Errorf("failed to convert session config for netlink use: %v", err)
+	}
+
+	err = sdp.f.nlconn.ModifySession(nlcfg)
+	if err != nil {
+		return fmt.Errorf("failed to modify session via. netlink: %v", err)
+	}
+	sdp.cfg.SendSeq = nlcfg.SendSeq
+	sdp.cfg.RecvSeq = nlcfg.RecvSeq
+	sdp.cfg.IsLNS = nlcfg.IsLNS
+	sdp.cfg.ReorderTimeout = nlcfg.ReorderTimeout
+	sdp.cfg.DebugFlags = nlcfg.DebugFlags
+	return nil
+}
+
 func (sdp *nlSessionDataPlane) Down() error {
 	return sdp.f.nlconn.DeleteSession(sdp.cfg)
 }
 
-func newNetlinkDataPlane() (DataPlane, error) {
+func newNetlinkDataPlane(netns int) (DataPlane, error) {
 
-	nlconn, err := nll2tp.Dial()
+	// The netlink package uses zero to indicate the current namespace
+	if netns < 0 {
+		netns = 0
+	}
+
+	nlconn, err := nll2tp.DialNetNS(netns)
 	if err != nil {
 		return nil, fmt.Errorf("failed to establish a netlink/L2TP connection: %v", err)
 	}
 
+	portID, err := nlconn.PortID()
+	if err != nil {
+		nlconn.Close()
+		return nil, fmt.Errorf("failed to get netlink/L2TP port ID: %v", err)
+	}
+
+	mon, err := nll2tp.DialMonitorNetNS(netns)
+	if err != nil {
+		nlconn.Close()
+		return nil, fmt.Errorf("failed to monitor netlink/L2TP notifications: %v", err)
+	}
+
 	return &nlDataPlane{
 		nlconn: nlconn,
+		portID: portID,
+		mon:    mon,
 	}, nil
 }
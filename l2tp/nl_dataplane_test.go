@@ -0,0 +1,270 @@
+package l2tp
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/katalix/go-l2tp/internal/nll2tp"
+	"golang.org/x/sys/unix"
+)
+
+// testNlConn is a fake netlink connection holding a set of kernel
+// tunnel instances.  Creating a tunnel which already exists fails
+// with EEXIST, as it would for the kernel.
+type testNlConn struct {
+	tunnels  []nll2tp.TunnelInfo
+	sessions []nll2tp.SessionInfo
+	dumps    int
+	modified int
+}
+
+func (c *testNlConn) createTunnel(config *nll2tp.TunnelConfig) error {
+	for _, t := range c.tunnels {
+		if t.Tid == config.Tid {
+			return unix.EEXIST
+		}
+	}
+	c.tunnels = append(c.tunnels, nll2tp.TunnelInfo{
+		Tid:        config.Tid,
+		Ptid:       config.Ptid,
+		Version:    config.Version,
+		Encap:      config.Encap,
+		DebugFlags: config.DebugFlags,
+	})
+	return nil
+}
+
+func (c *testNlConn) CreateManagedTunnel(fd int, config *nll2tp.TunnelConfig) error {
+	return c.createTunnel(config)
+}
+
+func (c *testNlConn) CreateStaticTunnel(localAddr []byte, localPort uint16, peerAddr []byte, peerPort uint16, config *nll2tp.TunnelConfig) error {
+	return c.createTunnel(config)
+}
+
+func (c *testNlConn) DeleteTunnel(config *nll2tp.TunnelConfig) error {
+	return nil
+}
+
+func (c *testNlConn) ModifyTunnel(config *nll2tp.TunnelConfig) error {
+	c.modified++
+	return nil
+}
+
+func (c *testNlConn) GetTunnelInfo(config *nll2tp.TunnelConfig) (*nll2tp.TunnelInfo, error) {
+	for i := range c.tunnels {
+		if c.tunnels[i].Tid == config.Tid {
+			return &c.tunnels[i], nil
+		}
+	}
+	return nil, unix.ENOENT
+}
+
+func (c *testNlConn) DumpTunnels() ([]nll2tp.TunnelInfo, error) {
+	c.dumps++
+	return c.tunnels, nil
+}
+
+func (c *testNlConn) CreateSession(config *nll2tp.SessionConfig) error {
+	return nil
+}
+
+func (c *testNlConn) DeleteSession(config *nll2tp.SessionConfig) error {
+	return nil
+}
+
+func (c *testNlConn) ModifySession(config *nll2tp.SessionConfig) error {
+	return nil
+}
+
+func (c *testNlConn) GetSessionInfo(config *nll2tp.SessionConfig) (*nll2tp.SessionInfo, error) {
+	return nil, unix.ENOENT
+}
+
+func (c *testNlConn) DumpSessions() ([]nll2tp.SessionInfo, error) {
+	return c.sessions, nil
+}
+
+func (c *testNlConn) PortID() (uint32, error) {
+	return 1234, nil
+}
+
+func (c *testNlConn) Close() {
+}
+
+func TestNetlinkAdoptTunnel(t *testing.T) {
+	sal := &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}, Port: 6000}
+	sap := &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}, Port: 5000}
+
+	existing := nll2tp.TunnelInfo{
+		Tid:       42,
+		Ptid:      43,
+		Version:   nll2tp.ProtocolVersion3,
+		Encap:     nll2tp.EncaptypeUdp,
+		LocalAddr: []byte{127, 0, 0, 1},
+		LocalPort: 6000,
+		PeerAddr:  []byte{127, 0, 0, 1},
+		PeerPort:  5000,
+	}
+
+	cases := []struct {
+		name         string
+		cfg          TunnelConfig
+		fd           int
+		expectAdopt  bool
+		expectModify bool
+	}{
+		{
+			name:        "static",
+			cfg:         TunnelConfig{TunnelID: 42, PeerTunnelID: 43, Version: ProtocolVersion3, Encap: EncapTypeUDP},
+			fd:          -1,
+			expectAdopt: true,
+		},
+		{
+			name:         "static with new debug flags",
+			cfg:          TunnelConfig{TunnelID: 42, PeerTunnelID: 43, Version: ProtocolVersion3, Encap: EncapTypeUDP, DebugFlags: DebugFlagsControl},
+			fd:           -1,
+			expectAdopt:  true,
+			expectModify: true,
+		},
+		{
+			name: "static with mismatched peer tunnel ID",
+			cfg:  TunnelConfig{TunnelID: 42, PeerTunnelID: 44, Version: ProtocolVersion3, Encap: EncapTypeUDP},
+			fd:   -1,
+		},
+		{
+			// The kernel tunnel belongs to some other socket
+			name: "managed",
+			cfg:  TunnelConfig{TunnelID: 42, PeerTunnelID: 43, Version: ProtocolVersion3, Encap: EncapTypeUDP},
+			fd:   10,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn := &testNlConn{tunnels: []nll2tp.TunnelInfo{existing}}
+			dpf := &nlDataPlane{nlconn: conn}
+
+			_, err := dpf.NewTunnel(&c.cfg, sal, sap, c.fd)
+			if c.expectAdopt {
+				if err != nil {
+					t.Fatalf("NewTunnel(): %v", err)
+				}
+			} else {
+				if err == nil {
+					t.Fatalf("NewTunnel() adopted kernel tunnel")
+				}
+			}
+			if c.fd >= 0 && conn.dumps > 0 {
+				t.Errorf("kernel tunnels dumped for tunnel with a socket")
+			}
+			if (conn.modified > 0) != c.expectModify {
+				t.Errorf("expected tunnel modified %v, got %v modifications", c.expectModify, conn.modified)
+			}
+		})
+	}
+}
+
+// testNlMonitor delivers notifications to the data plane monitor, and
+// fails once all the notifications have been delivered.
+type testNlMonitor struct {
+	notifications [][]nll2tp.Notification
+}
+
+func (m *testNlMonitor) Receive() ([]nll2tp.Notification, error) {
+	if len(m.notifications) == 0 {
+		return nil, errors.New("monitor closed")
+	}
+	n := m.notifications[0]
+	m.notifications = m.notifications[1:]
+	return n, nil
+}
+
+func (m *testNlMonitor) Close() {
+}
+
+type testDeleteRecorder struct {
+	tunnels  []ControlConnID
+	sessions [][2]ControlConnID
+}
+
+func (r *testDeleteRecorder) onDataPlaneTunnelDeleted(tid ControlConnID) {
+	r.tunnels = append(r.tunnels, tid)
+}
+
+func (r *testDeleteRecorder) onDataPlaneSessionDeleted(tid, sid ControlConnID) {
+	r.sessions = append(r.sessions, [2]ControlConnID{tid, sid})
+}
+
+func TestNetlinkMonitor(t *testing.T) {
+	const ourPortID, otherPortID = 1234, 5678
+
+	mon := &testNlMonitor{
+		notifications: [][]nll2tp.Notification{
+			{
+				// Deleted by us: ignored
+				{Command: nll2tp.CmdTunnelDelete, PortID: ourPortID, Tunnel: &nll2tp.TunnelInfo{Tid: 1}},
+				{Command: nll2tp.CmdSessionDelete, PortID: ourPortID, Session: &nll2tp.SessionInfo{Tid: 1, Sid: 2}},
+				// Deleted by another process
+				{Command: nll2tp.CmdTunnelDelete, PortID: otherPortID, Tunnel: &nll2tp.TunnelInfo{Tid: 3}},
+			},
+			{
+				// Not a delete: ignored
+				{Command: nll2tp.CmdSessionCreate, PortID: otherPortID, Session: &nll2tp.SessionInfo{Tid: 3, Sid: 5}},
+				{Command: nll2tp.CmdSessionDelete, PortID: otherPortID, Session: &nll2tp.SessionInfo{Tid: 3, Sid: 4}},
+				// Deleted by the kernel
+				{Command: nll2tp.CmdTunnelDelete, PortID: 0, Tunnel: &nll2tp.TunnelInfo{Tid: 6}},
+			},
+		},
+	}
+	dpf := &nlDataPlane{nlconn: &testNlConn{}, portID: ourPortID, mon: mon}
+
+	rec := &testDeleteRecorder{}
+	dpf.monitor(rec)
+	dpf.Close()
+
+	expectTunnels := []ControlConnID{3, 6}
+	if !reflect.DeepEqual(rec.tunnels, expectTunnels) {
+		t.Errorf("expected tunnels %v deleted, got %v", expectTunnels, rec.tunnels)
+	}
+	expectSessions := [][2]ControlConnID{{3, 4}}
+	if !reflect.DeepEqual(rec.sessions, expectSessions) {
+		t.Errorf("expected sessions %v deleted, got %v", expectSessions, rec.sessions)
+	}
+}
+
+func TestNetlinkTunnelStatistics(t *testing.T) {
+	conn := &testNlConn{
+		tunnels: []nll2tp.TunnelInfo{
+			{
+				Tid: 42,
+				Statistics: nll2tp.SessionStatistics{
+					RxErrorCount:         1,
+					RxSeqDiscardCount:    2,
+					RxOOSCount:           3,
+					RxCookieDiscardCount: 4,
+					RxInvalidCount:       5,
+				},
+			},
+		},
+	}
+	tdp := &nlTunnelDataPlane{
+		f:   &nlDataPlane{nlconn: conn},
+		cfg: &nll2tp.TunnelConfig{Tid: 42},
+	}
+
+	stats, err := tdp.GetStatistics()
+	if err != nil {
+		t.Fatalf("GetStatistics(): %v", err)
+	}
+	expect := TunnelDataPlaneStatistics{
+		RxErrors:         1,
+		RxSeqDiscards:    2,
+		RxOOSPackets:     3,
+		RxCookieDiscards: 4,
+		RxInvalid:        5,
+	}
+	if *stats != expect {
+		t.Errorf("expected %+v, got %+v", expect, *stats)
+	}
+}
@@ -28,6 +28,14 @@ func (ndp *nullDataPlane) NewSession(tid, ptid ControlConnID, scfg *SessionConfi
 func (ndp *nullDataPlane) Close() {
 }
 
+func (tdp *nullTunnelDataPlane) Update(tcfg *TunnelConfig) error {
+	return nil
+}
+
+func (tdp *nullTunnelDataPlane) GetStatistics() (*TunnelDataPlaneStatistics, error) {
+	return &TunnelDataPlaneStatistics{}, nil
+}
+
 func (tdp *nullTunnelDataPlane) Down() error {
 	return nil
 }
@@ -40,6 +48,10 @@ func (sdp *nullSessionDataPlane) GetInterfaceName() (string, error) {
 	return "", nil
 }
 
+func (sdp *nullSessionDataPlane) Update(scfg *SessionConfig) error {
+	return nil
+}
+
 func (tdp *nullSessionDataPlane) Down() error {
 	return nil
 }
@@ -0,0 +1,345 @@
+package l2tp
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/sys/unix"
+)
+
+// MessageObserver is an interface for observing the control messages
+// sent and received by the tunnels of a Context.
+//
+// Implementations must be comparable types, since observers are
+// unregistered by comparing them with ==: a pointer receiver is the
+// simplest way to ensure this.
+type MessageObserver interface {
+	// ObserveMessage is called for each control message sent or
+	// received by a tunnel, including acknowledgements and
+	// retransmissions.
+	//
+	// ObserveMessage is called from a goroutine dedicated to message
+	// observers rather than from the tunnel goroutine, so it may be
+	// called some time after the message was sent or received.  Messages
+	// are passed to observers in the order they were sent or received
+	// by a given tunnel.  If observers fall too far behind, messages are
+	// dropped rather than delaying the tunnel.
+	//
+	// The message passed is shared between all registered observers,
+	// and must not be modified.
+	ObserveMessage(msg *ObservedMessage)
+}
+
+// MessageDirection indicates whether an observed control message
+// was sent or received.
+type MessageDirection int
+
+const (
+	// MessageSent indicates a message sent to the peer.
+	MessageSent MessageDirection = iota
+	// MessageReceived indicates a message received from the peer.
+	MessageReceived
+)
+
+// String converts a MessageDirection into a human-readable string.
+func (d MessageDirection) String() string {
+	switch d {
+	case MessageSent:
+		return "sent"
+	case MessageReceived:
+		return "received"
+	}
+	return fmt.Sprintf("MessageDirection(%d)", int(d))
+}
+
+// ControlMessageType identifies the type of an L2TP control message,
+// as specified by RFC2661 and RFC3931.
+type ControlMessageType uint16
+
+// Control message types.  L2TPv2 zero-length body acknowledgements
+// are reported as MessageTypeACK, the L2TPv3 explicit acknowledgement.
+const (
+	MessageTypeSCCRQ   = ControlMessageType(avpMsgTypeSccrq)
+	MessageTypeSCCRP   = ControlMessageType(avpMsgTypeSccrp)
+	MessageTypeSCCCN   = ControlMessageType(avpMsgTypeScccn)
+	MessageTypeStopCCN = ControlMessageType(avpMsgTypeStopccn)
+	MessageTypeHello   = ControlMessageType(avpMsgTypeHello)
+	MessageTypeOCRQ    = ControlMessageType(avpMsgTypeOcrq)
+	MessageTypeOCRP    = ControlMessageType(avpMsgTypeOcrp)
+	MessageTypeOCCN    = ControlMessageType(avpMsgTypeOccn)
+	MessageTypeICRQ    = ControlMessageType(avpMsgTypeIcrq)
+	MessageTypeICRP    = ControlMessageType(avpMsgTypeIcrp)
+	MessageTypeICCN    = ControlMessageType(avpMsgTypeIccn)
+	MessageTypeCDN     = ControlMessageType(avpMsgTypeCdn)
+	MessageTypeWEN     = ControlMessageType(avpMsgTypeWen)
+	MessageTypeSLI     = ControlMessageType(avpMsgTypeSli)
+	MessageTypeACK     = ControlMessageType(avpMsgTypeAck)
+)
+
+// String converts a ControlMessageType into a human-readable string,
+// e.g. "SCCRQ".
+func (t ControlMessageType) String() string {
+	return strings.ToUpper(strings.TrimPrefix(avpMsgType(t).String(), "avpMsgType"))
+}
+
+// ObservedAVP is a read-only view of an Attribute Value Pair (AVP)
+// carried by an observed control message.
+type ObservedAVP struct {
+	// VendorID is the AVP vendor ID, which is zero for the AVPs
+	// defined by RFC2661 and RFC3931.
+	VendorID uint16
+	// Type is the AVP attribute type.
+	Type uint16
+	// Mandatory is set if the AVP has the M bit set.
+	Mandatory bool
+	// Hidden is set if the AVP is hidden on the wire.  If the tunnel is
+	// configured with the secret used to hide it, Value holds the
+	// original value of the AVP: otherwise it holds the hidden value.
+	Hidden bool
+	// Value is the AVP attribute value.
+	Value []byte
+}
+
+// Name returns a human-readable name for the AVP type.
+func (a *ObservedAVP) Name() string {
+	if a.VendorID != vendorIDIetf {
+		return fmt.Sprintf("vendor %d type %d", a.VendorID, a.Type)
+	}
+	return strings.TrimPrefix(avpType(a.Type).String(), "avpType")
+}
+
+// ObservedMessage is a read-only view of a control message sent or
+// received by a tunnel.
+type ObservedMessage struct {
+	// TunnelName is the name of the tunnel which sent or received
+	// the message.
+	TunnelName string
+	// Direction indicates whether the message was sent or received.
+	Direction MessageDirection
+	// Retransmit is set for sent messages which are retransmissions.
+	Retransmit bool
+	// Peer is the address of the peer the message was sent to or
+	// received from.
+	Peer string
+	// Version is the protocol version of the message.
+	Version ProtocolVersion
+	// Type is the control message type.
+	Type ControlMessageType
+	// Ns and Nr are the transport sequence numbers of the message.
+	Ns, Nr uint16
+	// TunnelID is the tunnel ID (L2TPv2) or control connection ID
+	// (L2TPv3) from the message header, which identifies the tunnel
+	// at the receiver of the message.
+	TunnelID ControlConnID
+	// SessionID identifies the session at the receiver of the message.
+	// For L2TPv2 this is the session ID from the message header.  For
+	// L2TPv3 it is taken from the Remote Session ID AVP, if present.
+	// It is zero for messages which don't relate to a session.
+	SessionID ControlConnID
+	// AVPs holds the AVPs carried by the message, including the
+	// Message Type AVP.
+	AVPs []ObservedAVP
+}
+
+// ResultCode returns the contents of the message's Result Code AVP,
+// as carried by StopCCN and CDN messages.  If the message doesn't
+// carry a valid Result Code AVP, ok is false.
+func (m *ObservedMessage) ResultCode() (result, errCode uint16, errMsg string, ok bool) {
+	for i := range m.AVPs {
+		a := &m.AVPs[i]
+		if a.VendorID != vendorIDIetf || avpType(a.Type) != avpTypeResultCode {
+			continue
+		}
+		p := avpPayload{dataType: avpDataTypeResultCode, data: a.Value}
+		rc, err := p.toResultCode()
+		if err != nil {
+			return 0, 0, "", false
+		}
+		return uint16(rc.result), uint16(rc.errCode), rc.errMsg, true
+	}
+	return 0, 0, "", false
+}
+
+func newObservedMessage(tunnelName string, msg controlMessage, dir MessageDirection, peer unix.Sockaddr, unhideSecret []byte) *ObservedMessage {
+	om := &ObservedMessage{
+		TunnelName: tunnelName,
+		Direction:  dir,
+		Version:    msg.protocolVersion(),
+		Type:       ControlMessageType(msg.getType()),
+		Ns:         msg.ns(),
+		Nr:         msg.nr(),
+	}
+	if peer != nil {
+		om.Peer = sockaddrString(peer)
+	}
+
+	// unhideAvps returns the AVPs in the same order, but with the hidden
+	// flag cleared, so keep hold of the AVPs as they were on the wire.
+	wire := msg.getAvps()
+	avps := wire
+	if len(unhideSecret) > 0 {
+		if unhidden, err := unhideAvps(wire, unhideSecret); err == nil {
+			avps = unhidden
+		}
+	}
+
+	switch m := msg.(type) {
+	case *v2ControlMessage:
+		om.TunnelID = ControlConnID(m.Tid())
+		om.SessionID = ControlConnID(m.Sid())
+	case *v3ControlMessage:
+		om.TunnelID = ControlConnID(m.ControlConnectionID())
+		for i := range avps {
+			if avps[i].vendorID() == vendorIDIetf && avps[i].getType() == avpTypeRemoteSessionID {
+				if sid, err := avps[i].decodeUint32Data(); err == nil {
+					om.SessionID = ControlConnID(sid)
+				}
+			}
+		}
+	}
+
+	om.AVPs = make([]ObservedAVP, 0, len(avps))
+	for i := range avps {
+		_, data := avps[i].rawData()
+		om.AVPs = append(om.AVPs, ObservedAVP{
+			VendorID:  uint16(avps[i].vendorID()),
+			Type:      uint16(avps[i].getType()),
+			Mandatory: avps[i].isMandatory(),
+			Hidden:    wire[i].isHidden(),
+			Value:     append([]byte(nil), data...),
+		})
+	}
+
+	return om
+}
+
+// observerQueueLen is the number of observed messages which may be
+// pending delivery to observers before further messages are dropped.
+const observerQueueLen = 1024
+
+// messageObservers passes observed messages to the MessageObservers
+// registered on a Context.
+//
+// Messages are queued for delivery by a dedicated goroutine, so that
+// tunnel goroutines are never blocked by a slow observer.
+type messageObservers struct {
+	logger    log.Logger
+	lock      sync.RWMutex
+	observers []MessageObserver
+	queue     chan *ObservedMessage
+	closeChan chan bool
+	isClosed  bool
+	dropped   uint64
+	wg        sync.WaitGroup
+}
+
+func (mo *messageObservers) register(observer MessageObserver) {
+	mo.lock.Lock()
+	defer mo.lock.Unlock()
+
+	// The dispatch goroutine is only started once there's something
+	// to dispatch to.
+	if mo.queue == nil && !mo.isClosed {
+		mo.queue = make(chan *ObservedMessage, observerQueueLen)
+		mo.closeChan = make(chan bool)
+		mo.wg.Add(1)
+		go mo.run()
+	}
+
+	mo.observers = append(mo.observers, observer)
+}
+
+func (mo *messageObservers) unregister(observer MessageObserver) {
+	mo.lock.Lock()
+	defer mo.lock.Unlock()
+	for i, o := range mo.observers {
+		if o == observer {
+			mo.observers = append(mo.observers[:i], mo.observers[i+1:]...)
+			break
+		}
+	}
+}
+
+func (mo *messageObservers) enabled() bool {
+	if mo == nil {
+		return false
+	}
+	mo.lock.RLock()
+	defer mo.lock.RUnlock()
+	return len(mo.observers) > 0 && !mo.isClosed
+}
+
+// observe queues a message for delivery to the registered observers.
+// It never blocks: if the queue is full the message is dropped.
+func (mo *messageObservers) observe(om *ObservedMessage) {
+	mo.lock.Lock()
+	defer mo.lock.Unlock()
+
+	if mo.isClosed || len(mo.observers) == 0 {
+		return
+	}
+
+	select {
+	case mo.queue <- om:
+	default:
+		if mo.dropped == 0 {
+			level.Error(mo.logger).Log(
+				"message", "message observer queue full, dropping messages")
+		}
+		mo.dropped++
+	}
+}
+
+func (mo *messageObservers) run() {
+	defer mo.wg.Done()
+	for {
+		select {
+		case om := <-mo.queue:
+			mo.dispatch(om)
+		case <-mo.closeChan:
+			// Deliver anything sent as the context closed
+			for {
+				select {
+				case om := <-mo.queue:
+					mo.dispatch(om)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (mo *messageObservers) dispatch(om *ObservedMessage) {
+	mo.lock.Lock()
+	if mo.dropped > 0 && len(mo.queue) == 0 {
+		level.Info(mo.logger).Log(
+			"message", "message observers caught up",
+			"dropped", mo.dropped)
+		mo.dropped = 0
+	}
+	observers := append([]MessageObserver(nil), mo.observers...)
+	mo.lock.Unlock()
+
+	for _, o := range observers {
+		o.ObserveMessage(om)
+	}
+}
+
+// close stops delivery of messages to observers, waiting for the
+// dispatch goroutine to exit.
+func (mo *messageObservers) close() {
+	mo.lock.Lock()
+	if mo.isClosed || mo.queue == nil {
+		mo.isClosed = true
+		mo.lock.Unlock()
+		return
+	}
+	mo.isClosed = true
+	close(mo.closeChan)
+	mo.lock.Unlock()
+	mo.wg.Wait()
+}
@@ -0,0 +1,446 @@
+package l2tp
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+type testMessageRecorder struct {
+	lock     sync.Mutex
+	messages []*ObservedMessage
+}
+
+func (tmr *testMessageRecorder) ObserveMessage(msg *ObservedMessage) {
+	tmr.lock.Lock()
+	defer tmr.lock.Unlock()
+	tmr.messages = append(tmr.messages, msg)
+}
+
+// Returns the first observed message of the given direction and type
+func (tmr *testMessageRecorder) find(dir MessageDirection, mt ControlMessageType) (*ObservedMessage, error) {
+	tmr.lock.Lock()
+	defer tmr.lock.Unlock()
+	for _, m := range tmr.messages {
+		if m.Direction == dir && m.Type == mt {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("no %v %v message observed", dir, mt)
+}
+
+func TestObservedMessage(t *testing.T) {
+	rc := &resultCode{result: avpCDNResultCodeAdminDisconnect, errCode: avpErrorCodeNoError, errMsg: "bye"}
+	scfg := &SessionConfig{SessionID: 10, PeerSessionID: 20}
+
+	v2cdn, err := newV2Cdn(42, rc, scfg)
+	if err != nil {
+		t.Fatalf("newV2Cdn(): %v", err)
+	}
+	v2cdn.setTransportSeqNum(3, 4)
+
+	v3cdn, err := newV3Cdn(42, rc, scfg)
+	if err != nil {
+		t.Fatalf("newV3Cdn(): %v", err)
+	}
+	v3cdn.setTransportSeqNum(3, 4)
+
+	for _, msg := range []controlMessage{v2cdn, v3cdn} {
+		t.Run(fmt.Sprintf("L2TPv%v", msg.protocolVersion()), func(t *testing.T) {
+			om := newObservedMessage("t1", msg, MessageSent, nil, nil)
+			if om.TunnelName != "t1" || om.Direction != MessageSent || om.Version != msg.protocolVersion() {
+				t.Errorf("bad message metadata: %+v", om)
+			}
+			if om.Type != MessageTypeCDN || om.Type.String() != "CDN" {
+				t.Errorf("expected CDN, got %v", om.Type)
+			}
+			if om.Ns != 3 || om.Nr != 4 {
+				t.Errorf("expected ns 3 nr 4, got ns %v nr %v", om.Ns, om.Nr)
+			}
+			if om.TunnelID != 42 || om.SessionID != 20 {
+				t.Errorf("expected tunnel ID 42 session ID 20, got %v, %v", om.TunnelID, om.SessionID)
+			}
+			if len(om.AVPs) != len(msg.getAvps()) || om.AVPs[0].Name() != "Message" {
+				t.Errorf("bad AVPs: %+v", om.AVPs)
+			}
+
+			result, errCode, errMsg, ok := om.ResultCode()
+			if !ok || result != 3 || errCode != 0 || errMsg != "bye" {
+				t.Errorf("ResultCode(): got %v, %v, %q, %v", result, errCode, errMsg, ok)
+			}
+
+			// The view must not share memory with the message
+			for i := range om.AVPs {
+				for j := range om.AVPs[i].Value {
+					om.AVPs[i].Value[j] = 0xff
+				}
+			}
+			_, data := msg.getAvps()[1].rawData()
+			if data[0] == 0xff {
+				t.Errorf("observed message shares AVP data with the control message")
+			}
+		})
+	}
+}
+
+func TestObservedMessageHiddenAVPs(t *testing.T) {
+	secret := []byte("secret")
+	msg, err := newV2Cdn(42,
+		&resultCode{result: avpCDNResultCodeAdminDisconnect},
+		&SessionConfig{SessionID: 0x1234, PeerSessionID: 20})
+	if err != nil {
+		t.Fatalf("newV2Cdn(): %v", err)
+	}
+	err = hideMsgAvps(msg, secret)
+	if err != nil {
+		t.Fatalf("hideMsgAvps(): %v", err)
+	}
+
+	for _, c := range []struct {
+		name   string
+		secret []byte
+		unhide bool
+	}{
+		{"with secret", secret, true},
+		{"without secret", nil, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			om := newObservedMessage("t1", msg, MessageSent, nil, c.secret)
+
+			var found bool
+			for _, a := range om.AVPs {
+				if a.VendorID != vendorIDIetf || avpType(a.Type) != avpTypeSessionID {
+					continue
+				}
+				found = true
+				if !a.Hidden {
+					t.Errorf("session ID AVP not flagged as hidden")
+				}
+				unhidden := bytes.Equal(a.Value, []byte{0x12, 0x34})
+				if unhidden != c.unhide {
+					t.Errorf("expected unhidden %v, got value %x", c.unhide, a.Value)
+				}
+			}
+			if !found {
+				t.Errorf("no session ID AVP observed")
+			}
+		})
+	}
+}
+
+type testBlockingObserver struct {
+	unblock chan bool
+	count   int
+}
+
+func (tbo *testBlockingObserver) ObserveMessage(msg *ObservedMessage) {
+	<-tbo.unblock
+	tbo.count++
+}
+
+func TestMessageObserversNonBlocking(t *testing.T) {
+	mo := &messageObservers{logger: log.NewNopLogger()}
+
+	if mo.enabled() {
+		t.Errorf("observers enabled with no observer registered")
+	}
+	// With no observers this should just be a no-op
+	mo.observe(&ObservedMessage{})
+
+	observer := &testBlockingObserver{unblock: make(chan bool)}
+	mo.register(observer)
+	if !mo.enabled() {
+		t.Errorf("observers not enabled with an observer registered")
+	}
+
+	// The observer is blocked, so the dispatch goroutine will block on
+	// the first message and the queue will fill up behind it.  Observing
+	// further messages must not block.
+	total := observerQueueLen + 100
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < total; i++ {
+			mo.observe(&ObservedMessage{Ns: uint16(i)})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("observe() blocked")
+	}
+
+	close(observer.unblock)
+	mo.close()
+
+	// All the messages in the queue are delivered on close
+	if observer.count == 0 || observer.count > observerQueueLen+1 {
+		t.Errorf("expected at most %v messages delivered, got %v", observerQueueLen+1, observer.count)
+	}
+
+	// Observing after close should be a no-op
+	mo.observe(&ObservedMessage{})
+	mo.close()
+}
+
+func TestObserveDynamicTunnel(t *testing.T) {
+	versions := []struct {
+		version    ProtocolVersion
+		pseudowire PseudowireType
+	}{
+		{ProtocolVersion2, PseudowireTypePPP},
+		{ProtocolVersion3, PseudowireTypeEth},
+	}
+	for _, v := range versions {
+		t.Run(fmt.Sprintf("L2TPv%v", v.version), func(t *testing.T) {
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+			lacCtx, err := NewContext(nil, log.With(logger, "context", "lac"))
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer lacCtx.Close()
+
+			lnsCtx, err := NewContext(nil, log.With(logger, "context", "lns"))
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer lnsCtx.Close()
+
+			lacEvents := &testSessionEventCounterCloser{}
+			lacCtx.RegisterEventHandler(lacEvents)
+			lacMessages := &testMessageRecorder{}
+			lacCtx.RegisterMessageObserver(lacMessages)
+
+			lnsEvents := &testTunnelDownWaiter{downChan: make(chan interface{})}
+			lnsCtx.RegisterEventHandler(lnsEvents)
+			lnsCtx.SetIncomingCallHandler(&testCallHandler{scfg: SessionConfig{Pseudowire: v.pseudowire}})
+			lnsMessages := &testMessageRecorder{}
+			lnsCtx.RegisterMessageObserver(lnsMessages)
+
+			sal, sap, err := newUDPAddressPair("127.0.0.1:6000", "127.0.0.1:5000")
+			if err != nil {
+				t.Fatalf("newUDPAddressPair(): %v", err)
+			}
+			lacCp, lnsCp := newControlPlanePipe(sal, sap, pipeImpairment{}, pipeImpairment{})
+
+			lacCfg := &TunnelConfig{
+				Local:          "127.0.0.1:6000",
+				Peer:           "127.0.0.1:5000",
+				Version:        v.version,
+				TunnelID:       1001,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			}
+			lac, err := newDynamicTunnelWithControlPlane("t1", lacCtx, sal, sap, lacCfg, lacCp)
+			if err != nil {
+				lnsCp.close()
+				t.Fatalf("newDynamicTunnelWithControlPlane(): %v", err)
+			}
+			lacCtx.linkTunnel(lac)
+
+			sccrq, err := pipeTestRecvSccrq(lnsCp, 3*time.Second)
+			if err != nil {
+				t.Fatalf("pipeTestRecvSccrq(): %v", err)
+			}
+
+			lnsCfg := &TunnelConfig{
+				Local:          "127.0.0.1:5000",
+				Peer:           "127.0.0.1:6000",
+				Version:        v.version,
+				TunnelID:       2002,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			}
+			lns, err := newDynamicLNSTunnelWithControlPlane("t2", lnsCtx, sap, sal, lnsCfg, lnsCp, sccrq)
+			if err != nil {
+				t.Fatalf("newDynamicLNSTunnelWithControlPlane(): %v", err)
+			}
+			lnsCtx.linkTunnel(lns)
+
+			_, err = lac.NewSession("s1", &SessionConfig{Pseudowire: v.pseudowire, SessionID: 3003})
+			if err != nil {
+				t.Fatalf("NewSession(): %v", err)
+			}
+
+			// The LAC closes its tunnel once the session is up
+			select {
+			case <-lnsEvents.downChan:
+			case <-time.After(5 * time.Second):
+				t.Errorf("timed out waiting for LNS tunnel down")
+			}
+
+			lacCtx.Close()
+			lacEvents.wait()
+			lnsCtx.Close()
+
+			// LAC: the SCCRQ is the first message sent
+			m, err := lacMessages.find(MessageSent, MessageTypeSCCRQ)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if m.TunnelName != "t1" || m.Peer != "127.0.0.1:5000" || m.Ns != 0 || m.Retransmit {
+				t.Errorf("bad SCCRQ: %+v", m)
+			}
+
+			// LAC: the ICRP is addressed to our tunnel and session
+			m, err = lacMessages.find(MessageReceived, MessageTypeICRP)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if m.TunnelID != 1001 || m.SessionID != 3003 {
+				t.Errorf("expected ICRP for tunnel 1001 session 3003, got tunnel %v session %v",
+					m.TunnelID, m.SessionID)
+			}
+
+			// LNS: the SCCRQ was received by the listener, but should
+			// still be observed by the tunnel
+			m, err = lnsMessages.find(MessageReceived, MessageTypeSCCRQ)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if m.TunnelName != "t2" || m.Peer != "127.0.0.1:6000" {
+				t.Errorf("bad SCCRQ: %+v", m)
+			}
+
+			// LNS: the StopCCN carries a result code
+			m, err = lnsMessages.find(MessageReceived, MessageTypeStopCCN)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if _, _, _, ok := m.ResultCode(); !ok {
+				t.Errorf("StopCCN has no result code")
+			}
+
+			// Sent messages are observed in the order they're sent
+			var ns uint16
+			for _, m := range lacMessages.messages {
+				if m.Direction != MessageSent || m.Type == MessageTypeACK || m.Retransmit {
+					continue
+				}
+				if m.Ns != ns {
+					t.Errorf("expected ns %v, got %v for %v", ns, m.Ns, m.Type)
+				}
+				ns++
+			}
+		})
+	}
+}
+
+func TestObserveDynamicTunnelHiddenAVPs(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lacCtx, err := NewContext(nil, log.With(logger, "context", "lac"))
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lacCtx.Close()
+
+	lnsCtx, err := NewContext(nil, log.With(logger, "context", "lns"))
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lnsCtx.Close()
+
+	lacEvents := &testSessionEventCounterCloser{}
+	lacCtx.RegisterEventHandler(lacEvents)
+
+	lnsEvents := &testTunnelDownWaiter{downChan: make(chan interface{})}
+	lnsCtx.RegisterEventHandler(lnsEvents)
+	lnsCtx.SetIncomingCallHandler(&testCallHandler{scfg: SessionConfig{Pseudowire: PseudowireTypePPP}})
+	lnsMessages := &testMessageRecorder{}
+	lnsCtx.RegisterMessageObserver(lnsMessages)
+
+	sal, sap, err := newUDPAddressPair("127.0.0.1:6000", "127.0.0.1:5000")
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+	lacCp, lnsCp := newControlPlanePipe(sal, sap, pipeImpairment{}, pipeImpairment{})
+
+	// The LAC hides AVPs, the LNS shares the secret but doesn't
+	lacCfg := &TunnelConfig{
+		Local:          "127.0.0.1:6000",
+		Peer:           "127.0.0.1:5000",
+		Version:        ProtocolVersion2,
+		TunnelID:       1001,
+		Encap:          EncapTypeUDP,
+		Secret:         []byte("cheese"),
+		HideAVPs:       true,
+		StopCCNTimeout: 250 * time.Millisecond,
+	}
+	lac, err := newDynamicTunnelWithControlPlane("t1", lacCtx, sal, sap, lacCfg, lacCp)
+	if err != nil {
+		lnsCp.close()
+		t.Fatalf("newDynamicTunnelWithControlPlane(): %v", err)
+	}
+	lacCtx.linkTunnel(lac)
+
+	sccrq, err := pipeTestRecvSccrq(lnsCp, 3*time.Second)
+	if err != nil {
+		t.Fatalf("pipeTestRecvSccrq(): %v", err)
+	}
+
+	// The listener would unhide the SCCRQ before creating the tunnel
+	err = unhideMsgAvps(sccrq, lacCfg.Secret)
+	if err != nil {
+		t.Fatalf("unhideMsgAvps(): %v", err)
+	}
+
+	lnsCfg := &TunnelConfig{
+		Local:          "127.0.0.1:5000",
+		Peer:           "127.0.0.1:6000",
+		Version:        ProtocolVersion2,
+		TunnelID:       2002,
+		Encap:          EncapTypeUDP,
+		Secret:         []byte("cheese"),
+		StopCCNTimeout: 250 * time.Millisecond,
+	}
+	lns, err := newDynamicLNSTunnelWithControlPlane("t2", lnsCtx, sap, sal, lnsCfg, lnsCp, sccrq)
+	if err != nil {
+		t.Fatalf("newDynamicLNSTunnelWithControlPlane(): %v", err)
+	}
+	lnsCtx.linkTunnel(lns)
+
+	_, err = lac.NewSession("s1", &SessionConfig{Pseudowire: PseudowireTypePPP, SessionID: 0x1234})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+
+	select {
+	case <-lnsEvents.downChan:
+	case <-time.After(5 * time.Second):
+		t.Errorf("timed out waiting for LNS tunnel down")
+	}
+
+	lacCtx.Close()
+	lacEvents.wait()
+	lnsCtx.Close()
+
+	// The LNS observes the session ID in the ICRQ unhidden
+	m, err := lnsMessages.find(MessageReceived, MessageTypeICRQ)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var found bool
+	for _, a := range m.AVPs {
+		if a.VendorID != vendorIDIetf || avpType(a.Type) != avpTypeSessionID {
+			continue
+		}
+		found = true
+		if !a.Hidden {
+			t.Errorf("session ID AVP not flagged as hidden")
+		}
+		if !bytes.Equal(a.Value, []byte{0x12, 0x34}) {
+			t.Errorf("expected unhidden session ID 1234, got %x", a.Value)
+		}
+	}
+	if !found {
+		t.Errorf("no session ID AVP observed")
+	}
+}
@@ -3,7 +3,6 @@ package l2tp
 import (
 	"errors"
 	"fmt"
-	"strings"
 	"sync"
 	"time"
 
@@ -51,6 +50,9 @@ type rawMsg struct {
 type recvMsg struct {
 	msg  controlMessage
 	from unix.Sockaddr
+	// err is set, and msg is nil, if the peer sent a message which
+	// requires the tunnel to be torn down.
+	err error
 }
 
 // nrInd represents a received sequence value.
@@ -84,6 +86,24 @@ type transportConfig struct {
 	Version ProtocolVersion
 	// Peer control connection ID to use for transport-generated messages
 	PeerControlConnID ControlConnID
+	// Shared secret for hiding AVPs in transmitted messages.  If unset,
+	// AVPs are not hidden.
+	HideAVPsSecret []byte
+	// Shared secret for unhiding AVPs in messages passed to the message
+	// observers.  This is set independently of HideAVPsSecret since the
+	// peer may hide AVPs even if we don't.  If unset, observers are
+	// passed hidden AVPs as they appear on the wire.
+	UnhideAVPsSecret []byte
+	// Message authentication state for L2TPv3.  If set, transmitted
+	// messages carry a Message Digest AVP, and received messages which
+	// fail digest verification are discarded.
+	MessageAuth *messageAuth
+	// Capture, if set, is passed each control frame sent and received.
+	Capture *captureWriter
+	// Observers, if set, are passed each control message sent and
+	// received, identified by TunnelName.
+	Observers  *messageObservers
+	TunnelName string
 }
 
 // transport represents the RFC2661/RFC3931
@@ -92,7 +112,7 @@ type transport struct {
 	logger               log.Logger
 	slowStart            slowStartState
 	config               transportConfig
-	cp                   *controlPlane
+	cp                   controlPlane
 	helloTimer, ackTimer *time.Timer
 	helloInFlight        bool
 	sendChan             chan *xmitMsg
@@ -252,6 +272,7 @@ func (xport *transport) rawRecv() (buffer []byte, from unix.Sockaddr, err error)
 }
 
 func (xport *transport) receiver() {
+	var peerFailed bool
 	for {
 		buffer, from, err := xport.rawRecv()
 		if err != nil {
@@ -266,6 +287,8 @@ func (xport *transport) receiver() {
 			"message", "socket recv",
 			"length", len(buffer))
 
+		xport.capture(buffer, from, false)
+
 		// Parse the received frame into control messages, perform early
 		// sequence number validation.
 		messages, err := xport.recvFrame(&rawMsg{b: buffer, sa: from})
@@ -274,12 +297,17 @@ func (xport *transport) receiver() {
 			// The most important of these is if a peer sends a mandatory
 			// AVP that we don't recognise: this MUST cause the tunnel to fail
 			// per the RFCs.  Anything else we just log for information.
+			// L2TPv2 session messages are the exception: these terminate
+			// only the session, so are passed up as normal by recvFrame.
 			level.Error(xport.logger).Log(
 				"message", "frame receive failed",
 				"error", err)
-			if strings.Contains("failed to parse mandatory AVP", err.Error()) {
-				close(xport.nrChan)
-				return
+			if errors.Is(err, errUnknownMandatoryAVP) && !peerFailed {
+				// Leave the transport up so that the tunnel can send
+				// StopCCN to the peer.  The peer will likely retransmit
+				// the message, but the tunnel need only be told once.
+				peerFailed = true
+				xport.recvChan <- &recvMsg{from: from, err: err}
 			}
 		}
 
@@ -289,6 +317,7 @@ func (xport *transport) receiver() {
 		rxNr := []nrInd{}
 
 		for _, msg := range messages {
+			xport.observe(msg, MessageReceived, from, false)
 			xport.rxQueue = append(xport.rxQueue, &recvMsg{msg: msg, from: from})
 			rxNr = append(rxNr, nrInd{msgType: msg.getType(), nr: msg.nr()})
 		}
@@ -402,6 +431,12 @@ func (xport *transport) recvFrame(rawMsg *rawMsg) (messages []controlMessage, er
 		return nil, err
 	}
 
+	// RFC3931 section 4.3 requires that messages failing authentication
+	// are silently discarded, so they're not acked or handled further.
+	if xport.config.MessageAuth != nil {
+		messages = xport.authenticateMessages(messages)
+	}
+
 	ns, nr := xport.slowStart.getSequenceNumbers()
 	for _, msg := range messages {
 		// Sanity check the packet sequence number: return an error if it's not OK
@@ -414,6 +449,22 @@ func (xport *transport) recvFrame(rawMsg *rawMsg) (messages []controlMessage, er
 	return messages, nil
 }
 
+func (xport *transport) authenticateMessages(messages []controlMessage) (verified []controlMessage) {
+	for _, msg := range messages {
+		err := xport.config.MessageAuth.verify(msg)
+		if err != nil {
+			level.Debug(xport.logger).Log(
+				"message", "dropping message which failed authentication",
+				"message_type", msg.getType(),
+				"error", err)
+			continue
+		}
+		xport.config.MessageAuth.learnPeerNonce(msg)
+		verified = append(verified, msg)
+	}
+	return verified
+}
+
 // Find the next message which can be handled (either stale or in-sequence)
 func (xport *transport) dequeueRxMessage() *recvMsg {
 	for i := 0; i < len(xport.rxQueue); i++ {
@@ -471,13 +522,56 @@ func (xport *transport) sendMessage1(msg controlMessage, isRetransmit bool) erro
 		"isRetransmit", isRetransmit)
 
 	// Render as a byte slice and send.
-	b, err := msg.toBytes()
+	var b []byte
+	var err error
+	if xport.config.MessageAuth != nil {
+		b, err = xport.config.MessageAuth.sign(msg)
+	} else {
+		b, err = msg.toBytes()
+	}
 	if err == nil {
 		_, err = xport.cp.write(b)
 	}
+	if err == nil {
+		xport.capture(b, xport.cp.getRemoteAddr(), true)
+		xport.observe(msg, MessageSent, xport.cp.getRemoteAddr(), isRetransmit)
+	}
 	return err
 }
 
+// observe passes a control message sent to or received from the peer
+// to the message observers, if any are registered.
+func (xport *transport) observe(msg controlMessage, dir MessageDirection, peer unix.Sockaddr, isRetransmit bool) {
+	if !xport.config.Observers.enabled() {
+		return
+	}
+	om := newObservedMessage(xport.config.TunnelName, msg, dir, peer, xport.config.UnhideAVPsSecret)
+	om.Retransmit = isRetransmit
+	xport.config.Observers.observe(om)
+}
+
+// capture passes a control frame sent to or received from the peer
+// to the capture writer, if capture is enabled.
+func (xport *transport) capture(b []byte, peer unix.Sockaddr, outbound bool) {
+	if !xport.config.Capture.enabled() {
+		return
+	}
+
+	local, err := xport.cp.getLocalAddr()
+	if err == nil {
+		if outbound {
+			err = xport.config.Capture.capture(b, local, peer, true)
+		} else {
+			err = xport.config.Capture.capture(b, peer, local, false)
+		}
+	}
+	if err != nil {
+		level.Error(xport.logger).Log(
+			"message", "frame capture failed",
+			"error", err)
+	}
+}
+
 // Exponential retry timeout scaling as per RFC2661/RFC3931
 func (xport *transport) scaleRetryTimeout(msg *xmitMsg) time.Duration {
 	return xport.config.RetryTimeout * (1 << msg.nretries)
@@ -690,7 +784,7 @@ func defaulttransportConfig() transportConfig {
 // newTransport creates a new RFC2661/RFC3931 reliable transport.
 // The control plane passed in is owned by the transport and will
 // be closed by the transport when the transport is closed.
-func newTransport(logger log.Logger, cp *controlPlane, cfg transportConfig) (xport *transport, err error) {
+func newTransport(logger log.Logger, cp controlPlane, cfg transportConfig) (xport *transport, err error) {
 
 	if cp == nil {
 		return nil, errors.New("illegal nil control plane argument")
@@ -758,6 +852,12 @@ func (xport *transport) send(msg controlMessage) error {
 	if err != nil {
 		return fmt.Errorf("failed to validate message: %v", err)
 	}
+	if len(xport.config.HideAVPsSecret) > 0 {
+		err = hideMsgAvps(msg, xport.config.HideAVPsSecret)
+		if err != nil {
+			return fmt.Errorf("failed to hide message AVPs: %v", err)
+		}
+	}
 	cm := xmitMsg{
 		xport:        xport,
 		msg:          msg,
@@ -782,9 +882,23 @@ func (xport *transport) recv() (msg controlMessage, from unix.Sockaddr, err erro
 	if !ok {
 		return nil, nil, errors.New("transport is down")
 	}
+	if m.err != nil {
+		return nil, nil, m.err
+	}
 	return m.msg, m.from, nil
 }
 
+// accept informs the transport of a control message which was received
+// out of band, for example an SCCRQ read from a listener socket prior to
+// the transport being created.  The transport sequence state is updated
+// such that the message is acked by subsequent transmissions.
+func (xport *transport) accept(msg controlMessage) {
+	xport.observe(msg, MessageReceived, xport.cp.getRemoteAddr(), false)
+	if xport.slowStart.msgIsInSequence(msg) {
+		xport.slowStart.incrementNr()
+	}
+}
+
 // close closes the transport.
 func (xport *transport) close() {
 	close(xport.sendChan)
@@ -1,6 +1,9 @@
 package l2tp
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -179,7 +182,7 @@ func flipTestInfo(info *transportSendRecvTestInfo) *transportSendRecvTestInfo {
 func transportTestnewTransport(testCfg *transportSendRecvTestInfo) (xport *transport, err error) {
 
 	var sal, sap unix.Sockaddr
-	var cp *controlPlane
+	var cp *socketControlPlane
 
 	switch testCfg.encap {
 	case EncapTypeUDP:
@@ -193,7 +196,7 @@ func transportTestnewTransport(testCfg *transportSendRecvTestInfo) (xport *trans
 		return nil, fmt.Errorf("failed to init tunnel address structures: %v", err)
 	}
 
-	cp, err = newL2tpControlPlane(sal, sap)
+	cp, err = newL2tpControlPlane(-1, sal, sap, &TunnelConfig{})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create control plane: %v", err)
 	}
@@ -400,3 +403,455 @@ func TestBasicSendReceive(t *testing.T) {
 			})
 	}
 }
+
+func pipeTestNewTransportPair(version ProtocolVersion, aToB, bToA pipeImpairment) (a, b *transport, err error) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug(), level.AllowInfo())
+
+	sal, sap, err := newUDPAddressPair("127.0.0.1:9000", "127.0.0.1:9001")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to init tunnel address structures: %v", err)
+	}
+
+	cpa, cpb := newControlPlanePipe(sal, sap, aToB, bToA)
+
+	xcfg := transportConfig{
+		Version:           version,
+		AckTimeout:        5 * time.Millisecond,
+		RetryTimeout:      10 * time.Millisecond,
+		MaxRetries:        8,
+		PeerControlConnID: 90,
+	}
+	a, err = newTransport(log.With(logger, "side", "a"), cpa, xcfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	xcfg.PeerControlConnID = 42
+	b, err = newTransport(log.With(logger, "side", "b"), cpb, xcfg)
+	if err != nil {
+		a.close()
+		return nil, nil, err
+	}
+
+	return a, b, nil
+}
+
+func TestPipeSendReceive(t *testing.T) {
+	cases := []struct {
+		name       string
+		impairment pipeImpairment
+	}{
+		{
+			name: "no impairment",
+		},
+		{
+			name:       "loss",
+			impairment: pipeImpairment{Loss: 0.2, Seed: 1},
+		},
+		{
+			name:       "duplication",
+			impairment: pipeImpairment{Duplicate: 0.3, Seed: 2},
+		},
+		{
+			name:       "reordering",
+			impairment: pipeImpairment{Reorder: 0.3, Seed: 3},
+		},
+		{
+			name:       "delay",
+			impairment: pipeImpairment{Delay: 20 * time.Millisecond},
+		},
+		{
+			name: "everything",
+			impairment: pipeImpairment{
+				Loss:      0.1,
+				Duplicate: 0.1,
+				Reorder:   0.1,
+				Delay:     2 * time.Millisecond,
+				Seed:      4,
+			},
+		},
+	}
+	for _, c := range cases {
+		for _, version := range []ProtocolVersion{ProtocolVersion2, ProtocolVersion3} {
+			t.Run(fmt.Sprintf("%s L2TPv%v", c.name, version), func(t *testing.T) {
+				tx, rx, err := pipeTestNewTransportPair(version, c.impairment, c.impairment)
+				if err != nil {
+					t.Fatalf("pipeTestNewTransportPair(): %v", err)
+				}
+				defer tx.close()
+				defer rx.close()
+
+				txCompletion := make(chan error)
+				rxCompletion := make(chan error)
+
+				go func() {
+					txCompletion <- testBasicSendRecvHelloSender(tx)
+				}()
+
+				go func() {
+					rxCompletion <- testBasicSendRecvHelloReceiver(rx)
+				}()
+
+				err = <-txCompletion
+				if err != nil {
+					t.Errorf("test sender function reported an error: %v", err)
+				}
+				err = <-rxCompletion
+				if err != nil {
+					t.Errorf("test receiver function reported an error: %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestPipeRetransmit(t *testing.T) {
+	sal, sap, err := newUDPAddressPair("127.0.0.1:9000", "127.0.0.1:9001")
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+
+	// The peer end of the pipe never acks anything, so the transport
+	// should retransmit until it runs out of retries and then fail.
+	cpa, cpb := newControlPlanePipe(sal, sap, pipeImpairment{}, pipeImpairment{})
+	defer cpb.close()
+
+	xcfg := transportConfig{
+		Version:           ProtocolVersion3,
+		RetryTimeout:      10 * time.Millisecond,
+		MaxRetries:        3,
+		PeerControlConnID: 90,
+	}
+	xport, err := newTransport(log.NewLogfmtLogger(os.Stderr), cpa, xcfg)
+	if err != nil {
+		t.Fatalf("newTransport(): %v", err)
+	}
+	defer xport.close()
+
+	sendCompletion := make(chan error)
+	go func() {
+		msg, err := testBasicSendRecvSenderNewHelloMsg(&xcfg)
+		if err != nil {
+			sendCompletion <- err
+			return
+		}
+		sendCompletion <- xport.send(msg)
+	}()
+
+	frames := make(chan []byte)
+	go func() {
+		for {
+			b := make([]byte, 4096)
+			n, _, err := cpb.recvFrom(b)
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- b[:n]
+		}
+	}()
+
+	var nframes int
+	for done := false; !done; {
+		select {
+		case b := <-frames:
+			messages, err := parseMessageBuffer(b)
+			if err != nil {
+				t.Fatalf("parseMessageBuffer(): %v", err)
+			}
+			for _, msg := range messages {
+				if msg.ns() != 0 {
+					t.Errorf("expected retransmit of ns 0, got ns %v", msg.ns())
+				}
+			}
+			nframes++
+		case err := <-sendCompletion:
+			if err == nil {
+				t.Errorf("expected send to fail")
+			}
+			done = true
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timed out waiting for send to fail")
+		}
+	}
+
+	// The initial transmission counts towards the retry limit
+	if expect := int(xcfg.MaxRetries); nframes != expect {
+		t.Errorf("expected %v transmissions, got %v", expect, nframes)
+	}
+}
+
+func TestPipeReorderRelease(t *testing.T) {
+	sal, sap, err := newUDPAddressPair("127.0.0.1:9000", "127.0.0.1:9001")
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+
+	for _, closePipe := range []bool{false, true} {
+		t.Run(fmt.Sprintf("close %v", closePipe), func(t *testing.T) {
+			// Every frame is a candidate for reordering, so the only
+			// frame sent is held back waiting for another
+			cpa, cpb := newControlPlanePipe(sal, sap, pipeImpairment{Reorder: 1.0}, pipeImpairment{})
+			defer cpb.close()
+			defer cpa.close()
+
+			_, err := cpa.write([]byte{1, 2, 3})
+			if err != nil {
+				t.Fatalf("write(): %v", err)
+			}
+			if closePipe {
+				cpa.close()
+			}
+
+			rx := make(chan []byte)
+			go func() {
+				b := make([]byte, 16)
+				n, _, err := cpb.recvFrom(b)
+				if err != nil {
+					close(rx)
+					return
+				}
+				rx <- b[:n]
+			}()
+
+			select {
+			case b := <-rx:
+				if !bytes.Equal(b, []byte{1, 2, 3}) {
+					t.Errorf("expected frame 010203, got %x", b)
+				}
+			case <-time.After(10 * pipeReorderTimeout):
+				cpb.close()
+				t.Errorf("held frame not delivered")
+			}
+		})
+	}
+}
+
+// Receive frames from the pipe, failing unless exactly n frames arrive
+// before the transmit window closes.
+func pipeTestRecvBatch(frames chan []byte, n int, quiet time.Duration) (ns []uint16, err error) {
+	timeout := time.After(3 * time.Second)
+	for len(ns) < n {
+		select {
+		case b := <-frames:
+			messages, err := parseMessageBuffer(b)
+			if err != nil {
+				return nil, fmt.Errorf("parseMessageBuffer(): %v", err)
+			}
+			for _, msg := range messages {
+				ns = append(ns, msg.ns())
+			}
+		case <-timeout:
+			return nil, fmt.Errorf("timed out after receiving %v of %v frames", len(ns), n)
+		}
+	}
+	select {
+	case b := <-frames:
+		return nil, fmt.Errorf("received %v frames, and then another: %x", n, b)
+	case <-time.After(quiet):
+	}
+	return ns, nil
+}
+
+// Send an L2TPv3 explicit ack from the raw end of a pipe
+func pipeTestSendAck(cp *pipeControlPlane, nr uint16) error {
+	ackType, err := newAvp(vendorIDIetf, avpTypeMessage, avpMsgTypeAck)
+	if err != nil {
+		return fmt.Errorf("newAvp(): %v", err)
+	}
+	ack, err := newV3ControlMessage(42, []avp{*ackType})
+	if err != nil {
+		return fmt.Errorf("newV3ControlMessage(): %v", err)
+	}
+	ack.setTransportSeqNum(0, nr)
+	b, err := ack.toBytes()
+	if err != nil {
+		return fmt.Errorf("toBytes(): %v", err)
+	}
+	_, err = cp.write(b)
+	return err
+}
+
+func TestPipeSlowStart(t *testing.T) {
+	sal, sap, err := newUDPAddressPair("127.0.0.1:9000", "127.0.0.1:9001")
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+
+	// The test drives the peer end of the pipe, acknowledging each
+	// batch of messages the transport sends.  The retry timeout is
+	// long enough that nothing is retransmitted during the test.
+	cpa, cpb := newControlPlanePipe(sal, sap, pipeImpairment{}, pipeImpairment{})
+	defer cpb.close()
+
+	xcfg := transportConfig{
+		Version:           ProtocolVersion3,
+		TxWindowSize:      4,
+		RetryTimeout:      5 * time.Second,
+		AckTimeout:        time.Second,
+		MaxRetries:        3,
+		PeerControlConnID: 90,
+	}
+	xport, err := newTransport(log.NewLogfmtLogger(os.Stderr), cpa, xcfg)
+	if err != nil {
+		t.Fatalf("newTransport(): %v", err)
+	}
+	defer xport.close()
+
+	frames := make(chan []byte, 16)
+	go func() {
+		for {
+			b := make([]byte, 4096)
+			n, _, err := cpb.recvFrom(b)
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- b[:n]
+		}
+	}()
+
+	// The congestion window starts at one message, and grows by one
+	// for each message acknowledged until it reaches the slow start
+	// threshold, which is initially the transmit window size.
+	batches := []int{1, 2, 4, 4}
+	var total int
+	for _, n := range batches {
+		total += n
+	}
+
+	sendCompletion := make(chan error, total)
+	for i := 0; i < total; i++ {
+		msg, err := testBasicSendRecvSenderNewHelloMsg(&xcfg)
+		if err != nil {
+			t.Fatalf("testBasicSendRecvSenderNewHelloMsg(): %v", err)
+		}
+		go func() {
+			sendCompletion <- xport.send(msg)
+		}()
+	}
+
+	var nr uint16
+	for i, n := range batches {
+		ns, err := pipeTestRecvBatch(frames, n, 50*time.Millisecond)
+		if err != nil {
+			t.Fatalf("batch %v: %v", i, err)
+		}
+		for _, s := range ns {
+			if s != nr {
+				t.Fatalf("batch %v: expected ns %v, got %v", i, nr, s)
+			}
+			nr++
+		}
+
+		err = pipeTestSendAck(cpb, nr)
+		if err != nil {
+			t.Fatalf("pipeTestSendAck(): %v", err)
+		}
+	}
+
+	for i := 0; i < total; i++ {
+		select {
+		case err := <-sendCompletion:
+			if err != nil {
+				t.Errorf("send(): %v", err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timed out waiting for sends to complete")
+		}
+	}
+}
+
+func TestPipeUnknownMandatoryAVP(t *testing.T) {
+	sal, sap, err := newUDPAddressPair("127.0.0.1:9000", "127.0.0.1:9001")
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+
+	cpa, cpb := newControlPlanePipe(sal, sap, pipeImpairment{}, pipeImpairment{})
+	defer cpb.close()
+
+	xcfg := transportConfig{
+		Version:           ProtocolVersion3,
+		RetryTimeout:      time.Second,
+		AckTimeout:        time.Second,
+		MaxRetries:        3,
+		PeerControlConnID: 90,
+	}
+	xport, err := newTransport(log.NewLogfmtLogger(os.Stderr), cpa, xcfg)
+	if err != nil {
+		t.Fatalf("newTransport(): %v", err)
+	}
+	defer xport.close()
+
+	hello, err := testBasicSendRecvSenderNewHelloMsg(&xcfg)
+	if err != nil {
+		t.Fatalf("testBasicSendRecvSenderNewHelloMsg(): %v", err)
+	}
+	good, err := hello.toBytes()
+	if err != nil {
+		t.Fatalf("toBytes(): %v", err)
+	}
+
+	// Append an AVP of unknown type 1000 with the M bit set, and
+	// fix up the length in the message header
+	bad := append(append([]byte(nil), good...), 0x80, 0x07, 0x00, 0x00, 0x03, 0xe8, 0x00)
+	binary.BigEndian.PutUint16(bad[2:], uint16(len(bad)))
+
+	// The peer retransmits the bad message, and then sends a good one
+	for _, b := range [][]byte{bad, bad, good} {
+		_, err = cpb.write(b)
+		if err != nil {
+			t.Fatalf("write(): %v", err)
+		}
+	}
+
+	// The failure is reported to the tunnel once...
+	_, _, err = xport.recv()
+	if !errors.Is(err, errUnknownMandatoryAVP) {
+		t.Fatalf("expected mandatory AVP error, got %v", err)
+	}
+
+	// ...but the transport remains up, so that the tunnel can send
+	// StopCCN to the peer.
+	msg, _, err := xport.recv()
+	if err != nil {
+		t.Fatalf("recv(): %v", err)
+	}
+	if msg.getType() != avpMsgTypeHello {
+		t.Errorf("expected HELLO, got %v", msg.getType())
+	}
+
+	stopccn, err := newV3Stopccn(
+		&resultCode{result: avpStopCCNResultCodeGeneralError, errCode: avpErrorCodeMBitShutdown},
+		&TunnelConfig{PeerTunnelID: 90})
+	if err != nil {
+		t.Fatalf("newV3Stopccn(): %v", err)
+	}
+	sendCompletion := make(chan error)
+	go func() {
+		sendCompletion <- xport.send(stopccn)
+	}()
+
+	b := make([]byte, 4096)
+	n, _, err := cpb.recvFrom(b)
+	if err != nil {
+		t.Fatalf("recvFrom(): %v", err)
+	}
+	messages, err := parseMessageBuffer(b[:n])
+	if err != nil {
+		t.Fatalf("parseMessageBuffer(): %v", err)
+	}
+	if len(messages) != 1 || messages[0].getType() != avpMsgTypeStopccn {
+		t.Fatalf("expected StopCCN, got %v", messages)
+	}
+
+	err = pipeTestSendAck(cpb, messages[0].ns()+1)
+	if err != nil {
+		t.Fatalf("pipeTestSendAck(): %v", err)
+	}
+	err = <-sendCompletion
+	if err != nil {
+		t.Errorf("send(): %v", err)
+	}
+}